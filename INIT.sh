@@ -89,8 +89,27 @@ echo ""
 echo "🗄️  Initializing database schema..."
 docker exec -i $CONTAINER_NAME psql -U $DB_USER -d $DB_NAME << 'EOF'
 -- Drop existing tables if they exist (fresh start)
-DROP TABLE IF EXISTS blocks CASCADE;
+DROP VIEW IF EXISTS blocks;
+DROP TABLE IF EXISTS ticket_links CASCADE;
 DROP TABLE IF EXISTS tickets CASCADE;
+DROP TABLE IF EXISTS epics CASCADE;
+DROP TABLE IF EXISTS labels CASCADE;
+DROP TABLE IF EXISTS sla_rules CASCADE;
+DROP TABLE IF EXISTS sla_breaches CASCADE;
+DROP TABLE IF EXISTS custom_fields CASCADE;
+DROP TABLE IF EXISTS ticket_templates CASCADE;
+DROP TABLE IF EXISTS recurring_tickets CASCADE;
+DROP TABLE IF EXISTS ticket_presence CASCADE;
+DROP TABLE IF EXISTS webhook_deliveries CASCADE;
+DROP TABLE IF EXISTS webhooks CASCADE;
+DROP TABLE IF EXISTS notifications CASCADE;
+DROP TABLE IF EXISTS notification_prefs CASCADE;
+DROP TABLE IF EXISTS email_outbox CASCADE;
+DROP TABLE IF EXISTS mentions CASCADE;
+DROP TABLE IF EXISTS ticket_watchers CASCADE;
+DROP TABLE IF EXISTS inbound_messages CASCADE;
+DROP TABLE IF EXISTS attachments CASCADE;
+DROP TABLE IF EXISTS attachment_deletions CASCADE;
 DROP TABLE IF EXISTS projects CASCADE;
 
 -- Projects table
@@ -116,19 +135,27 @@ CREATE TABLE tickets (
   updated_at TIMESTAMP DEFAULT now()
 );
 
--- Blocking relationships table
-CREATE TABLE blocks (
-  blocker_ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
-  blocked_ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+-- Ticket links table (blocks, relates, duplicates, clones, parent)
+CREATE TABLE ticket_links (
+  id SERIAL PRIMARY KEY,
   account_id TEXT NOT NULL,
-  PRIMARY KEY (blocker_ticket_id, blocked_ticket_id),
-  CHECK (blocker_ticket_id != blocked_ticket_id)
+  link_type TEXT NOT NULL,
+  source_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  target_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (link_type, source_ticket_id, target_ticket_id),
+  CHECK (source_ticket_id != target_ticket_id)
 );
 
+-- Blocking relationships (compatibility view over ticket_links)
+CREATE VIEW blocks AS
+  SELECT source_ticket_id AS blocker_ticket_id, target_ticket_id AS blocked_ticket_id, account_id
+  FROM ticket_links WHERE link_type='blocks';
+
 -- Verify tables created
 SELECT 'Created ' || COUNT(*) || ' tables' AS result
 FROM information_schema.tables 
-WHERE table_name IN ('projects', 'tickets', 'blocks');
+WHERE table_name IN ('projects', 'tickets', 'ticket_links');
 EOF
 
 if [ $? -eq 0 ]; then
@@ -203,7 +230,7 @@ echo ""
 # Step 7: Build the application
 echo "🔨 Building Pippin..."
 if [ -f "main.go" ]; then
-    go build -o pippin main.go
+    go build -o pippin .
     if [ $? -eq 0 ]; then
         echo -e "${GREEN}✓ Build successful${NC}"
     else
@@ -264,7 +291,7 @@ echo "━━━━━━━━━━━━━━━━━━━━━━━━
 echo ""
 echo "📊 What was created:"
 echo "  • PostgreSQL container: $CONTAINER_NAME (port $DB_PORT)"
-echo "  • Database: $DB_NAME with tables: projects, tickets, blocks"
+echo "  • Database: $DB_NAME with tables: projects, tickets, ticket_links"
 if [[ $ADD_DEMO =~ ^[Yy]$ ]]; then
     echo "  • Demo data: 3 projects, 5 tickets"
 fi
@@ -283,7 +310,7 @@ echo "  • View logs:     docker logs -f $CONTAINER_NAME"
 echo "  • Stop DB:       docker stop $CONTAINER_NAME"
 echo "  • Start DB:      docker start $CONTAINER_NAME"
 echo "  • DB shell:      docker exec -it $CONTAINER_NAME psql -U $DB_USER -d $DB_NAME"
-echo "  • Rebuild:       go build -o pippin main.go"
+echo "  • Rebuild:       go build -o pippin ."
 echo ""
 echo "📖 Configuration:"
 echo "  Edit .env to customize settings (port, theme, sprint length, etc.)"
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Ticket attachments. Files go to the blob store (storage.go) under a
+// random key; the attachments table holds the name, type and size. Images
+// get a thumbnail, stored next to the file. Rows go away with their ticket
+// (and so with its project) through ON DELETE CASCADE, and a trigger
+// queues the stored files in attachment_deletions, which the cleanup
+// worker empties, so every way of deleting a ticket cleans up after it.
+
+// defaultAttachmentTypes is ATTACHMENT_TYPES when unset. SVG is left out
+// on purpose: it can carry scripts.
+const defaultAttachmentTypes = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,text/csv," +
+	"application/json,application/zip,application/gzip"
+
+const (
+	thumbSize            = 240      // longest side, in pixels
+	thumbMaxPixels       = 40 << 20 // bigger images get no thumbnail
+	maxFilesPerUpload    = 10
+	cleanupBatch         = 50
+	cleanupMaxAttempts   = 10
+	cleanupBaseDelay     = time.Minute
+	cleanupMaxDelay      = 6 * time.Hour
+	attachmentNameLength = 200
+)
+
+// attachmentCleanupWake nudges the cleanup worker after a delete.
+var attachmentCleanupWake = make(chan struct{}, 1)
+
+type Attachment struct {
+	ID           int       `json:"id"`
+	TicketID     int       `json:"ticket_id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	HasThumbnail bool      `json:"has_thumbnail"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	UploadedBy   string    `json:"uploaded_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const attachmentSelect = `SELECT id, ticket_id, filename, content_type, size, thumb_key <> '', uploaded_by, created_at
+	FROM attachments`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.ID, &a.TicketID, &a.Filename, &a.ContentType, &a.Size, &a.HasThumbnail, &a.UploadedBy, &a.CreatedAt)
+	a.URL = "/api/attachments/" + strconv.Itoa(a.ID)
+	if a.HasThumbnail {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+	return a, err
+}
+
+func loadAttachments(ticketID int) ([]Attachment, error) {
+	rows, err := db.Query(attachmentSelect+" WHERE ticket_id=$1 AND account_id=$2 ORDER BY id", ticketID, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// cleanFilename keeps the last path element of an uploaded name, without
+// control characters.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if r := []rune(strings.TrimSpace(name)); len(r) > attachmentNameLength {
+		name = string(r[:attachmentNameLength])
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+// attachmentType is the file's MIME type, from its extension or else its
+// first bytes, without parameters.
+func attachmentType(name string, data []byte) string {
+	t := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if t == "" {
+		t = http.DetectContentType(data)
+	}
+	t, _, _ = strings.Cut(t, ";")
+	return strings.TrimSpace(t)
+}
+
+func typeAllowed(t string) bool {
+	family, _, _ := strings.Cut(t, "/")
+	for _, a := range cfg.AttachmentTypes {
+		if a == "*" || a == t || a == family+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAttachment validates a file of size bytes, starting with head,
+// before it is stored and returns its cleaned name and type, or an error
+// status and message.
+func checkAttachment(name string, size int64, head []byte) (string, string, int, string) {
+	name = cleanFilename(name)
+	if size == 0 {
+		return name, "", 400, "empty file"
+	}
+	if size > cfg.AttachmentMaxBytes {
+		return name, "", 413, fmt.Sprintf("file too large (limit %s)", formatSize(int(cfg.AttachmentMaxBytes)))
+	}
+	t := attachmentType(name, head)
+	if !typeAllowed(t) {
+		return name, t, 415, "file type " + t + " not allowed"
+	}
+	return name, t, 0, ""
+}
+
+// storeAttachment saves a checked file and its thumbnail and records it.
+func storeAttachment(ticketID int, name, contentType string, body io.ReadSeeker, size int64, actor string) (Attachment, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	key := strconv.Itoa(ticketID) + "/" + hex.EncodeToString(id)
+	if err := store.Put(key, contentType, body, size); err != nil {
+		return Attachment{}, err
+	}
+	thumbKey := ""
+	if thumbnailTypes[contentType] {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			log.Printf("attachments: thumbnail for T-%d %s: %v", ticketID, name, err)
+		} else if thumb, thumbType, err := makeThumbnail(body); err == nil {
+			if err := store.Put(key+".thumb", thumbType, bytes.NewReader(thumb), int64(len(thumb))); err != nil {
+				log.Printf("attachments: thumbnail for T-%d %s: %v", ticketID, name, err)
+			} else {
+				thumbKey = key + ".thumb"
+			}
+		}
+	}
+	a, err := scanAttachment(db.QueryRow(`INSERT INTO attachments
+		(account_id, ticket_id, filename, content_type, size, storage_key, thumb_key, uploaded_by)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		RETURNING id, ticket_id, filename, content_type, size, thumb_key <> '', uploaded_by, created_at`,
+		cfg.AccountID, ticketID, name, contentType, size, key, thumbKey, actor))
+	if err != nil {
+		// Nothing points at the files, so they go straight away.
+		store.Delete(key)
+		if thumbKey != "" {
+			store.Delete(thumbKey)
+		}
+		return Attachment{}, err
+	}
+	return a, nil
+}
+
+// thumbnailTypes are the image types makeThumbnail can decode. There is
+// no WebP decoder in the standard library, so WebP images get none.
+var thumbnailTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+// makeThumbnail scales an image down to thumbSize on its longest side,
+// averaging the pixels each thumbnail pixel covers. JPEGs stay JPEG;
+// anything else becomes PNG to keep transparency.
+func makeThumbnail(r io.ReadSeeker) ([]byte, string, error) {
+	conf, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if conf.Width*conf.Height > thumbMaxPixels || conf.Width == 0 || conf.Height == 0 {
+		return nil, "", fmt.Errorf("%dx%d image too large to thumbnail", conf.Width, conf.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > thumbSize || h > thumbSize {
+		if w >= h {
+			tw, th = thumbSize, max(1, h*thumbSize/w)
+		} else {
+			tw, th = max(1, w*thumbSize/h), thumbSize
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+max((x+1)*w/tw, x*w/tw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+		return out.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&out, dst)
+	return out.Bytes(), "image/png", err
+}
+
+type upload struct {
+	name, contentType string
+	file              *os.File
+	size              int64
+}
+
+// handleUploadAttachments takes a multipart form with one or more "file"
+// parts. Every file is checked before any is stored, so a rejected file
+// means nothing was attached, and a failure while storing removes the
+// files already stored. Parts are spooled to temporary files rather
+// than held in memory while the rest of the upload arrives.
+func handleUploadAttachments(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if !ticketExists(ticketID) {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFilesPerUpload*cfg.AttachmentMaxBytes+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "expected a multipart/form-data upload"})
+		return
+	}
+	var files []upload
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+			os.Remove(f.file.Name())
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "unreadable upload: " + err.Error()})
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		if len(files) == maxFilesPerUpload {
+			writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("at most %d files per upload", maxFilesPerUpload)})
+			return
+		}
+		tmp, err := os.CreateTemp("", "pippin-upload-*")
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		f := upload{file: tmp}
+		files = append(files, f)
+		f.size, err = io.Copy(tmp, io.LimitReader(part, cfg.AttachmentMaxBytes+1))
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "unreadable upload: " + err.Error()})
+			return
+		}
+		head := make([]byte, 512)
+		n, _ := tmp.ReadAt(head, 0)
+		var status int
+		var msg string
+		f.name, f.contentType, status, msg = checkAttachment(part.FileName(), f.size, head[:n])
+		if status != 0 {
+			writeJSON(w, status, map[string]string{"error": f.name + ": " + msg})
+			return
+		}
+		files[len(files)-1] = f
+	}
+	if len(files) == 0 {
+		writeJSON(w, 400, map[string]string{"error": "no file in the upload (use the form field \"file\")"})
+		return
+	}
+
+	actor := currentUser(r)
+	saved := []Attachment{}
+	for _, f := range files {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		a, err := storeAttachment(ticketID, f.name, f.contentType, f.file, f.size, actor)
+		if err != nil {
+			removeAttachments(saved)
+			writeJSON(w, 500, map[string]string{"error": f.name + ": " + err.Error()})
+			return
+		}
+		saved = append(saved, a)
+	}
+	publish(Event{Type: "attachment.added", TicketID: ticketID, Actor: actor})
+	writeJSON(w, 201, saved)
+}
+
+// removeAttachments deletes attachments stored earlier in a failed
+// upload; the deletion trigger queues their files for the cleanup worker.
+func removeAttachments(list []Attachment) {
+	if len(list) == 0 {
+		return
+	}
+	ids := make([]int64, len(list))
+	for i, a := range list {
+		ids[i] = int64(a.ID)
+	}
+	if _, err := db.Exec("DELETE FROM attachments WHERE id = ANY($1) AND account_id=$2", pq.Array(ids), cfg.AccountID); err != nil {
+		log.Printf("attachments: removing a failed upload's files: %v", err)
+		return
+	}
+	select {
+	case attachmentCleanupWake <- struct{}{}:
+	default:
+	}
+}
+
+func handleGetAttachments(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if !ticketExists(ticketID) {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	list, err := loadAttachments(ticketID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, list)
+}
+
+// inlineTypes may be shown in the browser with ?inline=true; everything
+// else is always a download.
+var inlineTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+func handleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	var a Attachment
+	var key string
+	err := db.QueryRow("SELECT filename, content_type, size, storage_key FROM attachments WHERE id=$1 AND account_id=$2",
+		r.PathValue("id"), cfg.AccountID).Scan(&a.Filename, &a.ContentType, &a.Size, &key)
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "attachment not found"})
+		return
+	}
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "true" && inlineTypes[a.ContentType] {
+		disposition = "inline"
+	}
+	// FormatMediaType switches to filename*=utf-8''... for names that
+	// aren't plain ASCII.
+	disposition = mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})
+	serveBlob(w, key, http.Header{
+		"Content-Type":        {a.ContentType},
+		"Content-Length":      {strconv.FormatInt(a.Size, 10)},
+		"Content-Disposition": {disposition},
+	})
+}
+
+func handleAttachmentThumbnail(w http.ResponseWriter, r *http.Request) {
+	var key string
+	err := db.QueryRow("SELECT thumb_key FROM attachments WHERE id=$1 AND account_id=$2",
+		r.PathValue("id"), cfg.AccountID).Scan(&key)
+	if err != nil || key == "" {
+		writeJSON(w, 404, map[string]string{"error": "thumbnail not found"})
+		return
+	}
+	serveBlob(w, key, http.Header{}) // JPEG or PNG, sniffed when written
+}
+
+// serveBlob copies a stored file to the response, with header added once
+// the file is found. Files never change under a key, so browsers may keep
+// them.
+func serveBlob(w http.ResponseWriter, key string, header http.Header) {
+	body, err := store.Get(key)
+	if err == errBlobNotFound {
+		writeJSON(w, 404, map[string]string{"error": "file missing from storage"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 502, map[string]string{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	io.Copy(w, body)
+}
+
+func handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	var ticketID int
+	err := db.QueryRow("DELETE FROM attachments WHERE id=$1 AND account_id=$2 RETURNING ticket_id",
+		r.PathValue("id"), cfg.AccountID).Scan(&ticketID)
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "attachment not found"})
+		return
+	}
+	select {
+	case attachmentCleanupWake <- struct{}{}:
+	default:
+	}
+	publish(Event{Type: "attachment.removed", TicketID: ticketID, Actor: currentUser(r)})
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+func runAttachmentCleanup(interval time.Duration) {
+	for {
+		for {
+			n, err := runCleanupBatch()
+			if err != nil {
+				log.Printf("attachment cleanup: %v", err)
+			}
+			if n < cleanupBatch || err != nil {
+				break
+			}
+		}
+		select {
+		case <-attachmentCleanupWake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runCleanupBatch deletes up to cleanupBatch queued files from the store,
+// claiming them first like the webhook worker does.
+func runCleanupBatch() (int, error) {
+	rows, err := db.Query(`UPDATE attachment_deletions SET next_attempt_at = now() + interval '5 minutes'
+		WHERE id IN (SELECT id FROM attachment_deletions WHERE next_attempt_at <= now()
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, storage_key, attempts`, cleanupBatch)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id       int
+		key      string
+		attempts int
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.key, &p.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+
+	for _, p := range list {
+		err := store.Delete(p.key)
+		if err == nil || p.attempts+1 >= cleanupMaxAttempts {
+			if err != nil {
+				log.Printf("attachment cleanup: giving up on %s: %v", p.key, err)
+			}
+			db.Exec("DELETE FROM attachment_deletions WHERE id=$1", p.id)
+			continue
+		}
+		next := time.Now().Add(retryBackoff(p.attempts+1, cleanupBaseDelay, cleanupMaxDelay))
+		db.Exec("UPDATE attachment_deletions SET attempts=attempts+1, last_error=$1, next_attempt_at=$2 WHERE id=$3",
+			err.Error(), next, p.id)
+	}
+	return len(list), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestCheckAttachment(t *testing.T) {
+	defer func(max int64, types []string) {
+		cfg.AttachmentMaxBytes, cfg.AttachmentTypes = max, types
+	}(cfg.AttachmentMaxBytes, cfg.AttachmentTypes)
+	cfg.AttachmentMaxBytes = 1 << 10
+	cfg.AttachmentTypes = []string{"image/*", "text/plain"}
+	pngHead := []byte("\x89PNG\r\n\x1a\n")
+
+	for _, tc := range []struct {
+		name       string
+		size       int64
+		head       []byte
+		wantName   string
+		wantType   string
+		wantStatus int
+	}{
+		{"notes.txt", 5, []byte("hello"), "notes.txt", "text/plain", 0},
+		{`C:\Users\jane\shot.png`, 100, pngHead, "shot.png", "image/png", 0},
+		{"noext", 100, pngHead, "noext", "image/png", 0},
+		{"empty.txt", 0, nil, "empty.txt", "", 400},
+		{"big.txt", 1<<10 + 1, []byte("hello"), "big.txt", "", 413},
+		{"limit.txt", 1 << 10, []byte("hello"), "limit.txt", "text/plain", 0},
+		{"page.html", 20, []byte("<html><body>"), "page.html", "text/html", 415},
+		{"logo.svg", 20, []byte("<svg>"), "logo.svg", "image/svg+xml", 0},
+	} {
+		name, typ, status, msg := checkAttachment(tc.name, tc.size, tc.head)
+		if name != tc.wantName || typ != tc.wantType || status != tc.wantStatus {
+			t.Errorf("checkAttachment(%q, %d) = %q, %q, %d %q; want %q, %q, %d",
+				tc.name, tc.size, name, typ, status, msg, tc.wantName, tc.wantType, tc.wantStatus)
+		}
+		if (status == 0) != (msg == "") {
+			t.Errorf("checkAttachment(%q): status %d with message %q", tc.name, status, msg)
+		}
+	}
+
+	cfg.AttachmentTypes = parseAllowList(defaultAttachmentTypes)
+	if _, _, status, _ := checkAttachment("logo.svg", 20, []byte("<svg>")); status != 415 {
+		t.Errorf("SVG with the default types: status %d, want 415", status)
+	}
+}
+
+func encodeImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	for _, tc := range []struct {
+		format   string
+		w, h     int
+		tw, th   int
+		wantType string
+	}{
+		{"png", 480, 120, 240, 60, "image/png"},
+		{"png", 120, 480, 60, 240, "image/png"},
+		{"png", 100, 50, 100, 50, "image/png"},
+		{"png", 2000, 1, 240, 1, "image/png"},
+		{"jpeg", 600, 600, 240, 240, "image/jpeg"},
+	} {
+		thumb, typ, err := makeThumbnail(bytes.NewReader(encodeImage(t, tc.format, tc.w, tc.h)))
+		if err != nil {
+			t.Errorf("%s %dx%d: %v", tc.format, tc.w, tc.h, err)
+			continue
+		}
+		conf, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+		if err != nil {
+			t.Errorf("%s %dx%d: thumbnail doesn't decode: %v", tc.format, tc.w, tc.h, err)
+			continue
+		}
+		if conf.Width != tc.tw || conf.Height != tc.th || typ != tc.wantType || "image/"+format != typ {
+			t.Errorf("%s %dx%d: thumbnail %dx%d %s (%s), want %dx%d %s",
+				tc.format, tc.w, tc.h, conf.Width, conf.Height, typ, format, tc.tw, tc.th, tc.wantType)
+		}
+	}
+
+	if _, _, err := makeThumbnail(strings.NewReader("not an image")); err == nil {
+		t.Error("makeThumbnail accepted a text file")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Critical path and blocked-chain analysis. Only open dependencies
+// count: once a blocker is done it no longer holds anything up, so
+// chains are cut at done tickets.
+
+// loadOpenEdges returns the account's edges whose blocker is not done.
+func loadOpenEdges() ([]depEdge, error) {
+	rows, err := db.Query(`SELECT b.blocker_ticket_id, b.blocked_ticket_id FROM blocks b
+		JOIN tickets bt ON bt.id=b.blocker_ticket_id
+		WHERE b.account_id=$1 AND bt.state <> 'done'`, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edges []depEdge
+	for rows.Next() {
+		var e depEdge
+		if err := rows.Scan(&e.From, &e.To); err != nil {
+			return nil, err
+		}
+		edges = append(edges, e)
+	}
+	return edges, rows.Err()
+}
+
+func loadGraphNodes(ids []int) (map[int]graphNode, error) {
+	arr := make([]int64, len(ids))
+	for i, id := range ids {
+		arr[i] = int64(id)
+	}
+	rows, err := db.Query(`SELECT t.id, p.key, t.title, t.state, COALESCE(t.assignee,'')
+		FROM tickets t JOIN projects p ON p.id=t.project_id
+		WHERE t.account_id=$1 AND t.id = ANY($2)`, cfg.AccountID, pq.Array(arr))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make(map[int]graphNode, len(ids))
+	for rows.Next() {
+		var n graphNode
+		if err := rows.Scan(&n.ID, &n.ProjectKey, &n.Title, &n.State, &n.Assignee); err != nil {
+			return nil, err
+		}
+		nodes[n.ID] = n
+	}
+	return nodes, rows.Err()
+}
+
+// restrictEdges keeps edges with both ends in keep.
+func restrictEdges(edges []depEdge, keep map[int]bool) []depEdge {
+	var out []depEdge
+	for _, e := range edges {
+		if keep[e.From] && keep[e.To] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// longestChains computes, for every node, the length of the longest
+// chain ending at it and its predecessor on that chain. Nodes caught in
+// a cycle (only possible with data predating cycle checks) are skipped.
+func longestChains(nodes []int, edges []depEdge) (dist map[int]int, prev map[int]int) {
+	indeg := map[int]int{}
+	next := map[int][]int{}
+	for _, e := range edges {
+		next[e.From] = append(next[e.From], e.To)
+		indeg[e.To]++
+	}
+	dist, prev = map[int]int{}, map[int]int{}
+	var queue []int
+	for _, n := range nodes {
+		dist[n] = 1
+		if indeg[n] == 0 {
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, m := range next[n] {
+			if dist[n]+1 > dist[m] {
+				dist[m] = dist[n] + 1
+				prev[m] = n
+			}
+			if indeg[m]--; indeg[m] == 0 {
+				queue = append(queue, m)
+			}
+		}
+	}
+	return dist, prev
+}
+
+// chainTo walks prev back from end and returns the chain in blocking order.
+func chainTo(end int, prev map[int]int) []int {
+	chain := []int{end}
+	for {
+		p, ok := prev[chain[0]]
+		if !ok {
+			return chain
+		}
+		chain = append([]int{p}, chain...)
+	}
+}
+
+// criticalPath returns the longest chain of open dependencies among nodes.
+func criticalPath(nodes []int, edges []depEdge) []int {
+	if len(nodes) == 0 {
+		return nil
+	}
+	dist, prev := longestChains(nodes, edges)
+	best := nodes[0]
+	for _, n := range nodes {
+		if dist[n] > dist[best] || (dist[n] == dist[best] && n < best) {
+			best = n
+		}
+	}
+	return chainTo(best, prev)
+}
+
+// transitiveBlockers returns every ticket that directly or indirectly
+// blocks id via open dependencies, in BFS order.
+func transitiveBlockers(id int, edges []depEdge) []int {
+	blockers := map[int][]int{}
+	for _, e := range edges {
+		blockers[e.To] = append(blockers[e.To], e.From)
+	}
+	seen := map[int]bool{id: true}
+	var out []int
+	queue := []int{id}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, b := range blockers[n] {
+			if !seen[b] {
+				seen[b] = true
+				out = append(out, b)
+				queue = append(queue, b)
+			}
+		}
+	}
+	return out
+}
+
+func nodeList(ids []int, nodes map[int]graphNode) []graphNode {
+	out := make([]graphNode, 0, len(ids))
+	for _, id := range ids {
+		if n, ok := nodes[id]; ok {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func handleCriticalPath(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	sprint := r.URL.Query().Get("sprint")
+
+	tickets, err := queryTickets(project, sprint, nil, listOptions{})
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	var ids []int
+	open := map[int]bool{}
+	for _, t := range tickets {
+		if t.State != "done" {
+			ids = append(ids, t.ID)
+			open[t.ID] = true
+		}
+	}
+	edges, err := loadOpenEdges()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	path := criticalPath(ids, restrictEdges(edges, open))
+	nodes, err := loadGraphNodes(path)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]interface{}{
+		"project": project,
+		"sprint":  sprint,
+		"length":  len(path),
+		"path":    nodeList(path, nodes),
+	})
+}
+
+// blockedChain gathers the open blockers of a ticket and the longest
+// chain ending at it.
+type blockedChain struct {
+	Ticket   graphNode   `json:"ticket"`
+	Blockers []graphNode `json:"blockers"`
+	Edges    []depEdge   `json:"edges"`
+	Longest  []int       `json:"longest_chain"`
+}
+
+func loadBlockedChain(id int) (*blockedChain, error) {
+	edges, err := loadOpenEdges()
+	if err != nil {
+		return nil, err
+	}
+	blockers := transitiveBlockers(id, edges)
+	ids := append([]int{id}, blockers...)
+	keep := map[int]bool{}
+	for _, b := range ids {
+		keep[b] = true
+	}
+	nodes, err := loadGraphNodes(ids)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := nodes[id]
+	if !ok {
+		return nil, nil
+	}
+	sub := restrictEdges(edges, keep)
+	if sub == nil {
+		sub = []depEdge{}
+	}
+	_, prev := longestChains(ids, sub)
+	return &blockedChain{
+		Ticket:   t,
+		Blockers: nodeList(blockers, nodes),
+		Edges:    sub,
+		Longest:  chainTo(id, prev),
+	}, nil
+}
+
+func handleTicketBlockers(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	chain, err := loadBlockedChain(id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if chain == nil {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	writeJSON(w, 200, chain)
+}
+
+func handleTicketDependencySVG(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	chain, err := loadBlockedChain(id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if chain == nil {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(chain.svg()))
+}
+
+// svg lays the chain out left to right: each node's column is the length
+// of the longest chain leading into it, so the selected ticket ends up on
+// the right and its deepest blockers on the left. Edges on the longest
+// chain are drawn in red.
+func (c *blockedChain) svg() string {
+	const (
+		boxW, boxH = 180, 44
+		gapX, gapY = 60, 20
+		pad        = 16
+	)
+	nodes := append([]graphNode{c.Ticket}, c.Blockers...)
+	ids := make([]int, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	depth, _ := longestChains(ids, c.Edges)
+
+	columns := map[int][]int{}
+	maxCol, maxRow := 0, 0
+	for _, id := range ids {
+		col := depth[id] - 1
+		columns[col] = append(columns[col], id)
+		if col > maxCol {
+			maxCol = col
+		}
+	}
+	pos := map[int][2]int{}
+	for col, members := range columns {
+		sort.Ints(members)
+		for row, id := range members {
+			pos[id] = [2]int{pad + col*(boxW+gapX), pad + row*(boxH+gapY)}
+			if row > maxRow {
+				maxRow = row
+			}
+		}
+	}
+
+	critical := map[depEdge]bool{}
+	for i := 1; i < len(c.Longest); i++ {
+		critical[depEdge{c.Longest[i-1], c.Longest[i]}] = true
+	}
+
+	width := 2*pad + (maxCol+1)*boxW + maxCol*gapX
+	height := 2*pad + (maxRow+1)*boxH + maxRow*gapY
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="system-ui,sans-serif" font-size="12">`, width, height, width, height)
+	sb.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="7" markerHeight="7" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z" fill="#8b6f64"/></marker>`)
+	sb.WriteString(`<marker id="arrow-hot" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="7" markerHeight="7" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z" fill="#e03131"/></marker></defs>`)
+
+	for _, e := range c.Edges {
+		from, to := pos[e.From], pos[e.To]
+		stroke, marker, sw := "#8b6f64", "arrow", 1.5
+		if critical[e] {
+			stroke, marker, sw = "#e03131", "arrow-hot", 2.5
+		}
+		fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s" stroke-width="%.1f" marker-end="url(#%s)"/>`,
+			from[0]+boxW, from[1]+boxH/2, to[0], to[1]+boxH/2, stroke, sw, marker)
+	}
+
+	for _, n := range nodes {
+		p := pos[n.ID]
+		fill, stroke := "#fffaf5", "#e2c6b6"
+		if n.ID == c.Ticket.ID {
+			fill, stroke = "#ffe3b0", "#ffb86b"
+		}
+		fmt.Fprintf(&sb, `<g><title>%s</title>`, html.EscapeString(fmt.Sprintf("%s-%d %s (%s)", n.ProjectKey, n.ID, n.Title, n.State)))
+		fmt.Fprintf(&sb, `<rect x="%d" y="%d" width="%d" height="%d" rx="8" fill="%s" stroke="%s" stroke-width="1.5"/>`, p[0], p[1], boxW, boxH, fill, stroke)
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" font-weight="600" fill="#3b2e2a">%s-%d</text>`, p[0]+8, p[1]+17, html.EscapeString(n.ProjectKey), n.ID)
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" fill="#8b6f64" text-anchor="end">%s</text>`, p[0]+boxW-8, p[1]+17, html.EscapeString(n.State))
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" fill="#3b2e2a">%s</text></g>`, p[0]+8, p[1]+34, html.EscapeString(truncate(n.Title, 26)))
+	}
+	sb.WriteString(`</svg>`)
+	return sb.String()
+}
+
+func truncate(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	return string(rs[:n-1]) + "…"
+}
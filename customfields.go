@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Custom fields are per-project definitions (customer, environment,
+// release, ...). Values live in tickets.custom, a JSONB object keyed by
+// the field's key, and are validated against the ticket's project.
+
+type CustomField struct {
+	ID         int       `json:"id"`
+	ProjectKey string    `json:"project_key"`
+	Key        string    `json:"key"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Options    []string  `json:"options,omitempty"` // select only
+	Required   bool      `json:"required"`
+	Position   int       `json:"position"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var customFieldTypes = []string{"text", "number", "select", "date", "user"}
+
+// customKeyRe limits keys to identifiers, so they are safe in URLs
+// (?cf.key=) and the query language (cf.key = x).
+var customKeyRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+var customUserRe = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dbQuerier is satisfied by both *sql.DB and *sql.Tx.
+type dbQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+const customFieldSelect = `SELECT f.id, p.key, f.key, f.name, f.type, f.options, f.required, f.position, f.created_at
+	FROM custom_fields f JOIN projects p ON p.id=f.project_id`
+
+func scanCustomField(row interface{ Scan(...interface{}) error }) (CustomField, error) {
+	var f CustomField
+	err := row.Scan(&f.ID, &f.ProjectKey, &f.Key, &f.Name, &f.Type, pq.Array(&f.Options), &f.Required, &f.Position, &f.CreatedAt)
+	return f, err
+}
+
+func queryCustomFields(q dbQuerier, where string, args ...interface{}) ([]CustomField, error) {
+	rows, err := q.Query(customFieldSelect+" WHERE "+where+" ORDER BY p.key, f.position, f.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields []CustomField
+	for rows.Next() {
+		f, err := scanCustomField(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// handleGetCustomFields lists definitions, for one project with ?project=KEY.
+func handleGetCustomFields(w http.ResponseWriter, r *http.Request) {
+	where := "f.account_id=$1"
+	args := []interface{}{cfg.AccountID}
+	if project := r.URL.Query().Get("project"); project != "" && project != "ALL" {
+		where += " AND p.key=$2"
+		args = append(args, project)
+	}
+	fields, err := queryCustomFields(db, where, args...)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if fields == nil {
+		fields = []CustomField{}
+	}
+	writeJSON(w, 200, fields)
+}
+
+// validate normalises a definition from a request.
+func (f *CustomField) validate() error {
+	f.Key = strings.ToLower(strings.TrimSpace(f.Key))
+	f.Name = strings.TrimSpace(f.Name)
+	if !customKeyRe.MatchString(f.Key) {
+		return fmt.Errorf("key must start with a letter and contain only a-z, 0-9 and _ (max 40)")
+	}
+	if f.Name == "" {
+		f.Name = f.Key
+	}
+	if !slices.Contains(customFieldTypes, f.Type) {
+		return fmt.Errorf("type must be one of %s", strings.Join(customFieldTypes, ", "))
+	}
+	if f.Type != "select" {
+		f.Options = []string{} // not nil: the column is NOT NULL
+		return nil
+	}
+	var opts []string
+	for _, o := range f.Options {
+		if o = strings.TrimSpace(o); o != "" && !slices.Contains(opts, o) {
+			opts = append(opts, o)
+		}
+	}
+	if len(opts) == 0 {
+		return fmt.Errorf("select fields need at least one option")
+	}
+	f.Options = opts
+	return nil
+}
+
+func handleCreateCustomField(w http.ResponseWriter, r *http.Request) {
+	var req CustomField
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	var projectID int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&projectID); err != nil {
+		writeJSON(w, 404, map[string]string{"error": "project not found"})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO custom_fields (account_id,project_id,key,name,type,options,required,position)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`,
+		cfg.AccountID, projectID, req.Key, req.Name, req.Type, pq.Array(req.Options), req.Required, req.Position).Scan(&id)
+	if isUniqueViolation(err) {
+		writeJSON(w, 409, map[string]string{"error": fmt.Sprintf("field %q already exists in %s", req.Key, req.ProjectKey)})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+// handleUpdateCustomField changes a definition's name, options, required
+// flag or position. The key, type and project are fixed once created, so
+// stored values never need converting.
+func handleUpdateCustomField(w http.ResponseWriter, r *http.Request) {
+	existing, err := scanCustomField(db.QueryRow(customFieldSelect+" WHERE f.id=$1 AND f.account_id=$2",
+		r.PathValue("id"), cfg.AccountID))
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "field not found"})
+		return
+	}
+	req := existing
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	req.Key, req.Type = existing.Key, existing.Type
+	if err := req.validate(); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE custom_fields SET name=$1, options=$2, required=$3, position=$4 WHERE id=$5`,
+		req.Name, pq.Array(req.Options), req.Required, req.Position, existing.ID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteCustomField(w http.ResponseWriter, r *http.Request) {
+	var projectID int
+	var key string
+	err := db.QueryRow("DELETE FROM custom_fields WHERE id=$1 AND account_id=$2 RETURNING project_id, key",
+		r.PathValue("id"), cfg.AccountID).Scan(&projectID, &key)
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "field not found"})
+		return
+	}
+	// Drop the stored values too, so a field re-created later starts empty.
+	if _, err := db.Exec("UPDATE tickets SET custom = custom - $1 WHERE project_id=$2 AND custom ? $1", key, projectID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// mergeCustomValues applies patch to current using the project's field
+// definitions and returns the new value set. A null (or empty) value
+// removes the field. Unknown keys and badly typed values are errors and,
+// with strict set, so are leaving a required field empty and naming a
+// user nobody knows (see knownUsers); user values are then spelled the
+// way the user is known.
+func mergeCustomValues(q dbQuerier, projectID int, current, patch map[string]interface{}, strict bool) (map[string]interface{}, error) {
+	fields, err := queryCustomFields(q, "f.project_id=$1", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defs := make(map[string]CustomField, len(fields))
+	for _, f := range fields {
+		defs[f.Key] = f
+	}
+
+	merged := make(map[string]interface{}, len(current)+len(patch))
+	for k, v := range current {
+		merged[k] = v
+	}
+	var users map[string]string
+	for k, v := range patch {
+		f, ok := defs[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown custom field %q", k)
+		}
+		v, err := f.normalize(v)
+		if err != nil {
+			return nil, err
+		}
+		if strict && f.Type == "user" && v != nil {
+			if users == nil {
+				known, err := knownUsers()
+				if err != nil {
+					return nil, err
+				}
+				users = make(map[string]string, len(known))
+				for _, u := range known {
+					users[strings.ToLower(u)] = u
+				}
+			}
+			u, ok := users[strings.ToLower(v.(string))]
+			if !ok {
+				return nil, fmt.Errorf("custom field %q: unknown user %q", f.Key, v)
+			}
+			v = u
+		}
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	for _, f := range fields {
+		if _, ok := merged[f.Key]; strict && f.Required && !ok {
+			return nil, fmt.Errorf("custom field %q is required", f.Key)
+		}
+	}
+	return merged, nil
+}
+
+// normalize checks a single value against the field's type. It returns
+// nil for "no value".
+func (f *CustomField) normalize(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if f.Type == "number" {
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("custom field %q must be a number", f.Key)
+		}
+		return n, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("custom field %q must be a string", f.Key)
+	}
+	if s = strings.TrimSpace(s); s == "" {
+		return nil, nil
+	}
+	switch f.Type {
+	case "select":
+		if !slices.Contains(f.Options, s) {
+			return nil, fmt.Errorf("custom field %q must be one of %s", f.Key, strings.Join(f.Options, ", "))
+		}
+	case "date":
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return nil, fmt.Errorf("custom field %q must be YYYY-MM-DD", f.Key)
+		}
+	case "user":
+		if !customUserRe.MatchString(s) {
+			return nil, fmt.Errorf("custom field %q must be a username", f.Key)
+		}
+	}
+	return s, nil
+}
+
+// customFilter turns ?cf.<key>=value params into equality filters,
+// e.g. /api/tickets?cf.customer=Acme&cf.env=prod.
+func customFilter(r *http.Request) (queryNode, error) {
+	var filter queryNode
+	for param, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(param, "cf.")
+		if !ok {
+			continue
+		}
+		if !customKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("invalid custom field %q", key)
+		}
+		var vals []interface{}
+		for _, v := range values {
+			vals = append(vals, v)
+		}
+		filter = andQuery(filter, &clauseNode{field: param, op: "IN", values: vals})
+	}
+	return filter, nil
+}
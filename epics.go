@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Epics group tickets across sprints (and optionally across projects).
+// Subtasks are "parent" links (see links.go), rolled up per ticket in
+// loadDependencies. Both report their children as a Progress.
+
+type Epic struct {
+	ID          int       `json:"id"`
+	AccountID   string    `json:"account_id"`
+	ProjectKey  string    `json:"project_key,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	Progress    Progress  `json:"progress"`
+}
+
+// Progress rolls up a set of child tickets by count and by story points.
+type Progress struct {
+	Total         int     `json:"total"`
+	Done          int     `json:"done"`
+	Percent       float64 `json:"percent"`
+	Points        int     `json:"points"`
+	PointsDone    int     `json:"points_done"`
+	PointsPercent float64 `json:"points_percent"`
+}
+
+func (p *Progress) compute() {
+	if p.Total > 0 {
+		p.Percent = float64(p.Done*1000/p.Total) / 10
+	}
+	if p.Points > 0 {
+		p.PointsPercent = float64(p.PointsDone*1000/p.Points) / 10
+	}
+}
+
+const epicSelect = `SELECT e.id, e.account_id, COALESCE(p.key,''), e.name, e.description, e.created_at,
+		COUNT(t.id), COUNT(t.id) FILTER (WHERE t.state='done'),
+		COALESCE(SUM(t.points),0), COALESCE(SUM(t.points) FILTER (WHERE t.state='done'),0)
+	FROM epics e
+	LEFT JOIN projects p ON p.id=e.project_id
+	LEFT JOIN tickets t ON t.epic_id=e.id`
+
+func scanEpic(row interface{ Scan(...interface{}) error }) (Epic, error) {
+	var e Epic
+	err := row.Scan(&e.ID, &e.AccountID, &e.ProjectKey, &e.Name, &e.Description, &e.CreatedAt,
+		&e.Progress.Total, &e.Progress.Done, &e.Progress.Points, &e.Progress.PointsDone)
+	e.Progress.compute()
+	return e, err
+}
+
+var epicSortColumns = map[string]sortColumn[Epic]{
+	"id":      {"e.id", func(e *Epic) string { return strconv.Itoa(e.ID) }},
+	"name":    {"e.name", func(e *Epic) string { return e.Name }},
+	"created": {"e.created_at", func(e *Epic) string { return cursorTime(e.CreatedAt) }},
+}
+
+func queryEpics(opts listOptions) ([]Epic, error) {
+	query := epicSelect + " WHERE e.account_id=$1"
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID}}
+	where, tail := pageSQL(opts, b, epicSortColumns, "name", "e.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	// GROUP BY must precede ORDER BY/LIMIT, so splice it into the tail.
+	rows, err := db.Query(query+" GROUP BY e.id, p.key"+tail, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var epics []Epic
+	for rows.Next() {
+		e, err := scanEpic(rows)
+		if err != nil {
+			return nil, err
+		}
+		epics = append(epics, e)
+	}
+	return epics, rows.Err()
+}
+
+func handleGetEpics(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, epicSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	epics, err := queryEpics(opts)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeList(w, r, epics, opts, epicSortColumns, "name", func(e *Epic) int { return e.ID })
+}
+
+func handleGetEpic(w http.ResponseWriter, r *http.Request) {
+	e, err := scanEpic(db.QueryRow(epicSelect+" WHERE e.id=$1 AND e.account_id=$2 GROUP BY e.id, p.key",
+		r.PathValue("id"), cfg.AccountID))
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "epic not found"})
+		return
+	}
+	filter := &clauseNode{field: "epic_id", op: "=", values: []interface{}{e.ID}}
+	tickets, err := queryTickets("ALL", "all", filter, listOptions{})
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"epic":    e,
+		"tickets": tickets,
+	})
+}
+
+type epicRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ProjectKey  string `json:"project_key"`
+}
+
+// projectID resolves the optional project key; nil means account-wide.
+func (req *epicRequest) projectID() (*int, int, string) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, 400, "name is required"
+	}
+	if req.ProjectKey == "" {
+		return nil, 0, ""
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&id); err != nil {
+		return nil, 404, "project not found"
+	}
+	return &id, 0, ""
+}
+
+func handleCreateEpic(w http.ResponseWriter, r *http.Request) {
+	var req epicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.projectID()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO epics (account_id,project_id,name,description) VALUES ($1,$2,$3,$4) RETURNING id`,
+		cfg.AccountID, projectID, req.Name, req.Description).Scan(&id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+func handleUpdateEpic(w http.ResponseWriter, r *http.Request) {
+	var req epicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.projectID()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE epics SET name=$1, description=$2, project_id=$3 WHERE id=$4 AND account_id=$5`,
+		req.Name, req.Description, projectID, r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "epic not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteEpic(w http.ResponseWriter, r *http.Request) {
+	// Tickets stay; ON DELETE SET NULL detaches them.
+	result, err := db.Exec("DELETE FROM epics WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "epic not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// validateEpic checks that an epic ID from a request belongs to the account.
+func validateEpic(id *int) error {
+	if id == nil {
+		return nil
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM epics WHERE id=$1 AND account_id=$2)", *id, cfg.AccountID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("epic %d not found", *id)
+	}
+	return nil
+}
+
+// optionalInt decodes a JSON field that may be absent, null or a number.
+// set reports whether the field was present at all.
+func optionalInt(raw json.RawMessage) (set bool, v *int, err error) {
+	if len(raw) == 0 {
+		return false, nil, nil
+	}
+	if string(raw) == "null" {
+		return true, nil, nil
+	}
+	var n int
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return true, nil, err
+	}
+	return true, &n, nil
+}
+
+// optionalString is optionalInt for string fields; null reads as "".
+func optionalString(raw json.RawMessage) (set bool, v string, err error) {
+	if len(raw) == 0 {
+		return false, "", nil
+	}
+	if string(raw) == "null" {
+		return true, "", nil
+	}
+	err = json.Unmarshal(raw, &v)
+	return true, v, err
+}
+
+// epicOptions lists epics for the board's selects.
+func epicOptions() []Epic {
+	epics, err := queryEpics(listOptions{})
+	if err != nil {
+		log.Printf("list epics: %v", err)
+	}
+	return epics
+}
+
+// setParent makes parent the parent of ticketID, replacing any existing
+// parent link; a nil parent detaches the subtask. It writes in tx, so the
+// caller's other changes to the ticket stand or fall with it.
+func setParent(tx *sql.Tx, ticketID int, parent *int) (int, string) {
+	var existing int
+	err := tx.QueryRow("SELECT id FROM ticket_links WHERE link_type='parent' AND target_ticket_id=$1 AND account_id=$2",
+		ticketID, cfg.AccountID).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return 500, err.Error()
+	}
+	if parent == nil {
+		if existing != 0 {
+			if _, err := tx.Exec("DELETE FROM ticket_links WHERE id=$1", existing); err != nil {
+				return 500, err.Error()
+			}
+		}
+		return 0, ""
+	}
+	_, status, msg := saveLinkTx(tx, "parent", *parent, ticketID, existing)
+	return status, msg
+}
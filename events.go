@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Board changes are pushed to browsers over Server-Sent Events
+// (GET /api/events). Handlers publish an Event after a mutation; it goes
+// out through Postgres NOTIFY, so every instance sharing the database
+// receives it on its LISTEN connection and forwards it, with the affected
+// cards freshly rendered, to its own subscribers. If LISTEN isn't
+// available the instance delivers its own events in-process only.
+
+const eventChannel = "pippin_events"
+
+// Event is what handlers publish. NOTIFY payloads are limited to 8000
+// bytes, so it only names what changed; cards are rendered on delivery.
+type Event struct {
+	Type      string    `json:"type"` // ticket.created, ticket.moved, block.added, ...
+	AccountID string    `json:"account_id"`
+	TicketID  int       `json:"ticket_id,omitempty"`
+	Related   []int     `json:"related,omitempty"` // other tickets whose cards changed
+	Project   string    `json:"project,omitempty"`
+	Actor     string    `json:"actor,omitempty"` // the user who made the change, if known
+	At        time.Time `json:"at"`
+}
+
+// eventCard is a re-rendered board card. A card that no longer exists is
+// sent with Deleted set.
+type eventCard struct {
+	ID      int                 `json:"id"`
+	Deleted bool                `json:"deleted,omitempty"`
+	State   string              `json:"state,omitempty"`
+	Project string              `json:"project,omitempty"`
+	Lanes   map[string][]string `json:"lanes,omitempty"` // lane keys per grouping, see laneKeys
+	HTML    string              `json:"html,omitempty"`
+}
+
+type eventMessage struct {
+	Event
+	Cards []eventCard `json:"cards,omitempty"`
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]bool
+}
+
+var (
+	hub = &eventHub{subs: map[chan []byte]bool{}}
+	// eventsListening is set once this instance LISTENs, from then on
+	// events round-trip through Postgres instead of being delivered locally.
+	eventsListening atomic.Bool
+)
+
+func (h *eventHub) subscribe() chan []byte {
+	ch := make(chan []byte, 32)
+	h.mu.Lock()
+	h.subs[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+	h.mu.Unlock()
+}
+
+func (h *eventHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// broadcast sends msg to every subscriber. One that has fallen 32
+// messages behind is dropped; its browser reconnects and reloads.
+func (h *eventHub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish announces a change. Errors are only logged: the mutation has
+// already succeeded, and boards catch up on their next reload. Webhooks
+// are queued here rather than on delivery, so once and not per instance.
+func publish(ev Event) {
+	ev.AccountID = cfg.AccountID
+	ev.At = time.Now().UTC()
+	enqueueWebhooks(ev)
+	if eventsListening.Load() {
+		payload, _ := json.Marshal(ev)
+		_, err := db.Exec("SELECT pg_notify($1, $2)", eventChannel, string(payload))
+		if err == nil {
+			return
+		}
+		log.Printf("events: notify %s: %v", ev.Type, err)
+	}
+	hub.deliver(ev)
+}
+
+// publishLink announces a link being added or removed; blocks links get
+// their own block.* events since they drive the card badges.
+func publishLink(kind, linkType string, source, target int) {
+	prefix := "link."
+	if linkType == "blocks" {
+		prefix = "block."
+	}
+	publish(Event{Type: prefix + kind, TicketID: source, Related: []int{target}})
+}
+
+// listenEvents runs for the life of the process, forwarding NOTIFYs from
+// every instance to this instance's subscribers.
+func listenEvents() {
+	l := pq.NewListener(cfg.DatabaseURL, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("events listener: %v", err)
+		}
+	})
+	if err := l.Listen(eventChannel); err != nil {
+		log.Printf("events: LISTEN failed, delivering locally only: %v", err)
+		l.Close()
+		return
+	}
+	eventsListening.Store(true)
+
+	for {
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				// The connection was re-established; anything sent in
+				// between is lost, so boards must reload.
+				hub.broadcast([]byte(`{"type":"resync"}`))
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+				log.Printf("events: bad payload: %v", err)
+				continue
+			}
+			hub.deliver(ev)
+		case <-time.After(90 * time.Second):
+			go l.Ping()
+		}
+	}
+}
+
+// deliver renders the cards an event touches, once per instance, and
+// broadcasts it.
+func (h *eventHub) deliver(ev Event) {
+	if ev.AccountID != cfg.AccountID {
+		return
+	}
+	deliverPresence(ev)
+	if h.count() == 0 || strings.HasPrefix(ev.Type, "presence.") {
+		return
+	}
+	msg := eventMessage{Event: ev}
+	if ev.TicketID != 0 {
+		cards, err := renderCards(ev.TicketID, ev.Related)
+		if err != nil {
+			log.Printf("events: render %s T-%d: %v", ev.Type, ev.TicketID, err)
+		}
+		msg.Cards = cards
+	}
+	data, _ := json.Marshal(msg)
+	h.broadcast(data)
+}
+
+// renderCards renders the ticket, the related tickets and its parent and
+// blocking neighbours, whose badges and progress depend on it.
+func renderCards(id int, related []int) ([]eventCard, error) {
+	ids := []int64{int64(id)}
+	for _, r := range related {
+		ids = append(ids, int64(r))
+	}
+	rows, err := db.Query(`SELECT target_ticket_id FROM ticket_links WHERE source_ticket_id=$1 AND link_type IN ('blocks','parent')
+		UNION SELECT source_ticket_id FROM ticket_links WHERE target_ticket_id=$1 AND link_type IN ('blocks','parent')`, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var n int64
+		if rows.Scan(&n) == nil {
+			ids = append(ids, n)
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(ticketSelect+" WHERE t.account_id=$1 AND t.id = ANY($2)", cfg.AccountID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	var tickets []Ticket
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tickets = append(tickets, t)
+	}
+	rows.Close()
+	if err := loadDependencies(tickets); err != nil {
+		return nil, err
+	}
+	if err := loadLabels(tickets); err != nil {
+		return nil, err
+	}
+
+	found := map[int]bool{}
+	var cards []eventCard
+	for i := range tickets {
+		t := &tickets[i]
+		var buf bytes.Buffer
+		if err := tpl.ExecuteTemplate(&buf, "card", t); err != nil {
+			return nil, err
+		}
+		lanes := map[string][]string{}
+		for _, by := range laneOptions {
+			lanes[by] = laneKeys(t, by)
+		}
+		cards = append(cards, eventCard{ID: t.ID, State: t.State, Project: t.ProjectKey, Lanes: lanes, HTML: buf.String()})
+		found[t.ID] = true
+	}
+	for _, n := range ids {
+		if !found[int(n)] {
+			cards = append(cards, eventCard{ID: int(n), Deleted: true})
+			found[int(n)] = true
+		}
+	}
+	return cards, nil
+}
+
+// handleEvents streams the account's events as SSE, one JSON object per
+// message.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, 500, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		case <-ping.C:
+			// Comments keep proxies from closing an idle stream.
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SavedFilter is a named board view: a query-language expression plus
+// sort order and visible columns. Private filters are only visible to
+// their owner; shared ones to everyone in the account, and can be
+// linked as /board?filter=<id>.
+type SavedFilter struct {
+	ID        int       `json:"id"`
+	AccountID string    `json:"account_id"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Shared    bool      `json:"shared"`
+	Query     string    `json:"query"`
+	Sort      string    `json:"sort"`
+	Columns   []string  `json:"columns"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type filterRequest struct {
+	Name    string   `json:"name"`
+	Shared  bool     `json:"shared"`
+	Query   string   `json:"query"`
+	Sort    string   `json:"sort"`
+	Columns []string `json:"columns"`
+}
+
+// validate normalises the request and checks the query, sort and columns.
+func (req *filterRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, err := parseTicketQuery(req.Query); err != nil {
+		return err
+	}
+	if err := validateTicketSort(req.Sort); err != nil {
+		return err
+	}
+	if len(req.Columns) == 0 {
+		req.Columns = ticketStates
+	}
+	for _, c := range req.Columns {
+		if !isTicketState(c) {
+			return fmt.Errorf("invalid column %q", c)
+		}
+	}
+	return nil
+}
+
+const filterColumns = `id, account_id, owner, name, shared, query, sort, columns, created_at, updated_at`
+
+func scanFilter(row interface{ Scan(...interface{}) error }) (SavedFilter, error) {
+	var f SavedFilter
+	var cols string
+	err := row.Scan(&f.ID, &f.AccountID, &f.Owner, &f.Name, &f.Shared, &f.Query, &f.Sort, &cols, &f.CreatedAt, &f.UpdatedAt)
+	if cols != "" {
+		f.Columns = strings.Split(cols, ",")
+	}
+	return f, err
+}
+
+// queryFilters returns the filters visible to user: their own plus shared ones.
+func queryFilters(user string, opts listOptions) ([]SavedFilter, error) {
+	query := `SELECT ` + filterColumns + ` FROM saved_filters WHERE account_id=$1 AND (shared OR owner=$2)`
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID, user}}
+	where, tail := pageSQL(opts, b, filterSortColumns, "name", "id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []SavedFilter
+	for rows.Next() {
+		f, err := scanFilter(rows)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// loadFilter fetches one filter if user may see it.
+func loadFilter(id, user string) (SavedFilter, error) {
+	return scanFilter(db.QueryRow(`SELECT `+filterColumns+` FROM saved_filters
+		WHERE id=$1 AND account_id=$2 AND (shared OR owner=$3)`, id, cfg.AccountID, user))
+}
+
+func handleGetFilters(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, filterSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	filters, err := queryFilters(currentUser(r), opts)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeList(w, r, filters, opts, filterSortColumns, "name", func(f *SavedFilter) int { return f.ID })
+}
+
+func handleGetFilter(w http.ResponseWriter, r *http.Request) {
+	f, err := loadFilter(r.PathValue("id"), currentUser(r))
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "filter not found"})
+		return
+	}
+	writeJSON(w, 200, f)
+}
+
+func handleCreateFilter(w http.ResponseWriter, r *http.Request) {
+	var req filterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO saved_filters (account_id,owner,name,shared,query,sort,columns)
+		VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id`,
+		cfg.AccountID, currentUser(r), req.Name, req.Shared, req.Query, req.Sort, strings.Join(req.Columns, ",")).Scan(&id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+func handleUpdateFilter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req filterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if status, msg := checkFilterOwner(id, currentUser(r)); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	_, err := db.Exec(`UPDATE saved_filters SET name=$1, shared=$2, query=$3, sort=$4, columns=$5, updated_at=now()
+		WHERE id=$6 AND account_id=$7`,
+		req.Name, req.Shared, req.Query, req.Sort, strings.Join(req.Columns, ","), id, cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteFilter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if status, msg := checkFilterOwner(id, currentUser(r)); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM saved_filters WHERE id=$1 AND account_id=$2", id, cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// checkFilterOwner returns a non-zero HTTP status if user may not modify
+// the filter. Shared filters are readable by all but editable only by
+// their owner.
+func checkFilterOwner(id, user string) (int, string) {
+	var owner string
+	var shared bool
+	err := db.QueryRow("SELECT owner, shared FROM saved_filters WHERE id=$1 AND account_id=$2",
+		id, cfg.AccountID).Scan(&owner, &shared)
+	if err == sql.ErrNoRows || (err == nil && !shared && owner != user) {
+		return 404, "filter not found"
+	}
+	if err != nil {
+		return 500, err.Error()
+	}
+	if owner != user {
+		return 403, "only the owner can modify this filter"
+	}
+	return 0, ""
+}
+
+var filterSortColumns = map[string]sortColumn[SavedFilter]{
+	"id":      {"id", func(f *SavedFilter) string { return strconv.Itoa(f.ID) }},
+	"name":    {"name", func(f *SavedFilter) string { return f.Name }},
+	"owner":   {"owner", func(f *SavedFilter) string { return f.Owner }},
+	"created": {"created_at", func(f *SavedFilter) string { return cursorTime(f.CreatedAt) }},
+	"updated": {"updated_at", func(f *SavedFilter) string { return cursorTime(f.UpdatedAt) }},
+}
+
+func validateTicketSort(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	if _, ok := ticketSortColumns[strings.TrimPrefix(spec, "-")]; !ok {
+		return fmt.Errorf("invalid sort %q (want one of %s, optionally prefixed with -)", spec, sortNames(ticketSortColumns))
+	}
+	return nil
+}
+
+func isTicketState(s string) bool {
+	return stateIndex(s) >= 0
+}
+
+func stateIndex(s string) int {
+	for i, st := range ticketStates {
+		if st == s {
+			return i
+		}
+	}
+	return -1
+}
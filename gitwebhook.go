@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Incoming git webhook (POST /api/git/webhook): GitHub, GitLab and Gitea
+// push and pull/merge request events. Ticket references in commit messages
+// and merged pull requests get a comment linking the commit; a reference
+// after a transition keyword ("fixes T-42", "closes CART-7, CART-8") also
+// moves the ticket, through moveTicket like the board's arrows.
+//
+// Commits only move tickets when pushed to the repository's default
+// branch, so work on a feature branch is linked but not closed until it
+// lands.
+
+// defaultGitTransitions is GIT_TRANSITIONS when unset: keywords, then the
+// state they move to; groups are separated by semicolons.
+const defaultGitTransitions = "fix,fixes,fixed,close,closes,closed,resolve,resolves,resolved=done"
+
+// parseGitTransitions parses "fixes,closes=done;starts=in_progress" into
+// keyword -> state.
+func parseGitTransitions(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, group := range strings.Split(s, ";") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+		words, state, ok := strings.Cut(group, "=")
+		state = strings.TrimSpace(state)
+		if !ok || stateTitles[state] == "" {
+			return nil, fmt.Errorf("%q: expected keyword,...=state with a known state", group)
+		}
+		for _, w := range strings.Split(words, ",") {
+			if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+				out[w] = state
+			}
+		}
+	}
+	return out, nil
+}
+
+// gitRef is a ticket referenced from a commit or pull request, as Key-ID;
+// State is empty for a plain mention.
+type gitRef struct {
+	Key      string
+	TicketID int
+	State    string
+}
+
+var (
+	gitWordRe = regexp.MustCompile(`[A-Za-z][A-Za-z0-9_]*-\d+|[A-Za-z]+|\S`)
+	gitRefRe  = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)-(\d+)$`)
+)
+
+// parseGitRefs finds ticket references in a message. A transition keyword
+// applies to the references right after it, through commas and "and":
+// in "Fixes T-1, T-2 and T-3; refs T-4" the first three move.
+func parseGitRefs(msg string, keys map[string]bool, transitions map[string]string) []gitRef {
+	var refs []gitRef
+	seen := map[string]int{} // reference -> index in refs
+	state := ""
+	for _, word := range gitWordRe.FindAllString(msg, -1) {
+		lower := strings.ToLower(word)
+		if m := gitRefRe.FindStringSubmatch(word); m != nil && keys[m[1]] {
+			id, _ := strconv.Atoi(m[2])
+			if i, ok := seen[word]; ok {
+				if refs[i].State == "" {
+					refs[i].State = state
+				}
+			} else {
+				seen[word] = len(refs)
+				refs = append(refs, gitRef{Key: m[1], TicketID: id, State: state})
+			}
+			continue
+		}
+		switch {
+		case transitions[lower] != "":
+			state = transitions[lower]
+		case word == "," || word == ":" || word == "#" || lower == "and":
+			// keeps the current keyword going
+		default:
+			state = ""
+		}
+	}
+	return refs
+}
+
+// gitChange is a commit or merged pull request, whichever forge sent it.
+type gitChange struct {
+	Kind    string // "commit" or "pull request"
+	ID      string // commit SHA or PR number
+	Message string
+	URL     string
+	Author  string
+	Repo    string
+	Moves   bool // references with a keyword may transition tickets
+}
+
+func (c gitChange) label() string {
+	if c.Kind == "commit" {
+		short := c.ID
+		if len(short) > 7 {
+			short = short[:7]
+		}
+		return "commit " + short
+	}
+	return "pull request #" + c.ID
+}
+
+// verifyGitSecret checks whichever signature the forge sent: GitHub's
+// X-Hub-Signature-256, Gitea's X-Gitea-Signature (both HMAC-SHA256 of
+// the body) or GitLab's X-Gitlab-Token (the secret itself).
+func verifyGitSecret(r *http.Request, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(cfg.GitWebhookSecret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		return hmac.Equal([]byte(sig), []byte("sha256="+expected))
+	}
+	if sig := r.Header.Get("X-Gitea-Signature"); sig != "" {
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.GitWebhookSecret)) == 1
+	}
+	return false
+}
+
+// The subset of the forges' payloads used here. GitHub and Gitea share a
+// shape; GitLab's fields are the ones tagged for it.
+type gitPayload struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Project struct { // GitLab
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+	} `json:"project"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"author"`
+	} `json:"commits"`
+	Action      string `json:"action"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		Body    string `json:"body"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"pull_request"`
+	ObjectAttributes *struct { // GitLab merge request
+		IID         int    `json:"iid"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		URL         string `json:"url"`
+		Action      string `json:"action"`
+	} `json:"object_attributes"`
+	User struct { // GitLab
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// changes turns a push or merged pull request into gitChanges; other
+// events yield none.
+func (p *gitPayload) changes(event string) []gitChange {
+	repo, defaultBranch := p.Repository.FullName, p.Repository.DefaultBranch
+	if p.Project.PathWithNamespace != "" {
+		repo, defaultBranch = p.Project.PathWithNamespace, p.Project.DefaultBranch
+	}
+
+	var out []gitChange
+	switch event {
+	case "push", "Push Hook":
+		onDefault := defaultBranch != "" && p.Ref == "refs/heads/"+defaultBranch
+		for _, c := range p.Commits {
+			author := c.Author.Username
+			if author == "" {
+				author = c.Author.Name
+			}
+			out = append(out, gitChange{Kind: "commit", ID: c.ID, Message: c.Message, URL: c.URL,
+				Author: author, Repo: repo, Moves: onDefault})
+		}
+	case "pull_request":
+		if pr := p.PullRequest; pr != nil && p.Action == "closed" && pr.Merged {
+			out = append(out, gitChange{Kind: "pull request", ID: strconv.Itoa(pr.Number), Message: pr.Title + "\n" + pr.Body,
+				URL: pr.HTMLURL, Author: pr.User.Login, Repo: repo, Moves: true})
+		}
+	case "Merge Request Hook":
+		if mr := p.ObjectAttributes; mr != nil && mr.Action == "merge" {
+			out = append(out, gitChange{Kind: "pull request", ID: strconv.Itoa(mr.IID), Message: mr.Title + "\n" + mr.Description,
+				URL: mr.URL, Author: p.User.Username, Repo: repo, Moves: true})
+		}
+	}
+	return out
+}
+
+// gitResult reports what was done to one ticket.
+type gitResult struct {
+	TicketID  int    `json:"ticket_id"`
+	Change    string `json:"change"`
+	Commented bool   `json:"commented"`
+	MovedTo   string `json:"moved_to,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func handleGitWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.GitWebhookSecret == "" {
+		writeJSON(w, 404, map[string]string{"error": "git webhook not configured (set GIT_WEBHOOK_SECRET)"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 5<<20))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "unreadable body"})
+		return
+	}
+	if !verifyGitSecret(r, body) {
+		writeJSON(w, 401, map[string]string{"error": "invalid signature"})
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitea-Event")
+	}
+	if event == "" {
+		event = r.Header.Get("X-Gitlab-Event")
+	}
+	if event == "ping" {
+		writeJSON(w, 200, map[string]string{"status": "pong"})
+		return
+	}
+	var p gitPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+
+	keys := ticketRefKeys()
+	results := []gitResult{}
+	for _, c := range p.changes(event) {
+		for _, ref := range parseGitRefs(c.Message, keys, cfg.GitTransitions) {
+			results = append(results, applyGitRef(c, ref))
+		}
+	}
+	writeJSON(w, 200, map[string]interface{}{"status": "processed", "event": event, "tickets": results})
+}
+
+// applyGitRef comments on a referenced ticket and moves it if asked to.
+// Redelivered payloads don't comment twice: the change's URL is looked
+// for in the existing comments first.
+func applyGitRef(c gitChange, ref gitRef) gitResult {
+	res := gitResult{TicketID: ref.TicketID, Change: c.label()}
+	if !refersToTicket(ref.Key, ref.TicketID) {
+		res.Error = "ticket not found"
+		return res
+	}
+	var comments string
+	err := db.QueryRow("SELECT COALESCE(comments,'') FROM tickets WHERE id=$1 AND account_id=$2",
+		ref.TicketID, cfg.AccountID).Scan(&comments)
+	if err != nil {
+		res.Error = "ticket not found"
+		return res
+	}
+
+	actor := c.Author
+	if c.URL == "" || !strings.Contains(comments, c.URL) {
+		title, _, _ := strings.Cut(strings.TrimSpace(c.Message), "\n")
+		text := fmt.Sprintf("%s %s by %s: %s", c.Repo, c.label(), actor, title)
+		if c.URL != "" {
+			text = fmt.Sprintf("[%s %s](%s) by %s: %s", c.Repo, c.label(), c.URL, actor, title)
+		}
+		if err := addComment(ref.TicketID, text, actor); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Commented = true
+	}
+
+	if ref.State != "" && c.Moves {
+		moved, err := moveTicket(ref.TicketID, ref.State, actor)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if moved {
+			res.MovedTo = ref.State
+			log.Printf("git webhook: T-%d moved to %s by %s", ref.TicketID, ref.State, c.label())
+		}
+	}
+	return res
+}
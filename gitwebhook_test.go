@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseGitTransitions(t *testing.T) {
+	got, err := parseGitTransitions(" Fixes, closes = done ; starts=in_progress;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"fixes": "done", "closes": "done", "starts": "in_progress"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGitTransitions = %v, want %v", got, want)
+	}
+	if got, err := parseGitTransitions(defaultGitTransitions); err != nil || len(got) != 9 || got["resolved"] != "done" {
+		t.Errorf("default transitions = %v, %v", got, err)
+	}
+	for _, bad := range []string{"fixes", "fixes=shipped", "fixes=done;closes"} {
+		if _, err := parseGitTransitions(bad); err == nil {
+			t.Errorf("parseGitTransitions(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseGitRefs(t *testing.T) {
+	keys := map[string]bool{"T": true, "CART": true, "OPS": true}
+	transitions, _ := parseGitTransitions(defaultGitTransitions + ";starts=in_progress")
+
+	for _, tc := range []struct {
+		msg  string
+		want []gitRef
+	}{
+		{"Fixes T-1, T-2 and T-3; refs T-4", []gitRef{{"T", 1, "done"}, {"T", 2, "done"}, {"T", 3, "done"}, {"T", 4, ""}}},
+		{"closes CART-7", []gitRef{{"CART", 7, "done"}}},
+		{"Starts OPS-3", []gitRef{{"OPS", 3, "in_progress"}}},
+		{"fixes: T-8", []gitRef{{"T", 8, "done"}}},
+		{"Fixed #T-9", []gitRef{{"T", 9, "done"}}},
+		{"fix the T-1 bug", []gitRef{{"T", 1, ""}}},
+		{"Update docs for CART-2", []gitRef{{"CART", 2, ""}}},
+		// A plain mention picks up a later keyword; repeats are dropped.
+		{"T-5 cleanup, fixes T-5", []gitRef{{"T", 5, "done"}}},
+		{"fixes T-5 and T-5", []gitRef{{"T", 5, "done"}}},
+		// The same number under two keys stays two references; only
+		// one of them can name the ticket.
+		{"closes T-6 and CART-6", []gitRef{{"T", 6, "done"}, {"CART", 6, "done"}}},
+		// Unknown keys aren't references, and end the keyword's run.
+		{"fixes ABC-1 T-2", []gitRef{{"T", 2, ""}}},
+		{"fixes cart-7", nil},
+		{"no tickets here", nil},
+		{"", nil},
+	} {
+		got := parseGitRefs(tc.msg, keys, transitions)
+		if len(got) != len(tc.want) || len(got) > 0 && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseGitRefs(%q) = %v, want %v", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyGitSecret(t *testing.T) {
+	defer func(s string) { cfg.GitWebhookSecret = s }(cfg.GitWebhookSecret)
+	cfg.GitWebhookSecret = "s3cret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	for _, tc := range []struct {
+		name, header, value string
+		want                bool
+	}{
+		{"github", "X-Hub-Signature-256", "sha256=" + sig, true},
+		{"github unprefixed", "X-Hub-Signature-256", sig, false},
+		{"github wrong", "X-Hub-Signature-256", "sha256=" + sig[:60] + "0000", false},
+		{"gitea", "X-Gitea-Signature", sig, true},
+		{"gitea prefixed", "X-Gitea-Signature", "sha256=" + sig, false},
+		{"gitlab", "X-Gitlab-Token", "s3cret", true},
+		{"gitlab wrong", "X-Gitlab-Token", "s3cre", false},
+		{"no signature", "X-Other", "s3cret", false},
+	} {
+		r := httptest.NewRequest("POST", "/api/git/webhook", nil)
+		r.Header.Set(tc.header, tc.value)
+		if got := verifyGitSecret(r, body); got != tc.want {
+			t.Errorf("%s: verifyGitSecret = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGitPayloadChanges(t *testing.T) {
+	const githubPush = `{"ref":"refs/heads/%s","repository":{"full_name":"acme/shop","default_branch":"main"},
+		"commits":[{"id":"1a2b3c4d5e6f","message":"Fixes T-1","url":"https://git.example/c/1a2b3c4",
+			"author":{"name":"Jane Doe","username":"jane"}},
+		{"id":"9f8e7d","message":"wip","url":"https://git.example/c/9f8e7d","author":{"name":"Lee"}}]}`
+	pushed := func(moves bool) []gitChange {
+		return []gitChange{
+			{Kind: "commit", ID: "1a2b3c4d5e6f", Message: "Fixes T-1", URL: "https://git.example/c/1a2b3c4",
+				Author: "jane", Repo: "acme/shop", Moves: moves},
+			{Kind: "commit", ID: "9f8e7d", Message: "wip", URL: "https://git.example/c/9f8e7d",
+				Author: "Lee", Repo: "acme/shop", Moves: moves},
+		}
+	}
+	const githubPR = `{"action":"%s","repository":{"full_name":"acme/shop","default_branch":"main"},
+		"pull_request":{"number":12,"title":"Checkout","body":"closes CART-7","html_url":"https://git.example/pr/12",
+			"merged":%s,"user":{"login":"lee"}}}`
+	merged := []gitChange{{Kind: "pull request", ID: "12", Message: "Checkout\ncloses CART-7",
+		URL: "https://git.example/pr/12", Author: "lee", Repo: "acme/shop", Moves: true}}
+	const gitlabMR = `{"project":{"path_with_namespace":"acme/api","default_branch":"main"},"user":{"username":"sam"},
+		"object_attributes":{"iid":4,"title":"Auth","description":"fixes OPS-2","url":"https://gl.example/mr/4","action":"%s"}}`
+
+	for _, tc := range []struct {
+		name, event, payload string
+		want                 []gitChange
+	}{
+		{"push to the default branch", "push", fmt.Sprintf(githubPush, "main"), pushed(true)},
+		{"push to a feature branch", "push", fmt.Sprintf(githubPush, "feature/checkout"), pushed(false)},
+		{"tag push", "push", `{"ref":"refs/tags/main","repository":{"full_name":"acme/shop","default_branch":"main"},
+			"commits":[{"id":"1","message":"m"}]}`, []gitChange{{Kind: "commit", ID: "1", Message: "m", Repo: "acme/shop"}}},
+		{"merged pull request", "pull_request", fmt.Sprintf(githubPR, "closed", "true"), merged},
+		{"closed pull request", "pull_request", fmt.Sprintf(githubPR, "closed", "false"), nil},
+		{"opened pull request", "pull_request", fmt.Sprintf(githubPR, "opened", "false"), nil},
+		{"gitlab push", "Push Hook", `{"ref":"refs/heads/main","project":{"path_with_namespace":"acme/api","default_branch":"main"},
+			"commits":[{"id":"abc","message":"m","author":{"name":"Sam"}}]}`,
+			[]gitChange{{Kind: "commit", ID: "abc", Message: "m", Author: "Sam", Repo: "acme/api", Moves: true}}},
+		{"gitlab merge", "Merge Request Hook", fmt.Sprintf(gitlabMR, "merge"), []gitChange{{Kind: "pull request", ID: "4",
+			Message: "Auth\nfixes OPS-2", URL: "https://gl.example/mr/4", Author: "sam", Repo: "acme/api", Moves: true}}},
+		{"gitlab close", "Merge Request Hook", fmt.Sprintf(gitlabMR, "close"), nil},
+		{"other event", "issues", fmt.Sprintf(githubPR, "closed", "true"), nil},
+	} {
+		var p gitPayload
+		if err := json.Unmarshal([]byte(tc.payload), &p); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := p.changes(tc.event)
+		if len(got) != len(tc.want) || len(got) > 0 && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: changes = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	c := gitChange{Kind: "commit", ID: "1a2b3c4d5e6f"}
+	if got := c.label(); got != "commit 1a2b3c4" {
+		t.Errorf("label = %q", got)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/hadlock/pippin
 
 go 1.23.2
 
-require github.com/lib/pq v1.10.9 // indirect
+require github.com/lib/pq v1.10.9
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Dependency graph over "blocks" links. An edge From→To means ticket
+// From blocks ticket To. The graph must stay acyclic, so new edges are
+// checked against every existing edge in the account (see saveLink),
+// not just the two tickets involved.
+
+type depEdge struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type graphNode struct {
+	ID         int    `json:"id"`
+	ProjectKey string `json:"project_key"`
+	Title      string `json:"title"`
+	State      string `json:"state"`
+	Assignee   string `json:"assignee"`
+}
+
+type depGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []depEdge   `json:"edges"`
+}
+
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// findPath returns a path of ticket IDs from → … → to following edges,
+// or nil if to is unreachable.
+func findPath(edges []depEdge, from, to int) []int {
+	next := map[int][]int{}
+	for _, e := range edges {
+		next[e.From] = append(next[e.From], e.To)
+	}
+	prev := map[int]int{from: from}
+	queue := []int{from}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n == to {
+			path := []int{to}
+			for n != from {
+				n = prev[n]
+				path = append([]int{n}, path...)
+			}
+			return path
+		}
+		for _, m := range next[n] {
+			if _, seen := prev[m]; !seen {
+				prev[m] = n
+				queue = append(queue, m)
+			}
+		}
+	}
+	return nil
+}
+
+func formatPath(path []int) string {
+	parts := make([]string, len(path))
+	for i, id := range path {
+		parts[i] = fmt.Sprintf("T-%d", id)
+	}
+	return strings.Join(parts, " → ")
+}
+
+// projectGraph returns the project's tickets plus any tickets in other
+// projects linked to them, and every edge touching the project.
+func projectGraph(key string) (depGraph, error) {
+	g := depGraph{Nodes: []graphNode{}, Edges: []depEdge{}}
+
+	rows, err := db.Query(`SELECT b.blocker_ticket_id, b.blocked_ticket_id FROM blocks b
+		JOIN tickets bt ON bt.id=b.blocker_ticket_id JOIN projects bp ON bp.id=bt.project_id
+		JOIN tickets dt ON dt.id=b.blocked_ticket_id JOIN projects dp ON dp.id=dt.project_id
+		WHERE b.account_id=$1 AND (bp.key=$2 OR dp.key=$2)
+		ORDER BY 1, 2`, cfg.AccountID, key)
+	if err != nil {
+		return g, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e depEdge
+		if err := rows.Scan(&e.From, &e.To); err != nil {
+			return g, err
+		}
+		g.Edges = append(g.Edges, e)
+	}
+	if err := rows.Err(); err != nil {
+		return g, err
+	}
+
+	var linked []int64
+	for _, e := range g.Edges {
+		linked = append(linked, int64(e.From), int64(e.To))
+	}
+	nrows, err := db.Query(`SELECT t.id, p.key, t.title, t.state, COALESCE(t.assignee,'')
+		FROM tickets t JOIN projects p ON p.id=t.project_id
+		WHERE t.account_id=$1 AND (p.key=$2 OR t.id = ANY($3))
+		ORDER BY t.id`, cfg.AccountID, key, pq.Array(linked))
+	if err != nil {
+		return g, err
+	}
+	defer nrows.Close()
+	for nrows.Next() {
+		var n graphNode
+		if err := nrows.Scan(&n.ID, &n.ProjectKey, &n.Title, &n.State, &n.Assignee); err != nil {
+			return g, err
+		}
+		g.Nodes = append(g.Nodes, n)
+	}
+	return g, nrows.Err()
+}
+
+// dot renders the graph in Graphviz DOT. Nodes in other projects are
+// dashed; done tickets are greyed out.
+func (g depGraph) dot(key string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(key))
+	sb.WriteString("  rankdir=LR;\n  node [shape=box, style=rounded, fontname=\"sans-serif\"];\n")
+	for _, n := range g.Nodes {
+		attrs := []string{"label=" + dotQuote(fmt.Sprintf("%s-%d", n.ProjectKey, n.ID), n.Title)}
+		style := "rounded"
+		if n.ProjectKey != key {
+			style += ",dashed"
+		}
+		if n.State == "done" {
+			style += ",filled"
+			attrs = append(attrs, `fillcolor="#c7f9cc"`, `fontcolor="#666666"`)
+		}
+		attrs = append(attrs, "style="+dotQuote(style))
+		fmt.Fprintf(&sb, "  t%d [%s];\n", n.ID, strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&sb, "  t%d -> t%d;\n", e.From, e.To)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// dotQuote makes a DOT quoted string of lines joined by \n line breaks.
+// Only " and \ are escaped; DOT takes UTF-8 as it is, unlike the \u and
+// \x escapes strconv.Quote would write.
+func dotQuote(lines ...string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, l := range lines {
+		lines[i] = r.Replace(l)
+	}
+	return `"` + strings.Join(lines, `\n`) + `"`
+}
+
+func handleProjectGraph(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM projects WHERE account_id=$1 AND key=$2)", cfg.AccountID, key).Scan(&exists)
+	if !exists {
+		writeJSON(w, 404, map[string]string{"error": "project not found"})
+		return
+	}
+
+	g, err := projectGraph(key)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if r.URL.Query().Get("format") == "dot" || strings.Contains(r.Header.Get("Accept"), "text/vnd.graphviz") {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.Write([]byte(g.dot(key)))
+		return
+	}
+	writeJSON(w, 200, g)
+}
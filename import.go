@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// exportDoc is the shape written by GET /api/export and read back by
+// POST /api/import.
+type exportDoc struct {
+	Projects     []Project     `json:"projects"`
+	Epics        []Epic        `json:"epics"`
+	Labels       []Label       `json:"labels"`
+	CustomFields []CustomField `json:"custom_fields"`
+	Tickets      []Ticket      `json:"tickets"`
+	Links        []exportLink  `json:"links"`
+}
+
+// exportLink is one ticket_links row, with the tickets' exported IDs.
+type exportLink struct {
+	Type   string `json:"type"`
+	Source int    `json:"source"`
+	Target int    `json:"target"`
+}
+
+// queryExportLinks returns every link in the account, of every type.
+func queryExportLinks() ([]exportLink, error) {
+	rows, err := db.Query(`SELECT link_type, source_ticket_id, target_ticket_id FROM ticket_links
+		WHERE account_id=$1 ORDER BY id`, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []exportLink{}
+	for rows.Next() {
+		var l exportLink
+		if err := rows.Scan(&l.Type, &l.Source, &l.Target); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// handleImport loads an export into the current account in one
+// transaction. Projects, labels and custom fields are matched by key or
+// name and created when missing; epics are matched by name; tickets are
+// always created, with new IDs, and their epic, label and link
+// references are remapped to the imported rows.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	var doc exportDoc
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	counts, status, err := importDoc(tx, &doc)
+	if err != nil {
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	publish(Event{Type: "data.imported"})
+	writeJSON(w, 201, counts)
+}
+
+func importDoc(tx *sql.Tx, doc *exportDoc) (map[string]int, int, error) {
+	counts := map[string]int{}
+
+	projects := map[string]int{}
+	for _, p := range doc.Projects {
+		var id int
+		err := tx.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, p.Key).Scan(&id)
+		if err == sql.ErrNoRows {
+			var count int
+			tx.QueryRow("SELECT COUNT(*) FROM projects WHERE account_id=$1", cfg.AccountID).Scan(&count)
+			if count >= 3 {
+				return nil, 400, fmt.Errorf("project limit reached importing %s", p.Key)
+			}
+			err = tx.QueryRow("INSERT INTO projects (account_id,key,name) VALUES ($1,$2,$3) RETURNING id",
+				cfg.AccountID, p.Key, p.Name).Scan(&id)
+			counts["projects"]++
+		}
+		if err != nil {
+			return nil, 500, err
+		}
+		projects[p.Key] = id
+	}
+	projectID := func(key string) (int, error) {
+		if id, ok := projects[key]; ok {
+			return id, nil
+		}
+		var id int
+		if err := tx.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, key).Scan(&id); err != nil {
+			return 0, fmt.Errorf("project %q not found", key)
+		}
+		projects[key] = id
+		return id, nil
+	}
+	optionalProject := func(key string) (*int, error) {
+		if key == "" {
+			return nil, nil
+		}
+		id, err := projectID(key)
+		return &id, err
+	}
+
+	epics := map[int]int{}
+	for _, e := range doc.Epics {
+		pid, err := optionalProject(e.ProjectKey)
+		if err != nil {
+			return nil, 400, err
+		}
+		var id int
+		err = tx.QueryRow(`SELECT id FROM epics WHERE account_id=$1 AND name=$2 AND project_id IS NOT DISTINCT FROM $3 LIMIT 1`,
+			cfg.AccountID, e.Name, pid).Scan(&id)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow("INSERT INTO epics (account_id,project_id,name,description) VALUES ($1,$2,$3,$4) RETURNING id",
+				cfg.AccountID, pid, e.Name, e.Description).Scan(&id)
+			counts["epics"]++
+		}
+		if err != nil {
+			return nil, 500, err
+		}
+		epics[e.ID] = id
+	}
+
+	labels := map[int]int{}
+	for _, l := range doc.Labels {
+		pid, err := optionalProject(l.ProjectKey)
+		if err != nil {
+			return nil, 400, err
+		}
+		var id int
+		err = tx.QueryRow(`SELECT id FROM labels WHERE account_id=$1 AND lower(name)=lower($2) AND project_id IS NOT DISTINCT FROM $3`,
+			cfg.AccountID, l.Name, pid).Scan(&id)
+		if err == sql.ErrNoRows {
+			if !labelColorRe.MatchString(l.Color) {
+				l.Color = defaultLabelColor
+			}
+			err = tx.QueryRow("INSERT INTO labels (account_id,project_id,name,color) VALUES ($1,$2,$3,$4) RETURNING id",
+				cfg.AccountID, pid, l.Name, l.Color).Scan(&id)
+			counts["labels"]++
+		}
+		if err != nil {
+			return nil, 500, err
+		}
+		labels[l.ID] = id
+	}
+
+	for _, f := range doc.CustomFields {
+		if err := f.validate(); err != nil {
+			return nil, 400, fmt.Errorf("custom field %q: %v", f.Key, err)
+		}
+		pid, err := projectID(f.ProjectKey)
+		if err != nil {
+			return nil, 400, err
+		}
+		if _, err := tx.Exec(`INSERT INTO custom_fields (account_id,project_id,key,name,type,options,required,position)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+			ON CONFLICT (project_id, key) DO UPDATE SET name=EXCLUDED.name, options=EXCLUDED.options`,
+			cfg.AccountID, pid, f.Key, f.Name, f.Type, pq.Array(f.Options), f.Required, f.Position); err != nil {
+			return nil, 500, err
+		}
+		counts["custom_fields"]++
+	}
+
+	tickets := map[int]int{}
+	for _, t := range doc.Tickets {
+		pid, err := projectID(t.ProjectKey)
+		if err != nil {
+			return nil, 400, err
+		}
+		if !isTicketState(t.State) {
+			t.State = "backlog"
+		}
+		if !isPriority(t.Priority) {
+			t.Priority = "medium"
+		}
+		var epicID *int
+		if t.EpicID != nil {
+			if id, ok := epics[*t.EpicID]; ok {
+				epicID = &id
+			}
+		}
+		// Required fields and known users aren't enforced: the export may
+		// predate the fields, and name users who are only assignees of
+		// tickets not imported yet.
+		custom, err := mergeCustomValues(tx, pid, nil, t.Custom, false)
+		if err != nil {
+			return nil, 400, fmt.Errorf("ticket %d: %v", t.ID, err)
+		}
+		customJSON, _ := json.Marshal(custom)
+		createdAt := t.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		var id int
+		err = tx.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state,assignee,comments,created_at,
+				epic_id,points,priority,due_date,custom)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING id`,
+			cfg.AccountID, pid, t.Title, t.Body, t.State, t.Assignee, t.Comments, createdAt,
+			epicID, t.Points, t.Priority, t.DueDate, string(customJSON)).Scan(&id)
+		if err != nil {
+			return nil, 500, err
+		}
+		if err := watchTicket(tx, id, "assigned", t.Assignee); err != nil {
+			return nil, 500, err
+		}
+		tickets[t.ID] = id
+		counts["tickets"]++
+	}
+
+	// Links and labels reference other tickets, so they go in once every
+	// ticket has its new ID.
+	for _, t := range doc.Tickets {
+		for _, l := range t.Labels {
+			if labelID, ok := labels[l.ID]; ok {
+				if _, err := tx.Exec("INSERT INTO ticket_labels (ticket_id,label_id) VALUES ($1,$2) ON CONFLICT DO NOTHING", tickets[t.ID], labelID); err != nil {
+					return nil, 500, err
+				}
+			}
+		}
+	}
+	links := doc.Links
+	if links == nil {
+		links = legacyLinks(doc.Tickets)
+	}
+	for _, l := range links {
+		source, ok := tickets[l.Source]
+		target, ok2 := tickets[l.Target]
+		if !ok || !ok2 {
+			continue
+		}
+		if _, status, msg := saveLinkTx(tx, l.Type, source, target, 0); status != 0 {
+			return nil, status, fmt.Errorf("link T-%d %s T-%d: %s", l.Source, l.Type, l.Target, msg)
+		}
+		counts["links"]++
+	}
+	return counts, 0, nil
+}
+
+// legacyLinks reads the parent and blocks links out of the tickets of an
+// export written before the links list existed.
+func legacyLinks(tickets []Ticket) []exportLink {
+	var links []exportLink
+	for _, t := range tickets {
+		if t.ParentID != nil {
+			links = append(links, exportLink{Type: "parent", Source: *t.ParentID, Target: t.ID})
+		}
+		for _, b := range t.Blocks {
+			var blocked int
+			if _, err := fmt.Sscanf(b, "T-%d", &blocked); err == nil {
+				links = append(links, exportLink{Type: "blocks", Source: t.ID, Target: blocked})
+			}
+		}
+	}
+	return links
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email to ticket (POST /api/mail/inbound): the body is a raw RFC 5322
+// message, as handed over by a mail provider's inbound route or piped in
+// by the MTA (curl --data-binary @-). A message whose subject names an
+// existing ticket ("Re: CART-42 moved to Done") is a reply and becomes a
+// comment; anything else opens a ticket in INBOUND_MAIL_PROJECT. The
+// sender watches the ticket, so they hear about what happens to it.
+// Attachments are stored like uploaded ones, within the same limits.
+//
+// Only senders on INBOUND_MAIL_ALLOW get in, and automatic mail
+// (Auto-Submitted, bulk Precedence) is dropped so Pippin's own
+// notifications bouncing back can't loop. Message-IDs are remembered so a
+// provider retrying a delivery doesn't file it twice.
+
+const inboundMaxBytes = 10 << 20
+
+// inboundMaxDepth caps how deeply multipart parts may nest. Real mail
+// nests a few levels; each level costs a reader, so a body made of
+// nothing but part headers is refused.
+const inboundMaxDepth = 16
+
+// inboundClaimTimeout is how long a claimed Message-ID may stay unfiled
+// before a redelivery takes it over, in case the claiming instance died.
+const inboundClaimTimeout = 10 * time.Minute
+
+// inboundMessage is the part of an email Pippin uses.
+type inboundMessage struct {
+	MessageID   string
+	From        string // bare address, lower case
+	Name        string // display name, if any
+	Subject     string
+	Automatic   bool // auto-reply, bounce or list mail
+	Text        string
+	Attachments []inboundAttachment
+}
+
+type inboundAttachment struct {
+	Name    string
+	Type    string
+	Data    []byte
+	Problem string // why it can't be attached, see checkAttachment
+}
+
+// parseAllowList parses INBOUND_MAIL_ALLOW: addresses, "@domain" for a
+// whole domain, or "*" for anyone.
+func parseAllowList(s string) []string {
+	var out []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.ToLower(strings.TrimSpace(a)); a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func senderAllowed(addr string, allow []string) bool {
+	addr = strings.ToLower(addr)
+	for _, a := range allow {
+		if a == "*" || a == addr || (strings.HasPrefix(a, "@") && strings.HasSuffix(addr, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInbound reads a raw message.
+func parseInbound(raw []byte) (*inboundMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("From: %v", err)
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	m := &inboundMessage{
+		MessageID: strings.Trim(msg.Header.Get("Message-Id"), "<> "),
+		From:      strings.ToLower(from.Address),
+		Name:      from.Name,
+		Subject:   strings.TrimSpace(subject),
+		Automatic: isAutomatic(msg.Header),
+	}
+	var plain, htmlText string
+	err = m.walk(0, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body, &plain, &htmlText)
+	if err != nil {
+		return nil, err
+	}
+	m.Text = plain
+	if strings.TrimSpace(m.Text) == "" {
+		m.Text = htmlToText(htmlText)
+	}
+	m.Text = strings.TrimSpace(strings.ReplaceAll(m.Text, "\r\n", "\n"))
+	return m, nil
+}
+
+// walk collects the first text/plain and text/html bodies and the
+// attachments of a (possibly nested) MIME part, depth levels down.
+func (m *inboundMessage) walk(depth int, contentType, encoding, disposition string, body io.Reader, plain, htmlText *string) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= inboundMaxDepth {
+			return fmt.Errorf("MIME parts nested more than %d deep", inboundMaxDepth)
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// NextPart has already undone quoted-printable.
+			err = m.walk(depth+1, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part, plain, htmlText)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(body, encoding))
+	if err != nil {
+		return err
+	}
+	disp, dparams, _ := mime.ParseMediaType(disposition)
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	switch {
+	case disp != "attachment" && mediaType == "text/plain" && *plain == "":
+		*plain = decodeCharset(data, params["charset"])
+	case disp != "attachment" && mediaType == "text/html" && *htmlText == "":
+		*htmlText = decodeCharset(data, params["charset"])
+	case name != "" || disp == "attachment" || !strings.HasPrefix(mediaType, "text/"):
+		if name == "" {
+			name = "attachment"
+		}
+		m.Attachments = append(m.Attachments, inboundAttachment{Name: name, Type: mediaType, Data: data})
+	}
+	return nil
+}
+
+func decodeTransfer(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// decodeCharset turns Latin-1 text into UTF-8; everything else is taken
+// to be UTF-8 (or ASCII) already.
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
+
+var (
+	htmlBreakRe = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</tr>`)
+	htmlTagRe   = regexp.MustCompile(`(?s)<style.*?</style>|<script.*?</script>|<[^>]*>`)
+	blankRunRe  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText is a rough plaintext of an HTML-only email.
+func htmlToText(s string) string {
+	s = htmlBreakRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return blankRunRe.ReplaceAllString(s, "\n\n")
+}
+
+var quoteHeaderRe = regexp.MustCompile(`^(On .+ wrote:|-+ ?Original Message ?-+|_{10,})$`)
+
+// stripQuoted cuts a reply down to what was written: the quoted message
+// below it and "> " lines are dropped.
+func stripQuoted(text string) string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if quoteHeaderRe.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+var subjectRefRe = regexp.MustCompile(`\b([A-Za-z][A-Za-z0-9_]*)-(\d+)\b`)
+
+// replyTicket is the existing ticket a subject refers to, or 0. A
+// reference must use the ticket's own project key or the generic T, so
+// "CART-12" doesn't comment on ticket 12 if it is in another project.
+func replyTicket(subject string, keys map[string]bool) int {
+	for _, m := range subjectRefRe.FindAllStringSubmatch(subject, -1) {
+		if !keys[m[1]] {
+			continue
+		}
+		id, err := strconv.Atoi(m[2])
+		if err == nil && refersToTicket(m[1], id) {
+			return id
+		}
+	}
+	return 0
+}
+
+// inboundActor is who an email is from, as a Pippin user: whoever saved
+// that address in their notification settings, or the address itself.
+func inboundActor(addr string) string {
+	var user string
+	err := db.QueryRow("SELECT username FROM notification_prefs WHERE account_id=$1 AND lower(email)=$2 LIMIT 1",
+		cfg.AccountID, addr).Scan(&user)
+	if err != nil {
+		return addr
+	}
+	return user
+}
+
+// attachmentSummary lists a message's attachments for the ticket text,
+// with the reason for any that were left out.
+func attachmentSummary(list []inboundAttachment) string {
+	if len(list) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\nAttachments:")
+	for _, a := range list {
+		fmt.Fprintf(&b, "\n- %s (%s, %s)", a.Name, a.Type, formatSize(len(a.Data)))
+		if a.Problem != "" {
+			b.WriteString(": not attached, " + a.Problem)
+		}
+	}
+	return b.String()
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// isAutomatic reports mail no one typed: auto-replies, bounces, lists.
+func isAutomatic(h mail.Header) bool {
+	if a := strings.ToLower(h.Get("Auto-Submitted")); a != "" && a != "no" {
+		return true
+	}
+	switch strings.ToLower(h.Get("Precedence")) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return h.Get("X-Autoreply") != "" || h.Get("X-Autorespond") != ""
+}
+
+func handleInboundMail(w http.ResponseWriter, r *http.Request) {
+	if cfg.InboundMailToken == "" || cfg.InboundMailProject == "" {
+		writeJSON(w, 404, map[string]string{"error": "inbound mail not configured (set INBOUND_MAIL_TOKEN and INBOUND_MAIL_PROJECT)"})
+		return
+	}
+	token := r.Header.Get("X-Pippin-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.InboundMailToken)) != 1 {
+		writeJSON(w, 401, map[string]string{"error": "invalid token"})
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, inboundMaxBytes+1))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "unreadable body"})
+		return
+	}
+	if len(raw) > inboundMaxBytes {
+		writeJSON(w, 413, map[string]string{"error": "message too large"})
+		return
+	}
+	m, err := parseInbound(raw)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "not an email: " + err.Error()})
+		return
+	}
+	if m.Automatic {
+		writeJSON(w, 200, map[string]string{"status": "ignored", "reason": "automatic message"})
+		return
+	}
+	if !senderAllowed(m.From, cfg.InboundMailAllow) {
+		log.Printf("inbound mail: rejected sender %s", m.From)
+		writeJSON(w, 403, map[string]string{"error": "sender not allowed"})
+		return
+	}
+
+	// Claim the Message-ID before doing anything: when the same message
+	// is delivered twice at once, only the request whose insert lands
+	// goes on. Returning without filing gives the claim back so a retry
+	// can work; a claim left unfiled by a crash goes stale and is taken
+	// over.
+	if m.MessageID != "" {
+		result, err := db.Exec(`INSERT INTO inbound_messages (account_id, message_id, sender)
+			VALUES ($1,$2,$3)
+			ON CONFLICT (account_id, message_id) DO UPDATE SET sender=EXCLUDED.sender, received_at=now()
+			WHERE inbound_messages.ticket_id IS NULL
+				AND inbound_messages.received_at < now() - $4 * interval '1 second'`,
+			cfg.AccountID, m.MessageID, m.From, int(inboundClaimTimeout.Seconds()))
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var ticketID *int // nil while the first delivery is still being filed
+			db.QueryRow("SELECT ticket_id FROM inbound_messages WHERE account_id=$1 AND message_id=$2",
+				cfg.AccountID, m.MessageID).Scan(&ticketID)
+			writeJSON(w, 200, map[string]interface{}{"status": "duplicate", "ticket_id": ticketID})
+			return
+		}
+	}
+	filed := false
+	defer func() {
+		if !filed && m.MessageID != "" {
+			db.Exec("DELETE FROM inbound_messages WHERE account_id=$1 AND message_id=$2 AND ticket_id IS NULL",
+				cfg.AccountID, m.MessageID)
+		}
+	}()
+
+	for i := range m.Attachments {
+		a := &m.Attachments[i]
+		name, contentType, status, msg := checkAttachment(a.Name, int64(len(a.Data)), a.Data)
+		a.Name = name
+		if status != 0 {
+			a.Problem = msg
+		} else {
+			a.Type = contentType
+		}
+	}
+
+	actor := inboundActor(m.From)
+	status, code := "commented", 200
+	ticketID := replyTicket(m.Subject, ticketRefKeys())
+	if ticketID != 0 {
+		text := stripQuoted(m.Text)
+		if text == "" && len(m.Attachments) == 0 {
+			writeJSON(w, 200, map[string]string{"status": "ignored", "reason": "empty reply"})
+			return
+		}
+		if err := addComment(ticketID, "(email) "+text+attachmentSummary(m.Attachments), actor); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+	} else {
+		if ticketID, err = createInboundTicket(m, actor); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		status, code = "created", 201
+	}
+	filed = true
+	if m.MessageID != "" {
+		if _, err := db.Exec("UPDATE inbound_messages SET ticket_id=$1 WHERE account_id=$2 AND message_id=$3",
+			ticketID, cfg.AccountID, m.MessageID); err != nil {
+			log.Printf("inbound mail: %v", err)
+		}
+	}
+	stored := 0
+	for _, a := range m.Attachments {
+		if a.Problem != "" {
+			continue
+		}
+		if _, err := storeAttachment(ticketID, a.Name, a.Type, bytes.NewReader(a.Data), int64(len(a.Data)), actor); err != nil {
+			log.Printf("inbound mail: T-%d attachment %s: %v", ticketID, a.Name, err)
+			continue
+		}
+		stored++
+	}
+	if stored > 0 {
+		publish(Event{Type: "attachment.added", TicketID: ticketID, Actor: actor})
+	}
+	log.Printf("inbound mail: %s from %s, T-%d", status, m.From, ticketID)
+	writeJSON(w, code, map[string]interface{}{"status": status, "ticket_id": ticketID})
+}
+
+// createInboundTicket opens a backlog ticket in INBOUND_MAIL_PROJECT.
+func createInboundTicket(m *inboundMessage, actor string) (int, error) {
+	var projectID int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2",
+		cfg.AccountID, cfg.InboundMailProject).Scan(&projectID); err != nil {
+		return 0, fmt.Errorf("INBOUND_MAIL_PROJECT %s: project not found", cfg.InboundMailProject)
+	}
+	title := m.Subject
+	if title == "" {
+		title = "(no subject)"
+	}
+	from := m.From
+	if m.Name != "" {
+		from = m.Name + " <" + m.From + ">"
+	}
+	body := "From: " + from + "\n\n" + m.Text + attachmentSummary(m.Attachments)
+	var id int
+	err := db.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state)
+		VALUES ($1,$2,$3,$4,'backlog') RETURNING id`, cfg.AccountID, projectID, title, body).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	publish(Event{Type: "ticket.created", TicketID: id, Actor: actor})
+	autoWatch(id, "created", actor)
+	recordMentions(id, "body", body, actor)
+	return id, nil
+}
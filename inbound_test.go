@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseInbound(t *testing.T) {
+	for _, tc := range []struct {
+		name, raw     string
+		from, subject string
+		text          string
+		automatic     bool
+		attachments   []inboundAttachment
+	}{
+		{
+			name: "plain, quoted-printable",
+			raw: "From: Jane Doe <Jane@Example.COM>\nSubject: =?UTF-8?Q?Caf=C3=A9_broken?=\nMessage-Id: <abc@mail>\n" +
+				"Content-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\n" +
+				"The caf=C3=A9 page is =\nbroken.\n",
+			from: "jane@example.com", subject: "Café broken", text: "The café page is broken.",
+		},
+		{
+			name: "no content type",
+			raw:  "From: lee@example.com\nSubject: hi\n\nhello\r\nthere\r\n",
+			from: "lee@example.com", subject: "hi", text: "hello\nthere",
+		},
+		{
+			name: "alternative prefers plain",
+			raw: "From: lee@example.com\nSubject: s\nContent-Type: multipart/alternative; boundary=b1\n\n" +
+				"--b1\nContent-Type: text/plain\n\nplain body\n" +
+				"--b1\nContent-Type: text/html\n\n<p>html body</p>\n--b1--\n",
+			from: "lee@example.com", subject: "s", text: "plain body",
+		},
+		{
+			name: "html only",
+			raw: "From: lee@example.com\nSubject: s\nContent-Type: text/html\n\n" +
+				"<style>p{color:red}</style><p>First &amp; foremost</p><p>second<br>line</p><script>x()</script>",
+			from: "lee@example.com", subject: "s", text: "First & foremost\nsecond\nline",
+		},
+		{
+			name: "latin-1 base64",
+			raw: "From: lee@example.com\nSubject: s\nContent-Type: text/plain; charset=ISO-8859-1\n" +
+				"Content-Transfer-Encoding: base64\n\nQ2Fm6SBvbGU=\n",
+			from: "lee@example.com", subject: "s", text: "Café ole",
+		},
+		{
+			name: "nested multipart with attachments",
+			raw: "From: lee@example.com\nSubject: s\nContent-Type: multipart/mixed; boundary=outer\n\n" +
+				"--outer\nContent-Type: multipart/alternative; boundary=inner\n\n" +
+				"--inner\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\nSee attached=2E\n" +
+				"--inner\nContent-Type: text/html\n\n<p>See attached.</p>\n--inner--\n" +
+				"--outer\nContent-Type: image/png; name=\"shot.png\"\nContent-Transfer-Encoding: base64\n" +
+				"Content-Disposition: attachment; filename=\"screen shot.png\"\n\naGVsbG8=\n" +
+				"--outer\nContent-Type: text/plain\nContent-Disposition: attachment\n\nlog line\n" +
+				"--outer\nContent-Type: application/pdf\n\n%PDF\n--outer--\n",
+			from: "lee@example.com", subject: "s", text: "See attached.",
+			attachments: []inboundAttachment{
+				{Name: "screen shot.png", Type: "image/png", Data: []byte("hello")},
+				{Name: "attachment", Type: "text/plain", Data: []byte("log line")},
+				{Name: "attachment", Type: "application/pdf", Data: []byte("%PDF")},
+			},
+		},
+		{
+			name: "auto-reply",
+			raw:  "From: lee@example.com\nSubject: Out of office\nAuto-Submitted: auto-replied\n\naway",
+			from: "lee@example.com", subject: "Out of office", text: "away", automatic: true,
+		},
+	} {
+		m, err := parseInbound([]byte(tc.raw))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if m.From != tc.from || m.Subject != tc.subject || m.Text != tc.text || m.Automatic != tc.automatic {
+			t.Errorf("%s: from %q, subject %q, text %q, automatic %v", tc.name, m.From, m.Subject, m.Text, m.Automatic)
+		}
+		if len(m.Attachments) != len(tc.attachments) {
+			t.Errorf("%s: %d attachments, want %d", tc.name, len(m.Attachments), len(tc.attachments))
+			continue
+		}
+		for i, a := range m.Attachments {
+			want := tc.attachments[i]
+			if a.Name != want.Name || a.Type != want.Type || string(a.Data) != string(want.Data) {
+				t.Errorf("%s: attachment %d = %s %s %q, want %s %s %q", tc.name, i, a.Name, a.Type, a.Data, want.Name, want.Type, want.Data)
+			}
+		}
+	}
+
+	m, _ := parseInbound([]byte("From: \"Doe, Jane\" <jane@example.com>\nMessage-ID:  <id.1@mail.example>\n\nx"))
+	if m.MessageID != "id.1@mail.example" || m.Name != "Doe, Jane" {
+		t.Errorf("Message-ID %q, name %q", m.MessageID, m.Name)
+	}
+	if _, err := parseInbound([]byte("Subject: no sender\n\nx")); err == nil {
+		t.Error("a message without From was accepted")
+	}
+}
+
+func nestedMultipart(depth int) string {
+	var b strings.Builder
+	b.WriteString("From: lee@example.com\nSubject: deep\nContent-Type: multipart/mixed; boundary=b0\n\n")
+	for i := 1; i < depth; i++ {
+		fmt.Fprintf(&b, "--b%d\nContent-Type: multipart/mixed; boundary=b%d\n\n", i-1, i)
+	}
+	fmt.Fprintf(&b, "--b%d\nContent-Type: text/plain\n\ndeep text\n", depth-1)
+	for i := depth - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "--b%d--\n", i)
+	}
+	return b.String()
+}
+
+func TestParseInboundDepth(t *testing.T) {
+	m, err := parseInbound([]byte(nestedMultipart(inboundMaxDepth)))
+	if err != nil || m.Text != "deep text" {
+		t.Errorf("%d levels: %v, text %q", inboundMaxDepth, err, m.Text)
+	}
+	if _, err := parseInbound([]byte(nestedMultipart(inboundMaxDepth + 1))); err == nil {
+		t.Errorf("%d levels were accepted", inboundMaxDepth+1)
+	}
+	if _, err := parseInbound([]byte(nestedMultipart(10000))); err == nil {
+		t.Error("10000 levels were accepted")
+	}
+}
+
+func TestStripQuoted(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Thanks, fixed.\n\nOn Tue, Jan 7, 2025 at 10:00 Pippin wrote:\n> CART-42 moved to Done", "Thanks, fixed."},
+		{"Looks good\n> quoted line\n>> older\nstill mine", "Looks good\nstill mine"},
+		{"Reply\n-----Original Message-----\nFrom: x", "Reply"},
+		{"Reply\n____________\nFrom: x", "Reply"},
+		{"  > only quotes\n>more", ""},
+		{"a > b is fine", "a > b is fine"},
+	} {
+		if got := stripQuoted(tc.in); got != tc.want {
+			t.Errorf("stripQuoted(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSenderAllowed(t *testing.T) {
+	allow := parseAllowList(" Jane@Example.com, @Corp.example ,,")
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"jane@example.com", true},
+		{"JANE@EXAMPLE.COM", true},
+		{"lee@example.com", false},
+		{"lee@corp.example", true},
+		{"lee@evilcorp.example", false},
+		{"lee@sub.corp.example", false},
+		{"corp.example", false},
+		{"", false},
+	} {
+		if got := senderAllowed(tc.addr, allow); got != tc.want {
+			t.Errorf("senderAllowed(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+	if !senderAllowed("anyone@anywhere.example", parseAllowList("*")) {
+		t.Error("* doesn't allow everyone")
+	}
+	if senderAllowed("jane@example.com", nil) {
+		t.Error("an empty list allows someone")
+	}
+}
+
+func TestReplyTicket(t *testing.T) {
+	const account = "test-inbound"
+	testDB(t, account)
+	seedBoard(t, account, 3, 0) // one ticket each in BA, BB, BC
+	var ba, bb int
+	if err := db.QueryRow(`SELECT min(t.id) FILTER (WHERE p.key='BA'), min(t.id) FILTER (WHERE p.key='BB')
+		FROM tickets t JOIN projects p ON p.id=t.project_id WHERE t.account_id=$1`, account).Scan(&ba, &bb); err != nil {
+		t.Fatal(err)
+	}
+	keys := ticketRefKeys()
+	for _, tc := range []struct {
+		subject string
+		want    int
+	}{
+		{fmt.Sprintf("Re: BA-%d moved to Done", ba), ba},
+		{fmt.Sprintf("Re: T-%d", bb), bb},
+		{fmt.Sprintf("Re: BB-%d", ba), 0}, // ba is not in BB
+		{fmt.Sprintf("Re: BB-%d and BA-%d", ba, ba), ba},
+		{fmt.Sprintf("Re: XX-%d", ba), 0},
+		{"Re: T-999999999", 0},
+		{"Hello", 0},
+	} {
+		if got := replyTicket(tc.subject, keys); got != tc.want {
+			t.Errorf("replyTicket(%q) = %d, want %d", tc.subject, got, tc.want)
+		}
+	}
+}
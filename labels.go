@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Labels are coloured tags, either account-wide or scoped to one project.
+// A project-scoped label can only be put on that project's tickets.
+
+type Label struct {
+	ID         int       `json:"id"`
+	AccountID  string    `json:"account_id"`
+	ProjectKey string    `json:"project_key,omitempty"`
+	Name       string    `json:"name"`
+	Color      string    `json:"color"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TicketLabel is the short form of a label carried on a Ticket.
+type TicketLabel struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+const defaultLabelColor = "#8b6f64"
+
+var labelColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+const labelSelect = `SELECT l.id, l.account_id, COALESCE(p.key,''), l.name, l.color, l.created_at
+	FROM labels l LEFT JOIN projects p ON p.id=l.project_id`
+
+func scanLabel(row interface{ Scan(...interface{}) error }) (Label, error) {
+	var l Label
+	err := row.Scan(&l.ID, &l.AccountID, &l.ProjectKey, &l.Name, &l.Color, &l.CreatedAt)
+	return l, err
+}
+
+var labelSortColumns = map[string]sortColumn[Label]{
+	"id":      {"l.id", func(l *Label) string { return strconv.Itoa(l.ID) }},
+	"name":    {"lower(l.name)", func(l *Label) string { return strings.ToLower(l.Name) }},
+	"created": {"l.created_at", func(l *Label) string { return cursorTime(l.CreatedAt) }},
+}
+
+// queryLabels lists labels; a non-empty project limits the list to the
+// labels usable in that project (its own plus account-wide ones).
+func queryLabels(project string, opts listOptions) ([]Label, error) {
+	query := labelSelect + " WHERE l.account_id=$1"
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID}}
+	if project != "" && project != "ALL" {
+		query += " AND (l.project_id IS NULL OR p.key=" + b.arg(project) + ")"
+	}
+	where, tail := pageSQL(opts, b, labelSortColumns, "name", "l.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labels []Label
+	for rows.Next() {
+		l, err := scanLabel(rows)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
+
+func handleGetLabels(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, labelSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	labels, err := queryLabels(r.URL.Query().Get("project"), opts)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeList(w, r, labels, opts, labelSortColumns, "name", func(l *Label) int { return l.ID })
+}
+
+type labelRequest struct {
+	Name       string `json:"name"`
+	Color      string `json:"color"`
+	ProjectKey string `json:"project_key"`
+}
+
+// validate normalises the request and resolves the optional project key.
+func (req *labelRequest) validate() (*int, int, string) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, 400, "name is required"
+	}
+	if strings.Contains(req.Name, ",") {
+		return nil, 400, "label names cannot contain commas"
+	}
+	if req.Color == "" {
+		req.Color = defaultLabelColor
+	}
+	if !labelColorRe.MatchString(req.Color) {
+		return nil, 400, "color must be #rrggbb"
+	}
+	if req.ProjectKey == "" {
+		return nil, 0, ""
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&id); err != nil {
+		return nil, 404, "project not found"
+	}
+	return &id, 0, ""
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func handleCreateLabel(w http.ResponseWriter, r *http.Request) {
+	var req labelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.validate()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO labels (account_id,project_id,name,color) VALUES ($1,$2,$3,$4) RETURNING id`,
+		cfg.AccountID, projectID, req.Name, req.Color).Scan(&id)
+	if isUniqueViolation(err) {
+		writeJSON(w, 409, map[string]string{"error": fmt.Sprintf("label %q already exists", req.Name)})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+func handleUpdateLabel(w http.ResponseWriter, r *http.Request) {
+	var req labelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.validate()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE labels SET name=$1, color=$2, project_id=$3 WHERE id=$4 AND account_id=$5`,
+		req.Name, req.Color, projectID, r.PathValue("id"), cfg.AccountID)
+	if isUniqueViolation(err) {
+		writeJSON(w, 409, map[string]string{"error": fmt.Sprintf("label %q already exists", req.Name)})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "label not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteLabel(w http.ResponseWriter, r *http.Request) {
+	// ticket_labels rows go with it (ON DELETE CASCADE).
+	result, err := db.Exec("DELETE FROM labels WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "label not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// dbConn is satisfied by both *sql.DB and *sql.Tx.
+type dbConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// addTicketLabel puts a label on a ticket. The label must be account-wide
+// or belong to the ticket's project. Adding a label twice is a no-op.
+func addTicketLabel(q dbConn, ticketID, labelID int) (int, string) {
+	var ok bool
+	err := q.QueryRow(`SELECT l.project_id IS NULL OR l.project_id=t.project_id
+		FROM tickets t, labels l
+		WHERE t.id=$1 AND t.account_id=$3 AND l.id=$2 AND l.account_id=$3`,
+		ticketID, labelID, cfg.AccountID).Scan(&ok)
+	if err != nil {
+		return 404, "ticket or label not found"
+	}
+	if !ok {
+		return 400, "label belongs to another project"
+	}
+	if _, err := q.Exec(`INSERT INTO ticket_labels (ticket_id,label_id) VALUES ($1,$2) ON CONFLICT DO NOTHING`,
+		ticketID, labelID); err != nil {
+		return 500, err.Error()
+	}
+	return 0, ""
+}
+
+// labelIDsByName resolves label names (case-insensitive) usable in a
+// project to their IDs.
+func labelIDsByName(projectID int, names []string) ([]int, error) {
+	var ids []int
+	for _, name := range names {
+		var id int
+		err := db.QueryRow(`SELECT id FROM labels
+			WHERE account_id=$1 AND lower(name)=lower($2) AND (project_id IS NULL OR project_id=$3)
+			ORDER BY project_id NULLS LAST LIMIT 1`, cfg.AccountID, strings.TrimSpace(name), projectID).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("label %q not found", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func handleAddTicketLabel(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	var req struct {
+		LabelID int `json:"label_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if status, msg := addTicketLabel(db, ticketID, req.LabelID); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+	db.Exec("UPDATE tickets SET updated_at=now() WHERE id=$1 AND account_id=$2", ticketID, cfg.AccountID)
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	writeJSON(w, 201, map[string]string{"status": "ok"})
+}
+
+func handleRemoveTicketLabel(w http.ResponseWriter, r *http.Request) {
+	result, err := db.Exec(`DELETE FROM ticket_labels tl USING tickets t
+		WHERE tl.ticket_id=t.id AND t.id=$1 AND tl.label_id=$2 AND t.account_id=$3`,
+		r.PathValue("id"), r.PathValue("label_id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "label not on ticket"})
+		return
+	}
+	db.Exec("UPDATE tickets SET updated_at=now() WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	ticketID, _ := strconv.Atoi(r.PathValue("id"))
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// loadLabels fills Labels for every ticket with one query.
+func loadLabels(tickets []Ticket) error {
+	if len(tickets) == 0 {
+		return nil
+	}
+	index := make(map[int]int, len(tickets))
+	ids := make([]int64, len(tickets))
+	for i, t := range tickets {
+		index[t.ID] = i
+		ids[i] = int64(t.ID)
+	}
+
+	rows, err := db.Query(`SELECT tl.ticket_id, l.id, l.name, l.color
+		FROM ticket_labels tl JOIN labels l ON l.id=tl.label_id
+		WHERE tl.ticket_id = ANY($1)
+		ORDER BY lower(l.name)`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ticketID int
+		var l TicketLabel
+		if err := rows.Scan(&ticketID, &l.ID, &l.Name, &l.Color); err != nil {
+			return err
+		}
+		if i, ok := index[ticketID]; ok {
+			tickets[i].Labels = append(tickets[i].Labels, l)
+		}
+	}
+	return rows.Err()
+}
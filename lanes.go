@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Board layout: the board is a list of horizontal lanes, each holding the
+// visible state columns. Without ?lanes= there is a single unnamed lane.
+// Every lane type knows how to read its key off a ticket and how to write
+// it back, so dragging a card into another lane reassigns it.
+
+type boardColumn struct {
+	State   string
+	Title   string
+	Tickets []Ticket
+}
+
+type boardLane struct {
+	Key     string // "" for the catch-all lane (unassigned, no epic, …)
+	Name    string
+	Count   int
+	Columns []boardColumn
+}
+
+var stateTitles = map[string]string{
+	"backlog":     "📋 Backlog",
+	"todo":        "📝 Todo",
+	"in_progress": "🔧 In Progress",
+	"done":        "✅ Done",
+}
+
+// laneOptions lists the lanes the board can group by.
+var laneOptions = []string{"assignee", "project", "epic", "label", "priority"}
+
+// laneKeys returns the lanes a ticket belongs to when grouping by by.
+// Only labels are multi-valued: a ticket shows up in each label's lane.
+func laneKeys(t *Ticket, by string) []string {
+	switch by {
+	case "assignee":
+		return []string{t.Assignee}
+	case "project":
+		return []string{t.ProjectKey}
+	case "epic":
+		if t.EpicID != nil {
+			return []string{strconv.Itoa(*t.EpicID)}
+		}
+	case "priority":
+		return []string{t.Priority}
+	case "label":
+		var keys []string
+		for _, l := range t.Labels {
+			keys = append(keys, strconv.Itoa(l.ID))
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
+	return []string{""}
+}
+
+// lanesFor returns the ordered (key, name) pairs to seed lanes with, so
+// empty lanes still render as drop targets.
+func lanesFor(by string, tickets []Ticket) [][2]string {
+	var seeds [][2]string
+	switch by {
+	case "assignee":
+		seen := map[string]bool{}
+		var names []string
+		for _, t := range tickets {
+			if t.Assignee != "" && !seen[t.Assignee] {
+				seen[t.Assignee] = true
+				names = append(names, t.Assignee)
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			seeds = append(seeds, [2]string{n, "👤 " + n})
+		}
+		seeds = append(seeds, [2]string{"", "Unassigned"})
+	case "project":
+		projects, _ := queryProjects(listOptions{Sort: "key"})
+		for _, p := range projects {
+			seeds = append(seeds, [2]string{p.Key, p.Key + " — " + p.Name})
+		}
+	case "epic":
+		for _, e := range epicOptions() {
+			seeds = append(seeds, [2]string{strconv.Itoa(e.ID), "◆ " + e.Name})
+		}
+		seeds = append(seeds, [2]string{"", "No epic"})
+	case "label":
+		labels, _ := queryLabels("", listOptions{})
+		for _, l := range labels {
+			seeds = append(seeds, [2]string{strconv.Itoa(l.ID), "🏷 " + l.Name})
+		}
+		seeds = append(seeds, [2]string{"", "No label"})
+	case "priority":
+		// Most urgent first.
+		for i := len(priorities) - 1; i >= 0; i-- {
+			p := priorities[i]
+			seeds = append(seeds, [2]string{p, priorityIcons[p] + " " + strings.ToUpper(p[:1]) + p[1:]})
+		}
+	}
+	return seeds
+}
+
+// buildLanes buckets tickets into lanes × columns. Only states in columns
+// are shown, in that order.
+func buildLanes(tickets []Ticket, columns []string, by string) []boardLane {
+	seeds := [][2]string{{"", ""}}
+	if by != "" {
+		seeds = lanesFor(by, tickets)
+	}
+
+	var lanes []boardLane
+	index := map[string]int{}
+	addLane := func(key, name string) int {
+		l := boardLane{Key: key, Name: name}
+		for _, state := range columns {
+			l.Columns = append(l.Columns, boardColumn{State: state, Title: stateTitles[state]})
+		}
+		lanes = append(lanes, l)
+		index[key] = len(lanes) - 1
+		return len(lanes) - 1
+	}
+	for _, s := range seeds {
+		addLane(s[0], s[1])
+	}
+
+	for _, t := range tickets {
+		for _, key := range laneKeys(&t, by) {
+			i, ok := index[key]
+			if !ok {
+				// e.g. an epic created after the seeds were read.
+				i = addLane(key, key)
+			}
+			for c := range lanes[i].Columns {
+				if lanes[i].Columns[c].State == t.State {
+					lanes[i].Columns[c].Tickets = append(lanes[i].Columns[c].Tickets, t)
+					lanes[i].Count++
+				}
+			}
+		}
+	}
+	return lanes
+}
+
+// handleSetLane moves a ticket into another lane by setting the lane's
+// attribute, e.g. {"lanes": "assignee", "value": "jane"} reassigns it.
+// An empty value is the catch-all lane. Label lanes also take "from",
+// the label lane the card left, which is removed from the ticket.
+func handleSetLane(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req struct {
+		Lanes string `json:"lanes"`
+		Value string `json:"value"`
+		From  string `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if req.Lanes == "label" {
+		setLabelLane(w, r, req.From, req.Value)
+		return
+	}
+
+	var column string
+	var value interface{}
+	switch req.Lanes {
+	case "assignee":
+		column, value = "assignee", req.Value
+	case "project":
+		var projectID int
+		if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.Value).Scan(&projectID); err != nil {
+			writeJSON(w, 404, map[string]string{"error": "project not found"})
+			return
+		}
+		column, value = "project_id", projectID
+	case "epic":
+		var epicID *int
+		if req.Value != "" {
+			n, err := strconv.Atoi(req.Value)
+			if err != nil {
+				writeJSON(w, 400, map[string]string{"error": "invalid epic id"})
+				return
+			}
+			epicID = &n
+		}
+		if err := validateEpic(epicID); err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		column, value = "epic_id", epicID
+	case "priority":
+		if !isPriority(req.Value) {
+			writeJSON(w, 400, map[string]string{"error": "priority must be one of " + strings.Join(priorities, ", ")})
+			return
+		}
+		column, value = "priority", req.Value
+	default:
+		writeJSON(w, 400, map[string]string{"error": "lanes must be one of " + strings.Join(laneOptions, ", ")})
+		return
+	}
+
+	// column comes from the switch above, never from the request.
+	result, err := db.Exec("UPDATE tickets SET "+column+"=$1, updated_at=now() WHERE id=$2 AND account_id=$3",
+		value, id, cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	ticketID, _ := strconv.Atoi(id)
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	if column == "assignee" {
+		autoWatch(ticketID, "assigned", req.Value)
+		notify("assigned", ticketID, currentUser(r), "", req.Value)
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func setLabelLane(w http.ResponseWriter, r *http.Request, from, to string) {
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if to != "" {
+		labelID, err := strconv.Atoi(to)
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "invalid label id"})
+			return
+		}
+		if status, msg := addTicketLabel(db, ticketID, labelID); status != 0 {
+			writeJSON(w, status, map[string]string{"error": msg})
+			return
+		}
+	}
+	if from != "" {
+		if _, err := db.Exec(`DELETE FROM ticket_labels tl USING tickets t
+			WHERE tl.ticket_id=t.id AND t.id=$1 AND tl.label_id=$2 AND t.account_id=$3`, ticketID, from, cfg.AccountID); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+	} else if to == "" {
+		writeJSON(w, 200, map[string]string{"status": "unchanged"})
+		return
+	}
+	db.Exec("UPDATE tickets SET updated_at=now() WHERE id=$1 AND account_id=$2", ticketID, cfg.AccountID)
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Typed issue links. Every relationship between two tickets is a row in
+// ticket_links with a type from linkTypes; "source <outward> target" and
+// "target <inward> source" read as the two ends of the same link. The
+// blocks view and the /blocks endpoints are kept on top of the
+// "blocks" type for older clients.
+
+type linkType struct {
+	Name    string `json:"name"`
+	Outward string `json:"outward"`
+	Inward  string `json:"inward"`
+	// Acyclic types reject links that would close a loop (A blocks B
+	// blocks A); Symmetric types treat A→B and B→A as the same link.
+	Acyclic   bool `json:"acyclic"`
+	Symmetric bool `json:"symmetric"`
+	// SingleInward limits a ticket to one incoming link of this type,
+	// e.g. a subtask has exactly one parent.
+	SingleInward bool `json:"single_inward"`
+}
+
+var linkTypes = []linkType{
+	{Name: "blocks", Outward: "blocks", Inward: "is blocked by", Acyclic: true},
+	{Name: "relates", Outward: "relates to", Inward: "relates to", Symmetric: true},
+	{Name: "duplicates", Outward: "duplicates", Inward: "is duplicated by"},
+	{Name: "clones", Outward: "clones", Inward: "is cloned by"},
+	{Name: "parent", Outward: "is parent of", Inward: "is subtask of", Acyclic: true, SingleInward: true},
+}
+
+func findLinkType(name string) (linkType, bool) {
+	for _, lt := range linkTypes {
+		if lt.Name == name {
+			return lt, true
+		}
+	}
+	return linkType{}, false
+}
+
+// TicketLink is a link as seen from one of its tickets.
+type TicketLink struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	Direction string    `json:"direction"` // outward: this ticket is the source
+	Label     string    `json:"label"`
+	Ticket    graphNode `json:"ticket"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// loadLinkEdges returns every link of type typ in the account as edges.
+func loadLinkEdges(q sqlQueryer, typ string) ([]depEdge, error) {
+	rows, err := q.Query("SELECT source_ticket_id, target_ticket_id FROM ticket_links WHERE account_id=$1 AND link_type=$2",
+		cfg.AccountID, typ)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edges []depEdge
+	for rows.Next() {
+		var e depEdge
+		if err := rows.Scan(&e.From, &e.To); err != nil {
+			return nil, err
+		}
+		edges = append(edges, e)
+	}
+	return edges, rows.Err()
+}
+
+// saveLink records "source <typ> target", as a new link when linkID is
+// 0 or by updating link linkID in place. It returns the link ID, or a
+// non-zero HTTP status and message when the link is invalid: unknown
+// type or tickets, a self-reference, a cycle for acyclic types, or a
+// second parent. An edited link is checked as if its old version were
+// gone.
+func saveLink(typ string, source, target, linkID int) (int, int, string) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 500, err.Error()
+	}
+	defer tx.Rollback()
+	linkID, status, msg := saveLinkTx(tx, typ, source, target, linkID)
+	if status != 0 {
+		return 0, status, msg
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 500, err.Error()
+	}
+	return linkID, 0, ""
+}
+
+// saveLinkTx is saveLink as part of the caller's transaction, for links
+// written along with the tickets they join.
+func saveLinkTx(tx *sql.Tx, typ string, source, target, linkID int) (int, int, string) {
+	lt, ok := findLinkType(typ)
+	if !ok {
+		return 0, 400, fmt.Sprintf("unknown link type %q", typ)
+	}
+	if source == target {
+		return 0, 400, "a ticket cannot link to itself"
+	}
+
+	// Serialise link changes per account so two concurrent inserts can't
+	// each pass the cycle check and together close a loop.
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('links:' || $1))", cfg.AccountID); err != nil {
+		return 0, 500, err.Error()
+	}
+
+	var old depEdge
+	var oldType string
+	if linkID != 0 {
+		err := tx.QueryRow("SELECT link_type, source_ticket_id, target_ticket_id FROM ticket_links WHERE id=$1 AND account_id=$2",
+			linkID, cfg.AccountID).Scan(&oldType, &old.From, &old.To)
+		if err == sql.ErrNoRows {
+			return 0, 404, "link not found"
+		} else if err != nil {
+			return 0, 500, err.Error()
+		}
+	}
+
+	for _, id := range []int{source, target} {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tickets WHERE id=$1 AND account_id=$2)", id, cfg.AccountID).Scan(&exists); err != nil {
+			return 0, 500, err.Error()
+		}
+		if !exists {
+			return 0, 404, fmt.Sprintf("ticket T-%d not found", id)
+		}
+	}
+
+	edges, err := loadLinkEdges(tx, typ)
+	if err != nil {
+		return 0, 500, err.Error()
+	}
+	if oldType == typ {
+		edges = slices.DeleteFunc(edges, func(e depEdge) bool { return e == old })
+	}
+	for _, e := range edges {
+		if e.From == source && e.To == target || lt.Symmetric && e.From == target && e.To == source {
+			return 0, 409, fmt.Sprintf("T-%d already %s T-%d", source, lt.Outward, target)
+		}
+		if lt.SingleInward && e.To == target {
+			return 0, 409, fmt.Sprintf("T-%d already %s T-%d", target, lt.Inward, e.From)
+		}
+	}
+	if lt.Acyclic {
+		if path := findPath(edges, target, source); path != nil {
+			return 0, 409, fmt.Sprintf("link would create a cycle: %s → T-%d", formatPath(path), target)
+		}
+	}
+
+	if linkID == 0 {
+		err = tx.QueryRow(`INSERT INTO ticket_links (account_id,link_type,source_ticket_id,target_ticket_id)
+			VALUES ($1,$2,$3,$4) RETURNING id`, cfg.AccountID, typ, source, target).Scan(&linkID)
+	} else {
+		_, err = tx.Exec(`UPDATE ticket_links SET link_type=$1, source_ticket_id=$2, target_ticket_id=$3
+			WHERE id=$4 AND account_id=$5`, typ, source, target, linkID, cfg.AccountID)
+	}
+	if err != nil {
+		return 0, 500, err.Error()
+	}
+	return linkID, 0, ""
+}
+
+// queryLinks returns every link touching ticketID, labelled from its side.
+func queryLinks(ticketID int) ([]TicketLink, error) {
+	rows, err := db.Query(`SELECT l.id, l.link_type, l.source_ticket_id=$1, l.created_at,
+			o.id, p.key, o.title, o.state, COALESCE(o.assignee,'')
+		FROM ticket_links l
+		JOIN tickets o ON o.id = CASE WHEN l.source_ticket_id=$1 THEN l.target_ticket_id ELSE l.source_ticket_id END
+		JOIN projects p ON p.id=o.project_id
+		WHERE l.account_id=$2 AND (l.source_ticket_id=$1 OR l.target_ticket_id=$1)
+		ORDER BY l.link_type, l.id`, ticketID, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []TicketLink{}
+	for rows.Next() {
+		var l TicketLink
+		var outward bool
+		if err := rows.Scan(&l.ID, &l.Type, &outward, &l.CreatedAt,
+			&l.Ticket.ID, &l.Ticket.ProjectKey, &l.Ticket.Title, &l.Ticket.State, &l.Ticket.Assignee); err != nil {
+			return nil, err
+		}
+		lt, _ := findLinkType(l.Type)
+		l.Direction, l.Label = "outward", lt.Outward
+		if !outward {
+			l.Direction, l.Label = "inward", lt.Inward
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+func handleGetLinkTypes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, linkTypes)
+}
+
+func handleGetLinks(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	links, err := queryLinks(id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, links)
+}
+
+type linkRequest struct {
+	Type      string `json:"type"`
+	TargetID  int    `json:"target_id"`
+	Direction string `json:"direction"`
+}
+
+// ends resolves the request into (source, target) for ticket id.
+func (req linkRequest) ends(id int) (int, int, error) {
+	switch req.Direction {
+	case "", "outward":
+		return id, req.TargetID, nil
+	case "inward":
+		return req.TargetID, id, nil
+	}
+	return 0, 0, fmt.Errorf("direction must be outward or inward")
+}
+
+func handleCreateLink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	var req linkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	source, target, err := req.ends(id)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	linkID, status, msg := saveLink(req.Type, source, target, 0)
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+	publishLink("added", req.Type, source, target)
+	writeJSON(w, 201, map[string]int{"id": linkID})
+}
+
+// handleUpdateLink changes a link's type, direction or other ticket.
+// Omitted fields keep their current values.
+func handleUpdateLink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	linkID, err := strconv.Atoi(r.PathValue("link_id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid link id"})
+		return
+	}
+
+	var typ string
+	var source, target int
+	err = db.QueryRow(`SELECT link_type, source_ticket_id, target_ticket_id FROM ticket_links
+		WHERE id=$1 AND account_id=$2 AND (source_ticket_id=$3 OR target_ticket_id=$3)`,
+		linkID, cfg.AccountID, id).Scan(&typ, &source, &target)
+	if err == sql.ErrNoRows {
+		writeJSON(w, 404, map[string]string{"error": "link not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	oldType, oldSource, oldTarget := typ, source, target
+	req := linkRequest{Type: typ, TargetID: target, Direction: "outward"}
+	if source != id {
+		req.TargetID, req.Direction = source, "inward"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	source, target, err = req.ends(id)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if _, status, msg := saveLink(req.Type, source, target, linkID); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+	publishLink("removed", oldType, oldSource, oldTarget)
+	publishLink("added", req.Type, source, target)
+	writeJSON(w, 200, map[string]int{"id": linkID})
+}
+
+func handleDeleteLink(w http.ResponseWriter, r *http.Request) {
+	var typ string
+	var source, target int
+	err := db.QueryRow(`DELETE FROM ticket_links WHERE id=$1 AND account_id=$2
+		AND (source_ticket_id=$3 OR target_ticket_id=$3)
+		RETURNING link_type, source_ticket_id, target_ticket_id`,
+		r.PathValue("link_id"), cfg.AccountID, r.PathValue("id")).Scan(&typ, &source, &target)
+	if err == sql.ErrNoRows {
+		writeJSON(w, 404, map[string]string{"error": "link not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	publishLink("removed", typ, source, target)
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
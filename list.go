@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// List endpoints share one set of query params:
+//
+//	limit=50            page size (max 1000; omitted = everything)
+//	cursor=...          opaque keyset cursor from a previous page
+//	sort=-updated       any sortable column, "-" for descending
+//	fields=id,title     sparse fieldset of JSON keys
+//
+// Pagination is keyset-based on (sort column, id), so pages stay stable
+// while rows are inserted. The next page is advertised with a
+// `Link: <...>; rel="next"` header and `X-Next-Cursor`.
+
+const maxListLimit = 1000
+
+type listOptions struct {
+	Limit  int
+	Sort   string
+	Fields []string
+	after  *listCursor
+	stats  *queryStats
+}
+
+type listCursor struct {
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// sortColumn describes a sortable column: the SQL expression used in
+// ORDER BY and the keyset predicate, and how to read the same value back
+// from a loaded row so it can be put in the next cursor.
+type sortColumn[T any] struct {
+	expr  string
+	value func(*T) string
+}
+
+func parseListOptions[T any](r *http.Request, cols map[string]sortColumn[T]) (listOptions, error) {
+	q := r.URL.Query()
+	var o listOptions
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxListLimit {
+			return o, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		o.Limit = n
+	}
+
+	o.Sort = q.Get("sort")
+	if o.Sort != "" {
+		if _, ok := cols[strings.TrimPrefix(o.Sort, "-")]; !ok {
+			return o, fmt.Errorf("invalid sort %q (want one of %s, optionally prefixed with -)", o.Sort, sortNames(cols))
+		}
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		var c listCursor
+		if err == nil {
+			err = json.Unmarshal(raw, &c)
+		}
+		if err != nil {
+			return o, fmt.Errorf("invalid cursor")
+		}
+		o.after = &c
+		if o.Limit == 0 {
+			o.Limit = 50
+		}
+	}
+
+	if s := q.Get("fields"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				o.Fields = append(o.Fields, f)
+			}
+		}
+	}
+	return o, nil
+}
+
+func sortNames[T any](cols map[string]sortColumn[T]) string {
+	names := make([]string, 0, len(cols))
+	for k := range cols {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// pageSQL returns the keyset predicate (empty when on the first page),
+// and the ORDER BY / LIMIT tail. idExpr is the unique tie-breaker. One
+// extra row is requested so writeList can tell whether a next page exists.
+func pageSQL[T any](o listOptions, b *sqlBuilder, cols map[string]sortColumn[T], defaultSort, idExpr string) (where, tail string) {
+	spec := o.Sort
+	if spec == "" {
+		spec = defaultSort
+	}
+	col := cols[strings.TrimPrefix(spec, "-")]
+	dir, cmp := "ASC", ">"
+	if strings.HasPrefix(spec, "-") {
+		dir, cmp = "DESC", "<"
+	}
+
+	if o.after != nil {
+		where = fmt.Sprintf("(%s, %s) %s (%s, %s)", col.expr, idExpr, cmp, b.arg(o.after.Value), b.arg(o.after.ID))
+	}
+	tail = fmt.Sprintf(" ORDER BY %s %s, %s %s", col.expr, dir, idExpr, dir)
+	if o.Limit > 0 {
+		tail += fmt.Sprintf(" LIMIT %d", o.Limit+1)
+	}
+	return where, tail
+}
+
+// writeList trims the look-ahead row, sets pagination headers and writes
+// items (reduced to the requested fields) as a JSON array.
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T, o listOptions, cols map[string]sortColumn[T], defaultSort string, id func(*T) int) {
+	if o.Limit > 0 && len(items) > o.Limit {
+		items = items[:o.Limit]
+		spec := o.Sort
+		if spec == "" {
+			spec = defaultSort
+		}
+		last := &items[len(items)-1]
+		raw, _ := json.Marshal(listCursor{Value: cols[strings.TrimPrefix(spec, "-")].value(last), ID: id(last)})
+		next := base64.RawURLEncoding.EncodeToString(raw)
+
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		q.Set("limit", strconv.Itoa(o.Limit))
+		u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.String()))
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	if items == nil {
+		items = []T{}
+	}
+
+	if len(o.Fields) == 0 {
+		writeJSON(w, 200, items)
+		return
+	}
+	out, err := selectFields(items, o.Fields)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, out)
+}
+
+// selectFields round-trips items through JSON and keeps only fields.
+func selectFields(items interface{}, fields []string) ([]map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		return nil, err
+	}
+	out := make([]map[string]json.RawMessage, len(rows))
+	for i, row := range rows {
+		out[i] = make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := row[f]; ok {
+				out[i][f] = v
+			}
+		}
+	}
+	return out, nil
+}
+
+func cursorTime(t time.Time) string { return t.Format(time.RFC3339Nano) }
+
+var ticketSortColumns = map[string]sortColumn[Ticket]{
+	"id":       {"t.id", func(t *Ticket) string { return strconv.Itoa(t.ID) }},
+	"title":    {"t.title", func(t *Ticket) string { return t.Title }},
+	"body":     {"COALESCE(t.body,'')", func(t *Ticket) string { return t.Body }},
+	"assignee": {"COALESCE(t.assignee,'')", func(t *Ticket) string { return t.Assignee }},
+	"project":  {"p.key", func(t *Ticket) string { return t.ProjectKey }},
+	"state": {"array_position(ARRAY['backlog','todo','in_progress','done'], t.state)",
+		func(t *Ticket) string { return strconv.Itoa(stateIndex(t.State) + 1) }},
+	"created": {"t.created_at", func(t *Ticket) string { return cursorTime(t.CreatedAt) }},
+	"updated": {"t.updated_at", func(t *Ticket) string { return cursorTime(t.UpdatedAt) }},
+	"priority": {"array_position(ARRAY['low','medium','high','urgent'], t.priority)",
+		func(t *Ticket) string { return strconv.Itoa(priorityRank(t.Priority)) }},
+	// Tickets without a due date sort last.
+	"due": {"COALESCE(t.due_date, '9999-12-31')", func(t *Ticket) string {
+		if t.DueDate == nil {
+			return "9999-12-31"
+		}
+		return *t.DueDate
+	}},
+}
+
+var projectSortColumns = map[string]sortColumn[Project]{
+	"id":      {"id", func(p *Project) string { return strconv.Itoa(p.ID) }},
+	"key":     {"key", func(p *Project) string { return p.Key }},
+	"name":    {"name", func(p *Project) string { return p.Name }},
+	"created": {"created_at", func(p *Project) string { return cursorTime(p.CreatedAt) }},
+}
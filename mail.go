@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Outgoing mail over SMTP, with net/smtp. SMTP_TLS picks how the
+// connection is secured: "starttls" (the default) upgrades a plain
+// connection and fails if the server can't, "tls" connects with TLS from
+// the start (usually port 465) and "none" sends in the clear, for local
+// relays and test servers.
+
+// smtpRootCAs verifies the SMTP server's certificate; nil means the
+// system roots. Tests point it at their own server's certificate.
+var smtpRootCAs *x509.CertPool
+
+type mailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// buildMail renders a multipart/alternative message with plaintext and
+// HTML parts.
+func buildMail(from string, m mailMessage, now time.Time) []byte {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ typ, content string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.typ + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qp := quotedprintable.NewWriter(pw)
+		qp.Write([]byte(part.content))
+		qp.Close()
+	}
+	mw.Close()
+
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := "pippin.local"
+	if _, d, ok := strings.Cut(from, "@"); ok {
+		domain = strings.Trim(d, "> ")
+	}
+
+	var msg bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&msg, "%s: %s\r\n", k, v) }
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(id)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	header("Auto-Submitted", "auto-generated")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// sendMail delivers one message through the configured SMTP server.
+func sendMail(m mailMessage) error {
+	if cfg.SMTPHost == "" {
+		return errors.New("SMTP_HOST is not set")
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort)
+	tlsConfig := &tls.Config{ServerName: cfg.SMTPHost, RootCAs: smtpRootCAs}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if cfg.SMTPTLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.SMTPTLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not offer STARTTLS (set SMTP_TLS=none to send in the clear)")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(bareAddress(cfg.SMTPFrom)); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMail(cfg.SMTPFrom, m, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// bareAddress strips a display name: "Pippin <pippin@example.com>"
+// becomes "pippin@example.com".
+func bareAddress(s string) string {
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		return strings.TrimSuffix(s[i+1:], ">")
+	}
+	return strings.TrimSpace(s)
+}
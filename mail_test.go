@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a fake SMTP server on 127.0.0.1 that keeps what it is
+// sent. With a TLS config it offers STARTTLS and AUTH PLAIN once the
+// connection is secure.
+type smtpServer struct {
+	ln   net.Listener
+	tls  *tls.Config
+	mu   sync.Mutex
+	fail int // MAIL commands still to refuse with a 451
+	msgs []smtpReceived
+}
+
+type smtpReceived struct {
+	from, to string
+	data     string
+	secure   bool
+	auth     string // decoded AUTH PLAIN response
+}
+
+func newSMTPServer(t *testing.T, tlsConfig *tls.Config) *smtpServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln, tls: tlsConfig}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// use points the mail config at the server.
+func (s *smtpServer) use(t *testing.T, mode string) {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPTLS = host, port, mode
+	cfg.SMTPFrom = "Pippin <pippin@example.com>"
+	cfg.SMTPUsername, cfg.SMTPPassword = "", ""
+}
+
+func (s *smtpServer) received() []smtpReceived {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpReceived(nil), s.msgs...)
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	var msg smtpReceived
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ext := []string{"fake"}
+			if s.tls != nil && !msg.secure {
+				ext = append(ext, "STARTTLS")
+			}
+			if msg.secure {
+				ext = append(ext, "AUTH PLAIN")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn, tp = tc, textproto.NewConn(tc)
+			msg.secure = true
+		case "AUTH":
+			_, resp, _ := strings.Cut(arg, " ")
+			raw, _ := base64.StdEncoding.DecodeString(resp)
+			msg.auth = string(raw)
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			s.mu.Lock()
+			refuse := s.fail > 0
+			if refuse {
+				s.fail--
+			}
+			s.mu.Unlock()
+			if refuse {
+				tp.PrintfLine("451 try again later")
+				continue
+			}
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// selfSigned returns a server config with a fresh certificate for
+// 127.0.0.1, and trusts it for sendMail until the test ends.
+func selfSigned(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	smtpRootCAs = pool
+	t.Cleanup(func() { smtpRootCAs = nil })
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+var testMail = mailMessage{To: "jane@example.com", Subject: "T-1 was assigned to you", Text: "Hello Jane", HTML: "<p>Hello Jane</p>"}
+
+func TestSendMailPlain(t *testing.T) {
+	srv := newSMTPServer(t, nil)
+	srv.use(t, "none")
+
+	if err := sendMail(testMail); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.received()
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages received", len(msgs))
+	}
+	m := msgs[0]
+	if m.secure || m.from != "pippin@example.com" || m.to != "jane@example.com" {
+		t.Errorf("envelope: %+v", m)
+	}
+	for _, want := range []string{"From: Pippin <pippin@example.com>", "To: jane@example.com", "Hello Jane", "Auto-Submitted: auto-generated"} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, m.data)
+		}
+	}
+}
+
+func TestSendMailStartTLS(t *testing.T) {
+	srv := newSMTPServer(t, selfSigned(t))
+	srv.use(t, "starttls")
+	cfg.SMTPUsername, cfg.SMTPPassword = "pippin", "hunter2"
+
+	if err := sendMail(testMail); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.received()
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages received", len(msgs))
+	}
+	if m := msgs[0]; !m.secure || m.auth != "\x00pippin\x00hunter2" || !strings.Contains(m.data, "Hello Jane") {
+		t.Errorf("received %+v", m)
+	}
+}
+
+func TestSendMailStartTLSRequired(t *testing.T) {
+	srv := newSMTPServer(t, nil) // no STARTTLS on offer
+	srv.use(t, "starttls")
+
+	err := sendMail(testMail)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("sendMail = %v, want a STARTTLS error", err)
+	}
+	if n := len(srv.received()); n != 0 {
+		t.Errorf("%d messages sent in the clear", n)
+	}
+}
+
+func TestSendMailUntrustedCertificate(t *testing.T) {
+	srv := newSMTPServer(t, selfSigned(t))
+	srv.use(t, "starttls")
+	smtpRootCAs = x509.NewCertPool()
+
+	if err := sendMail(testMail); err == nil {
+		t.Fatal("sent to a server with an untrusted certificate")
+	}
+}
+
+func TestBuildMail(t *testing.T) {
+	m := mailMessage{To: "lee@example.com", Subject: "Über T-3", Text: "plain", HTML: "<b>html</b>"}
+	raw := string(buildMail("Pippin <pippin@example.org>", m, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(raw)))
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Subject") != "=?utf-8?q?=C3=9Cber_T-3?=" || !strings.HasSuffix(h.Get("Message-Id"), "@example.org>") {
+		t.Errorf("headers: %v", h)
+	}
+	if !strings.HasPrefix(h.Get("Content-Type"), "multipart/alternative; boundary=") ||
+		!strings.Contains(raw, "text/plain; charset=utf-8") || !strings.Contains(raw, "text/html; charset=utf-8") {
+		t.Errorf("message:\n%s", raw)
+	}
+}
+
+// mailTestAccount resets the test account's outbox, notifications and
+// tickets, and points mail at a fake server that refuses fail messages.
+func mailTestAccount(t *testing.T, fail int) *smtpServer {
+	const account = "test-mail"
+	testDB(t, account)
+	for _, q := range []string{
+		"DELETE FROM email_outbox WHERE account_id=$1",
+		"DELETE FROM notification_prefs WHERE account_id=$1",
+		"DELETE FROM projects WHERE account_id=$1",
+	} {
+		if _, err := db.Exec(q, account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := newSMTPServer(t, nil)
+	srv.fail = fail
+	srv.use(t, "none")
+	return srv
+}
+
+type outboxRow struct {
+	status   string
+	attempts int
+	next     *time.Time
+	err      string
+}
+
+func loadOutbox(t *testing.T) []outboxRow {
+	t.Helper()
+	rows, err := db.Query("SELECT status, attempts, next_attempt_at, last_error FROM email_outbox WHERE account_id=$1 ORDER BY id", cfg.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var list []outboxRow
+	for rows.Next() {
+		var o outboxRow
+		if err := rows.Scan(&o.status, &o.attempts, &o.next, &o.err); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, o)
+	}
+	return list
+}
+
+func TestMailBatchRetry(t *testing.T) {
+	srv := mailTestAccount(t, 1)
+	if err := queueMail(db, testMail); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runMailBatch(); err != nil {
+		t.Fatal(err)
+	}
+	out := loadOutbox(t)
+	if len(out) != 1 || out[0].status != "pending" || out[0].attempts != 1 || out[0].err == "" || out[0].next == nil {
+		t.Fatalf("after a refusal: %+v", out)
+	}
+	if wait := out[0].next.Sub(time.Now().UTC()); wait <= 0 || wait > mailBaseDelay {
+		t.Errorf("next attempt in %v, want about %v", wait, mailBaseDelay)
+	}
+
+	// Not due yet; then due, and delivered.
+	runMailBatch()
+	if n := len(srv.received()); n != 0 {
+		t.Fatalf("retried before the backoff: %d messages", n)
+	}
+	db.Exec("UPDATE email_outbox SET next_attempt_at='epoch' WHERE account_id=$1", cfg.AccountID)
+	if _, err := runMailBatch(); err != nil {
+		t.Fatal(err)
+	}
+	out = loadOutbox(t)
+	if out[0].status != "sent" || out[0].attempts != 2 || len(srv.received()) != 1 {
+		t.Errorf("after the retry: %+v, %d messages", out, len(srv.received()))
+	}
+}
+
+func TestMailBatchGivesUp(t *testing.T) {
+	srv := mailTestAccount(t, 1)
+	queueMail(db, testMail)
+	db.Exec("UPDATE email_outbox SET attempts=$1 WHERE account_id=$2", mailMaxAttempts-1, cfg.AccountID)
+
+	if _, err := runMailBatch(); err != nil {
+		t.Fatal(err)
+	}
+	out := loadOutbox(t)
+	if out[0].status != "failed" || out[0].attempts != mailMaxAttempts || out[0].next != nil || len(srv.received()) != 0 {
+		t.Errorf("after the last attempt: %+v", out)
+	}
+}
+
+func TestDigestBatching(t *testing.T) {
+	srv := mailTestAccount(t, 0)
+	var ticketID int
+	err := db.QueryRow(`WITH p AS (INSERT INTO projects (account_id, key, name) VALUES ($1, 'ML', 'Mail') RETURNING id)
+		INSERT INTO tickets (account_id, project_id, title, state) SELECT $1, id, 'Fix the printer', 'todo' FROM p RETURNING id`,
+		cfg.AccountID).Scan(&ticketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO notification_prefs (account_id, username, email, digest) VALUES ($1, 'jane', 'jane@example.com', 'hourly')`,
+		cfg.AccountID); err != nil {
+		t.Fatal(err)
+	}
+	hold := func(kind, detail, age string) {
+		if _, err := db.Exec(`INSERT INTO notifications (account_id, username, kind, ticket_id, actor, detail, digest_pending, created_at)
+			VALUES ($1, 'jane', $2, $3, 'lee', $4, true, now() - $5::interval)`, cfg.AccountID, kind, ticketID, detail, age); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Held for less than the period: nothing yet.
+	hold("assigned", "", "10 minutes")
+	if sent, err := runNextDigest(); err != nil || sent {
+		t.Fatalf("runNextDigest = %v, %v before the hour is up", sent, err)
+	}
+
+	// Once the oldest is an hour old, everything held goes in one email.
+	hold("commented", "Looks good", "2 hours")
+	if sent, err := runNextDigest(); err != nil || !sent {
+		t.Fatalf("runNextDigest = %v, %v", sent, err)
+	}
+	if sent, _ := runNextDigest(); sent {
+		t.Errorf("sent a second digest for the same notifications")
+	}
+	var pending int
+	db.QueryRow("SELECT count(*) FROM notifications WHERE account_id=$1 AND digest_pending", cfg.AccountID).Scan(&pending)
+	if pending != 0 {
+		t.Errorf("%d notifications still held", pending)
+	}
+
+	var to, subject, text string
+	if err := db.QueryRow("SELECT to_addr, subject, text_body FROM email_outbox WHERE account_id=$1", cfg.AccountID).Scan(&to, &subject, &text); err != nil {
+		t.Fatal(err)
+	}
+	if to != "jane@example.com" || subject != "2 updates on your tickets" || !strings.Contains(text, "Looks good") {
+		t.Errorf("digest to %s, %q:\n%s", to, subject, text)
+	}
+
+	if _, err := runMailBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.received(); len(msgs) != 1 || msgs[0].to != "jane@example.com" {
+		t.Errorf("received %+v", msgs)
+	}
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -24,6 +28,39 @@ var (
 		SprintLength int
 		SprintEpoch  time.Time
 		CozyTheme    string
+		// SLA checker; an interval of 0 disables it on this instance.
+		SLACheckInterval time.Duration
+		// Recurring ticket scheduler; 0 disables it on this instance.
+		RecurringInterval time.Duration
+		// Outgoing webhook worker poll; 0 disables it on this instance.
+		WebhookInterval time.Duration
+		// Incoming git webhook; disabled without a secret.
+		GitWebhookSecret string
+		GitTransitions   map[string]string // keyword -> state, see gitwebhook.go
+		// Email notifications; nothing is emailed without an SMTP host.
+		BaseURL        string // links in emails
+		SMTPHost       string
+		SMTPPort       string
+		SMTPUsername   string
+		SMTPPassword   string
+		SMTPFrom       string
+		SMTPTLS        string // starttls, tls or none
+		NotifyInterval time.Duration
+		// Email to ticket; disabled without a token and project.
+		InboundMailToken   string
+		InboundMailProject string
+		InboundMailAllow   []string // addresses, @domains or *
+		// Attachments, see storage.go and attachments.go.
+		AttachmentStore    string // disk or s3
+		AttachmentDir      string
+		AttachmentMaxBytes int64
+		AttachmentTypes    []string // MIME types; "image/*" matches a family
+		AttachmentCleanup  time.Duration
+		S3Endpoint         string
+		S3Bucket           string
+		S3Region           string
+		S3AccessKey        string
+		S3SecretKey        string
 	}
 )
 
@@ -36,18 +73,62 @@ type Project struct {
 }
 
 type Ticket struct {
-	ID         int       `json:"id"`
-	AccountID  string    `json:"account_id"`
-	ProjectID  int       `json:"project_id"`
-	Title      string    `json:"title"`
-	Body       string    `json:"body"`
-	State      string    `json:"state"`
-	Assignee   string    `json:"assignee"`
-	Comments   string    `json:"comments"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
-	ProjectKey string    `json:"project_key,omitempty"`
-	BlockedBy  []string  `json:"blocked_by,omitempty"`
+	ID         int           `json:"id"`
+	AccountID  string        `json:"account_id"`
+	ProjectID  int           `json:"project_id"`
+	Title      string        `json:"title"`
+	Body       string        `json:"body"`
+	State      string        `json:"state"`
+	Assignee   string        `json:"assignee"`
+	Comments   string        `json:"comments"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	ProjectKey string        `json:"project_key,omitempty"`
+	BlockedBy  []string      `json:"blocked_by,omitempty"`
+	Blocks     []string      `json:"blocks,omitempty"`
+	EpicID     *int          `json:"epic_id"`
+	EpicName   string        `json:"epic_name,omitempty"`
+	Points     *int          `json:"points"`
+	ParentID   *int          `json:"parent_id,omitempty"`
+	Subtasks   []int         `json:"subtasks,omitempty"`
+	Labels     []TicketLabel `json:"labels,omitempty"`
+	Priority   string        `json:"priority"`
+	DueDate    *string       `json:"due_date"` // YYYY-MM-DD
+	Overdue    bool          `json:"overdue"`
+	// Custom holds the project's custom field values by key.
+	Custom map[string]interface{} `json:"custom,omitempty"`
+	// SLABreached is set while an SLA rule is being violated (see sla.go).
+	SLABreached bool `json:"sla_breached"`
+	// Progress rolls up the subtasks; nil when the ticket has none.
+	Progress *Progress `json:"subtask_progress,omitempty"`
+	// Watchers and Attachments are only filled in when a single ticket
+	// is fetched.
+	Watchers    []string     `json:"watchers,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// BodyHTML and CommentsHTML are the rendered Markdown, only filled in
+	// when a single ticket is fetched (see markdown.go).
+	BodyHTML     string            `json:"body_html,omitempty"`
+	CommentsHTML []RenderedComment `json:"comments_html,omitempty"`
+}
+
+// ticketSelect is the column list shared by every full ticket read;
+// scanTicket must be kept in step with it.
+const ticketSelect = `SELECT t.id, t.account_id, t.project_id, t.title, t.body, t.state, t.assignee, COALESCE(t.comments,''),
+		t.created_at, t.updated_at, p.key, t.epic_id, COALESCE(e.name,''), t.points,
+		t.priority, to_char(t.due_date,'YYYY-MM-DD'), COALESCE(t.due_date < CURRENT_DATE AND t.state <> 'done', false),
+		EXISTS (SELECT 1 FROM sla_breaches sb WHERE sb.ticket_id=t.id AND sb.resolved_at IS NULL), t.custom
+	FROM tickets t JOIN projects p ON t.project_id=p.id LEFT JOIN epics e ON e.id=t.epic_id`
+
+func scanTicket(row interface{ Scan(...interface{}) error }) (Ticket, error) {
+	var t Ticket
+	var custom []byte
+	err := row.Scan(&t.ID, &t.AccountID, &t.ProjectID, &t.Title, &t.Body, &t.State, &t.Assignee, &t.Comments,
+		&t.CreatedAt, &t.UpdatedAt, &t.ProjectKey, &t.EpicID, &t.EpicName, &t.Points,
+		&t.Priority, &t.DueDate, &t.Overdue, &t.SLABreached, &custom)
+	if err == nil && len(custom) > 2 {
+		err = json.Unmarshal(custom, &t.Custom)
+	}
+	return t, err
 }
 
 type Comment struct {
@@ -60,6 +141,23 @@ func main() {
 	initDB()
 	initSchema()
 	initTemplate()
+	initStore()
+	if cfg.SLACheckInterval > 0 {
+		go runSLAChecker(cfg.SLACheckInterval)
+	}
+	if cfg.RecurringInterval > 0 {
+		go runRecurringScheduler(cfg.RecurringInterval)
+	}
+	if cfg.WebhookInterval > 0 {
+		go runWebhookWorker(cfg.WebhookInterval)
+	}
+	if cfg.NotifyInterval > 0 {
+		go runNotifier(cfg.NotifyInterval)
+	}
+	if cfg.AttachmentCleanup > 0 {
+		go runAttachmentCleanup(cfg.AttachmentCleanup)
+	}
+	go listenEvents()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
@@ -69,17 +167,92 @@ func main() {
 	mux.HandleFunc("GET /api/projects", handleGetProjects)
 	mux.HandleFunc("POST /api/projects", handleCreateProject)
 	mux.HandleFunc("DELETE /api/projects/{key}", handleDeleteProject)
+	mux.HandleFunc("GET /api/projects/{key}/graph", handleProjectGraph)
 	mux.HandleFunc("GET /api/tickets", handleGetTickets)
 	mux.HandleFunc("GET /api/tickets/{id}", handleGetTicket)
 	mux.HandleFunc("POST /api/tickets", handleCreateTicket)
 	mux.HandleFunc("PATCH /api/tickets/{id}", handleUpdateTicket)
 	mux.HandleFunc("POST /api/tickets/{id}/move", handleMoveTicket)
+	mux.HandleFunc("POST /api/tickets/{id}/lane", handleSetLane)
 	mux.HandleFunc("POST /api/tickets/{id}/comments", handleAddComment)
+	mux.HandleFunc("POST /api/tickets/{id}/tasks/{index}", handleToggleTask)
 	mux.HandleFunc("POST /api/tickets/{id}/blocks", handleAddBlock)
 	mux.HandleFunc("DELETE /api/tickets/{id}/blocks/{blocked_id}", handleDeleteBlock)
+	mux.HandleFunc("GET /api/tickets/{id}/blockers", handleTicketBlockers)
+	mux.HandleFunc("GET /api/tickets/{id}/links", handleGetLinks)
+	mux.HandleFunc("POST /api/tickets/{id}/links", handleCreateLink)
+	mux.HandleFunc("PATCH /api/tickets/{id}/links/{link_id}", handleUpdateLink)
+	mux.HandleFunc("DELETE /api/tickets/{id}/links/{link_id}", handleDeleteLink)
+	mux.HandleFunc("GET /api/link-types", handleGetLinkTypes)
+	mux.HandleFunc("GET /api/tickets/{id}/dependencies.svg", handleTicketDependencySVG)
+	mux.HandleFunc("GET /api/critical-path", handleCriticalPath)
+	mux.HandleFunc("POST /api/tickets/{id}/labels", handleAddTicketLabel)
+	mux.HandleFunc("DELETE /api/tickets/{id}/labels/{label_id}", handleRemoveTicketLabel)
+	mux.HandleFunc("GET /api/labels", handleGetLabels)
+	mux.HandleFunc("POST /api/labels", handleCreateLabel)
+	mux.HandleFunc("PATCH /api/labels/{id}", handleUpdateLabel)
+	mux.HandleFunc("DELETE /api/labels/{id}", handleDeleteLabel)
+	mux.HandleFunc("GET /api/epics", handleGetEpics)
+	mux.HandleFunc("POST /api/epics", handleCreateEpic)
+	mux.HandleFunc("GET /api/epics/{id}", handleGetEpic)
+	mux.HandleFunc("PATCH /api/epics/{id}", handleUpdateEpic)
+	mux.HandleFunc("DELETE /api/epics/{id}", handleDeleteEpic)
+	mux.HandleFunc("GET /api/sla/rules", handleGetSLARules)
+	mux.HandleFunc("POST /api/sla/rules", handleCreateSLARule)
+	mux.HandleFunc("DELETE /api/sla/rules/{id}", handleDeleteSLARule)
+	mux.HandleFunc("GET /api/sla/breaches", handleGetSLABreaches)
+	mux.HandleFunc("GET /api/custom-fields", handleGetCustomFields)
+	mux.HandleFunc("POST /api/custom-fields", handleCreateCustomField)
+	mux.HandleFunc("PATCH /api/custom-fields/{id}", handleUpdateCustomField)
+	mux.HandleFunc("DELETE /api/custom-fields/{id}", handleDeleteCustomField)
+	mux.HandleFunc("GET /api/templates", handleGetTemplates)
+	mux.HandleFunc("POST /api/templates", handleCreateTemplate)
+	mux.HandleFunc("GET /api/templates/{id}", handleGetTemplate)
+	mux.HandleFunc("PATCH /api/templates/{id}", handleUpdateTemplate)
+	mux.HandleFunc("DELETE /api/templates/{id}", handleDeleteTemplate)
+	mux.HandleFunc("GET /api/recurring", handleGetRecurring)
+	mux.HandleFunc("POST /api/recurring", handleCreateRecurring)
+	mux.HandleFunc("GET /api/recurring/upcoming", handleUpcomingRecurring)
+	mux.HandleFunc("PATCH /api/recurring/{id}", handleUpdateRecurring)
+	mux.HandleFunc("DELETE /api/recurring/{id}", handleDeleteRecurring)
+	mux.HandleFunc("GET /api/webhooks", handleGetWebhooks)
+	mux.HandleFunc("POST /api/webhooks", handleCreateWebhook)
+	mux.HandleFunc("PATCH /api/webhooks/{id}", handleUpdateWebhook)
+	mux.HandleFunc("DELETE /api/webhooks/{id}", handleDeleteWebhook)
+	mux.HandleFunc("GET /api/webhooks/{id}/deliveries", handleGetDeliveries)
+	mux.HandleFunc("POST /api/webhooks/{id}/deliveries/{delivery_id}/redeliver", handleRedeliver)
+	mux.HandleFunc("POST /api/git/webhook", handleGitWebhook)
+	mux.HandleFunc("POST /api/mail/inbound", handleInboundMail)
+	mux.HandleFunc("GET /api/notifications/preferences", handleGetNotificationPrefs)
+	mux.HandleFunc("PUT /api/notifications/preferences", handleUpdateNotificationPrefs)
+	mux.HandleFunc("GET /api/notifications", handleGetNotifications)
+	mux.HandleFunc("GET /api/notifications/count", handleNotificationCount)
+	mux.HandleFunc("POST /api/notifications/read", handleReadAllNotifications)
+	mux.HandleFunc("POST /api/notifications/{id}/read", handleReadNotification)
+	mux.HandleFunc("GET /api/users", handleGetUsers)
+	mux.HandleFunc("GET /api/mentions", handleGetMentions)
+	mux.HandleFunc("GET /api/mentions/count", handleMentionCount)
+	mux.HandleFunc("POST /api/mentions/read", handleReadAllMentions)
+	mux.HandleFunc("POST /api/mentions/{id}/read", handleReadMention)
+	mux.HandleFunc("GET /api/tickets/{id}/attachments", handleGetAttachments)
+	mux.HandleFunc("POST /api/tickets/{id}/attachments", handleUploadAttachments)
+	mux.HandleFunc("GET /api/attachments/{id}", handleDownloadAttachment)
+	mux.HandleFunc("GET /api/attachments/{id}/thumbnail", handleAttachmentThumbnail)
+	mux.HandleFunc("DELETE /api/attachments/{id}", handleDeleteAttachment)
+	mux.HandleFunc("GET /api/tickets/{id}/watchers", handleGetWatchers)
+	mux.HandleFunc("POST /api/tickets/{id}/watch", handleWatchTicket)
+	mux.HandleFunc("DELETE /api/tickets/{id}/watch", handleUnwatchTicket)
+	mux.HandleFunc("GET /api/events", handleEvents)
+	mux.HandleFunc("GET /api/ws", handleWebSocket)
 	mux.HandleFunc("GET /api/settings", handleGetSettings)
 	mux.HandleFunc("POST /api/settings", handleUpdateSettings)
 	mux.HandleFunc("GET /api/export", handleExport)
+	mux.HandleFunc("POST /api/import", handleImport)
+	mux.HandleFunc("GET /api/filters", handleGetFilters)
+	mux.HandleFunc("POST /api/filters", handleCreateFilter)
+	mux.HandleFunc("GET /api/filters/{id}", handleGetFilter)
+	mux.HandleFunc("PATCH /api/filters/{id}", handleUpdateFilter)
+	mux.HandleFunc("DELETE /api/filters/{id}", handleDeleteFilter)
 
 	log.Printf("🍎 Pippin starting on :%s (account=%s, theme=%s)", cfg.Port, cfg.AccountID, cfg.CozyTheme)
 	log.Fatal(http.ListenAndServe(":"+cfg.Port, mux))
@@ -91,8 +264,40 @@ func loadConfig() {
 	cfg.AccountID = getEnv("ACCOUNT_ID", "demo")
 	cfg.SprintLength = getEnvInt("SPRINT_LENGTH_DAYS", 7)
 	cfg.CozyTheme = getEnv("COZY_THEME", "warm")
-	epochStr := getEnv("SPRINT_EPOCH", "2025-01-01")
+	cfg.SLACheckInterval = time.Duration(getEnvInt("SLA_CHECK_SECONDS", 300)) * time.Second
+	cfg.RecurringInterval = time.Duration(getEnvInt("RECURRING_CHECK_SECONDS", 60)) * time.Second
+	cfg.WebhookInterval = time.Duration(getEnvInt("WEBHOOK_POLL_SECONDS", 5)) * time.Second
+	cfg.GitWebhookSecret = getEnv("GIT_WEBHOOK_SECRET", "")
+	cfg.BaseURL = strings.TrimSuffix(getEnv("BASE_URL", "http://localhost:"+cfg.Port), "/")
+	cfg.SMTPHost = getEnv("SMTP_HOST", "")
+	cfg.SMTPPort = getEnv("SMTP_PORT", "587")
+	cfg.SMTPUsername = getEnv("SMTP_USERNAME", "")
+	cfg.SMTPPassword = getEnv("SMTP_PASSWORD", "")
+	cfg.SMTPFrom = getEnv("SMTP_FROM", "Pippin <pippin@localhost>")
+	cfg.SMTPTLS = getEnv("SMTP_TLS", "starttls")
+	if cfg.SMTPTLS != "starttls" && cfg.SMTPTLS != "tls" && cfg.SMTPTLS != "none" {
+		log.Fatalf("invalid SMTP_TLS %q: expected starttls, tls or none", cfg.SMTPTLS)
+	}
+	cfg.NotifyInterval = time.Duration(getEnvInt("NOTIFY_POLL_SECONDS", 30)) * time.Second
+	cfg.InboundMailToken = getEnv("INBOUND_MAIL_TOKEN", "")
+	cfg.InboundMailProject = getEnv("INBOUND_MAIL_PROJECT", "")
+	cfg.InboundMailAllow = parseAllowList(getEnv("INBOUND_MAIL_ALLOW", ""))
+	cfg.AttachmentStore = getEnv("ATTACHMENT_STORE", "disk")
+	cfg.AttachmentDir = getEnv("ATTACHMENT_DIR", "attachments")
+	cfg.AttachmentMaxBytes = int64(getEnvInt("ATTACHMENT_MAX_MB", 10)) << 20
+	cfg.AttachmentTypes = parseAllowList(getEnv("ATTACHMENT_TYPES", defaultAttachmentTypes))
+	cfg.AttachmentCleanup = time.Duration(getEnvInt("ATTACHMENT_CLEANUP_SECONDS", 60)) * time.Second
+	cfg.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	cfg.S3Bucket = getEnv("S3_BUCKET", "")
+	cfg.S3Region = getEnv("S3_REGION", "us-east-1")
+	cfg.S3AccessKey = getEnv("S3_ACCESS_KEY", "")
+	cfg.S3SecretKey = getEnv("S3_SECRET_KEY", "")
 	var err error
+	cfg.GitTransitions, err = parseGitTransitions(getEnv("GIT_TRANSITIONS", defaultGitTransitions))
+	if err != nil {
+		log.Fatalf("invalid GIT_TRANSITIONS: %v", err)
+	}
+	epochStr := getEnv("SPRINT_EPOCH", "2025-01-01")
 	cfg.SprintEpoch, err = time.Parse("2006-01-02", epochStr)
 	if err != nil {
 		log.Fatalf("invalid SPRINT_EPOCH: %v", err)
@@ -128,49 +333,120 @@ func handleBoard(w http.ResponseWriter, r *http.Request) {
 		projectFilter = "ALL"
 	}
 
-	tickets := queryTickets(projectFilter, sprint)
-	projects, _ := queryProjects()
+	q := r.URL.Query().Get("q")
+	filterID := r.URL.Query().Get("filter")
+	epicID := r.URL.Query().Get("epic")
+	label := r.URL.Query().Get("label")
+	laneBy := r.URL.Query().Get("lanes")
+	user := currentUser(r)
+
+	// A saved filter supplies the query, sort and visible columns; an
+	// explicit ?q= still wins so the view can be refined in place.
+	var queryErr, sortSpec string
+	columns := ticketStates
+	if filterID != "" {
+		if f, err := loadFilter(filterID, user); err != nil {
+			queryErr = "saved filter not found"
+		} else {
+			if q == "" {
+				q = f.Query
+			}
+			sortSpec = f.Sort
+			columns = f.Columns
+		}
+	}
+
+	var tickets []Ticket
+	stats := &queryStats{}
+	filter, err := parseTicketQuery(q)
+	epic, epicErr := epicFilter(epicID)
+	if err != nil {
+		queryErr = err.Error()
+	} else if epicErr != nil {
+		queryErr = epicErr.Error()
+	} else if queryErr == "" {
+		filter = andQuery(andQuery(filter, epic), labelFilter(label))
+		if tickets, err = queryTickets(projectFilter, sprint, filter, listOptions{Sort: sortSpec, stats: stats}); err != nil {
+			queryErr = err.Error()
+		}
+	}
+	projects, _ := queryProjects(listOptions{})
+	filters, _ := queryFilters(user, listOptions{})
+	labels, _ := queryLabels(projectFilter, listOptions{})
+	fields, _ := queryCustomFields(db, "f.account_id=$1", cfg.AccountID)
+	templates, _ := queryTemplates("")
+	recurring, _ := queryRecurring(projectFilter)
+	// Project lanes only make sense when every project is on the board.
+	if !slices.Contains(laneOptions, laneBy) || laneBy == "project" && projectFilter != "ALL" {
+		laneBy = ""
+	}
+
+	var grid []string
+	for _, c := range columns {
+		if c == "backlog" {
+			grid = append(grid, "260px")
+		} else {
+			grid = append(grid, "1fr")
+		}
+	}
 
 	data := struct {
-		Theme    string
-		Sprint   string
-		Project  string
-		Projects []Project
-		Backlog  []Ticket
-		Todo     []Ticket
-		InProg   []Ticket
-		Done     []Ticket
+		Theme       string
+		Sprint      string
+		Project     string
+		Query       string
+		QueryError  string
+		FilterID    string
+		Filters     []SavedFilter
+		Epic        string
+		Epics       []Epic
+		Label       string
+		Labels      []Label
+		Fields      []CustomField
+		Templates   []TicketTemplate
+		Recurring   []RecurringTicket
+		LaneBy      string
+		Lanes       []boardLane
+		GridColumns string
+		Projects    []Project
 	}{
-		Theme:    cfg.CozyTheme,
-		Sprint:   sprint,
-		Project:  projectFilter,
-		Projects: projects,
-	}
-
-	for _, t := range tickets {
-		switch t.State {
-		case "backlog":
-			data.Backlog = append(data.Backlog, t)
-		case "todo":
-			data.Todo = append(data.Todo, t)
-		case "in_progress":
-			data.InProg = append(data.InProg, t)
-		case "done":
-			data.Done = append(data.Done, t)
-		}
+		Theme:       cfg.CozyTheme,
+		Sprint:      sprint,
+		Project:     projectFilter,
+		Query:       q,
+		QueryError:  queryErr,
+		FilterID:    filterID,
+		Filters:     filters,
+		Epic:        epicID,
+		Epics:       epicOptions(),
+		Label:       label,
+		Labels:      labels,
+		Fields:      fields,
+		Templates:   templates,
+		Recurring:   recurring,
+		LaneBy:      laneBy,
+		Lanes:       buildLanes(tickets, columns, laneBy),
+		GridColumns: strings.Join(grid, " "),
+		Projects:    projects,
 	}
 
+	stats.writeHeaders(w)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	tpl.Execute(w, data)
 }
 
 func handleGetProjects(w http.ResponseWriter, r *http.Request) {
-	projects, err := queryProjects()
+	opts, err := parseListOptions(r, projectSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	projects, err := queryProjects(opts)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
-	writeJSON(w, 200, projects)
+	writeList(w, r, projects, opts, projectSortColumns, "created", func(p *Project) int { return p.ID })
 }
 
 func handleCreateProject(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +474,7 @@ func handleCreateProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publish(Event{Type: "project.created", Project: req.Key, Actor: currentUser(r)})
 	writeJSON(w, 201, map[string]int{"id": id})
 }
 
@@ -208,7 +485,7 @@ func handleDeleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete project (CASCADE will delete tickets and blocks)
+	// Delete project (CASCADE will delete tickets and links)
 	result, err := db.Exec("DELETE FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, key)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
@@ -221,47 +498,179 @@ func handleDeleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publish(Event{Type: "project.deleted", Project: key, Actor: currentUser(r)})
 	writeJSON(w, 200, map[string]string{"status": "deleted"})
 }
 
 func handleGetTickets(w http.ResponseWriter, r *http.Request) {
 	sprint := r.URL.Query().Get("sprint")
 	project := r.URL.Query().Get("project")
-	tickets := queryTickets(project, sprint)
-	writeJSON(w, 200, tickets)
+	filter, err := parseTicketQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	epic, err := epicFilter(r.URL.Query().Get("epic"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	custom, err := customFilter(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	filter = andQuery(andQuery(andQuery(filter, epic), labelFilter(r.URL.Query().Get("label"))), custom)
+	opts, err := parseListOptions(r, ticketSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	opts.stats = &queryStats{}
+	tickets, err := queryTickets(project, sprint, filter, opts)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	opts.stats.writeHeaders(w)
+	writeList(w, r, tickets, opts, ticketSortColumns, "created", func(t *Ticket) int { return t.ID })
+}
+
+type createTicketRequest struct {
+	ProjectKey string                 `json:"project_key"`
+	Title      string                 `json:"title"`
+	Body       string                 `json:"body"`
+	Assignee   string                 `json:"assignee"`
+	State      string                 `json:"state"`
+	EpicID     *int                   `json:"epic_id"`
+	Points     *int                   `json:"points"`
+	ParentID   *int                   `json:"parent_id"`
+	Labels     []string               `json:"labels"`
+	Priority   string                 `json:"priority"`
+	DueDate    string                 `json:"due_date"`
+	Custom     map[string]interface{} `json:"custom"`
+	// Template is a template ID or name in the ticket's project.
+	Template json.RawMessage `json:"template"`
 }
 
 func handleCreateTicket(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		ProjectKey string `json:"project_key"`
-		Title      string `json:"title"`
-		Body       string `json:"body"`
-		Assignee   string `json:"assignee"`
-		State      string `json:"state"`
-	}
+	var req createTicketRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, 400, map[string]string{"error": "invalid json"})
 		return
 	}
+	tmpl, err := findTemplate(req.Template, req.ProjectKey)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if tmpl != nil {
+		tmpl.apply(&req)
+	}
 	if req.State == "" {
 		req.State = "backlog"
 	}
+	if req.Priority == "" {
+		req.Priority = "medium"
+	}
+	if !isPriority(req.Priority) {
+		writeJSON(w, 400, map[string]string{"error": "priority must be one of " + strings.Join(priorities, ", ")})
+		return
+	}
+	dueDate, err := parseDueDate(req.DueDate)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Points != nil && *req.Points < 0 {
+		writeJSON(w, 400, map[string]string{"error": "points must not be negative"})
+		return
+	}
+	if err := validateEpic(req.EpicID); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.ParentID != nil {
+		var exists bool
+		db.QueryRow("SELECT EXISTS (SELECT 1 FROM tickets WHERE id=$1 AND account_id=$2)", *req.ParentID, cfg.AccountID).Scan(&exists)
+		if !exists {
+			writeJSON(w, 404, map[string]string{"error": fmt.Sprintf("parent ticket T-%d not found", *req.ParentID)})
+			return
+		}
+	}
 
 	var projectID int
-	err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&projectID)
+	err = db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&projectID)
 	if err != nil {
 		writeJSON(w, 404, map[string]string{"error": "project not found"})
 		return
 	}
 
+	labelIDs, err := labelIDsByName(projectID, req.Labels)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	custom, err := mergeCustomValues(db, projectID, nil, req.Custom, true)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	customJSON, _ := json.Marshal(custom)
+
+	// The ticket, its parent link, labels and subtasks are written
+	// together, so a failure part way leaves nothing behind.
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
 	var id int
-	err = db.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state,assignee) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id`,
-		cfg.AccountID, projectID, req.Title, req.Body, req.State, req.Assignee).Scan(&id)
+	err = tx.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state,assignee,epic_id,points,priority,due_date,custom)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id`,
+		cfg.AccountID, projectID, req.Title, req.Body, req.State, req.Assignee, req.EpicID, req.Points,
+		req.Priority, dueDate, string(customJSON)).Scan(&id)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
+	if req.ParentID != nil {
+		if status, msg := setParent(tx, id, req.ParentID); status != 0 {
+			writeJSON(w, status, map[string]string{"error": msg})
+			return
+		}
+	}
+	for _, labelID := range labelIDs {
+		if status, msg := addTicketLabel(tx, id, labelID); status != 0 {
+			writeJSON(w, status, map[string]string{"error": msg})
+			return
+		}
+	}
+	var subtasks []int
+	if tmpl != nil && len(tmpl.Subtasks) > 0 {
+		if subtasks, err = tmpl.createSubtasks(tx, id); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	autoWatch(id, "created", currentUser(r))
+	autoWatch(id, "assigned", req.Assignee)
+	notify("assigned", id, currentUser(r), "", req.Assignee)
+	recordMentions(id, "body", req.Body, currentUser(r))
+	if subtasks != nil {
+		publish(Event{Type: "ticket.created", TicketID: id, Related: subtasks, Actor: currentUser(r)})
+		writeJSON(w, 201, map[string]interface{}{"id": id, "subtasks": subtasks})
+		return
+	}
 
+	publish(Event{Type: "ticket.created", TicketID: id, Actor: currentUser(r)})
 	writeJSON(w, 201, map[string]int{"id": id})
 }
 
@@ -288,17 +697,36 @@ func handleMoveTicket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("UPDATE tickets SET state=$1, updated_at=now() WHERE id=$2 AND account_id=$3", newState, id, cfg.AccountID)
-	if err != nil {
+	ticketID, _ := strconv.Atoi(id)
+	if _, err := moveTicket(ticketID, newState, currentUser(r)); err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
-
 	writeJSON(w, 200, map[string]string{"state": newState})
 }
 
+// moveTicket puts a ticket into state and announces it. It reports false
+// when the ticket doesn't exist or already was in that state.
+func moveTicket(ticketID int, state, actor string) (bool, error) {
+	result, err := db.Exec("UPDATE tickets SET state=$1, state_changed_at=now(), updated_at=now() WHERE id=$2 AND account_id=$3 AND state<>$1",
+		state, ticketID, cfg.AccountID)
+	if err != nil {
+		return false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return false, nil
+	}
+	publish(Event{Type: "ticket.moved", TicketID: ticketID, Actor: actor})
+	notifyStateChange(ticketID, actor, state)
+	return true, nil
+}
+
 func handleAddBlock(w http.ResponseWriter, r *http.Request) {
-	blocker := r.PathValue("id")
+	blocker, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
 	var req struct {
 		BlockedID int `json:"blocked_id"`
 	}
@@ -307,41 +735,73 @@ func handleAddBlock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.Exec("INSERT INTO blocks (blocker_ticket_id,blocked_ticket_id,account_id) VALUES ($1,$2,$3) ON CONFLICT DO NOTHING",
-		blocker, req.BlockedID, cfg.AccountID)
-	if err != nil {
-		writeJSON(w, 500, map[string]string{"error": err.Error()})
+	// Re-adding an existing block has always been a no-op success here.
+	var exists bool
+	db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ticket_links WHERE link_type='blocks'
+		AND source_ticket_id=$1 AND target_ticket_id=$2 AND account_id=$3)`,
+		blocker, req.BlockedID, cfg.AccountID).Scan(&exists)
+	if exists {
+		writeJSON(w, 201, map[string]string{"status": "ok"})
+		return
+	}
+
+	if _, status, msg := saveLink("blocks", blocker, req.BlockedID, 0); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
 		return
 	}
 
+	publishLink("added", "blocks", blocker, req.BlockedID)
 	writeJSON(w, 201, map[string]string{"status": "ok"})
 }
 
 func handleDeleteBlock(w http.ResponseWriter, r *http.Request) {
 	blocker := r.PathValue("id")
 	blocked := r.PathValue("blocked_id")
-	_, err := db.Exec("DELETE FROM blocks WHERE blocker_ticket_id=$1 AND blocked_ticket_id=$2 AND account_id=$3",
+	result, err := db.Exec(`DELETE FROM ticket_links WHERE link_type='blocks'
+		AND source_ticket_id=$1 AND target_ticket_id=$2 AND account_id=$3`,
 		blocker, blocked, cfg.AccountID)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "dependency not found"})
+		return
+	}
+	source, _ := strconv.Atoi(blocker)
+	target, _ := strconv.Atoi(blocked)
+	publishLink("removed", "blocks", source, target)
 	writeJSON(w, 200, map[string]string{"status": "ok"})
 }
 
 func handleGetTicket(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	var t Ticket
-	err := db.QueryRow(`SELECT t.id, t.account_id, t.project_id, t.title, t.body, t.state, t.assignee, COALESCE(t.comments,''), t.created_at, t.updated_at, p.key
-		FROM tickets t JOIN projects p ON t.project_id=p.id 
-		WHERE t.id=$1 AND t.account_id=$2`, id, cfg.AccountID).Scan(
-		&t.ID, &t.AccountID, &t.ProjectID, &t.Title, &t.Body, &t.State, &t.Assignee, &t.Comments, &t.CreatedAt, &t.UpdatedAt, &t.ProjectKey)
+	t, err := scanTicket(db.QueryRow(ticketSelect+" WHERE t.id=$1 AND t.account_id=$2", id, cfg.AccountID))
 	if err != nil {
 		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
 		return
 	}
-	t.BlockedBy = queryBlockers(t.ID)
-	writeJSON(w, 200, t)
+	tickets := []Ticket{t}
+	if err := loadDependencies(tickets); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := loadLabels(tickets); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	keys := ticketRefKeys()
+	tickets[0].BodyHTML = renderMarkdown(t.Body, keys, true)
+	tickets[0].CommentsHTML = renderComments(t.Comments, keys)
+	if tickets[0].Watchers, err = ticketWatchers(t.ID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if tickets[0].Attachments, err = loadAttachments(t.ID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, tickets[0])
 }
 
 func handleUpdateTicket(w http.ResponseWriter, r *http.Request) {
@@ -351,20 +811,136 @@ func handleUpdateTicket(w http.ResponseWriter, r *http.Request) {
 		Body     string `json:"body"`
 		Assignee string `json:"assignee"`
 		State    string `json:"state"`
+		// The hierarchy fields are only touched when present, so older
+		// clients that PATCH the four fields above don't clear them.
+		EpicID   json.RawMessage `json:"epic_id"`
+		Points   json.RawMessage `json:"points"`
+		ParentID json.RawMessage `json:"parent_id"`
+		Priority json.RawMessage `json:"priority"`
+		DueDate  json.RawMessage `json:"due_date"`
+		// Custom only changes the keys it names; null removes a value.
+		Custom map[string]interface{} `json:"custom"`
+		// ExpectedUpdatedAt is the updated_at the client loaded; if the
+		// ticket has been saved since, the update fails with 409.
+		ExpectedUpdatedAt *time.Time `json:"expected_updated_at"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, 400, map[string]string{"error": "invalid json"})
 		return
 	}
+	ticketID, err := strconv.Atoi(id)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	setEpic, epicID, err1 := optionalInt(req.EpicID)
+	setPoints, points, err2 := optionalInt(req.Points)
+	setParentID, parentID, err3 := optionalInt(req.ParentID)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writeJSON(w, 400, map[string]string{"error": "epic_id, points and parent_id must be integers or null"})
+		return
+	}
+	setPriority, priority, err1 := optionalString(req.Priority)
+	setDue, due, err2 := optionalString(req.DueDate)
+	if err1 != nil || err2 != nil {
+		writeJSON(w, 400, map[string]string{"error": "priority and due_date must be strings or null"})
+		return
+	}
+	if setPriority && !isPriority(priority) {
+		writeJSON(w, 400, map[string]string{"error": "priority must be one of " + strings.Join(priorities, ", ")})
+		return
+	}
+	dueDate, err := parseDueDate(due)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if points != nil && *points < 0 {
+		writeJSON(w, 400, map[string]string{"error": "points must not be negative"})
+		return
+	}
+	if err := validateEpic(epicID); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the ticket so the old assignee and state (for notifications)
+	// and the custom values merged below are the ones being replaced.
+	var projectID int
+	var current []byte
+	var oldAssignee, oldState string
+	var updatedAt time.Time
+	err = tx.QueryRow(`SELECT project_id, custom, COALESCE(assignee,''), state, updated_at FROM tickets
+		WHERE id=$1 AND account_id=$2 FOR UPDATE`, ticketID, cfg.AccountID).Scan(&projectID, &current, &oldAssignee, &oldState, &updatedAt)
+	if err == sql.ErrNoRows {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.ExpectedUpdatedAt != nil && !updatedAt.Equal(*req.ExpectedUpdatedAt) {
+		writeJSON(w, 409, map[string]string{
+			"error":      "the ticket was changed by someone else since you opened it",
+			"updated_at": updatedAt.Format(time.RFC3339Nano),
+		})
+		return
+	}
+	var customJSON *string // nil leaves the stored values alone
+	if req.Custom != nil {
+		var existing map[string]interface{}
+		json.Unmarshal(current, &existing)
+		custom, err := mergeCustomValues(tx, projectID, existing, req.Custom, true)
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		b, _ := json.Marshal(custom)
+		s := string(b)
+		customJSON = &s
+	}
 
-	_, err := db.Exec(`UPDATE tickets SET title=$1, body=$2, assignee=$3, state=$4, updated_at=now() 
+	_, err = tx.Exec(`UPDATE tickets SET title=$1, body=$2, assignee=$3, state=$4,
+			state_changed_at=CASE WHEN state <> $4 THEN now() ELSE state_changed_at END,
+			epic_id=CASE WHEN $7 THEN $8 ELSE epic_id END,
+			points=CASE WHEN $9 THEN $10 ELSE points END,
+			priority=CASE WHEN $11 THEN $12 ELSE priority END,
+			due_date=CASE WHEN $13 THEN $14::date ELSE due_date END,
+			custom=COALESCE($15::jsonb, custom),
+			updated_at=now()
 		WHERE id=$5 AND account_id=$6`,
-		req.Title, req.Body, req.Assignee, req.State, id, cfg.AccountID)
+		req.Title, req.Body, req.Assignee, req.State, id, cfg.AccountID, setEpic, epicID, setPoints, points,
+		setPriority, priority, setDue, dueDate, customJSON)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
+	if setParentID {
+		if status, msg := setParent(tx, ticketID, parentID); status != 0 {
+			writeJSON(w, status, map[string]string{"error": msg})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
 
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	recordMentions(ticketID, "body", req.Body, currentUser(r))
+	if req.Assignee != oldAssignee {
+		autoWatch(ticketID, "assigned", req.Assignee)
+		notify("assigned", ticketID, currentUser(r), "", req.Assignee)
+	}
+	if req.State != oldState {
+		notifyStateChange(ticketID, currentUser(r), req.State)
+	}
 	writeJSON(w, 200, map[string]string{"status": "updated"})
 }
 
@@ -378,23 +954,15 @@ func handleAddComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get existing comments
-	var existing string
-	db.QueryRow("SELECT COALESCE(comments,'') FROM tickets WHERE id=$1 AND account_id=$2", id, cfg.AccountID).Scan(&existing)
-
-	// Append new comment with timestamp
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	newComment := fmt.Sprintf("[%s] %s", timestamp, req.Comment)
-
-	var updated string
-	if existing == "" {
-		updated = newComment
-	} else {
-		updated = existing + "\n" + newComment
-	}
-
-	_, err := db.Exec("UPDATE tickets SET comments=$1, updated_at=now() WHERE id=$2 AND account_id=$3", updated, id, cfg.AccountID)
+	ticketID, err := strconv.Atoi(id)
 	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if err := addComment(ticketID, req.Comment, currentUser(r)); err == errTicketNotFound {
+		writeJSON(w, 404, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
@@ -402,6 +970,29 @@ func handleAddComment(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, 201, map[string]string{"status": "comment added"})
 }
 
+var errTicketNotFound = errors.New("ticket not found")
+
+// addComment appends a timestamped comment to a ticket and announces it,
+// or returns errTicketNotFound. The append happens in the UPDATE itself, so comments posted at the
+// same time from the UI, git and email don't overwrite each other.
+func addComment(ticketID int, comment, actor string) error {
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	newComment := fmt.Sprintf("[%s] %s", timestamp, comment)
+
+	err := db.QueryRow(`UPDATE tickets SET comments = CASE WHEN comments IS NULL OR comments = '' THEN $1
+			ELSE comments || E'\n' || $1 END, updated_at=now()
+		WHERE id=$2 AND account_id=$3 RETURNING id`, newComment, ticketID, cfg.AccountID).Scan(&ticketID)
+	if err == sql.ErrNoRows {
+		return errTicketNotFound
+	} else if err != nil {
+		return err
+	}
+	publish(Event{Type: "comment.added", TicketID: ticketID, Actor: actor})
+	autoWatch(ticketID, "commented", actor)
+	notifyComment(ticketID, comment, actor)
+	return nil
+}
+
 func handleGetSettings(w http.ResponseWriter, r *http.Request) {
 	settings := map[string]interface{}{
 		"sprint_length_days": cfg.SprintLength,
@@ -441,14 +1032,33 @@ func handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleExport(w http.ResponseWriter, r *http.Request) {
-	projects, _ := queryProjects()
-	tickets := queryTickets("ALL", "all")
+	projects, _ := queryProjects(listOptions{})
+	epics, _ := queryEpics(listOptions{})
+	labels, _ := queryLabels("", listOptions{})
+	fields, _ := queryCustomFields(db, "f.account_id=$1", cfg.AccountID)
+	tickets, err := queryTickets("ALL", "all", nil, listOptions{})
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	links, err := queryExportLinks()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
 
+	// Tickets carry epic_id and custom values, and links every
+	// ticket_links row, so the hierarchy round-trips through POST
+	// /api/import.
 	export := map[string]interface{}{
-		"exported_at": time.Now().Format(time.RFC3339),
-		"account_id":  cfg.AccountID,
-		"projects":    projects,
-		"tickets":     tickets,
+		"exported_at":   time.Now().Format(time.RFC3339),
+		"account_id":    cfg.AccountID,
+		"projects":      projects,
+		"epics":         epics,
+		"labels":        labels,
+		"custom_fields": fields,
+		"tickets":       tickets,
+		"links":         links,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -456,16 +1066,315 @@ func handleExport(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(export)
 }
 
-func initSchema() {
+// migrations bring an existing database up to date with schema.sql.
+// Every statement must be idempotent; they run in order on each start.
+var migrations = []string{
 	// Add comments column if it doesn't exist
-	_, err := db.Exec(`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS comments TEXT DEFAULT ''`)
-	if err != nil {
-		log.Printf("schema migration warning: %v", err)
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS comments TEXT DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS saved_filters (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		owner TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		shared BOOLEAN NOT NULL DEFAULT false,
+		query TEXT NOT NULL DEFAULT '',
+		sort TEXT NOT NULL DEFAULT '',
+		columns TEXT NOT NULL DEFAULT 'backlog,todo,in_progress,done',
+		created_at TIMESTAMP DEFAULT now(),
+		updated_at TIMESTAMP DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_saved_filters_account ON saved_filters(account_id)`,
+	`CREATE TABLE IF NOT EXISTS ticket_links (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		link_type TEXT NOT NULL,
+		source_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		target_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT now(),
+		UNIQUE (link_type, source_ticket_id, target_ticket_id),
+		CHECK (source_ticket_id != target_ticket_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_ticket_links_account ON ticket_links(account_id, link_type)`,
+	`CREATE INDEX IF NOT EXISTS idx_ticket_links_target ON ticket_links(target_ticket_id)`,
+	// Move the old blocks table into ticket_links and leave a view behind
+	// so existing reads keep working.
+	`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name='blocks' AND table_type='BASE TABLE') THEN
+			INSERT INTO ticket_links (account_id, link_type, source_ticket_id, target_ticket_id)
+			SELECT account_id, 'blocks', blocker_ticket_id, blocked_ticket_id FROM blocks
+			ON CONFLICT DO NOTHING;
+			DROP TABLE blocks;
+		END IF;
+	END $$`,
+	`CREATE OR REPLACE VIEW blocks AS
+		SELECT source_ticket_id AS blocker_ticket_id, target_ticket_id AS blocked_ticket_id, account_id
+		FROM ticket_links WHERE link_type='blocks'`,
+	`CREATE TABLE IF NOT EXISTS epics (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER REFERENCES projects(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_epics_account ON epics(account_id)`,
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS epic_id INTEGER REFERENCES epics(id) ON DELETE SET NULL`,
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS points INTEGER CHECK (points >= 0)`,
+	`CREATE INDEX IF NOT EXISTS idx_tickets_epic ON tickets(epic_id)`,
+	`CREATE TABLE IF NOT EXISTS labels (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER REFERENCES projects(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		color TEXT NOT NULL DEFAULT '#8b6f64',
+		created_at TIMESTAMP DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_labels_name ON labels(account_id, COALESCE(project_id, 0), lower(name))`,
+	`CREATE TABLE IF NOT EXISTS ticket_labels (
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		label_id INTEGER NOT NULL REFERENCES labels(id) ON DELETE CASCADE,
+		PRIMARY KEY (ticket_id, label_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_ticket_labels_label ON ticket_labels(label_id)`,
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'medium'
+		CHECK (priority IN ('low','medium','high','urgent'))`,
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS due_date DATE`,
+	// Existing tickets count as having entered their state at their last update.
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS state_changed_at TIMESTAMP`,
+	`UPDATE tickets SET state_changed_at=COALESCE(updated_at, now()) WHERE state_changed_at IS NULL`,
+	`ALTER TABLE tickets ALTER COLUMN state_changed_at SET DEFAULT now()`,
+	`CREATE TABLE IF NOT EXISTS sla_rules (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+		priority TEXT NOT NULL,
+		state TEXT NOT NULL,
+		max_hours INTEGER NOT NULL CHECK (max_hours > 0),
+		created_at TIMESTAMP DEFAULT now(),
+		UNIQUE (project_id, priority, state)
+	)`,
+	`CREATE TABLE IF NOT EXISTS sla_breaches (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		rule_id INTEGER NOT NULL REFERENCES sla_rules(id) ON DELETE CASCADE,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		entered_at TIMESTAMP NOT NULL,
+		breached_at TIMESTAMP NOT NULL DEFAULT now(),
+		resolved_at TIMESTAMP,
+		UNIQUE (rule_id, ticket_id, entered_at)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_sla_breaches_open ON sla_breaches(ticket_id) WHERE resolved_at IS NULL`,
+	`CREATE TABLE IF NOT EXISTS custom_fields (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL CHECK (type IN ('text','number','select','date','user')),
+		options TEXT[] NOT NULL DEFAULT '{}',
+		required BOOLEAN NOT NULL DEFAULT false,
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT now(),
+		UNIQUE (project_id, key)
+	)`,
+	`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS custom JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS ticket_templates (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		title_prefix TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		assignee TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT '',
+		labels TEXT[] NOT NULL DEFAULT '{}',
+		subtasks TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP DEFAULT now(),
+		UNIQUE (project_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recurring_tickets (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		assignee TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT 'todo',
+		priority TEXT NOT NULL DEFAULT 'medium',
+		labels TEXT[] NOT NULL DEFAULT '{}',
+		schedule TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		next_run TIMESTAMP NOT NULL,
+		last_run TIMESTAMP,
+		last_ticket_id INTEGER REFERENCES tickets(id) ON DELETE SET NULL,
+		created_at TIMESTAMP DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_recurring_due ON recurring_tickets(next_run) WHERE enabled`,
+	`CREATE TABLE IF NOT EXISTS ticket_presence (
+		session_id TEXT PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		editing BOOLEAN NOT NULL DEFAULT false,
+		seen_at TIMESTAMP NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_ticket_presence_account ON ticket_presence(account_id, ticket_id)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL DEFAULT '{}',
+		active BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMP NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT now(),
+		last_status_code INTEGER,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_response TEXT NOT NULL DEFAULT '',
+		last_duration_ms INTEGER,
+		created_at TIMESTAMP NOT NULL DEFAULT now(),
+		delivered_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhooks_account ON webhooks(account_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status='pending'`,
+	`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id)`,
+	`CREATE TABLE IF NOT EXISTS notification_prefs (
+		account_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		assigned BOOLEAN NOT NULL DEFAULT true,
+		mentioned BOOLEAN NOT NULL DEFAULT true,
+		state_changed BOOLEAN NOT NULL DEFAULT true,
+		commented BOOLEAN NOT NULL DEFAULT true,
+		due_soon BOOLEAN NOT NULL DEFAULT true,
+		digest TEXT NOT NULL DEFAULT 'off',
+		PRIMARY KEY (account_id, username)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		actor TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT '',
+		digest_pending BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMP NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(account_id, username, id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_due ON notifications(ticket_id, username, detail) WHERE kind='due_soon'`,
+	`CREATE TABLE IF NOT EXISTS email_outbox (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		to_addr TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		text_body TEXT NOT NULL,
+		html_body TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT now(),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT now(),
+		sent_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(next_attempt_at) WHERE status='pending'`,
+	`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS read_at TIMESTAMP`,
+	`CREATE TABLE IF NOT EXISTS mentions (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		username TEXT NOT NULL,
+		source TEXT NOT NULL,
+		actor TEXT NOT NULL DEFAULT '',
+		excerpt TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT now(),
+		read_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(account_id, username, id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_mentions_body ON mentions(ticket_id, username) WHERE source='body'`,
+	`CREATE TABLE IF NOT EXISTS ticket_watchers (
+		account_id TEXT NOT NULL,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		username TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT 'manual',
+		watching BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMP NOT NULL DEFAULT now(),
+		PRIMARY KEY (ticket_id, username)
+	)`,
+	// Before watchers, assignees and people mentioned in the description
+	// were told about changes; they start out watching.
+	`INSERT INTO ticket_watchers (account_id, ticket_id, username, reason)
+		SELECT account_id, id, assignee, 'assigned' FROM tickets WHERE assignee <> ''
+		UNION SELECT account_id, ticket_id, username, 'mentioned' FROM mentions WHERE source='body'
+		ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS inbound_messages (
+		account_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE, -- NULL while being filed
+		sender TEXT NOT NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT now(),
+		PRIMARY KEY (account_id, message_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id SERIAL PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		storage_key TEXT NOT NULL,
+		thumb_key TEXT NOT NULL DEFAULT '',
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attachments_ticket ON attachments(ticket_id)`,
+	`CREATE TABLE IF NOT EXISTS attachment_deletions (
+		id SERIAL PRIMARY KEY,
+		storage_key TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT now()
+	)`,
+	// However an attachment row goes (its own DELETE, or a ticket or
+	// project cascading), its files are queued for the cleanup worker.
+	`CREATE OR REPLACE FUNCTION queue_attachment_deletion() RETURNS trigger AS $$
+	BEGIN
+		INSERT INTO attachment_deletions (storage_key) VALUES (OLD.storage_key);
+		IF OLD.thumb_key <> '' THEN
+			INSERT INTO attachment_deletions (storage_key) VALUES (OLD.thumb_key);
+		END IF;
+		RETURN OLD;
+	END $$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS attachments_cleanup ON attachments`,
+	`CREATE TRIGGER attachments_cleanup AFTER DELETE ON attachments
+		FOR EACH ROW EXECUTE FUNCTION queue_attachment_deletion()`,
+}
+
+func initSchema() {
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Printf("schema migration warning: %v", err)
+		}
 	}
 }
 
-func queryProjects() ([]Project, error) {
-	rows, err := db.Query("SELECT id,account_id,key,name,created_at FROM projects WHERE account_id=$1 ORDER BY created_at", cfg.AccountID)
+func queryProjects(opts listOptions) ([]Project, error) {
+	query := "SELECT id,account_id,key,name,created_at FROM projects WHERE account_id=$1"
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID}}
+	where, tail := pageSQL(opts, b, projectSortColumns, "created", "id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -480,14 +1389,15 @@ func queryProjects() ([]Project, error) {
 	return projects, nil
 }
 
-func queryTickets(projectFilter, sprint string) []Ticket {
-	query := `SELECT t.id, t.account_id, t.project_id, t.title, t.body, t.state, t.assignee, COALESCE(t.comments,''), t.created_at, t.updated_at, p.key
-		FROM tickets t JOIN projects p ON t.project_id=p.id WHERE t.account_id=$1`
-	args := []interface{}{cfg.AccountID}
+// queryTickets lists tickets for the account. filter is an optional
+// parsed query-language expression (see query.go) ANDed onto the
+// project/sprint conditions; opts controls sort order and paging.
+func queryTickets(projectFilter, sprint string, filter queryNode, opts listOptions) ([]Ticket, error) {
+	query := ticketSelect + " WHERE t.account_id=$1"
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID}}
 
 	if projectFilter != "" && projectFilter != "ALL" {
-		query += " AND p.key=$2"
-		args = append(args, projectFilter)
+		query += " AND p.key=" + b.arg(projectFilter)
 	}
 
 	if sprint == "current" {
@@ -495,43 +1405,150 @@ func queryTickets(projectFilter, sprint string) []Ticket {
 		query += fmt.Sprintf(" AND t.created_at >= '%s' AND t.created_at < '%s'", start.Format("2006-01-02"), end.Format("2006-01-02"))
 	}
 
-	query += " ORDER BY t.created_at"
+	if filter != nil {
+		query += " AND " + filter.sql(b)
+	}
+
+	where, tail := pageSQL(opts, b, ticketSortColumns, "created", "t.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	query += tail
 
-	rows, err := db.Query(query, args...)
+	start := time.Now()
+	rows, err := db.Query(query, b.args...)
 	if err != nil {
-		log.Printf("query tickets: %v", err)
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 
 	var tickets []Ticket
 	for rows.Next() {
-		var t Ticket
-		rows.Scan(&t.ID, &t.AccountID, &t.ProjectID, &t.Title, &t.Body, &t.State, &t.Assignee, &t.Comments, &t.CreatedAt, &t.UpdatedAt, &t.ProjectKey)
-		t.BlockedBy = queryBlockers(t.ID)
+		t, err := scanTicket(rows)
+		if err != nil {
+			return nil, err
+		}
 		tickets = append(tickets, t)
 	}
-	return tickets
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	opts.stats.add("tickets", start, 1)
+	if len(tickets) == 0 {
+		return tickets, nil
+	}
+
+	start = time.Now()
+	if err := loadDependencies(tickets); err != nil {
+		return nil, err
+	}
+	opts.stats.add("deps", start, 1)
+
+	start = time.Now()
+	if err := loadLabels(tickets); err != nil {
+		return nil, err
+	}
+	opts.stats.add("labels", start, 1)
+	return tickets, nil
 }
 
-func queryBlockers(ticketID int) []string {
-	rows, err := db.Query(`SELECT t.id, p.key FROM blocks b 
-		JOIN tickets t ON b.blocker_ticket_id=t.id 
-		JOIN projects p ON t.project_id=p.id
-		WHERE b.blocked_ticket_id=$1 AND b.account_id=$2`, ticketID, cfg.AccountID)
-	if err != nil {
+// loadDependencies fills BlockedBy/Blocks and the parent/subtask fields
+// for every ticket with a single query over ticket_links, joined back to
+// the slice in Go.
+func loadDependencies(tickets []Ticket) error {
+	if len(tickets) == 0 {
 		return nil
 	}
+	index := make(map[int]int, len(tickets))
+	ids := make([]int64, len(tickets))
+	for i, t := range tickets {
+		index[t.ID] = i
+		ids[i] = int64(t.ID)
+	}
+
+	rows, err := db.Query(`SELECT l.link_type, l.source_ticket_id, sp.key, l.target_ticket_id, tp.key, tt.state, COALESCE(tt.points,0)
+		FROM ticket_links l
+		JOIN tickets st ON st.id=l.source_ticket_id JOIN projects sp ON sp.id=st.project_id
+		JOIN tickets tt ON tt.id=l.target_ticket_id JOIN projects tp ON tp.id=tt.project_id
+		WHERE l.account_id=$1 AND l.link_type IN ('blocks','parent')
+			AND (l.target_ticket_id = ANY($2) OR l.source_ticket_id = ANY($2))
+		ORDER BY l.source_ticket_id, l.target_ticket_id`, cfg.AccountID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var blockers []string
 	for rows.Next() {
-		var id int
-		var key string
-		rows.Scan(&id, &key)
-		blockers = append(blockers, fmt.Sprintf("T-%d (%s)", id, key))
+		var typ, sourceKey, targetKey, targetState string
+		var source, target, targetPoints int
+		if err := rows.Scan(&typ, &source, &sourceKey, &target, &targetKey, &targetState, &targetPoints); err != nil {
+			return err
+		}
+		if typ == "parent" {
+			if i, ok := index[target]; ok {
+				parent := source
+				tickets[i].ParentID = &parent
+			}
+			if i, ok := index[source]; ok {
+				t := &tickets[i]
+				t.Subtasks = append(t.Subtasks, target)
+				if t.Progress == nil {
+					t.Progress = &Progress{}
+				}
+				t.Progress.Total++
+				t.Progress.Points += targetPoints
+				if targetState == "done" {
+					t.Progress.Done++
+					t.Progress.PointsDone += targetPoints
+				}
+			}
+			continue
+		}
+		if i, ok := index[target]; ok {
+			tickets[i].BlockedBy = append(tickets[i].BlockedBy, fmt.Sprintf("T-%d (%s)", source, sourceKey))
+		}
+		if i, ok := index[source]; ok {
+			tickets[i].Blocks = append(tickets[i].Blocks, fmt.Sprintf("T-%d (%s)", target, targetKey))
+		}
+	}
+	for i := range tickets {
+		if tickets[i].Progress != nil {
+			tickets[i].Progress.compute()
+		}
+	}
+	return rows.Err()
+}
+
+// queryStats collects the timings of the queries that load a request's
+// tickets (queryTickets: tickets, dependencies, labels) and reports them
+// as a Server-Timing header, visible in the browser's network panel,
+// along with how many of those queries ran as X-Ticket-Query-Count. The
+// handler's other queries (projects, filters, fields, ...) are a fixed
+// few per request and not counted; these are the ones that would grow
+// with the board.
+type queryStats struct {
+	parts   []string
+	queries int
+}
+
+// add records the time since start under name, spent running the given
+// number of queries. A nil receiver is a no-op so callers that don't care
+// can leave listOptions.stats unset.
+func (s *queryStats) add(name string, start time.Time, queries int) {
+	if s == nil {
+		return
+	}
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	s.parts = append(s.parts, fmt.Sprintf("%s;dur=%.2f", name, ms))
+	s.queries += queries
+}
+
+func (s *queryStats) writeHeaders(w http.ResponseWriter) {
+	if s == nil || len(s.parts) == 0 {
+		return
 	}
-	return blockers
+	w.Header().Set("Server-Timing", strings.Join(s.parts, ", "))
+	w.Header().Set("X-Ticket-Query-Count", strconv.Itoa(s.queries))
 }
 
 func adjacentState(current, direction string) string {
@@ -571,6 +1588,21 @@ func getEnvInt(key string, def int) int {
 	return def
 }
 
+// currentUser identifies the caller. Pippin has no login; the username
+// comes from the X-Pippin-User header (API clients) or the pippin_user
+// cookie set from the settings modal (browser).
+func currentUser(r *http.Request) string {
+	if u := strings.TrimSpace(r.Header.Get("X-Pippin-User")); u != "" {
+		return u
+	}
+	if c, err := r.Cookie("pippin_user"); err == nil {
+		if u, err := url.QueryUnescape(c.Value); err == nil {
+			return strings.TrimSpace(u)
+		}
+	}
+	return ""
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -617,7 +1649,22 @@ button:hover,.btn:hover{opacity:0.8}
 .btn-danger{background:#ff6b6b;color:#fff;font-size:11px;padding:3px 8px}
 .btn-danger:hover{background:#ff5252}
 .badge{background:#ff6b6b;color:#fff;padding:2px 6px;border-radius:4px;font-size:11px;margin-right:4px}
-#backlog-col.collapsed .card{display:none}
+.badge-blocks{background:var(--muted)}
+.badge-epic{background:#7c6fd6}
+.badge-points{background:var(--panel);color:var(--ink);border:1px solid var(--border)}
+.badge-due{background:var(--panel);color:var(--muted);border:1px solid var(--border)}
+.badge-overdue{background:#ff6b6b;color:#fff;border-color:#ff6b6b}
+.priority{margin-right:4px;font-size:12px}
+.priority-urgent,.priority-high{color:#ff6b6b}
+.card.overdue{border-left:3px solid #ff6b6b}
+.chip{display:inline-block;color:#fff;padding:1px 8px;border-radius:999px;font-size:11px;margin:2px 4px 2px 0;text-shadow:0 1px 1px rgba(0,0,0,0.25)}
+.chip button{background:none;border:none;color:#fff;padding:0 0 0 4px;margin:0;font-size:11px}
+.progress{height:4px;margin:6px 0 2px;border-radius:2px;background:var(--border);overflow:hidden}
+.progress div{height:100%;background:#51cf66}
+.col[data-state="backlog"].collapsed .card{display:none}
+.lane-header{padding:10px 16px 0;font-weight:600;color:var(--muted);cursor:pointer;user-select:none}
+.lane.collapsed .board{display:none}
+.lane.collapsed .lane-caret{display:inline-block;transform:rotate(-90deg)}
 select{padding:4px 8px;border:1px solid var(--border);background:var(--card);color:var(--ink);border-radius:4px}
 .modal{display:none;position:fixed;top:0;left:0;right:0;bottom:0;background:rgba(0,0,0,0.5);z-index:1000;align-items:center;justify-content:center}
 .modal.show{display:flex}
@@ -635,112 +1682,151 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
 .search-box .clear-search{position:absolute;right:8px;top:50%;transform:translateY(-50%);background:none;border:none;color:var(--muted);cursor:pointer;padding:0;font-size:16px;display:none}
 .search-box input:not(:placeholder-shown) + .clear-search{display:block}
 .card.search-hidden{display:none!important}
+.query-box{flex:1;max-width:380px}
+.query-box input{width:100%;padding:6px 10px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink);font:12px ui-monospace,monospace;box-sizing:border-box}
+.query-error{margin:12px 12px 0;padding:8px 12px;border:1px solid #ff6b6b;border-radius:8px;background:#ffe5e5;color:#8a1f1f;font-size:12px}
 .ticket-title{cursor:pointer;text-decoration:underline;text-decoration-style:dotted}
 .ticket-title:hover{text-decoration-style:solid;color:var(--accent)}
 .comments-list{background:var(--bg);border:1px solid var(--border);border-radius:8px;padding:12px;max-height:200px;overflow-y:auto;margin-bottom:12px;font-size:12px;white-space:pre-wrap}
 .comment-item{margin-bottom:8px;padding-bottom:8px;border-bottom:1px solid var(--border)}
 .comment-item:last-child{border-bottom:none;margin-bottom:0;padding-bottom:0}
 .comment-timestamp{color:var(--muted);font-size:11px;font-weight:600}
+.comments-list .markdown{white-space:normal}
+.markdown{font-size:13px;line-height:1.5;overflow-wrap:anywhere}
+.markdown p,.markdown ul,.markdown ol,.markdown pre,.markdown blockquote{margin:0 0 8px 0}
+.markdown>:last-child{margin-bottom:0}
+.markdown h1,.markdown h2,.markdown h3,.markdown h4,.markdown h5,.markdown h6{font-size:14px;margin:8px 0 4px 0}
+.markdown h1{font-size:17px}.markdown h2{font-size:15px}
+.markdown ul,.markdown ol{padding-left:20px}
+.markdown li.task{list-style:none;margin-left:-18px}
+.markdown code{background:var(--panel);border-radius:4px;padding:1px 4px;font-size:12px}
+.markdown pre{background:var(--panel);border:1px solid var(--border);border-radius:8px;padding:8px;overflow-x:auto}
+.markdown pre code{background:none;padding:0}
+.markdown blockquote{border-left:3px solid var(--border);padding-left:8px;color:var(--muted)}
+.markdown img{max-width:100%}
+.markdown hr{border:none;border-top:1px solid var(--border)}
+.tok-kw{color:#a0522d;font-weight:600}
+.tok-str{color:#2e7d32}
+.tok-com{color:var(--muted);font-style:italic}
+.tok-num{color:#1565c0}
+a.ticket-ref{font-weight:600}
 .ticket-meta{background:var(--panel);border:1px solid var(--border);border-radius:8px;padding:12px;margin-bottom:12px;font-size:12px}
 .ticket-meta-item{display:flex;justify-content:space-between;margin-bottom:6px}
 .ticket-meta-item:last-child{margin-bottom:0}
 .ticket-meta-label{color:var(--muted);font-weight:600}
+.link-item{display:flex;justify-content:space-between;align-items:center;font-size:12px;margin-bottom:4px}
+.dep-view{margin-top:8px;max-height:260px;overflow:auto;background:var(--bg);border:1px solid var(--border);border-radius:8px;padding:8px}
+.presence{display:flex;gap:2px;float:right}
+.avatar{display:inline-flex;align-items:center;justify-content:center;width:20px;height:20px;border-radius:50%;color:#fff;font-size:9px;font-weight:600;border:2px solid transparent}
+.avatar.editing{border-color:#ff6b6b}
+.notice{border-radius:8px;padding:8px 12px;margin-bottom:12px;font-size:12px;background:var(--panel);border:1px solid var(--border)}
+.notice-warn{background:#fff4e5;color:#8a5300;border-color:#ffcc80}
+.attachments{display:flex;flex-wrap:wrap;gap:8px}
+.attachment{width:120px;font-size:11px;background:var(--bg);border:1px solid var(--border);border-radius:8px;padding:6px;position:relative;word-break:break-all}
+.attachment img{display:block;width:100%;height:80px;object-fit:cover;border-radius:4px;margin-bottom:4px}
+.attachment .file-icon{display:flex;align-items:center;justify-content:center;height:80px;font-size:32px}
+.attachment .remove{position:absolute;top:2px;right:4px;cursor:pointer;color:var(--muted)}
+.dropdown-anchor{position:relative}
+.dropdown{position:absolute;right:0;top:100%;margin-top:6px;width:320px;max-height:400px;overflow:auto;background:var(--card);border:1px solid var(--border);border-radius:10px;box-shadow:0 4px 16px rgba(0,0,0,0.15);z-index:50;font-size:12px}
+.dropdown-head{display:flex;justify-content:space-between;align-items:center;padding:8px 10px;border-bottom:1px solid var(--border)}
+.dropdown-item{padding:8px 10px;border-bottom:1px solid var(--border);cursor:pointer}
+.dropdown-item:hover{background:var(--panel)}
+.dropdown-item.unread{border-left:3px solid var(--accent)}
+.count-badge{background:#ff6b6b;color:#fff;border-radius:999px;padding:0 6px;font-size:10px}
+.suggest{border:1px solid var(--border);border-radius:8px;background:var(--card);margin-top:2px;font-size:12px}
+.suggest div{padding:4px 8px;cursor:pointer}
+.suggest div.active{background:var(--accent)}
 </style>
 </head>
 <body>
 <header>
   <h1 style="margin:0;font-size:18px">🍎 Pippin</h1>
-  <select id="project-filter" onchange="location.href='?sprint={{.Sprint}}&project='+this.value">
+  <select id="project-filter" onchange="setBoardParam('project', this.value)">
     <option value="ALL" {{if eq .Project "ALL"}}selected{{end}}>All Projects</option>
     {{range .Projects}}<option value="{{.Key}}" {{if eq $.Project .Key}}selected{{end}}>{{.Key}}</option>{{end}}
   </select>
+  <select id="view-filter" onchange="selectView(this.value)" title="Saved views">
+    <option value="">All tickets</option>
+    {{range .Filters}}<option value="{{.ID}}" {{if eq (print .ID) $.FilterID}}selected{{end}}>{{if .Shared}}👥{{else}}🔒{{end}} {{.Name}}</option>{{end}}
+  </select>
+  <button class="btn btn-subtle" onclick="showSaveViewModal()" title="Save current query as a view">💾</button>
+  <select id="epic-filter" onchange="setBoardParam('epic', this.value)" title="Epic">
+    <option value="">All epics</option>
+    {{range .Epics}}<option value="{{.ID}}" {{if eq (print .ID) $.Epic}}selected{{end}}>◆ {{.Name}} ({{.Progress.Percent}}%)</option>{{end}}
+    <option value="none" {{if eq .Epic "none"}}selected{{end}}>No epic</option>
+  </select>
+  <select id="label-filter" onchange="setBoardParam('label', this.value)" title="Label">
+    <option value="">All labels</option>
+    {{range .Labels}}<option value="{{.Name}}" {{if eq .Name $.Label}}selected{{end}}>🏷 {{.Name}}</option>{{end}}
+  </select>
+  <select id="lane-filter" onchange="setBoardParam('lanes', this.value)" title="Swimlanes">
+    <option value="">No lanes</option>
+    <option value="assignee" {{if eq .LaneBy "assignee"}}selected{{end}}>Lanes: assignee</option>
+    {{if eq .Project "ALL"}}<option value="project" {{if eq .LaneBy "project"}}selected{{end}}>Lanes: project</option>{{end}}
+    <option value="epic" {{if eq .LaneBy "epic"}}selected{{end}}>Lanes: epic</option>
+    <option value="label" {{if eq .LaneBy "label"}}selected{{end}}>Lanes: label</option>
+    <option value="priority" {{if eq .LaneBy "priority"}}selected{{end}}>Lanes: priority</option>
+  </select>
   <button class="btn btn-hero" onclick="showAddTicketModal()">+ Add Ticket</button>
   {{if lt (len .Projects) 3}}
   <button class="btn btn-subtle" onclick="showAddProjectModal()">+ Add Project</button>
   {{end}}
   {{if eq .Sprint "current"}}
-  <a href="?sprint=all&project={{.Project}}" class="btn">Show All Tickets</a>
+  <a href="?sprint=all&project={{.Project}}&filter={{.FilterID}}&q={{.Query}}&epic={{.Epic}}&label={{.Label}}&lanes={{.LaneBy}}" class="btn">Show All Tickets</a>
   {{else}}
-  <a href="?sprint=current&project={{.Project}}" class="btn">Current Sprint</a>
+  <a href="?sprint=current&project={{.Project}}&filter={{.FilterID}}&q={{.Query}}&epic={{.Epic}}&label={{.Label}}&lanes={{.LaneBy}}" class="btn">Current Sprint</a>
   {{end}}
   {{if and (ge (len .Projects) 3) (ne .Project "ALL")}}
   <button class="btn btn-danger" onclick="confirmDeleteProject('{{.Project}}')">🗑️ Delete Project</button>
   {{end}}
+  <form class="query-box" method="get" action="/board">
+    <input type="hidden" name="sprint" value="{{.Sprint}}">
+    <input type="hidden" name="project" value="{{.Project}}">
+    <input type="hidden" name="filter" value="{{.FilterID}}">
+    <input type="hidden" name="epic" value="{{.Epic}}">
+    <input type="hidden" name="label" value="{{.Label}}">
+    <input type="hidden" name="lanes" value="{{.LaneBy}}">
+    <input type="text" name="q" id="query-input" value="{{.Query}}" placeholder="state IN (todo, in_progress) AND assignee = jane" autocomplete="off" title="Filter query (press Enter)">
+  </form>
   <div class="search-box">
     <input type="text" id="search-input" placeholder="🔍 Search tickets..." autocomplete="off">
     <button class="clear-search" onclick="clearSearch()">✕</button>
   </div>
+  <div class="dropdown-anchor">
+    <button class="btn btn-subtle" onclick="toggleNotifications()" title="Notifications">🔔 <span id="notifications-badge" class="count-badge hidden"></span></button>
+    <div id="notifications-panel" class="dropdown hidden">
+      <div class="dropdown-head"><strong>Notifications</strong><button class="btn-subtle" onclick="readAllNotifications()">Mark all read</button></div>
+      <div id="notifications-list"></div>
+    </div>
+  </div>
+  <div class="dropdown-anchor">
+    <button class="btn btn-subtle" onclick="toggleMentions()" title="Mentions">@ <span id="mentions-badge" class="count-badge hidden"></span></button>
+    <div id="mentions-panel" class="dropdown hidden">
+      <div class="dropdown-head"><strong>Mentions</strong><button class="btn-subtle" onclick="readAllMentions()">Mark all read</button></div>
+      <div id="mentions-list"></div>
+    </div>
+  </div>
   <button class="btn btn-subtle" onclick="showSettingsModal()" title="Settings">⚙️</button>
 </header>
-<div class="board">
-  <div class="col" data-state="backlog" id="backlog-col">
+{{if .QueryError}}<div class="query-error">⚠️ {{.QueryError}}</div>{{end}}
+{{range .Lanes}}
+<section class="lane" data-lane="{{.Key}}">
+{{if $.LaneBy}}<div class="lane-header" onclick="toggleLane(this.parentElement)"><span class="lane-caret">▾</span> <span class="lane-title">{{.Name}} ({{.Count}})</span></div>{{end}}
+<div class="board" style="grid-template-columns:{{$.GridColumns}}">
+  {{range .Columns}}
+  <div class="col" data-state="{{.State}}">
     <h3>
-      <span>📋 Backlog ({{len .Backlog}})</span>
-      <button onclick="toggleBacklog()" style="font-size:10px">Toggle</button>
+      <span>{{.Title}} ({{len .Tickets}})</span>
+      {{if eq .State "backlog"}}<button onclick="toggleBacklog()" style="font-size:10px">Toggle</button>{{end}}
     </h3>
     <div class="col-content">
-    {{range .Backlog}}
-    <div class="card" draggable="true" data-id="{{.ID}}" data-state="backlog" data-title="{{.Title}}" data-project="{{.ProjectKey}}" data-assignee="{{.Assignee}}">
-      <strong>{{.ProjectKey}}-{{.ID}}</strong> <span class="ticket-title" onclick="showTicketView({{.ID}})">{{.Title}}</span>
-      <div class="small">{{.Assignee}}</div>
-      {{range .BlockedBy}}<span class="badge">⚠ {{.}}</span>{{end}}
-      <div style="margin-top:6px">
-        <button onclick="move({{.ID}},'right')">→</button>
-      </div>
-    </div>
-    {{end}}
-    </div>
-  </div>
-  
-  <div class="col" data-state="todo">
-    <h3>📝 Todo ({{len .Todo}})</h3>
-    <div class="col-content">
-    {{range .Todo}}
-    <div class="card" draggable="true" data-id="{{.ID}}" data-state="todo" data-title="{{.Title}}" data-project="{{.ProjectKey}}" data-assignee="{{.Assignee}}">
-      <strong>{{.ProjectKey}}-{{.ID}}</strong> <span class="ticket-title" onclick="showTicketView({{.ID}})">{{.Title}}</span>
-      <div class="small">{{.Assignee}}</div>
-      {{range .BlockedBy}}<span class="badge">⚠ {{.}}</span>{{end}}
-      <div style="margin-top:6px">
-        <button onclick="move({{.ID}},'left')">←</button>
-        <button onclick="move({{.ID}},'right')">→</button>
-      </div>
-    </div>
-    {{end}}
-    </div>
-  </div>
-  
-  <div class="col" data-state="in_progress">
-    <h3>🔧 In Progress ({{len .InProg}})</h3>
-    <div class="col-content">
-    {{range .InProg}}
-    <div class="card" draggable="true" data-id="{{.ID}}" data-state="in_progress" data-title="{{.Title}}" data-project="{{.ProjectKey}}" data-assignee="{{.Assignee}}">
-      <strong>{{.ProjectKey}}-{{.ID}}</strong> <span class="ticket-title" onclick="showTicketView({{.ID}})">{{.Title}}</span>
-      <div class="small">{{.Assignee}}</div>
-      {{range .BlockedBy}}<span class="badge">⚠ {{.}}</span>{{end}}
-      <div style="margin-top:6px">
-        <button onclick="move({{.ID}},'left')">←</button>
-        <button onclick="move({{.ID}},'right')">→</button>
-      </div>
-    </div>
-    {{end}}
-    </div>
-  </div>
-  
-  <div class="col" data-state="done">
-    <h3>✅ Done ({{len .Done}})</h3>
-    <div class="col-content">
-    {{range .Done}}
-    <div class="card" draggable="true" data-id="{{.ID}}" data-state="done" data-title="{{.Title}}" data-project="{{.ProjectKey}}" data-assignee="{{.Assignee}}">
-      <strong>{{.ProjectKey}}-{{.ID}}</strong> <span class="ticket-title" onclick="showTicketView({{.ID}})">{{.Title}}</span>
-      <div class="small">{{.Assignee}}</div>
-      <div style="margin-top:6px">
-        <button onclick="move({{.ID}},'left')">←</button>
-      </div>
-    </div>
-    {{end}}
+    {{range .Tickets}}{{template "card" .}}{{end}}
     </div>
   </div>
+  {{end}}
 </div>
+</section>
+{{end}}
 
 <!-- Add Ticket Modal -->
 <div id="ticket-modal" class="modal">
@@ -749,11 +1835,16 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
     <form id="ticket-form" onsubmit="submitTicket(event)">
       <div class="form-group">
         <label>Project *</label>
-        <select id="ticket-project" required>
+        <select id="ticket-project" required onchange="projectChosen(this.value)">
           <option value="">Select a project...</option>
           {{range .Projects}}<option value="{{.Key}}">{{.Key}} - {{.Name}}</option>{{end}}
         </select>
       </div>
+      <div class="form-group" id="ticket-template-group" style="display:none">
+        <label>Template</label>
+        <select id="ticket-template" onchange="templateChosen(this.value)"></select>
+        <div class="small" id="ticket-template-hint"></div>
+      </div>
       <div class="form-group">
         <label>Title *</label>
         <input type="text" id="ticket-title" required placeholder="Brief description">
@@ -766,6 +1857,47 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
         <label>Assignee</label>
         <input type="text" id="ticket-assignee" placeholder="Username">
       </div>
+      <div class="form-group">
+        <label>Epic</label>
+        <select id="ticket-epic">
+          <option value="">No epic</option>
+          {{range .Epics}}<option value="{{.ID}}" {{if eq (print .ID) $.Epic}}selected{{end}}>{{.Name}}</option>{{end}}
+        </select>
+      </div>
+      <div style="display:flex;gap:8px">
+        <div class="form-group" style="flex:1">
+          <label>Points</label>
+          <input type="number" id="ticket-points" min="0" placeholder="—">
+        </div>
+        <div class="form-group" style="flex:1">
+          <label>Subtask of ticket #</label>
+          <input type="number" id="ticket-parent" min="1" placeholder="—">
+        </div>
+      </div>
+      <div style="display:flex;gap:8px">
+        <div class="form-group" style="flex:1">
+          <label>Priority</label>
+          <select id="ticket-priority">
+            <option value="low">▽ Low</option>
+            <option value="medium" selected>◇ Medium</option>
+            <option value="high">△ High</option>
+            <option value="urgent">🔥 Urgent</option>
+          </select>
+        </div>
+        <div class="form-group" style="flex:1">
+          <label>Due date</label>
+          <input type="date" id="ticket-due">
+        </div>
+      </div>
+      <div id="ticket-custom"></div>
+      {{if .Labels}}
+      <div class="form-group">
+        <label>Labels</label>
+        <select id="ticket-labels" multiple size="3">
+          {{range .Labels}}<option value="{{.Name}}">{{.Name}}{{if .ProjectKey}} ({{.ProjectKey}}){{end}}</option>{{end}}
+        </select>
+      </div>
+      {{end}}
       <div class="form-group">
         <label>Initial State</label>
         <select id="ticket-state">
@@ -804,6 +1936,49 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
   </div>
 </div>
 
+<!-- Save View Modal -->
+<div id="view-modal" class="modal">
+  <div class="modal-content">
+    <h2>💾 Save View</h2>
+    <form id="view-form" onsubmit="submitView(event)">
+      <div class="form-group">
+        <label>Name *</label>
+        <input type="text" id="view-name" required placeholder="My open bugs">
+      </div>
+      <div class="form-group">
+        <label>Filter</label>
+        <input type="text" id="view-query" placeholder="assignee = jane AND state != done">
+      </div>
+      <div class="form-group">
+        <label>Sort</label>
+        <select id="view-sort">
+          <option value="">Created (oldest first)</option>
+          <option value="-created">Created (newest first)</option>
+          <option value="-updated">Recently updated</option>
+          <option value="title">Title</option>
+          <option value="assignee">Assignee</option>
+          <option value="project">Project</option>
+        </select>
+      </div>
+      <div class="form-group">
+        <label>Columns</label>
+        <label style="display:inline;font-weight:normal"><input type="checkbox" class="view-col" value="backlog" checked style="width:auto"> Backlog</label>
+        <label style="display:inline;font-weight:normal"><input type="checkbox" class="view-col" value="todo" checked style="width:auto"> Todo</label>
+        <label style="display:inline;font-weight:normal"><input type="checkbox" class="view-col" value="in_progress" checked style="width:auto"> In Progress</label>
+        <label style="display:inline;font-weight:normal"><input type="checkbox" class="view-col" value="done" checked style="width:auto"> Done</label>
+      </div>
+      <div class="form-group">
+        <label style="font-weight:normal"><input type="checkbox" id="view-shared" style="width:auto"> Share with the team</label>
+      </div>
+      <div class="form-actions">
+        {{if .FilterID}}<button type="button" class="btn btn-danger" onclick="deleteView()">Delete</button>{{end}}
+        <button type="button" class="btn btn-subtle" onclick="hideSaveViewModal()">Cancel</button>
+        <button type="submit" class="btn btn-hero">Save View</button>
+      </div>
+    </form>
+  </div>
+</div>
+
 <!-- Settings Modal -->
 <div id="settings-modal" class="modal">
   <div class="modal-content">
@@ -821,6 +1996,10 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
         <label>Sprint Epoch (start date)</label>
         <input type="date" id="settings-sprint-epoch">
       </div>
+      <div class="form-group">
+        <label>Your username</label>
+        <input type="text" id="settings-user" placeholder="jane">
+      </div>
       <div class="form-group">
         <label>Theme</label>
         <select id="settings-theme">
@@ -833,12 +2012,139 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
         ⚠️ Settings only affect current session (not persisted to env vars)
       </p>
     </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Email Notifications</h3>
+      <p id="notify-no-user" class="small hidden">Set your username above first.</p>
+      <div id="notify-prefs">
+        <div class="form-group">
+          <label>Email</label>
+          <input type="email" id="notify-email" placeholder="jane@example.com">
+        </div>
+        <div class="form-group">
+          <label style="display:inline;font-weight:normal"><input type="checkbox" id="notify-assigned" style="width:auto"> Assigned to me</label>
+          <label style="display:inline;font-weight:normal"><input type="checkbox" id="notify-mentioned" style="width:auto"> Mentions</label>
+          <label style="display:inline;font-weight:normal"><input type="checkbox" id="notify-state_changed" style="width:auto"> State changes</label>
+          <label style="display:inline;font-weight:normal"><input type="checkbox" id="notify-commented" style="width:auto"> Comments</label>
+          <label style="display:inline;font-weight:normal"><input type="checkbox" id="notify-due_soon" style="width:auto"> Due dates and SLA breaches</label>
+        </div>
+        <div class="form-group">
+          <label>Delivery</label>
+          <select id="notify-digest">
+            <option value="off">Right away</option>
+            <option value="hourly">Hourly digest</option>
+            <option value="daily">Daily digest</option>
+          </select>
+        </div>
+        <button onclick="saveNotificationPrefs()" class="btn">Save Notifications</button>
+      </div>
+    </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Epics</h3>
+      {{range .Epics}}
+      <div class="link-item">
+        <span>◆ {{.Name}}{{if .ProjectKey}} ({{.ProjectKey}}){{end}} — {{.Progress.Done}}/{{.Progress.Total}} done{{if .Progress.Points}}, {{.Progress.PointsDone}}/{{.Progress.Points}} pts{{end}}</span>
+        <button class="btn-subtle" onclick="deleteEpic({{.ID}})">✕</button>
+      </div>
+      {{end}}
+      <div style="display:flex;gap:8px;margin-top:8px">
+        <input type="text" id="epic-name" placeholder="New epic name" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <button onclick="createEpic()" class="btn">◆ Add Epic</button>
+      </div>
+    </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Labels</h3>
+      {{range .Labels}}
+      <div class="link-item">
+        <span><span class="chip" style="background:{{.Color}}">{{.Name}}</span>{{if .ProjectKey}} {{.ProjectKey}} only{{end}}</span>
+        <button class="btn-subtle" onclick="deleteLabel({{.ID}})">✕</button>
+      </div>
+      {{end}}
+      <div style="display:flex;gap:8px;margin-top:8px">
+        <input type="text" id="label-name" placeholder="New label" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <input type="color" id="label-color" value="#8b6f64" style="width:40px;padding:0;border:none;background:none">
+        <button onclick="createLabel()" class="btn">🏷 Add Label</button>
+      </div>
+    </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Custom Fields</h3>
+      {{range .Fields}}{{if or (eq $.Project "ALL") (eq $.Project .ProjectKey)}}
+      <div class="link-item">
+        <span>{{.ProjectKey}} · {{.Name}} <span class="small">({{.Key}}, {{.Type}}{{if .Options}}: {{range $i, $o := .Options}}{{if $i}}, {{end}}{{$o}}{{end}}{{end}}{{if .Required}}, required{{end}})</span></span>
+        <button class="btn-subtle" onclick="deleteCustomField({{.ID}})">✕</button>
+      </div>
+      {{end}}{{end}}
+      <div style="display:flex;gap:8px;margin-top:8px;flex-wrap:wrap">
+        <input type="text" id="field-key" placeholder="key (e.g. customer)" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <input type="text" id="field-name" placeholder="Display name" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <select id="field-type">
+          <option value="text">Text</option>
+          <option value="number">Number</option>
+          <option value="select">Select</option>
+          <option value="date">Date</option>
+          <option value="user">User</option>
+        </select>
+        <input type="text" id="field-options" placeholder="Options (select): a, b, c" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <label class="small"><input type="checkbox" id="field-required"> required</label>
+        <button onclick="createCustomField()" class="btn">＋ Add Field</button>
+      </div>
+      <p class="small">Fields belong to the project picked in the header.</p>
+    </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Ticket Templates</h3>
+      {{range .Templates}}{{if or (eq $.Project "ALL") (eq $.Project .ProjectKey)}}
+      <div class="link-item">
+        <span>{{.ProjectKey}} · {{.Name}} <span class="small">{{if .TitlePrefix}}“{{.TitlePrefix}}…”{{end}}{{if .Subtasks}} + {{len .Subtasks}} subtasks{{end}}</span></span>
+        <button class="btn-subtle" onclick="deleteTemplate({{.ID}})">✕</button>
+      </div>
+      {{end}}{{end}}
+      <div class="form-group" style="margin-top:8px">
+        <div style="display:flex;gap:8px">
+          <input type="text" id="template-name" placeholder="Name (e.g. Bug report)" style="flex:1">
+          <input type="text" id="template-prefix" placeholder="Title prefix (e.g. [Bug] )" style="flex:1">
+        </div>
+        <textarea id="template-body" placeholder="Body skeleton (markdown)" style="margin-top:6px">## Steps to reproduce
+
+## Expected
+
+## Actual</textarea>
+        <div style="display:flex;gap:8px;margin-top:6px">
+          <input type="text" id="template-assignee" placeholder="Default assignee" style="flex:1">
+          <select id="template-state">
+            <option value="">Default state</option>
+            <option value="backlog">Backlog</option>
+            <option value="todo">Todo</option>
+            <option value="in_progress">In Progress</option>
+          </select>
+          <input type="text" id="template-labels" placeholder="Labels: bug, ux" style="flex:1">
+        </div>
+        <textarea id="template-subtasks" placeholder="Subtasks, one per line" rows="2" style="margin-top:6px"></textarea>
+        <button onclick="createTemplate()" class="btn" style="margin-top:6px">📄 Add Template</button>
+        <p class="small">Templates belong to the project picked in the header.</p>
+      </div>
+    </div>
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-bottom:20px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Recurring Tickets</h3>
+      {{range .Recurring}}
+      <div class="link-item">
+        <span>{{.ProjectKey}} · {{.Title}} <span class="small">({{.Schedule}}{{if .Enabled}}, next {{.NextRun.Format "2006-01-02 15:04"}} UTC{{else}}, paused{{end}})</span></span>
+        <button class="btn-subtle" onclick="deleteRecurring({{.ID}})">✕</button>
+      </div>
+      {{end}}
+      <div style="display:flex;gap:8px;margin-top:8px;flex-wrap:wrap">
+        <input type="text" id="recurring-title" placeholder="Title, e.g. Rotate certs {date}" style="flex:2;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <input type="text" id="recurring-schedule" placeholder="0 9 * * 1 or sprint+1" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <input type="text" id="recurring-assignee" placeholder="Assignee" style="flex:1;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <button onclick="createRecurring()" class="btn">🔁 Add</button>
+      </div>
+      <p class="small">Cron (UTC), @daily/@weekly/@monthly, or sprint / sprint+N days. Uses the project picked in the header.</p>
+    </div>
     <div style="border-top:1px solid var(--border);padding-top:16px">
       <h3 style="margin:0 0 8px 0;font-size:14px">Export Data</h3>
       <p style="font-size:12px;margin-bottom:12px;color:var(--muted)">
         Download all projects and tickets as JSON
       </p>
       <button onclick="exportData()" class="btn">📥 Export to JSON</button>
+      <label class="btn">📤 Import JSON<input type="file" accept="application/json" onchange="importData(this)" style="display:none"></label>
     </div>
     <div class="form-actions" style="margin-top:20px">
       <button class="btn btn-subtle" onclick="hideSettingsModal()">Close</button>
@@ -850,20 +2156,59 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
 <div id="ticket-view-modal" class="modal">
   <div class="modal-content" style="max-width:600px">
     <h2 id="ticket-view-title">Loading...</h2>
+    <div class="presence" id="ticket-view-presence"></div>
     <div class="ticket-meta" id="ticket-view-meta"></div>
+    <div class="small" style="margin-bottom:10px">
+      👁 <span id="ticket-view-watchers"></span>
+      <button type="button" class="btn-subtle" id="ticket-view-watch" onclick="toggleWatch()">Watch</button>
+    </div>
+    <div class="notice hidden" id="ticket-view-lock"></div>
+    <div class="notice notice-warn hidden" id="ticket-view-conflict">
+      Someone else changed this ticket while you had it open.
+      <button type="button" onclick="showTicketView(currentTicketId)">Reload</button>
+    </div>
     
     <div class="form-group">
       <label>Title *</label>
       <input type="text" id="ticket-view-title-input" required>
     </div>
     <div class="form-group">
-      <label>Description</label>
-      <textarea id="ticket-view-body"></textarea>
+      <label>Description <button type="button" class="btn-subtle" onclick="editTicketBody()">✎ Edit</button></label>
+      <div class="markdown" id="ticket-view-body-html"></div>
+      <textarea id="ticket-view-body" class="hidden" placeholder="Markdown: **bold**, - [ ] tasks, T-12 links"></textarea>
     </div>
     <div class="form-group">
       <label>Assignee</label>
       <input type="text" id="ticket-view-assignee">
     </div>
+    <div style="display:flex;gap:8px">
+      <div class="form-group" style="flex:2">
+        <label>Epic</label>
+        <select id="ticket-view-epic">
+          <option value="">No epic</option>
+          {{range .Epics}}<option value="{{.ID}}">{{.Name}}</option>{{end}}
+        </select>
+      </div>
+      <div class="form-group" style="flex:1">
+        <label>Points</label>
+        <input type="number" id="ticket-view-points" min="0" placeholder="—">
+      </div>
+    </div>
+    <div style="display:flex;gap:8px">
+      <div class="form-group" style="flex:1">
+        <label>Priority</label>
+        <select id="ticket-view-priority">
+          <option value="low">▽ Low</option>
+          <option value="medium">◇ Medium</option>
+          <option value="high">△ High</option>
+          <option value="urgent">🔥 Urgent</option>
+        </select>
+      </div>
+      <div class="form-group" style="flex:1">
+        <label>Due date</label>
+        <input type="date" id="ticket-view-due">
+      </div>
+    </div>
     <div class="form-group">
       <label>State</label>
       <select id="ticket-view-state">
@@ -874,6 +2219,47 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
       </select>
     </div>
     
+    <div id="ticket-view-custom"></div>
+
+    <div class="form-group">
+      <label>Labels</label>
+      <div id="ticket-view-labels"></div>
+      <select id="ticket-view-add-label" onchange="addTicketLabel(this)" style="width:auto;margin-top:4px">
+        <option value="">+ Add label…</option>
+        {{range .Labels}}<option value="{{.ID}}">{{.Name}}{{if .ProjectKey}} ({{.ProjectKey}}){{end}}</option>{{end}}
+      </select>
+    </div>
+
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-top:16px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Links</h3>
+      <div id="ticket-view-links"></div>
+      <div style="display:flex;gap:8px;align-items:center">
+        <select id="ticket-view-dep-kind" style="width:auto">
+          <option value="blocks:outward">blocks</option>
+          <option value="blocks:inward">is blocked by</option>
+          <option value="relates:outward">relates to</option>
+          <option value="duplicates:outward">duplicates</option>
+          <option value="duplicates:inward">is duplicated by</option>
+          <option value="clones:outward">clones</option>
+          <option value="clones:inward">is cloned by</option>
+          <option value="parent:outward">is parent of</option>
+          <option value="parent:inward">is subtask of</option>
+        </select>
+        <input type="number" id="ticket-view-dep-id" placeholder="Ticket #" min="1" style="width:100px;padding:4px 8px;border:1px solid var(--border);border-radius:8px;background:var(--bg);color:var(--ink)">
+        <button onclick="addLink()" class="btn">⛓ Add</button>
+        <button onclick="toggleDependencyView()" class="btn btn-subtle">🕸 Dependency view</button>
+      </div>
+      <div id="ticket-view-deps" class="dep-view hidden"></div>
+    </div>
+
+    <div style="border-top:1px solid var(--border);padding-top:16px;margin-top:16px">
+      <h3 style="margin:0 0 8px 0;font-size:14px">Attachments</h3>
+      <div class="attachments" id="ticket-view-attachments"></div>
+      <label class="btn btn-subtle" style="display:inline-block;margin-top:8px">📎 Attach files
+        <input type="file" id="ticket-view-upload" multiple class="hidden" onchange="uploadAttachments(this)">
+      </label>
+    </div>
+
     <div style="border-top:1px solid var(--border);padding-top:16px;margin-top:16px">
       <h3 style="margin:0 0 8px 0;font-size:14px">Comments</h3>
       <div class="comments-list" id="ticket-view-comments">
@@ -894,15 +2280,20 @@ select{padding:4px 8px;border:1px solid var(--border);background:var(--card);col
 
 <script>
 const stateOrder = ['backlog', 'todo', 'in_progress', 'done'];
+const laneBy = {{.LaneBy}};
+const boardProject = {{.Project}};
+// A filtered board can't tell whether a new ticket matches, so it doesn't
+// add cards for tickets created elsewhere.
+const boardFiltered = {{if or .Query .Epic .Label}}true{{else}}false{{end}};
 let draggedCard = null;
 
 function move(id,dir){
   fetch('/api/tickets/'+id+'/move',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify({direction:dir})})
-  .then(r=>r.json()).then(()=>location.reload());
+  .then(r=>r.json()).then(()=>refreshBoard());
 }
 
 function toggleBacklog(){
-  document.getElementById('backlog-col').classList.toggle('collapsed');
+  document.querySelectorAll('.col[data-state="backlog"]').forEach(col => col.classList.toggle('collapsed'));
 }
 
 // Modal functions
@@ -915,6 +2306,7 @@ function showAddTicketModal() {
   if (filter !== 'ALL') {
     projectSelect.value = filter;
   }
+  projectChosen(projectSelect.value);
   
   modal.classList.add('show');
 }
@@ -940,7 +2332,15 @@ function submitTicket(e) {
     title: document.getElementById('ticket-title').value,
     body: document.getElementById('ticket-body').value,
     assignee: document.getElementById('ticket-assignee').value,
-    state: document.getElementById('ticket-state').value
+    state: document.getElementById('ticket-state').value,
+    epic_id: intOrNull(document.getElementById('ticket-epic').value),
+    points: intOrNull(document.getElementById('ticket-points').value),
+    parent_id: intOrNull(document.getElementById('ticket-parent').value),
+    priority: document.getElementById('ticket-priority').value,
+    due_date: document.getElementById('ticket-due').value,
+    labels: Array.from(document.querySelectorAll('#ticket-labels option:checked')).map(o => o.value),
+    custom: customValues('ticket-custom'),
+    template: intOrNull(document.getElementById('ticket-template').value)
   };
   
   fetch('/api/tickets', {
@@ -953,12 +2353,295 @@ function submitTicket(e) {
     if (result.error) {
       alert('Error: ' + result.error);
     } else {
-      location.reload();
+      hideAddTicketModal();
+      refreshBoard();
     }
   })
   .catch(err => alert('Error creating ticket: ' + err));
 }
 
+function intOrNull(v) {
+  return v === '' ? null : parseInt(v, 10);
+}
+
+function createEpic() {
+  const name = document.getElementById('epic-name').value.trim();
+  if (!name) return;
+  const project = document.getElementById('project-filter').value;
+  fetch('/api/epics', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({name: name, project_key: project === 'ALL' ? '' : project})
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      location.reload();
+    }
+  });
+}
+
+function createLabel() {
+  const name = document.getElementById('label-name').value.trim();
+  if (!name) return;
+  const project = document.getElementById('project-filter').value;
+  fetch('/api/labels', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({name: name, color: document.getElementById('label-color').value, project_key: project === 'ALL' ? '' : project})
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      location.reload();
+    }
+  });
+}
+
+function deleteLabel(id) {
+  if (!confirm('Delete this label? It is removed from every ticket.')) return;
+  fetch('/api/labels/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+
+function renderTicketLabels(labels) {
+  const list = document.getElementById('ticket-view-labels');
+  list.innerHTML = '';
+  labels.forEach(l => {
+    const chip = document.createElement('span');
+    chip.className = 'chip';
+    chip.style.background = l.color;
+    chip.textContent = l.name;
+    const del = document.createElement('button');
+    del.textContent = '✕';
+    del.onclick = () => fetch('/api/tickets/' + currentTicketId + '/labels/' + l.id, {method: 'DELETE'})
+      .then(() => showTicketView(currentTicketId));
+    chip.appendChild(del);
+    list.appendChild(chip);
+  });
+}
+
+function addTicketLabel(select) {
+  const labelId = parseInt(select.value, 10);
+  select.value = '';
+  if (!labelId) return;
+  fetch('/api/tickets/' + currentTicketId + '/labels', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({label_id: labelId})
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      showTicketView(currentTicketId);
+    }
+  });
+}
+
+const customFields = {{.Fields}} || [];
+const ticketTemplates = {{.Templates}} || [];
+
+function projectChosen(projectKey) {
+  renderCustomFields('ticket-custom', projectKey, {});
+  const select = document.getElementById('ticket-template');
+  select.innerHTML = '<option value="">No template</option>';
+  const templates = ticketTemplates.filter(t => t.project_key === projectKey);
+  templates.forEach(t => {
+    const opt = document.createElement('option');
+    opt.value = t.id;
+    opt.textContent = t.name;
+    select.appendChild(opt);
+  });
+  document.getElementById('ticket-template-group').style.display = templates.length ? '' : 'none';
+  templateChosen('');
+}
+
+// templateChosen prefills the empty form fields from a template. The
+// server applies the title prefix and creates the subtasks.
+function templateChosen(id) {
+  const t = ticketTemplates.find(t => String(t.id) === id);
+  const hint = document.getElementById('ticket-template-hint');
+  if (!t) {
+    hint.textContent = '';
+    return;
+  }
+  const body = document.getElementById('ticket-body');
+  const assignee = document.getElementById('ticket-assignee');
+  if (!body.value) body.value = t.body;
+  if (!assignee.value) assignee.value = t.assignee;
+  if (t.state) document.getElementById('ticket-state').value = t.state;
+  document.querySelectorAll('#ticket-labels option').forEach(o => {
+    if ((t.labels || []).some(l => l.toLowerCase() === o.value.toLowerCase())) o.selected = true;
+  });
+  hint.textContent = (t.title_prefix ? 'Title prefix "' + t.title_prefix + '". ' : '') +
+    (t.subtasks && t.subtasks.length ? 'Creates ' + t.subtasks.length + ' subtasks: ' + t.subtasks.join(', ') : '');
+}
+
+function createTemplate() {
+  const project = document.getElementById('project-filter').value;
+  if (project === 'ALL') {
+    alert('Pick a project first: templates belong to one project.');
+    return;
+  }
+  const name = document.getElementById('template-name').value.trim();
+  if (!name) return;
+  const list = (id, sep) => document.getElementById(id).value.split(sep).map(s => s.trim()).filter(s => s);
+  fetch('/api/templates', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({
+      project_key: project,
+      name: name,
+      title_prefix: document.getElementById('template-prefix').value,
+      body: document.getElementById('template-body').value,
+      assignee: document.getElementById('template-assignee').value.trim(),
+      state: document.getElementById('template-state').value,
+      labels: list('template-labels', ','),
+      subtasks: list('template-subtasks', '\n')
+    })
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      location.reload();
+    }
+  });
+}
+
+function createRecurring() {
+  const project = document.getElementById('project-filter').value;
+  if (project === 'ALL') {
+    alert('Pick a project first: recurring tickets belong to one project.');
+    return;
+  }
+  const title = document.getElementById('recurring-title').value.trim();
+  if (!title) return;
+  fetch('/api/recurring', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({
+      project_key: project,
+      title: title,
+      schedule: document.getElementById('recurring-schedule').value,
+      assignee: document.getElementById('recurring-assignee').value.trim()
+    })
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      location.reload();
+    }
+  });
+}
+
+function deleteRecurring(id) {
+  if (!confirm('Stop this recurring ticket? Tickets already created are kept.')) return;
+  fetch('/api/recurring/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+
+function deleteTemplate(id) {
+  if (!confirm('Delete this template?')) return;
+  fetch('/api/templates/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+
+// renderCustomFields draws an input per custom field of the project into
+// the container, filled from values.
+function renderCustomFields(containerId, projectKey, values) {
+  const box = document.getElementById(containerId);
+  box.innerHTML = '';
+  customFields.filter(f => f.project_key === projectKey).forEach(f => {
+    const group = document.createElement('div');
+    group.className = 'form-group';
+    const label = document.createElement('label');
+    label.textContent = f.name + (f.required ? ' *' : '');
+    let input;
+    if (f.type === 'select') {
+      input = document.createElement('select');
+      ['', ...f.options].forEach(o => {
+        const opt = document.createElement('option');
+        opt.value = o;
+        opt.textContent = o || '—';
+        input.appendChild(opt);
+      });
+    } else {
+      input = document.createElement('input');
+      input.type = {number: 'number', date: 'date'}[f.type] || 'text';
+      if (f.type === 'user') input.placeholder = 'Username';
+    }
+    input.dataset.key = f.key;
+    input.dataset.type = f.type;
+    const v = values[f.key];
+    input.value = v === undefined || v === null ? '' : v;
+    group.appendChild(label);
+    group.appendChild(input);
+    box.appendChild(group);
+  });
+}
+
+// customValues reads a container back into a custom object; empty inputs
+// are sent as null so the server clears them.
+function customValues(containerId) {
+  const out = {};
+  document.querySelectorAll('#' + containerId + ' [data-key]').forEach(el => {
+    if (el.value === '') {
+      out[el.dataset.key] = null;
+    } else {
+      out[el.dataset.key] = el.dataset.type === 'number' ? parseFloat(el.value) : el.value;
+    }
+  });
+  return out;
+}
+
+function createCustomField() {
+  const project = document.getElementById('project-filter').value;
+  if (project === 'ALL') {
+    alert('Pick a project first: custom fields belong to one project.');
+    return;
+  }
+  const key = document.getElementById('field-key').value.trim();
+  if (!key) return;
+  const options = document.getElementById('field-options').value.split(',').map(o => o.trim()).filter(o => o);
+  fetch('/api/custom-fields', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({
+      project_key: project,
+      key: key,
+      name: document.getElementById('field-name').value.trim(),
+      type: document.getElementById('field-type').value,
+      options: options,
+      required: document.getElementById('field-required').checked
+    })
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      location.reload();
+    }
+  });
+}
+
+function deleteCustomField(id) {
+  if (!confirm('Delete this field? Its values are removed from every ticket.')) return;
+  fetch('/api/custom-fields/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+
+function deleteEpic(id) {
+  if (!confirm('Delete this epic? Its tickets are kept.')) return;
+  fetch('/api/epics/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+
 function submitProject(e) {
   e.preventDefault();
   const data = {
@@ -1061,6 +2744,7 @@ function searchTickets() {
     const title = card.dataset.title || '';
     const project = card.dataset.project || '';
     const assignee = card.dataset.assignee || '';
+    const labels = card.dataset.labels || '';
     const id = card.dataset.id || '';
     
     // Respect project filter
@@ -1069,8 +2753,8 @@ function searchTickets() {
       return;
     }
     
-    // Search in title, project key, assignee, and ID
-    const searchText = project + '-' + id + ' ' + title + ' ' + assignee;
+    // Search in title, project key, assignee, labels and ID
+    const searchText = project + '-' + id + ' ' + title + ' ' + assignee + ' ' + labels;
     const score = fuzzyMatch(query, searchText);
     
     if (score > 0) {
@@ -1089,10 +2773,29 @@ function clearSearch() {
   document.getElementById('search-input').focus();
 }
 
+function toggleLane(lane) {
+  lane.classList.toggle('collapsed');
+  const key = 'pippin-collapsed-lanes:' + laneBy;
+  const collapsed = Array.from(document.querySelectorAll('.lane.collapsed')).map(l => l.dataset.lane);
+  localStorage.setItem(key, JSON.stringify(collapsed));
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+  if (!laneBy) return;
+  const collapsed = JSON.parse(localStorage.getItem('pippin-collapsed-lanes:' + laneBy) || '[]');
+  document.querySelectorAll('.lane').forEach(l => {
+    if (collapsed.includes(l.dataset.lane)) l.classList.add('collapsed');
+  });
+});
+
 function updateColumnCounts() {
-  ['backlog', 'todo', 'in_progress', 'done'].forEach(state => {
-    const col = document.querySelector('.col[data-state="' + state + '"]');
-    if (!col) return;
+  document.querySelectorAll('.lane-header').forEach(header => {
+    const lane = header.parentElement;
+    const visible = lane.querySelectorAll('.card:not(.search-hidden)').length;
+    const title = header.querySelector('.lane-title');
+    title.textContent = title.textContent.replace(/\(\d+\)$/, '(' + visible + ')');
+  });
+  document.querySelectorAll('.col').forEach(col => {
     const visible = col.querySelectorAll('.card:not(.search-hidden)').length;
     const header = col.querySelector('h3 span');
     if (header) {
@@ -1129,25 +2832,27 @@ function getDirection(from, to) {
   return toIdx > fromIdx ? 'right' : 'left';
 }
 
+function bindCard(card) {
+  card.addEventListener('dragstart', (e) => {
+    draggedCard = card;
+    card.classList.add('dragging');
+    e.dataTransfer.effectAllowed = 'move';
+    e.dataTransfer.setData('text/html', card.innerHTML);
+  });
+  
+  card.addEventListener('dragend', (e) => {
+    card.classList.remove('dragging');
+    document.querySelectorAll('.col').forEach(col => {
+      col.classList.remove('drag-over');
+    });
+  });
+}
+
 document.addEventListener('DOMContentLoaded',()=>{
   // Don't auto-collapse backlog anymore - let users see all their tickets
   
   // Add drag event listeners to all cards
-  document.querySelectorAll('.card').forEach(card => {
-    card.addEventListener('dragstart', (e) => {
-      draggedCard = card;
-      card.classList.add('dragging');
-      e.dataTransfer.effectAllowed = 'move';
-      e.dataTransfer.setData('text/html', card.innerHTML);
-    });
-    
-    card.addEventListener('dragend', (e) => {
-      card.classList.remove('dragging');
-      document.querySelectorAll('.col').forEach(col => {
-        col.classList.remove('drag-over');
-      });
-    });
-  });
+  document.querySelectorAll('.card').forEach(bindCard);
   
   // Add drop zone listeners to all columns
   document.querySelectorAll('.col').forEach(col => {
@@ -1172,27 +2877,39 @@ document.addEventListener('DOMContentLoaded',()=>{
       const ticketId = draggedCard.dataset.id;
       const fromState = draggedCard.dataset.state;
       const toState = col.dataset.state;
+      const fromLane = draggedCard.closest('.lane').dataset.lane;
+      const toLane = col.closest('.lane').dataset.lane;
+      const changeLane = laneBy && fromLane !== toLane;
       
       // Check if move is valid (adjacent states only)
-      if (!isAdjacentState(fromState, toState)) {
+      if (fromState !== toState && !isAdjacentState(fromState, toState)) {
         alert('Can only move to adjacent states! (' + fromState + ' → ' + toState + ' not allowed)');
         return;
       }
+      if (fromState === toState && !changeLane) return;
       
-      const direction = getDirection(fromState, toState);
-      
-      // Make the API call
-      fetch('/api/tickets/'+ticketId+'/move', {
-        method: 'POST',
-        headers: {'Content-Type': 'application/json'},
-        body: JSON.stringify({direction: direction})
-      })
-      .then(r => r.json())
+      // Change the lane's attribute first (e.g. reassign), then the state.
+      let chain = Promise.resolve({});
+      if (changeLane) {
+        chain = chain.then(() => fetch('/api/tickets/'+ticketId+'/lane', {
+          method: 'POST',
+          headers: {'Content-Type': 'application/json'},
+          body: JSON.stringify({lanes: laneBy, value: toLane, from: fromLane})
+        }).then(r => r.json()));
+      }
+      if (fromState !== toState) {
+        chain = chain.then(data => data.error ? data : fetch('/api/tickets/'+ticketId+'/move', {
+          method: 'POST',
+          headers: {'Content-Type': 'application/json'},
+          body: JSON.stringify({direction: getDirection(fromState, toState)})
+        }).then(r => r.json()));
+      }
+      chain
       .then(data => {
         if (data.error) {
           alert('Error: ' + data.error);
         } else {
-          location.reload();
+          refreshBoard();
         }
       })
       .catch(err => {
@@ -1202,6 +2919,391 @@ document.addEventListener('DOMContentLoaded',()=>{
   });
 });
 
+// Live updates: GET /api/events pushes every change, from any instance,
+// and the cards involved are patched in place.
+let liveEvents = null;
+
+function liveConnected() {
+  return liveEvents !== null && liveEvents.readyState === EventSource.OPEN;
+}
+
+// refreshBoard follows our own changes: the event stream patches the
+// board, so only reload without one.
+function refreshBoard() {
+  if (!liveConnected()) location.reload();
+}
+
+function reloadWhenIdle() {
+  if (document.querySelector('.modal.show')) {
+    setTimeout(reloadWhenIdle, 5000);
+  } else {
+    location.reload();
+  }
+}
+
+function connectEvents() {
+  if (!window.EventSource) return;
+  let dropped = false;
+  liveEvents = new EventSource('/api/events');
+  liveEvents.onerror = () => { dropped = true; };
+  // Events sent while we were disconnected are gone: start over.
+  liveEvents.onopen = () => { if (dropped) reloadWhenIdle(); };
+  liveEvents.onmessage = (e) => applyEvent(JSON.parse(e.data));
+}
+
+function applyEvent(ev) {
+  if (ev.type === 'resync' || ev.type === 'project.deleted' || ev.type === 'data.imported') {
+    reloadWhenIdle();
+    return;
+  }
+  const created = ev.type === 'ticket.created' && !boardFiltered;
+  (ev.cards || []).forEach(c => patchCard(c, created));
+  updateColumnCounts();
+  searchTickets();
+  if (['comment.added', 'ticket.created', 'ticket.updated'].includes(ev.type) && ev.actor !== currentUser()) {
+    refreshMentionCount();
+  }
+  if (ev.ticket_id && ev.actor !== currentUser()) {
+    refreshNotificationCount();
+  }
+  if (ev.type.startsWith('attachment.') && currentTicketId == ev.ticket_id && ev.actor !== currentUser()) {
+    loadAttachments(ev.ticket_id);
+  }
+  if (ev.type === 'comment.added' && currentTicketId == ev.ticket_id) {
+    fetch('/api/tickets/' + ev.ticket_id).then(r => r.json()).then(renderCommentList);
+  }
+}
+
+// patchCard replaces a card with its re-rendered version, moving it to
+// the column and lanes it now belongs in. Cards not on the board are only
+// added for new tickets.
+function patchCard(c, insert) {
+  const existing = Array.from(document.querySelectorAll('.card[data-id="' + c.id + '"]'));
+  if (c.deleted || (boardProject !== 'ALL' && c.project !== boardProject)) {
+    existing.forEach(el => el.remove());
+    return;
+  }
+  if (existing.length === 0 && !insert) return;
+
+  const keys = laneBy ? (c.lanes[laneBy] || []) : [''];
+  keys.forEach(key => {
+    const lane = Array.from(document.querySelectorAll('.lane')).find(l => l.dataset.lane === key);
+    if (!lane) {
+      reloadWhenIdle(); // a lane that isn't on the board yet
+      return;
+    }
+    const holder = document.createElement('div');
+    holder.innerHTML = c.html.trim();
+    const card = holder.firstElementChild;
+    bindCard(card);
+    const old = existing.find(el => el.closest('.lane') === lane);
+    const col = lane.querySelector('.col[data-state="' + c.state + '"] .col-content');
+    if (old && old.closest('.col').dataset.state === c.state) {
+      old.replaceWith(card);
+    } else if (col) {
+      col.prepend(card);
+    }
+    // else: the view hides this column
+  });
+  // Whatever wasn't replaced left its column or lane.
+  existing.forEach(el => { if (el.isConnected) el.remove(); });
+  drawPresence(c.id);
+}
+
+document.addEventListener('DOMContentLoaded', connectEvents);
+
+// Collaboration channel (presence.go): who is viewing or editing which
+// ticket, and a warning when someone saves the ticket you have open.
+let collab = null;
+let presence = {};        // ticket id -> [{user, editing}]
+let editingTicket = null; // the ticket we've told the server we're editing
+let loadedUpdatedAt = null;
+
+function connectCollab() {
+  if (!window.WebSocket) return;
+  const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+  collab = new WebSocket(proto + '//' + location.host + '/api/ws');
+  collab.onopen = () => { if (currentTicketId) sendCollab('view', currentTicketId); };
+  collab.onmessage = (e) => applyCollab(JSON.parse(e.data));
+  collab.onclose = () => { collab = null; setTimeout(connectCollab, 3000); };
+}
+
+function sendCollab(type, id) {
+  if (collab && collab.readyState === WebSocket.OPEN) {
+    collab.send(JSON.stringify({type: type, ticket_id: Number(id) || 0}));
+  }
+}
+
+function applyCollab(msg) {
+  if (msg.type === 'hello') {
+    presence = msg.presence || {};
+    document.querySelectorAll('.card').forEach(card => drawPresence(card.dataset.id));
+    if (currentTicketId) drawPresence(currentTicketId);
+  } else if (msg.type === 'presence') {
+    presence[msg.ticket_id] = msg.viewers || [];
+    drawPresence(msg.ticket_id);
+  } else if (msg.type === 'changed') {
+    if (currentTicketId == msg.ticket_id && msg.actor !== currentUser() && msg.event !== 'comment.added') {
+      document.getElementById('ticket-view-conflict').classList.remove('hidden');
+    }
+  }
+}
+
+function others(id) {
+  return (presence[id] || []).filter(v => v.user !== currentUser());
+}
+
+function avatar(v) {
+  let hue = 0;
+  for (const ch of v.user) hue = (hue * 31 + ch.charCodeAt(0)) % 360;
+  const el = document.createElement('span');
+  el.className = 'avatar' + (v.editing ? ' editing' : '');
+  el.style.background = 'hsl(' + hue + ',55%,45%)';
+  el.title = v.user + (v.editing ? ' (editing)' : ' (viewing)');
+  el.textContent = v.user.replace(/[^A-Za-z0-9]/g, '').slice(0, 2).toUpperCase() || '?';
+  return el;
+}
+
+function drawPresence(id) {
+  const viewers = others(id);
+  document.querySelectorAll('.card[data-id="' + id + '"]').forEach(card => {
+    let box = card.querySelector('.presence');
+    if (!box) {
+      box = document.createElement('div');
+      box.className = 'presence';
+      card.prepend(box);
+    }
+    box.replaceChildren(...viewers.map(avatar));
+  });
+  if (currentTicketId != id) return;
+  document.getElementById('ticket-view-presence').replaceChildren(...viewers.map(avatar));
+  const editors = viewers.filter(v => v.editing).map(v => v.user);
+  const lock = document.getElementById('ticket-view-lock');
+  lock.textContent = editors.length ? '🔒 ' + editors.join(', ') + (editors.length > 1 ? ' are' : ' is') + ' editing this ticket' : '';
+  lock.classList.toggle('hidden', editors.length === 0);
+}
+
+// The first keystroke in the ticket view marks us as editing.
+document.addEventListener('input', (e) => {
+  if (!currentTicketId || editingTicket == currentTicketId) return;
+  if (!e.target.closest('#ticket-view-modal') || e.target.id === 'ticket-view-new-comment') return;
+  editingTicket = currentTicketId;
+  sendCollab('edit', currentTicketId);
+});
+
+document.addEventListener('DOMContentLoaded', connectCollab);
+
+// Mentions inbox (mentions.go)
+function refreshMentionCount() {
+  if (!currentUser()) return;
+  fetch('/api/mentions/count')
+    .then(r => r.json())
+    .then(data => {
+      const badge = document.getElementById('mentions-badge');
+      badge.textContent = data.unread;
+      badge.classList.toggle('hidden', !data.unread);
+    });
+}
+
+function toggleMentions() {
+  const panel = document.getElementById('mentions-panel');
+  if (!panel.classList.toggle('hidden')) loadMentions();
+}
+
+function loadMentions() {
+  const list = document.getElementById('mentions-list');
+  if (!currentUser()) {
+    list.innerHTML = '<div class="dropdown-item small">Set your username in Settings to see mentions.</div>';
+    return;
+  }
+  fetch('/api/mentions?limit=20')
+    .then(r => r.json())
+    .then(mentions => {
+      list.innerHTML = '';
+      if (mentions.length === 0) {
+        list.innerHTML = '<div class="dropdown-item small">Nobody has mentioned you yet.</div>';
+      }
+      mentions.forEach(m => {
+        const item = document.createElement('div');
+        item.className = 'dropdown-item' + (m.read_at ? '' : ' unread');
+        const head = document.createElement('div');
+        head.innerHTML = '<strong></strong> in <strong></strong> <span class="small"></span>';
+        head.children[0].textContent = m.actor || 'Pippin';
+        head.children[1].textContent = m.ticket_ref;
+        head.children[2].textContent = m.ticket_title;
+        const excerpt = document.createElement('div');
+        excerpt.className = 'small';
+        excerpt.textContent = m.excerpt;
+        item.append(head, excerpt);
+        item.onclick = () => {
+          fetch('/api/mentions/' + m.id + '/read', {method: 'POST'}).then(refreshMentionCount);
+          document.getElementById('mentions-panel').classList.add('hidden');
+          showTicketView(m.ticket_id);
+        };
+        list.appendChild(item);
+      });
+    });
+}
+
+function readAllMentions() {
+  fetch('/api/mentions/read', {method: 'POST'}).then(() => { refreshMentionCount(); loadMentions(); });
+}
+
+// Notification center (notify.go)
+function refreshNotificationCount() {
+  if (!currentUser()) return;
+  fetch('/api/notifications/count')
+    .then(r => r.json())
+    .then(data => {
+      const badge = document.getElementById('notifications-badge');
+      badge.textContent = data.unread;
+      badge.classList.toggle('hidden', !data.unread);
+    });
+}
+
+function toggleNotifications() {
+  const panel = document.getElementById('notifications-panel');
+  if (!panel.classList.toggle('hidden')) loadNotifications();
+}
+
+function loadNotifications() {
+  const list = document.getElementById('notifications-list');
+  if (!currentUser()) {
+    list.innerHTML = '<div class="dropdown-item small">Set your username in Settings to see notifications.</div>';
+    return;
+  }
+  fetch('/api/notifications?limit=30')
+    .then(r => r.json())
+    .then(notifications => {
+      list.innerHTML = '';
+      if (notifications.length === 0) {
+        list.innerHTML = '<div class="dropdown-item small">Nothing new.</div>';
+      }
+      notifications.forEach(n => {
+        const item = document.createElement('div');
+        item.className = 'dropdown-item' + (n.read_at ? '' : ' unread');
+        const text = document.createElement('div');
+        text.textContent = n.text;
+        const when = document.createElement('div');
+        when.className = 'small';
+        when.textContent = new Date(n.created_at).toLocaleString();
+        item.append(text, when);
+        item.onclick = () => {
+          fetch('/api/notifications/' + n.id + '/read', {method: 'POST'}).then(refreshNotificationCount);
+          document.getElementById('notifications-panel').classList.add('hidden');
+          showTicketView(n.ticket_id);
+        };
+        list.appendChild(item);
+      });
+    });
+}
+
+function readAllNotifications() {
+  fetch('/api/notifications/read', {method: 'POST'}).then(() => { refreshNotificationCount(); loadNotifications(); });
+}
+
+document.addEventListener('DOMContentLoaded', refreshNotificationCount);
+
+document.addEventListener('click', (e) => {
+  if (!e.target.closest('.dropdown-anchor')) {
+    document.querySelectorAll('.dropdown').forEach(d => d.classList.add('hidden'));
+  }
+});
+
+document.addEventListener('DOMContentLoaded', refreshMentionCount);
+
+// @username autocomplete in the comment box and description
+let knownUsers = null;
+let suggestFor = null;
+
+function loadKnownUsers() {
+  if (knownUsers) return Promise.resolve(knownUsers);
+  return fetch('/api/users').then(r => r.json()).then(users => { knownUsers = users; return users; });
+}
+
+// mentionPrefix returns the partial @name before the caret, or null.
+function mentionPrefix(el) {
+  const m = el.value.slice(0, el.selectionStart).match(/(?:^|[^\w@.])@([\w.-]*)$/);
+  return m ? m[1] : null;
+}
+
+function suggestBox() {
+  let box = document.getElementById('mention-suggest');
+  if (!box) {
+    box = document.createElement('div');
+    box.id = 'mention-suggest';
+    box.className = 'suggest hidden';
+  }
+  return box;
+}
+
+function hideSuggest() {
+  suggestBox().classList.add('hidden');
+  suggestFor = null;
+}
+
+function showSuggest(el) {
+  const prefix = mentionPrefix(el);
+  if (prefix === null) {
+    hideSuggest();
+    return;
+  }
+  loadKnownUsers().then(users => {
+    const p = prefix.toLowerCase();
+    const matches = users.filter(u => u.toLowerCase().startsWith(p)).slice(0, 8);
+    const box = suggestBox();
+    if (matches.length === 0) {
+      hideSuggest();
+      return;
+    }
+    box.replaceChildren(...matches.map((u, i) => {
+      const d = document.createElement('div');
+      d.textContent = '@' + u;
+      d.dataset.user = u;
+      if (i === 0) d.className = 'active';
+      d.onmousedown = (e) => { e.preventDefault(); pickSuggestion(el, u); };
+      return d;
+    }));
+    el.after(box);
+    box.classList.remove('hidden');
+    suggestFor = el;
+  });
+}
+
+function pickSuggestion(el, user) {
+  const caret = el.selectionStart;
+  const before = el.value.slice(0, caret).replace(/@[\w.-]*$/, '@' + user + ' ');
+  el.value = before + el.value.slice(caret);
+  el.selectionStart = el.selectionEnd = before.length;
+  hideSuggest();
+  el.focus();
+}
+
+function bindMentionAutocomplete(el) {
+  el.addEventListener('input', () => showSuggest(el));
+  el.addEventListener('blur', () => setTimeout(hideSuggest, 150));
+  el.addEventListener('keydown', (e) => {
+    if (suggestFor !== el) return;
+    const items = Array.from(suggestBox().children);
+    const at = items.findIndex(d => d.classList.contains('active'));
+    if (e.key === 'ArrowDown' || e.key === 'ArrowUp') {
+      e.preventDefault();
+      const next = (at + (e.key === 'ArrowDown' ? 1 : items.length - 1)) % items.length;
+      items.forEach((d, i) => d.classList.toggle('active', i === next));
+    } else if (e.key === 'Enter' || e.key === 'Tab') {
+      e.preventDefault();
+      pickSuggestion(el, items[Math.max(at, 0)].dataset.user);
+    } else if (e.key === 'Escape') {
+      e.stopPropagation(); // close the list, not the modal
+      hideSuggest();
+    }
+  });
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+  ['ticket-view-new-comment', 'ticket-view-body'].forEach(id => bindMentionAutocomplete(document.getElementById(id)));
+});
+
 // Settings Modal functions
 function showSettingsModal() {
   fetch('/api/settings')
@@ -1210,10 +3312,50 @@ function showSettingsModal() {
       document.getElementById('settings-sprint-length').value = data.sprint_length_days;
       document.getElementById('settings-sprint-epoch').value = data.sprint_epoch;
       document.getElementById('settings-theme').value = data.cozy_theme;
+      document.getElementById('settings-user').value = currentUser();
+      loadNotificationPrefs();
       document.getElementById('settings-modal').classList.add('show');
     });
 }
 
+const notifyKinds = ['assigned', 'mentioned', 'state_changed', 'commented', 'due_soon'];
+
+function loadNotificationPrefs() {
+  const known = currentUser() !== '';
+  document.getElementById('notify-no-user').classList.toggle('hidden', known);
+  document.getElementById('notify-prefs').classList.toggle('hidden', !known);
+  if (!known) return;
+  fetch('/api/notifications/preferences')
+    .then(r => r.json())
+    .then(p => {
+      document.getElementById('notify-email').value = p.email || '';
+      notifyKinds.forEach(k => { document.getElementById('notify-' + k).checked = p[k]; });
+      document.getElementById('notify-digest').value = p.digest;
+    });
+}
+
+function saveNotificationPrefs() {
+  const prefs = {
+    email: document.getElementById('notify-email').value.trim(),
+    digest: document.getElementById('notify-digest').value
+  };
+  notifyKinds.forEach(k => { prefs[k] = document.getElementById('notify-' + k).checked; });
+  fetch('/api/notifications/preferences', {
+    method: 'PUT',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify(prefs)
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      alert('Notification settings saved.');
+    }
+  })
+  .catch(err => alert('Error saving notification settings: ' + err));
+}
+
 function hideSettingsModal() {
   document.getElementById('settings-modal').classList.remove('show');
 }
@@ -1222,6 +3364,7 @@ function saveSettings() {
   const sprintLength = parseInt(document.getElementById('settings-sprint-length').value);
   const sprintEpoch = document.getElementById('settings-sprint-epoch').value;
   const theme = document.getElementById('settings-theme').value;
+  document.cookie = 'pippin_user=' + encodeURIComponent(document.getElementById('settings-user').value.trim()) + ';path=/;max-age=31536000';
   
   fetch('/api/settings', {
     method: 'POST',
@@ -1240,20 +3383,216 @@ function saveSettings() {
   .catch(err => alert('Error saving settings: ' + err));
 }
 
+function currentUser() {
+  const m = document.cookie.match(/(?:^|; )pippin_user=([^;]*)/);
+  return m ? decodeURIComponent(m[1]) : '';
+}
+
+// Saved views
+function setBoardParam(name, value) {
+  const params = new URLSearchParams(window.location.search);
+  if (value) params.set(name, value); else params.delete(name);
+  location.href = '/board?' + params.toString();
+}
+
+function selectView(id) {
+  const params = new URLSearchParams(window.location.search);
+  params.delete('q');
+  if (id) params.set('filter', id); else params.delete('filter');
+  location.href = '/board?' + params.toString();
+}
+
+// Only the owner may overwrite a view; anyone else saves a copy.
+let editingViewId = '';
+
+function showSaveViewModal() {
+  const id = document.getElementById('view-filter').value;
+  editingViewId = '';
+  document.getElementById('view-query').value = document.getElementById('query-input').value;
+  if (id) {
+    fetch('/api/filters/' + id).then(r => r.json()).then(f => {
+      if (f.error) return;
+      if (f.owner === currentUser()) editingViewId = id;
+      document.getElementById('view-name').value = f.name;
+      document.getElementById('view-sort').value = f.sort;
+      document.getElementById('view-shared').checked = f.shared;
+      document.querySelectorAll('.view-col').forEach(c => c.checked = f.columns.includes(c.value));
+    });
+  }
+  document.getElementById('view-modal').classList.add('show');
+}
+
+function hideSaveViewModal() {
+  document.getElementById('view-modal').classList.remove('show');
+}
+
+function submitView(e) {
+  e.preventDefault();
+  const id = editingViewId;
+  const data = {
+    name: document.getElementById('view-name').value,
+    query: document.getElementById('view-query').value,
+    sort: document.getElementById('view-sort').value,
+    shared: document.getElementById('view-shared').checked,
+    columns: Array.from(document.querySelectorAll('.view-col:checked')).map(c => c.value)
+  };
+  fetch(id ? '/api/filters/' + id : '/api/filters', {
+    method: id ? 'PATCH' : 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify(data)
+  })
+  .then(r => r.json())
+  .then(result => {
+    if (result.error) {
+      alert('Error: ' + result.error);
+    } else {
+      selectView(id || result.id);
+    }
+  })
+  .catch(err => alert('Error saving view: ' + err));
+}
+
+function deleteView() {
+  const id = document.getElementById('view-filter').value;
+  if (!id || !confirm('Delete this saved view?')) return;
+  fetch('/api/filters/' + id, {method: 'DELETE'})
+    .then(r => r.json())
+    .then(result => {
+      if (result.error) alert('Error: ' + result.error);
+      else selectView('');
+    });
+}
+
 function exportData() {
   window.location.href = '/api/export';
 }
 
+function importData(input) {
+  const file = input.files[0];
+  if (!file) return;
+  file.text().then(body => fetch('/api/import', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: body
+  }))
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Import failed: ' + data.error);
+    } else {
+      alert('Imported ' + (data.tickets || 0) + ' tickets.');
+      location.reload();
+    }
+  })
+  .catch(err => alert('Import failed: ' + err));
+}
+
 // Ticket View Modal functions
 let currentTicketId = null;
 
+// Attachments (attachments.go)
+function formatBytes(n) {
+  if (n >= 1048576) return (n / 1048576).toFixed(1) + ' MB';
+  if (n >= 1024) return Math.round(n / 1024) + ' KB';
+  return n + ' B';
+}
+
+function renderAttachments(list) {
+  const box = document.getElementById('ticket-view-attachments');
+  box.replaceChildren();
+  if (list.length === 0) {
+    box.innerHTML = '<div class="small" style="color:var(--muted)">No attachments</div>';
+    return;
+  }
+  list.forEach(a => {
+    const item = document.createElement('div');
+    item.className = 'attachment';
+    const link = document.createElement('a');
+    link.href = a.thumbnail_url ? a.url + '?inline=true' : a.url;
+    link.target = '_blank';
+    if (a.thumbnail_url) {
+      const img = document.createElement('img');
+      img.src = a.thumbnail_url;
+      img.alt = a.filename;
+      link.appendChild(img);
+    } else {
+      const icon = document.createElement('div');
+      icon.className = 'file-icon';
+      icon.textContent = '📄';
+      link.appendChild(icon);
+    }
+    const name = document.createElement('a');
+    name.href = a.url;
+    name.textContent = a.filename;
+    const size = document.createElement('div');
+    size.className = 'small';
+    size.textContent = formatBytes(a.size);
+    const remove = document.createElement('span');
+    remove.className = 'remove';
+    remove.textContent = '✕';
+    remove.title = 'Delete attachment';
+    remove.onclick = () => deleteAttachment(a);
+    item.append(link, name, size, remove);
+    box.appendChild(item);
+  });
+}
+
+function loadAttachments(ticketId) {
+  fetch('/api/tickets/' + ticketId + '/attachments')
+    .then(r => r.json())
+    .then(list => { if (Array.isArray(list)) renderAttachments(list); });
+}
+
+function uploadAttachments(input) {
+  if (!input.files.length) return;
+  const form = new FormData();
+  Array.from(input.files).forEach(f => form.append('file', f));
+  const ticketId = currentTicketId;
+  fetch('/api/tickets/' + ticketId + '/attachments', {method: 'POST', body: form})
+    .then(r => r.json())
+    .then(data => {
+      input.value = '';
+      if (data.error) { alert(data.error); return; }
+      loadAttachments(ticketId);
+    });
+}
+
+function deleteAttachment(a) {
+  if (!confirm('Delete ' + a.filename + '?')) return;
+  fetch(a.url, {method: 'DELETE'}).then(() => loadAttachments(a.ticket_id));
+}
+
+// Watchers (watchers.go)
+function renderWatchers(watchers) {
+  document.getElementById('ticket-view-watchers').textContent =
+    watchers.length ? watchers.join(', ') : 'Nobody is watching';
+  const button = document.getElementById('ticket-view-watch');
+  button.textContent = watchers.includes(currentUser()) ? 'Unwatch' : 'Watch';
+  button.classList.toggle('hidden', !currentUser());
+}
+
+function toggleWatch() {
+  const watching = document.getElementById('ticket-view-watch').textContent === 'Unwatch';
+  fetch('/api/tickets/' + currentTicketId + '/watch', {method: watching ? 'DELETE' : 'POST'})
+    .then(r => r.json())
+    .then(data => {
+      if (data.error) { alert(data.error); return; }
+      renderWatchers(data.watchers);
+    });
+}
+
 function showTicketView(ticketId) {
   currentTicketId = ticketId;
+  editingTicket = null;
+  sendCollab('view', ticketId);
   
   fetch('/api/tickets/' + ticketId)
     .then(r => r.json())
     .then(ticket => {
       document.getElementById('ticket-view-title').textContent = ticket.project_key + '-' + ticket.id;
+      loadedUpdatedAt = ticket.updated_at;
+      document.getElementById('ticket-view-conflict').classList.add('hidden');
+      drawPresence(ticket.id);
       
       // Populate metadata
       const meta = document.getElementById('ticket-view-meta');
@@ -1262,38 +3601,121 @@ function showTicketView(ticketId) {
         '<div class="ticket-meta-item"><span class="ticket-meta-label">Created:</span><span>' + new Date(ticket.created_at).toLocaleString() + '</span></div>' +
         '<div class="ticket-meta-item"><span class="ticket-meta-label">Updated:</span><span>' + new Date(ticket.updated_at).toLocaleString() + '</span></div>' +
         (ticket.blocked_by && ticket.blocked_by.length > 0 ? 
-          '<div class="ticket-meta-item"><span class="ticket-meta-label">Blocked by:</span><span>' + ticket.blocked_by.join(', ') + '</span></div>' : '');
+          '<div class="ticket-meta-item"><span class="ticket-meta-label">Blocked by:</span><span>' + ticket.blocked_by.join(', ') + '</span></div>' : '') +
+        (ticket.blocks && ticket.blocks.length > 0 ? 
+          '<div class="ticket-meta-item"><span class="ticket-meta-label">Blocks:</span><span>' + ticket.blocks.join(', ') + '</span></div>' : '') +
+        (ticket.parent_id ?
+          '<div class="ticket-meta-item"><span class="ticket-meta-label">Subtask of:</span><span>T-' + ticket.parent_id + '</span></div>' : '') +
+        (ticket.subtask_progress ?
+          '<div class="ticket-meta-item"><span class="ticket-meta-label">Subtasks:</span><span>' + ticket.subtask_progress.done + '/' + ticket.subtask_progress.total +
+          ' done (' + ticket.subtask_progress.percent + '%)' +
+          (ticket.subtask_progress.points ? ', ' + ticket.subtask_progress.points_done + '/' + ticket.subtask_progress.points + ' pts' : '') + '</span></div>' : '');
       
       // Populate form fields
       document.getElementById('ticket-view-title-input').value = ticket.title;
       document.getElementById('ticket-view-body').value = ticket.body || '';
+      showTicketBody(ticket.body_html || '');
       document.getElementById('ticket-view-assignee').value = ticket.assignee || '';
       document.getElementById('ticket-view-state').value = ticket.state;
+      document.getElementById('ticket-view-epic').value = ticket.epic_id || '';
+      document.getElementById('ticket-view-points').value = ticket.points === null ? '' : ticket.points;
+      document.getElementById('ticket-view-priority').value = ticket.priority;
+      document.getElementById('ticket-view-due').value = ticket.due_date || '';
+      renderTicketLabels(ticket.labels || []);
+      renderWatchers(ticket.watchers || []);
+      renderAttachments(ticket.attachments || []);
+      renderCustomFields('ticket-view-custom', ticket.project_key, ticket.custom || {});
       
-      // Display comments
-      const commentsDiv = document.getElementById('ticket-view-comments');
-      if (ticket.comments && ticket.comments.trim() !== '') {
-        const comments = ticket.comments.split('\\n');
-        commentsDiv.innerHTML = comments.map(c => {
-          const match = c.match(/^\\[(.+?)\\] (.+)$/);
-          if (match) {
-            return '<div class="comment-item"><div class="comment-timestamp">' + match[1] + '</div><div>' + match[2] + '</div></div>';
-          }
-          return '<div class="comment-item">' + c + '</div>';
-        }).join('');
-      } else {
-        commentsDiv.innerHTML = '<div style="color:var(--muted);font-style:italic">No comments yet</div>';
-      }
+      renderCommentList(ticket);
       
       document.getElementById('ticket-view-new-comment').value = '';
+      document.getElementById('ticket-view-deps').classList.add('hidden');
+      loadLinks(ticketId);
       document.getElementById('ticket-view-modal').classList.add('show');
     })
     .catch(err => alert('Error loading ticket: ' + err));
 }
 
+function renderCommentList(ticket) {
+  const commentsDiv = document.getElementById('ticket-view-comments');
+  commentsDiv.innerHTML = '';
+  if (!ticket.comments_html || ticket.comments_html.length === 0) {
+    commentsDiv.innerHTML = '<div style="color:var(--muted);font-style:italic">No comments yet</div>';
+    return;
+  }
+  ticket.comments_html.forEach(c => {
+    const item = document.createElement('div');
+    item.className = 'comment-item';
+    if (c.at) {
+      const at = document.createElement('div');
+      at.className = 'comment-timestamp';
+      at.textContent = c.at;
+      item.appendChild(at);
+    }
+    const text = document.createElement('div');
+    text.className = 'markdown';
+    text.innerHTML = c.html; // sanitized server-side (markdown.go)
+    item.appendChild(text);
+    commentsDiv.appendChild(item);
+  });
+}
+
+// showTicketBody shows the rendered description; an empty one opens
+// straight into the editor.
+function showTicketBody(html) {
+  const view = document.getElementById('ticket-view-body-html');
+  const editor = document.getElementById('ticket-view-body');
+  view.innerHTML = html;
+  view.classList.toggle('hidden', html === '');
+  editor.classList.toggle('hidden', html !== '');
+}
+
+function editTicketBody() {
+  document.getElementById('ticket-view-body-html').classList.add('hidden');
+  const editor = document.getElementById('ticket-view-body');
+  editor.classList.remove('hidden');
+  editor.focus();
+}
+
+// Task list checkboxes write straight back to the ticket body.
+document.addEventListener('change', (e) => {
+  if (!e.target.matches('#ticket-view-body-html input[data-task]')) return;
+  fetch('/api/tickets/' + currentTicketId + '/tasks/' + e.target.dataset.task, {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({checked: e.target.checked})
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+      e.target.checked = !e.target.checked;
+    } else {
+      document.getElementById('ticket-view-body').value = data.body;
+      showTicketBody(data.body_html);
+      loadedUpdatedAt = data.updated_at;
+    }
+  });
+});
+
+// Ticket references (T-12, CART-12) open the ticket view.
+document.addEventListener('click', (e) => {
+  const ref = e.target.closest('a.ticket-ref');
+  if (!ref) return;
+  e.preventDefault();
+  showTicketView(ref.dataset.ticket);
+});
+
+document.addEventListener('DOMContentLoaded', () => {
+  const m = location.hash.match(/^#T-(\d+)$/);
+  if (m) showTicketView(m[1]);
+});
+
 function hideTicketView() {
   document.getElementById('ticket-view-modal').classList.remove('show');
   currentTicketId = null;
+  editingTicket = null;
+  sendCollab('leave');
 }
 
 function saveComment() {
@@ -1320,7 +3742,85 @@ function saveComment() {
   .catch(err => alert('Error saving comment: ' + err));
 }
 
-function saveTicketUpdates() {
+function loadLinks(ticketId) {
+  const list = document.getElementById('ticket-view-links');
+  list.innerHTML = '';
+  fetch('/api/tickets/' + ticketId + '/links')
+    .then(r => r.json())
+    .then(links => {
+      (links || []).forEach(l => {
+        const row = document.createElement('div');
+        row.className = 'link-item';
+        const label = document.createElement('span');
+        label.textContent = l.label + ' ' + l.ticket.project_key + '-' + l.ticket.id + ' ' + l.ticket.title + ' (' + l.ticket.state + ')';
+        const remove = document.createElement('button');
+        remove.className = 'btn btn-subtle';
+        remove.textContent = '✕';
+        remove.onclick = () => deleteLink(ticketId, l.id);
+        row.appendChild(label);
+        row.appendChild(remove);
+        list.appendChild(row);
+      });
+    });
+}
+
+function deleteLink(ticketId, linkId) {
+  fetch('/api/tickets/' + ticketId + '/links/' + linkId, {method: 'DELETE'})
+    .then(r => r.json())
+    .then(data => {
+      if (data.error) alert('Error: ' + data.error);
+      else showTicketView(ticketId);
+    });
+}
+
+function toggleDependencyView() {
+  const view = document.getElementById('ticket-view-deps');
+  if (!view.classList.contains('hidden')) {
+    view.classList.add('hidden');
+    return;
+  }
+  fetch('/api/tickets/' + currentTicketId + '/blockers')
+    .then(r => r.json())
+    .then(chain => {
+      const summary = chain.blockers && chain.blockers.length > 0
+        ? chain.blockers.length + ' open blocker(s); longest chain: ' + chain.longest_chain.map(id => 'T-' + id).join(' → ')
+        : 'Nothing is blocking this ticket.';
+      view.innerHTML = '<div class="small" style="margin-bottom:6px"></div>' +
+        '<img alt="Dependency graph" src="/api/tickets/' + currentTicketId + '/dependencies.svg?ts=' + Date.now() + '">';
+      view.firstChild.textContent = summary;
+      view.classList.remove('hidden');
+    })
+    .catch(err => alert('Error loading dependencies: ' + err));
+}
+
+function addLink() {
+  const otherId = parseInt(document.getElementById('ticket-view-dep-id').value);
+  if (!otherId) {
+    alert('Please enter a ticket number');
+    return;
+  }
+  const [type, direction] = document.getElementById('ticket-view-dep-kind').value.split(':');
+  
+  fetch('/api/tickets/' + currentTicketId + '/links', {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({type: type, target_id: otherId, direction: direction})
+  })
+  .then(r => r.json())
+  .then(data => {
+    if (data.error) {
+      alert('Error: ' + data.error);
+    } else {
+      document.getElementById('ticket-view-dep-id').value = '';
+      showTicketView(currentTicketId);
+    }
+  })
+  .catch(err => alert('Error adding link: ' + err));
+}
+
+// saveTicketUpdates only overwrites the ticket as it was loaded; if
+// someone saved in between the user chooses whether to overwrite.
+function saveTicketUpdates(force) {
   const title = document.getElementById('ticket-view-title-input').value.trim();
   const body = document.getElementById('ticket-view-body').value;
   const assignee = document.getElementById('ticket-view-assignee').value;
@@ -1338,16 +3838,28 @@ function saveTicketUpdates() {
       title: title,
       body: body,
       assignee: assignee,
-      state: state
+      state: state,
+      epic_id: intOrNull(document.getElementById('ticket-view-epic').value),
+      points: intOrNull(document.getElementById('ticket-view-points').value),
+      priority: document.getElementById('ticket-view-priority').value,
+      due_date: document.getElementById('ticket-view-due').value,
+      custom: customValues('ticket-view-custom'),
+      expected_updated_at: force === true ? null : loadedUpdatedAt
     })
   })
   .then(r => r.json())
   .then(data => {
-    if (data.error) {
+    if (data.error && data.updated_at) {
+      if (confirm(data.error + '. Overwrite their changes with yours?')) {
+        saveTicketUpdates(true);
+      } else {
+        showTicketView(currentTicketId);
+      }
+    } else if (data.error) {
       alert('Error: ' + data.error);
     } else {
       hideTicketView();
-      location.reload();
+      refreshBoard();
     }
   })
   .catch(err => alert('Error saving changes: ' + err));
@@ -1367,5 +3879,26 @@ document.addEventListener('keydown', (e) => {
 });
 </script>
 </body>
-</html>`))
+</html>
+{{define "card"}}
+    <div class="card{{if .Overdue}} overdue{{end}}" draggable="true" data-id="{{.ID}}" data-state="{{.State}}" data-title="{{.Title}}" data-project="{{.ProjectKey}}" data-assignee="{{.Assignee}}" data-labels="{{range .Labels}}{{.Name}} {{end}}">
+      <span class="priority priority-{{.Priority}}" title="{{.Priority}} priority">{{.PriorityIcon}}</span><strong>{{.ProjectKey}}-{{.ID}}</strong> <span class="ticket-title" onclick="showTicketView({{.ID}})">{{.Title}}</span>
+      <div class="small">{{.Assignee}}</div>
+      {{range .Labels}}<span class="chip" style="background:{{.Color}}">{{.Name}}</span>{{end}}
+      {{if .EpicName}}<span class="badge badge-epic">◆ {{.EpicName}}</span>{{end}}
+      {{if .ParentID}}<span class="badge badge-epic">↳ T-{{.ParentID}}</span>{{end}}
+      {{if .Points}}<span class="badge badge-points">{{.Points}} pts</span>{{end}}
+      {{with .DueDate}}<span class="badge badge-due{{if $.Overdue}} badge-overdue{{end}}" title="{{if $.Overdue}}Overdue{{else}}Due{{end}}">📅 {{.}}</span>{{end}}
+      {{if .SLABreached}}<span class="badge" title="SLA breached">⏱ SLA</span>{{end}}
+      {{with .Progress}}<div class="progress" title="{{.Done}}/{{.Total}} subtasks done"><div style="width:{{.Percent}}%"></div></div>{{end}}
+      {{if ne .State "done"}}
+      {{range .BlockedBy}}<span class="badge">⚠ {{.}}</span>{{end}}
+      {{range .Blocks}}<span class="badge badge-blocks">⛓ {{.}}</span>{{end}}
+      {{end}}
+      <div style="margin-top:6px">
+        {{if ne .State "backlog"}}<button onclick="move({{.ID}},'left')">←</button>{{end}}
+        {{if ne .State "done"}}<button onclick="move({{.ID}},'right')">→</button>{{end}}
+      </div>
+    </div>
+{{end}}`))
 }
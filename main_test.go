@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var setupOnce sync.Once
+
+// testDB connects to DATABASE_URL and brings the schema up to date, or
+// skips the test when it isn't set. Tests run as the given account, so
+// their data stays apart from anything else in the database.
+func testDB(tb testing.TB, account string) {
+	tb.Helper()
+	if os.Getenv("DATABASE_URL") == "" {
+		tb.Skip("DATABASE_URL not set")
+	}
+	setupOnce.Do(func() {
+		loadConfig()
+		initDB()
+		initSchema()
+		initTemplate()
+	})
+	cfg.AccountID = account
+}
+
+// seedBoard fills account with three projects, the given number of
+// tickets spread over them, and a chain of blocks links between the
+// first links+1 tickets.
+func seedBoard(tb testing.TB, account string, tickets, links int) {
+	tb.Helper()
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM projects WHERE account_id=$1`, []interface{}{account}},
+		{`INSERT INTO projects (account_id, key, name) VALUES
+			($1, 'BA', 'Bench A'), ($1, 'BB', 'Bench B'), ($1, 'BC', 'Bench C')`, []interface{}{account}},
+		{`INSERT INTO tickets (account_id, project_id, title, body, state, assignee, created_at)
+			SELECT $1,
+				(SELECT id FROM projects WHERE account_id=$1 ORDER BY id OFFSET (g % 3) LIMIT 1),
+				'Bench ticket ' || g, 'Body ' || g,
+				(ARRAY['backlog','todo','in_progress','done'])[1 + g % 4],
+				(ARRAY['jane','lee','sam','alex'])[1 + g % 4],
+				now() - (g || ' minutes')::interval
+			FROM generate_series(1, $2::int) g`, []interface{}{account, tickets}},
+		{`INSERT INTO ticket_links (link_type, source_ticket_id, target_ticket_id, account_id)
+			SELECT 'blocks', a.id, b.id, $1
+			FROM (SELECT id, row_number() OVER (ORDER BY id) n FROM tickets WHERE account_id=$1) a
+			JOIN (SELECT id, row_number() OVER (ORDER BY id) n FROM tickets WHERE account_id=$1) b ON b.n = a.n + 1
+			WHERE a.n <= $2
+			ON CONFLICT DO NOTHING`, []interface{}{account, links}},
+	}
+	for _, s := range steps {
+		if _, err := db.Exec(s.query, s.args...); err != nil {
+			tb.Fatalf("seed: %v", err)
+		}
+	}
+}
+
+// BenchmarkBoard times the board and ticket list against a seeded
+// account. BENCH_TICKETS and BENCH_BLOCKS size the board:
+//
+//	DATABASE_URL=... BENCH_TICKETS=2000 BENCH_BLOCKS=1000 go test -run '^$' -bench Board
+func BenchmarkBoard(b *testing.B) {
+	const account = "bench"
+	testDB(b, account)
+	seedBoard(b, account, getEnvInt("BENCH_TICKETS", 500), getEnvInt("BENCH_BLOCKS", 250))
+
+	for _, bc := range []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"board", "/board?sprint=all&project=ALL", handleBoard},
+		{"tickets", "/api/tickets?sprint=all", handleGetTickets},
+		{"tickets_page", "/api/tickets?sprint=all&limit=100", handleGetTickets},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var queries int
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				bc.handler(w, httptest.NewRequest("GET", bc.path, nil))
+				if w.Code != 200 {
+					b.Fatalf("GET %s: %d %s", bc.path, w.Code, w.Body)
+				}
+				queries, _ = strconv.Atoi(w.Header().Get("X-Ticket-Query-Count"))
+			}
+			b.ReportMetric(float64(queries), "ticket-queries/op")
+		})
+	}
+}
+
+// A PATCH whose parent is rejected changes nothing, not even the fields
+// that were valid.
+func TestUpdateTicketBadParent(t *testing.T) {
+	const account = "test-tickets"
+	testDB(t, account)
+	seedBoard(t, account, 2, 0)
+	var id, other int
+	if err := db.QueryRow("SELECT min(id), max(id) FROM tickets WHERE account_id=$1", account).Scan(&id, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PATCH", "/", strings.NewReader(body))
+		r.SetPathValue("id", strconv.Itoa(id))
+		w := httptest.NewRecorder()
+		handleUpdateTicket(w, r)
+		return w
+	}
+	body := `{"title":"Renamed","body":"","assignee":"jane","state":"todo","parent_id":` + strconv.Itoa(id) + `}`
+	if w := patch(body); w.Code != 400 {
+		t.Fatalf("parent = itself: %d %s", w.Code, w.Body)
+	}
+	var title string
+	db.QueryRow("SELECT title FROM tickets WHERE id=$1", id).Scan(&title)
+	if title == "Renamed" {
+		t.Error("the update was applied although its parent was rejected")
+	}
+
+	if w := patch(`{"title":"Renamed","body":"","assignee":"jane","state":"todo","parent_id":` + strconv.Itoa(other) + `}`); w.Code != 200 {
+		t.Fatalf("valid parent: %d %s", w.Code, w.Body)
+	}
+	var parent int
+	db.QueryRow("SELECT source_ticket_id FROM ticket_links WHERE link_type='parent' AND target_ticket_id=$1", id).Scan(&parent)
+	if db.QueryRow("SELECT title FROM tickets WHERE id=$1", id).Scan(&title); title != "Renamed" || parent != other {
+		t.Errorf("after a valid update: title %q, parent %d", title, parent)
+	}
+}
+
+func TestAddCommentConcurrent(t *testing.T) {
+	const account = "test-comments"
+	testDB(t, account)
+	seedBoard(t, account, 1, 0)
+	var id int
+	if err := db.QueryRow("SELECT id FROM tickets WHERE account_id=$1", account).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := addComment(id, "comment "+strconv.Itoa(i), "jane"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var comments string
+	db.QueryRow("SELECT comments FROM tickets WHERE id=$1", id).Scan(&comments)
+	if n := len(strings.Split(comments, "\n")); n != 20 {
+		t.Errorf("%d comments kept of 20:\n%s", n, comments)
+	}
+
+	if err := addComment(-1, "lost", "jane"); err != errTicketNotFound {
+		t.Errorf("comment on a missing ticket: %v", err)
+	}
+}
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ticket bodies and comments are Markdown, rendered here rather than in
+// the browser. The renderer never passes raw HTML through: every piece of
+// text is escaped, only the tags below are emitted, and link and image
+// URLs must be http(s), mailto or relative. It covers the common subset:
+// headings, paragraphs (a newline is a line break, as in most trackers),
+// emphasis, strikethrough, code spans, fenced code with highlighting,
+// block quotes, nested and task lists, rules, links, images, bare URLs
+// and ticket references (T-12, CART-12).
+
+type mdLine struct {
+	text string
+	n    int // line number in the source, for task toggles
+}
+
+type mdRenderer struct {
+	keys   map[string]bool // prefixes linked as ticket references
+	tasks  bool            // task checkboxes are clickable
+	out    strings.Builder
+	taskAt []int // source line of each task item, in order
+	inLink bool
+	depth  int // quotes and lists we are inside
+}
+
+// mdMaxDepth caps quote and list nesting; deeper markers are plain text,
+// so a line of "> > > ..." or "- - - ..." can't make rendering quadratic.
+const mdMaxDepth = 16
+
+// RenderedComment is one entry of the comment log, rendered.
+type RenderedComment struct {
+	At   string `json:"at"`
+	HTML string `json:"html"`
+}
+
+// renderMarkdown renders src to sanitized HTML. With tasks set, task list
+// items get checkboxes numbered in document order (see toggleTask).
+func renderMarkdown(src string, keys map[string]bool, tasks bool) string {
+	m := &mdRenderer{keys: keys, tasks: tasks}
+	m.blocks(splitLines(src), false)
+	return m.out.String()
+}
+
+// renderComments renders the "[timestamp] text" comment log.
+func renderComments(comments string, keys map[string]bool) []RenderedComment {
+	var out []RenderedComment
+	for _, line := range strings.Split(comments, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var c RenderedComment
+		if m := commentLineRe.FindStringSubmatch(line); m != nil {
+			c.At, line = m[1], m[2]
+		}
+		c.HTML = renderMarkdown(line, keys, false)
+		out = append(out, c)
+	}
+	return out
+}
+
+var commentLineRe = regexp.MustCompile(`^\[(.+?)\] (.*)$`)
+
+// ticketRefKeys returns the prefixes that link to tickets: the account's
+// project keys plus the generic T.
+func ticketRefKeys() map[string]bool {
+	keys := map[string]bool{"T": true}
+	rows, err := db.Query("SELECT key FROM projects WHERE account_id=$1", cfg.AccountID)
+	if err != nil {
+		return keys
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		if rows.Scan(&k) == nil {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// refersToTicket reports whether key-id names an existing ticket: T
+// fits any ticket, a project key only that project's tickets. Anything
+// that acts on a reference checks it, so "fixes OPS-7" can't touch
+// ticket 7 in another project.
+func refersToTicket(key string, id int) bool {
+	var projectKey string
+	err := db.QueryRow(`SELECT p.key FROM tickets t JOIN projects p ON p.id = t.project_id
+		WHERE t.id=$1 AND t.account_id=$2`, id, cfg.AccountID).Scan(&projectKey)
+	return err == nil && (key == "T" || key == projectKey)
+}
+
+func splitLines(src string) []mdLine {
+	raw := strings.Split(src, "\n")
+	lines := make([]mdLine, len(raw))
+	for i, s := range raw {
+		s = strings.TrimRight(s, "\r")
+		// Expand tabs in the indentation, which decides list nesting.
+		if j := len(s) - len(strings.TrimLeft(s, " \t")); strings.Contains(s[:j], "\t") {
+			s = strings.ReplaceAll(s[:j], "\t", "    ") + s[j:]
+		}
+		lines[i] = mdLine{text: s, n: i}
+	}
+	return lines
+}
+
+func indentOf(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+func isBlank(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+var (
+	headingRe    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	listMarkerRe = regexp.MustCompile(`^( *)([-*+]|(\d{1,9})[.)])( +|$)(.*)$`)
+	quoteRe      = regexp.MustCompile(`^ {0,3}> ?`)
+	taskRe       = regexp.MustCompile(`^\[([ xX])\](?: +|$)`)
+	checkboxRe   = regexp.MustCompile(`\[[ xX]\]`)
+)
+
+// fence reports whether s opens a fenced code block, returning the fence
+// (e.g. "```") and the info string.
+func fence(s string) (string, string, bool) {
+	if indentOf(s) > 3 {
+		return "", "", false
+	}
+	t := strings.TrimLeft(s, " ")
+	if !strings.HasPrefix(t, "```") && !strings.HasPrefix(t, "~~~") {
+		return "", "", false
+	}
+	n := len(t) - len(strings.TrimLeft(t, t[:1]))
+	info := strings.TrimSpace(t[n:])
+	if t[0] == '`' && strings.Contains(info, "`") {
+		return "", "", false
+	}
+	return t[:n], info, true
+}
+
+func isRule(s string) bool {
+	if indentOf(s) > 3 {
+		return false
+	}
+	t := strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	return len(t) >= 3 && strings.Count(t, t[:1]) == len(t) && strings.Contains("-*_", t[:1])
+}
+
+type listMarker struct {
+	indent  int
+	content int // column the item's content starts at
+	ordered bool
+	delim   byte // bullet character, or . / ) after the number
+	start   int
+	rest    string
+}
+
+func parseListMarker(s string) (listMarker, bool) {
+	m := listMarkerRe.FindStringSubmatch(s)
+	if m == nil {
+		return listMarker{}, false
+	}
+	lm := listMarker{indent: len(m[1]), rest: m[5]}
+	lm.delim = m[2][len(m[2])-1]
+	if m[3] != "" {
+		lm.ordered = true
+		lm.start, _ = strconv.Atoi(m[3])
+	}
+	spaces := len(m[4])
+	if spaces == 0 || spaces > 4 {
+		spaces = 1
+	}
+	lm.content = lm.indent + len(m[2]) + spaces
+	return lm, true
+}
+
+// startsBlock reports whether s begins a block that interrupts a paragraph.
+func startsBlock(s string) bool {
+	if _, _, ok := fence(s); ok {
+		return true
+	}
+	if _, ok := parseListMarker(s); ok {
+		return true
+	}
+	return headingRe.MatchString(s) || isRule(s) || quoteRe.MatchString(s)
+}
+
+// blocks renders a run of lines. In a tight list, paragraphs are written
+// without <p>.
+func (m *mdRenderer) blocks(lines []mdLine, tight bool) {
+	for i := 0; i < len(lines); {
+		s := lines[i].text
+		if isBlank(s) {
+			i++
+			continue
+		}
+		if f, info, ok := fence(s); ok {
+			indent := indentOf(s)
+			var code []string
+			for i++; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i].text)
+				if strings.HasPrefix(t, f) && strings.Trim(t, f[:1]) == "" {
+					i++
+					break
+				}
+				line := lines[i].text
+				line = line[min(indent, indentOf(line)):]
+				code = append(code, line)
+			}
+			m.code(strings.Join(code, "\n"), info)
+			continue
+		}
+		if h := headingRe.FindStringSubmatch(s); h != nil {
+			tag := "h" + strconv.Itoa(len(h[1]))
+			m.out.WriteString("<" + tag + ">" + m.inline(h[2]) + "</" + tag + ">\n")
+			i++
+			continue
+		}
+		if isRule(s) {
+			m.out.WriteString("<hr>\n")
+			i++
+			continue
+		}
+		if quoteRe.MatchString(s) && m.depth < mdMaxDepth {
+			var inner []mdLine
+			for ; i < len(lines) && quoteRe.MatchString(lines[i].text); i++ {
+				inner = append(inner, mdLine{quoteRe.ReplaceAllString(lines[i].text, ""), lines[i].n})
+			}
+			m.out.WriteString("<blockquote>\n")
+			m.depth++
+			m.blocks(inner, false)
+			m.depth--
+			m.out.WriteString("</blockquote>\n")
+			continue
+		}
+		if lm, ok := parseListMarker(s); ok && m.depth < mdMaxDepth {
+			i = m.list(lines, i, lm)
+			continue
+		}
+
+		var para []string
+		for ; i < len(lines) && !isBlank(lines[i].text); i++ {
+			if len(para) > 0 && startsBlock(lines[i].text) {
+				break
+			}
+			para = append(para, strings.TrimSpace(lines[i].text))
+		}
+		text := m.inline(strings.Join(para, "\n"))
+		if tight {
+			m.out.WriteString(text + "\n")
+		} else {
+			m.out.WriteString("<p>" + text + "</p>\n")
+		}
+	}
+}
+
+// list renders the list starting at lines[i] and returns the index of the
+// first line after it.
+func (m *mdRenderer) list(lines []mdLine, i int, first listMarker) int {
+	var items [][]mdLine
+	loose, done := false, false
+	for i < len(lines) && !done {
+		lm, ok := parseListMarker(lines[i].text)
+		if !ok || lm.ordered != first.ordered || lm.delim != first.delim {
+			break
+		}
+		item := []mdLine{{lm.rest, lines[i].n}}
+		i++
+		for i < len(lines) {
+			s := lines[i].text
+			if isBlank(s) {
+				// Blank lines belong to the item only if it continues.
+				j := i
+				for j < len(lines) && isBlank(lines[j].text) {
+					j++
+				}
+				if j == len(lines) {
+					i, done = j, true
+					break
+				}
+				if indentOf(lines[j].text) >= lm.content {
+					loose = true
+					for ; i < j; i++ {
+						item = append(item, mdLine{"", lines[i].n})
+					}
+					continue
+				}
+				if next, ok := parseListMarker(lines[j].text); ok && next.ordered == first.ordered && next.delim == first.delim {
+					loose = true
+					i = j
+				} else {
+					done = true
+				}
+				break
+			}
+			if indentOf(s) >= lm.content {
+				item = append(item, mdLine{s[lm.content:], lines[i].n})
+				i++
+				continue
+			}
+			if _, ok := parseListMarker(s); ok || startsBlock(s) || isBlank(lines[i-1].text) {
+				break
+			}
+			// Lazy continuation of the item's paragraph.
+			item = append(item, mdLine{strings.TrimSpace(s), lines[i].n})
+			i++
+		}
+		items = append(items, item)
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	m.out.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		m.out.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+	}
+	m.out.WriteString(">\n")
+	for _, item := range items {
+		if t := taskRe.FindStringSubmatch(item[0].text); t != nil {
+			m.out.WriteString(`<li class="task"><input type="checkbox"`)
+			if m.tasks {
+				m.out.WriteString(` data-task="` + strconv.Itoa(len(m.taskAt)) + `"`)
+			} else {
+				m.out.WriteString(" disabled")
+			}
+			if t[1] != " " {
+				m.out.WriteString(" checked")
+			}
+			m.out.WriteString("> ")
+			m.taskAt = append(m.taskAt, item[0].n)
+			item[0].text = item[0].text[len(t[0]):]
+		} else {
+			m.out.WriteString("<li>")
+		}
+		m.depth++
+		m.blocks(item, !loose)
+		m.depth--
+		m.out.WriteString("</li>\n")
+	}
+	m.out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// toggleTask sets the checkbox of the index'th task item (counted as
+// renderMarkdown numbers them) and returns the new body.
+func toggleTask(body string, index int, checked bool) (string, bool) {
+	m := &mdRenderer{tasks: true}
+	m.blocks(splitLines(body), false)
+	if index < 0 || index >= len(m.taskAt) {
+		return body, false
+	}
+	lines := strings.Split(body, "\n")
+	n := m.taskAt[index]
+	loc := checkboxRe.FindStringIndex(lines[n])
+	if loc == nil {
+		return body, false
+	}
+	mark := "[ ]"
+	if checked {
+		mark = "[x]"
+	}
+	lines[n] = lines[n][:loc[0]] + mark + lines[n][loc[1]:]
+	return strings.Join(lines, "\n"), true
+}
+
+var (
+	bareURLRe   = regexp.MustCompile(`^https?://[^\s<>"]+`)
+	autolinkRe  = regexp.MustCompile(`^<((?:https?://|mailto:)[^\s<>]+)>`)
+	ticketRefRe = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)-(\d+)`)
+)
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// safeURL allows http, https and mailto links and relative ones; anything
+// else (javascript:, data:, ...) is dropped.
+func safeURL(u string, images bool) (string, bool) {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return "", false
+	}
+	for i := 0; i < len(u); i++ {
+		if u[i] < 0x20 || u[i] == 0x7f {
+			return "", false
+		}
+	}
+	lower := strings.ToLower(u)
+	if i := strings.IndexAny(lower, ":/?#"); i >= 0 && lower[i] == ':' {
+		switch lower[:i] {
+		case "http", "https":
+		case "mailto":
+			if images {
+				return "", false
+			}
+		default:
+			return "", false
+		}
+	}
+	return u, true
+}
+
+// inlineScan is what inline learns about s as it goes, so that no part
+// of s is searched over and over: brackets and parens are matched in one
+// pass, and once the search for a closing delimiter fails from some
+// position it fails from every later one too.
+type inlineScan struct {
+	s        string
+	closing  []int          // index of the ] or ) matching each [ or (, or -1
+	noCloser map[string]int // delimiter run → position after which it has no closer
+}
+
+// match returns the index of the bracket or paren closing s[i], or -1.
+// Brackets skip backslash-escaped characters; parens don't.
+func (sc *inlineScan) match(i int) int {
+	if sc.closing == nil {
+		sc.closing = make([]int, len(sc.s))
+		var brackets, parens []int
+		pop := func(stack *[]int, j int) {
+			if n := len(*stack); n > 0 {
+				sc.closing[(*stack)[n-1]] = j
+				*stack = (*stack)[:n-1]
+			}
+		}
+		escaped := false
+		for j := 0; j < len(sc.s); j++ {
+			sc.closing[j] = -1
+			c := sc.s[j]
+			switch {
+			case c == '(':
+				parens = append(parens, j)
+			case c == ')':
+				pop(&parens, j)
+			}
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '[':
+				brackets = append(brackets, j)
+			case c == ']':
+				pop(&brackets, j)
+			}
+		}
+	}
+	return sc.closing[i]
+}
+
+// hasNoCloser reports whether the delimiter run is known to have no
+// closer at or after from; setNoCloser records that a search from there
+// found none.
+func (sc *inlineScan) hasNoCloser(run string, from int) bool {
+	p, ok := sc.noCloser[run]
+	return ok && from >= p
+}
+
+func (sc *inlineScan) setNoCloser(run string, from int) {
+	if sc.noCloser == nil {
+		sc.noCloser = map[string]int{}
+	}
+	if p, ok := sc.noCloser[run]; !ok || from < p {
+		sc.noCloser[run] = from
+	}
+}
+
+// inline renders the spans in s; all text is HTML-escaped.
+func (m *mdRenderer) inline(s string) string {
+	sc := &inlineScan{s: s}
+	var b, text strings.Builder
+	flush := func() {
+		b.WriteString(html.EscapeString(text.String()))
+		text.Reset()
+	}
+	emit := func(markup string) {
+		flush()
+		b.WriteString(markup)
+	}
+	wordStart := func(i int) bool { return i == 0 || !isWordByte(s[i-1]) }
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_~[]()#+-.!<>|", s[i+1]) >= 0:
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+		case c == '\n':
+			emit("<br>\n")
+			i++
+			continue
+		case c == '`':
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			end := -1
+			if !sc.hasNoCloser(s[i:i+n], i+n) {
+				if end = findRun(s, i+n, '`', n); end < 0 {
+					sc.setNoCloser(s[i:i+n], i+n)
+				}
+			}
+			if end >= 0 {
+				code := s[i+n : end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				emit("<code>" + html.EscapeString(code) + "</code>")
+				i = end + n
+			} else {
+				text.WriteString(s[i : i+n])
+				i += n
+			}
+			continue
+		case c == '*' || c == '_' || c == '~':
+			if markup, next, ok := m.emphasis(sc, i); ok {
+				emit(markup)
+				i = next
+				continue
+			}
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], s[i:i+1]))
+			text.WriteString(s[i : i+n])
+			i += n
+			continue
+		case c == '!' && !m.inLink && strings.HasPrefix(s[i:], "!["):
+			if alt, url, next, ok := sc.link(i + 1); ok {
+				if u, ok := safeURL(url, true); ok {
+					emit(`<img src="` + html.EscapeString(u) + `" alt="` + html.EscapeString(alt) + `" loading="lazy">`)
+				} else {
+					text.WriteString(alt)
+				}
+				i = next
+				continue
+			}
+		case c == '[' && !m.inLink:
+			if label, url, next, ok := sc.link(i); ok {
+				m.inLink = true
+				inner := m.inline(label)
+				m.inLink = false
+				if u, ok := safeURL(url, false); ok {
+					emit(`<a href="` + html.EscapeString(u) + `" rel="nofollow noopener" target="_blank">` + inner + "</a>")
+				} else {
+					emit(inner)
+				}
+				i = next
+				continue
+			}
+		case c == '<' && !m.inLink:
+			if a := autolinkRe.FindStringSubmatch(s[i:]); a != nil {
+				emit(m.urlLink(a[1]))
+				i += len(a[0])
+				continue
+			}
+		case c == 'h' && !m.inLink && wordStart(i):
+			if u := bareURLRe.FindString(s[i:]); u != "" {
+				u = trimURL(u)
+				emit(m.urlLink(u))
+				i += len(u)
+				continue
+			}
+		}
+		if !m.inLink && wordStart(i) && isWordByte(c) {
+			if ref := ticketRefRe.FindStringSubmatch(s[i:]); ref != nil && m.keys[ref[1]] &&
+				(i+len(ref[0]) == len(s) || !isWordByte(s[i+len(ref[0])])) {
+				emit(`<a href="#T-` + ref[2] + `" class="ticket-ref" data-ticket="` + ref[2] + `">` + html.EscapeString(ref[0]) + "</a>")
+				i += len(ref[0])
+				continue
+			}
+		}
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return b.String()
+}
+
+func (m *mdRenderer) urlLink(u string) string {
+	e := html.EscapeString(u)
+	return `<a href="` + e + `" rel="nofollow noopener" target="_blank">` + html.EscapeString(strings.TrimPrefix(u, "mailto:")) + "</a>"
+}
+
+// trimURL drops trailing punctuation that more likely ends the sentence
+// than the URL, keeping a closing paren that has a matching open one.
+func trimURL(u string) string {
+	open, close := strings.Count(u, "("), strings.Count(u, ")")
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		if last == ')' && open >= close {
+			break
+		}
+		if strings.IndexByte(".,:;!?'\")*_~", last) < 0 {
+			break
+		}
+		if last == ')' {
+			close--
+		}
+		u = u[:len(u)-1]
+	}
+	return u
+}
+
+// findRun returns the index of the next run of exactly n c's at or after
+// from, or -1.
+func findRun(s string, from int, c byte, n int) int {
+	for j := from; j < len(s); {
+		if s[j] != c {
+			j++
+			continue
+		}
+		k := j
+		for k < len(s) && s[k] == c {
+			k++
+		}
+		if k-j == n {
+			return j
+		}
+		j = k
+	}
+	return -1
+}
+
+// emphasis renders *em*, **strong**, ***both***, the _ forms and ~~del~~
+// starting at sc.s[i]. An underscore inside a word (snake_case) is
+// literal.
+func (m *mdRenderer) emphasis(sc *inlineScan, i int) (string, int, bool) {
+	s := sc.s
+	c := s[i]
+	n := len(s[i:]) - len(strings.TrimLeft(s[i:], string(c)))
+	if n > 3 || c == '~' && n != 2 || i+n >= len(s) || isSpaceByte(s[i+n]) {
+		return "", 0, false
+	}
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return "", 0, false
+	}
+	run := s[i : i+n]
+	if sc.hasNoCloser(run, i+n+1) {
+		return "", 0, false
+	}
+	for j := i + n + 1; j < len(s); j++ {
+		if s[j] != c || isSpaceByte(s[j-1]) {
+			continue
+		}
+		k := j
+		for k < len(s) && s[k] == c {
+			k++
+		}
+		if k-j < n || c == '_' && k < len(s) && isWordByte(s[k]) {
+			j = k - 1
+			continue
+		}
+		// With a longer run, the delimiter closes at its end, so
+		// **a *b*** closes the strong after the inner em.
+		end := k - n
+		inner := m.inline(s[i+n : end])
+		var open, close string
+		switch {
+		case c == '~':
+			open, close = "<del>", "</del>"
+		case n == 1:
+			open, close = "<em>", "</em>"
+		case n == 2:
+			open, close = "<strong>", "</strong>"
+		default:
+			open, close = "<strong><em>", "</em></strong>"
+		}
+		return open + inner + close, k, true
+	}
+	sc.setNoCloser(run, i+n+1)
+	return "", 0, false
+}
+
+// link parses [label](url "title") at sc.s[i] and returns the label,
+// the URL and the index after the link.
+func (sc *inlineScan) link(i int) (string, string, int, bool) {
+	s := sc.s
+	j := sc.match(i)
+	if j < 0 || j+1 >= len(s) || s[j+1] != '(' {
+		return "", "", 0, false
+	}
+	k := sc.match(j + 1)
+	if k < 0 {
+		return "", "", 0, false
+	}
+	dest := strings.TrimSpace(s[j+2 : k])
+	if strings.HasPrefix(dest, "<") {
+		if end := strings.IndexByte(dest, '>'); end > 0 {
+			dest = dest[1:end]
+		}
+	} else if f := strings.Fields(dest); len(f) > 0 {
+		dest = f[0] // drop the title
+	}
+	return s[i+1 : j], dest, k + 1, true
+}
+
+// code writes a fenced block, highlighted when the language is known.
+func (m *mdRenderer) code(src, info string) {
+	lang := strings.ToLower(strings.Fields(info + " x")[0])
+	if info == "" || !codeLangRe.MatchString(lang) {
+		m.out.WriteString("<pre><code>" + html.EscapeString(src) + "</code></pre>\n")
+		return
+	}
+	m.out.WriteString(`<pre><code class="language-` + lang + `">` + highlight(src, lang) + "</code></pre>\n")
+}
+
+var codeLangRe = regexp.MustCompile(`^[a-z0-9+#-]{1,20}$`)
+
+type syntax struct {
+	keywords     map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	foldCase     bool // SQL keywords are case-insensitive
+}
+
+func words(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+var (
+	goSyntax = &syntax{
+		keywords: words(`break case chan const continue default defer else fallthrough for func go goto if import
+			interface map package range return select struct switch type var nil true false iota`),
+		lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: "\"'`",
+	}
+	jsSyntax = &syntax{
+		keywords: words(`async await break case catch class const continue debugger default delete do else enum
+			export extends false finally for function if implements import in instanceof interface let new null of
+			return super switch this throw true try type typeof undefined var void while with yield`),
+		lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: "\"'`",
+	}
+	pySyntax = &syntax{
+		keywords: words(`and as assert async await break class continue def del elif else except False finally
+			for from global if import in is lambda None nonlocal not or pass raise return True try while with yield`),
+		lineComments: []string{"#"}, quotes: "\"'",
+	}
+	shSyntax = &syntax{
+		keywords:     words(`case do done elif else esac exit export fi for function if in local return then until while`),
+		lineComments: []string{"#"}, quotes: "\"'",
+	}
+	sqlSyntax = &syntax{
+		keywords: words(`all alter and as asc begin between by case commit create default delete desc distinct drop
+			else end exists false from group having in index inner insert into is join key left like limit not null
+			offset on or order outer primary references returning right rollback select set table then true union
+			update values when where with`),
+		lineComments: []string{"--"}, blockComment: [2]string{"/*", "*/"}, quotes: "'", foldCase: true,
+	}
+	yamlSyntax = &syntax{keywords: words("true false null yes no"), lineComments: []string{"#"}, quotes: "\"'"}
+)
+
+var syntaxes = map[string]*syntax{
+	"go": goSyntax, "golang": goSyntax,
+	"js": jsSyntax, "javascript": jsSyntax, "ts": jsSyntax, "typescript": jsSyntax, "json": jsSyntax,
+	"py": pySyntax, "python": pySyntax,
+	"sh": shSyntax, "bash": shSyntax, "shell": shSyntax, "console": shSyntax,
+	"sql": sqlSyntax, "psql": sqlSyntax,
+	"yaml": yamlSyntax, "yml": yamlSyntax,
+}
+
+// highlight wraps keywords, strings, comments and numbers in tok-* spans.
+// It is a tokenizer, not a parser; unknown languages are only escaped.
+func highlight(src, lang string) string {
+	syn := syntaxes[lang]
+	if syn == nil {
+		return html.EscapeString(src)
+	}
+	var b strings.Builder
+	span := func(class, tok string) {
+		b.WriteString(`<span class="tok-` + class + `">` + html.EscapeString(tok) + "</span>")
+	}
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		if open := syn.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := strings.Index(rest[len(open):], syn.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(open) + end + len(syn.blockComment[1])
+			}
+			span("com", rest[:n])
+			i += n
+			continue
+		}
+		comment := false
+		for _, lc := range syn.lineComments {
+			if strings.HasPrefix(rest, lc) {
+				comment = true
+			}
+		}
+		if comment {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			span("com", rest[:n])
+			i += n
+			continue
+		}
+		c := src[i]
+		if strings.IndexByte(syn.quotes, c) >= 0 {
+			n := 1
+			for n < len(rest) && rest[n] != c && (c == '`' || rest[n] != '\n') {
+				if rest[n] == '\\' && c != '`' {
+					n++
+				}
+				n++
+			}
+			n = min(n+1, len(rest))
+			span("str", rest[:n])
+			i += n
+			continue
+		}
+		if c >= '0' && c <= '9' && (i == 0 || !isWordByte(src[i-1])) {
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			span("num", rest[:n])
+			i += n
+			continue
+		}
+		if isWordByte(c) {
+			n := 1
+			for n < len(rest) && isWordByte(rest[n]) {
+				n++
+			}
+			word := rest[:n]
+			if syn.keywords[word] || syn.foldCase && syn.keywords[strings.ToLower(word)] {
+				span("kw", word)
+			} else {
+				b.WriteString(html.EscapeString(word))
+			}
+			i += n
+			continue
+		}
+		b.WriteString(html.EscapeString(rest[:1]))
+		i++
+	}
+	return b.String()
+}
+
+// handleToggleTask checks or unchecks one task list item in a ticket's
+// body: POST /api/tickets/{id}/tasks/{index} with {"checked": true}.
+func handleToggleTask(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid task index"})
+		return
+	}
+	var req struct {
+		Checked bool `json:"checked"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the row so a concurrent edit can't be lost.
+	var body string
+	if err := tx.QueryRow("SELECT body FROM tickets WHERE id=$1 AND account_id=$2 FOR UPDATE",
+		r.PathValue("id"), cfg.AccountID).Scan(&body); err != nil {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	body, ok := toggleTask(body, index, req.Checked)
+	if !ok {
+		writeJSON(w, 404, map[string]string{"error": "task not found"})
+		return
+	}
+	var updatedAt time.Time
+	if err := tx.QueryRow("UPDATE tickets SET body=$1, updated_at=now() WHERE id=$2 RETURNING updated_at",
+		body, r.PathValue("id")).Scan(&updatedAt); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	ticketID, _ := strconv.Atoi(r.PathValue("id"))
+	publish(Event{Type: "ticket.updated", TicketID: ticketID, Actor: currentUser(r)})
+	writeJSON(w, 200, map[string]string{
+		"status":     "updated",
+		"body":       body,
+		"body_html":  renderMarkdown(body, ticketRefKeys(), true),
+		"updated_at": updatedAt.Format(time.RFC3339Nano),
+	})
+}
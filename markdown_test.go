@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeURL(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		images bool
+		want   string
+		ok     bool
+	}{
+		{"https://example.com/a?b=c", false, "https://example.com/a?b=c", true},
+		{"  http://example.com  ", false, "http://example.com", true},
+		{"mailto:jane@example.com", false, "mailto:jane@example.com", true},
+		{"mailto:jane@example.com", true, "", false},
+		{"/api/attachments/3", true, "/api/attachments/3", true},
+		{"#T-12", false, "#T-12", true},
+		{"docs/a:b", false, "docs/a:b", true}, // the colon comes after a slash
+		{"javascript:alert(1)", false, "", false},
+		{"JaVaScRiPt:alert(1)", false, "", false},
+		{"vbscript:msgbox(1)", false, "", false},
+		{"data:text/html,<script>alert(1)</script>", false, "", false},
+		{"data:image/png;base64,AAAA", true, "", false},
+		{"java\nscript:alert(1)", false, "", false},
+		{"java\x00script:alert(1)", false, "", false},
+		{"", false, "", false},
+	} {
+		got, ok := safeURL(tc.url, tc.images)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("safeURL(%q, %v) = %q, %v; want %q, %v", tc.url, tc.images, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	keys := map[string]bool{"T": true, "CART": true}
+	const a = ` rel="nofollow noopener" target="_blank"`
+
+	for _, tc := range []struct {
+		src, want string
+	}{
+		// URL schemes
+		{"[x](javascript:alert(1))", "<p>x</p>\n"},
+		{"[x](JaVaScRiPt:alert(1))", "<p>x</p>\n"},
+		{"[x]( javascript:alert(1))", "<p>x</p>\n"},
+		{"[x](data:text/html,hi)", "<p>x</p>\n"},
+		{"![i](data:image/png;base64,AAAA)", "<p>i</p>\n"},
+		{"![i](mailto:a@example.com)", "<p>i</p>\n"},
+		{"<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"[x](mailto:a@example.com)", `<p><a href="mailto:a@example.com"` + a + ">x</a></p>\n"},
+		{"[x](/rel?a=1&b=2)", `<p><a href="/rel?a=1&amp;b=2"` + a + ">x</a></p>\n"},
+
+		// Quotes can't leave an attribute; titles are dropped.
+		{`[x](http://e.com/a"b)`, `<p><a href="http://e.com/a&#34;b"` + a + ">x</a></p>\n"},
+		{`[x](http://e.com "a\"b")`, `<p><a href="http://e.com"` + a + ">x</a></p>\n"},
+		{`[x](http://e.com/"onmouseover="alert(1) "t")`, `<p><a href="http://e.com/&#34;onmouseover=&#34;alert(1)"` + a + ">x</a></p>\n"},
+		{`![a"b onerror=x](http://e.com/i.png)`, `<p><img src="http://e.com/i.png" alt="a&#34;b onerror=x" loading="lazy"></p>` + "\n"},
+		{`[a "q" label](http://e.com)`, `<p><a href="http://e.com"` + a + ">a &#34;q&#34; label</a></p>\n"},
+		{`<http://e.com/?a="b">`, `<p><a href="http://e.com/?a=&#34;b&#34;"` + a + ">http://e.com/?a=&#34;b&#34;</a></p>\n"},
+		{`http://e.com/"><script>`, `<p><a href="http://e.com/"` + a + ">http://e.com/</a>&#34;&gt;&lt;script&gt;</p>\n"},
+
+		// Raw HTML is text.
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"**<b>**", "<p><strong>&lt;b&gt;</strong></p>\n"},
+		{"`<i>`", "<p><code>&lt;i&gt;</code></p>\n"},
+		{"```html\n<script>\n```", `<pre><code class="language-html">&lt;script&gt;</code></pre>` + "\n"},
+		{"```\"><script>\nx\n```", "<pre><code>x</code></pre>\n"},
+
+		// Ticket references and bare URLs
+		{"see T-12, CART-3 and X-1", `<p>see <a href="#T-12" class="ticket-ref" data-ticket="12">T-12</a>, ` +
+			`<a href="#T-3" class="ticket-ref" data-ticket="3">CART-3</a> and X-1</p>` + "\n"},
+		{"http://e.com/a_(b)).", `<p><a href="http://e.com/a_(b)"` + a + ">http://e.com/a_(b)</a>).</p>\n"},
+
+		{"> a\n> > b", "<blockquote>\n<p>a</p>\n<blockquote>\n<p>b</p>\n</blockquote>\n</blockquote>\n"},
+	} {
+		if got := renderMarkdown(tc.src, keys, false); got != tc.want {
+			t.Errorf("renderMarkdown(%q) =\n%q\nwant\n%q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestRenderMarkdownNesting(t *testing.T) {
+	for _, tc := range []struct {
+		src, tag string
+	}{
+		{strings.Repeat("> ", 5000) + "x", "<blockquote>"},
+		{strings.Repeat("- ", 5000) + "x", "<ul>"},
+		{strings.Repeat("1. ", 5000) + "x", "<ol>"},
+	} {
+		out := renderMarkdown(tc.src, nil, false)
+		if n := strings.Count(out, tc.tag); n != mdMaxDepth {
+			t.Errorf("%.10q...: %d %s, want %d", tc.src, n, tc.tag, mdMaxDepth)
+		}
+		if strings.Count(out, "<"+tc.tag[1:]) != strings.Count(out, "</"+tc.tag[1:]) {
+			t.Errorf("%.10q...: unbalanced %s", tc.src, tc.tag)
+		}
+	}
+}
+
+// Inputs that make naive delimiter matching quadratic. At this size that
+// takes minutes; a linear scan takes milliseconds.
+func TestRenderMarkdownLinear(t *testing.T) {
+	for _, src := range []string{
+		strings.Repeat("[", 100000),
+		strings.Repeat("![", 50000),
+		strings.Repeat("[a](", 30000),
+		strings.Repeat("*a", 50000),
+		strings.Repeat("**a", 30000),
+		strings.Repeat("_a ", 30000),
+		strings.Repeat("~~a", 30000),
+		strings.Repeat("`a", 50000),
+		strings.Repeat("(", 50000) + "http://e.com" + strings.Repeat(")", 50000),
+	} {
+		start := time.Now()
+		renderMarkdown(src, nil, false)
+		if d := time.Since(start); d > 3*time.Second {
+			t.Errorf("%.10q... (%d bytes) took %v", src, len(src), d)
+		}
+	}
+}
+
+func TestToggleTask(t *testing.T) {
+	body := "```\n- [ ] not a task\n```\n- [ ] one\n  - [ ] two\n> - [ ] quoted\n* [X] three"
+	for _, tc := range []struct {
+		index   int
+		checked bool
+		want    string
+		ok      bool
+	}{
+		{0, true, "```\n- [ ] not a task\n```\n- [x] one\n  - [ ] two\n> - [ ] quoted\n* [X] three", true},
+		{1, true, "```\n- [ ] not a task\n```\n- [ ] one\n  - [x] two\n> - [ ] quoted\n* [X] three", true},
+		{2, true, "```\n- [ ] not a task\n```\n- [ ] one\n  - [ ] two\n> - [x] quoted\n* [X] three", true},
+		{3, false, "```\n- [ ] not a task\n```\n- [ ] one\n  - [ ] two\n> - [ ] quoted\n* [ ] three", true},
+		{4, true, body, false},
+		{-1, true, body, false},
+	} {
+		got, ok := toggleTask(body, tc.index, tc.checked)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("toggleTask(%d, %v) = %q, %v; want %q, %v", tc.index, tc.checked, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// The checkboxes renderMarkdown numbers are the ones toggleTask finds.
+	html := renderMarkdown(body, nil, true)
+	for i, want := range []string{`data-task="0">`, `data-task="1">`, `data-task="2">`, `data-task="3" checked>`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("task %d: %q not in %q", i, want, html)
+		}
+	}
+	if strings.Contains(html, `data-task="4"`) {
+		t.Errorf("the fenced task was numbered: %q", html)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// @mentions: comments and ticket descriptions are scanned for @username.
+// Pippin has no user table, so a name only counts if it is a known user:
+// someone tickets are assigned to or who saved notification settings.
+// Each mention is stored in the mentions table, which is the user's
+// mentions inbox, and notifies them (notify.go). A description mentions
+// someone once; editing it only notifies people newly mentioned.
+
+type Mention struct {
+	ID          int        `json:"id"`
+	TicketID    int        `json:"ticket_id"`
+	TicketRef   string     `json:"ticket_ref"`
+	TicketTitle string     `json:"ticket_title"`
+	Source      string     `json:"source"` // comment or body
+	Actor       string     `json:"actor"`
+	Excerpt     string     `json:"excerpt"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+// knownUsers lists the account's users, sorted.
+func knownUsers() ([]string, error) {
+	rows, err := db.Query(`SELECT assignee FROM tickets WHERE account_id=$1 AND assignee <> ''
+		UNION SELECT username FROM notification_prefs WHERE account_id=$1
+		ORDER BY 1`, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []string{}
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// resolveMentions returns the known users mentioned in text, spelled as
+// they are known; matching ignores case.
+func resolveMentions(text string) []string {
+	names := parseMentions(text)
+	if len(names) == 0 {
+		return nil
+	}
+	users, err := knownUsers()
+	if err != nil {
+		log.Printf("mentions: %v", err)
+		return nil
+	}
+	byLower := map[string]string{}
+	for _, u := range users {
+		byLower[strings.ToLower(u)] = u
+	}
+	var out []string
+	seen := map[string]bool{}
+	for _, n := range names {
+		if u, ok := byLower[strings.ToLower(n)]; ok && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// mentionExcerpt is the line of text that mentions user, shortened.
+func mentionExcerpt(text, user string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(strings.ToLower(line), "@"+strings.ToLower(user)); i >= 0 {
+			line = strings.TrimSpace(line)
+			if r := []rune(line); len(r) > 200 {
+				line = string(r[:199]) + "…"
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// recordMentions stores and notifies the mentions in a comment or body
+// and returns who was newly mentioned. Errors are only logged.
+func recordMentions(ticketID int, source, text, actor string) []string {
+	var added []string
+	for _, user := range resolveMentions(text) {
+		if user == actor {
+			continue
+		}
+		excerpt := mentionExcerpt(text, user)
+		var id int
+		// Body mentions are unique per ticket and user, so re-saving a
+		// description conflicts and notifies nobody again.
+		err := db.QueryRow(`INSERT INTO mentions (account_id, ticket_id, username, source, actor, excerpt)
+			VALUES ($1,$2,$3,$4,$5,$6) ON CONFLICT DO NOTHING RETURNING id`,
+			cfg.AccountID, ticketID, user, source, actor, excerpt).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("mentions: T-%d %s: %v", ticketID, user, err)
+			continue
+		}
+		added = append(added, user)
+		autoWatch(ticketID, "mentioned", user)
+		notify("mentioned", ticketID, actor, excerpt, user)
+	}
+	return added
+}
+
+func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := knownUsers()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, users)
+}
+
+// mentionsUser is the user whose inbox a request reads, or "" after
+// writing the error.
+func mentionsUser(w http.ResponseWriter, r *http.Request) string {
+	user := currentUser(r)
+	if user == "" {
+		writeJSON(w, 400, map[string]string{"error": "set your username first (X-Pippin-User header or Settings)"})
+	}
+	return user
+}
+
+var mentionSortColumns = map[string]sortColumn[Mention]{
+	"id":      {"m.id", func(m *Mention) string { return strconv.Itoa(m.ID) }},
+	"created": {"m.created_at", func(m *Mention) string { return cursorTime(m.CreatedAt) }},
+}
+
+// handleGetMentions is the current user's mentions inbox, newest first,
+// paged like the other lists but 50 at a time when no limit is given.
+// ?unread=true leaves out read ones.
+func handleGetMentions(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	opts, err := parseListOptions(r, mentionSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if opts.Limit == 0 {
+		opts.Limit = 50
+	}
+	query := `SELECT m.id, m.ticket_id, p.key, t.title, m.source, m.actor, m.excerpt, m.created_at, m.read_at
+		FROM mentions m JOIN tickets t ON t.id = m.ticket_id JOIN projects p ON p.id = t.project_id
+		WHERE m.account_id=$1 AND m.username=$2`
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID, user}}
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND m.read_at IS NULL"
+	}
+	where, tail := pageSQL(opts, b, mentionSortColumns, "-id", "m.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	var list []Mention
+	for rows.Next() {
+		var m Mention
+		var key string
+		if err := rows.Scan(&m.ID, &m.TicketID, &key, &m.TicketTitle, &m.Source, &m.Actor, &m.Excerpt, &m.CreatedAt, &m.ReadAt); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		m.TicketRef = key + "-" + strconv.Itoa(m.TicketID)
+		list = append(list, m)
+	}
+	writeList(w, r, list, opts, mentionSortColumns, "-id", func(m *Mention) int { return m.ID })
+}
+
+func handleMentionCount(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM mentions WHERE account_id=$1 AND username=$2 AND read_at IS NULL",
+		cfg.AccountID, user).Scan(&n); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]int{"unread": n})
+}
+
+func handleReadMention(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	result, err := db.Exec("UPDATE mentions SET read_at=COALESCE(read_at, now()) WHERE id=$1 AND account_id=$2 AND username=$3",
+		r.PathValue("id"), cfg.AccountID, user)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "mention not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "read"})
+}
+
+func handleReadAllMentions(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	if _, err := db.Exec("UPDATE mentions SET read_at=now() WHERE account_id=$1 AND username=$2 AND read_at IS NULL",
+		cfg.AccountID, user); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "read"})
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notifications: handlers call notify when something happens to a user's
+// ticket. Each one is recorded in the notifications table and, if the
+// user has an email address and wants that kind, turned into an email in
+// email_outbox; users on a digest get one email per hour or day instead.
+// Nothing talks to the SMTP server inside a request: the notifier
+// (runNotifier) sends the outbox with retries, builds digests and queues
+// due-date reminders, on every instance, sharing the work through row
+// locks like the webhook worker.
+
+const (
+	mailMaxAttempts = 10
+	mailBaseDelay   = time.Minute
+	mailMaxDelay    = 6 * time.Hour
+	mailBatch       = 20
+)
+
+var digestModes = map[string]bool{"off": true, "hourly": true, "daily": true}
+
+type NotificationPrefs struct {
+	User         string `json:"user"`
+	Email        string `json:"email"`
+	Assigned     bool   `json:"assigned"`
+	Mentioned    bool   `json:"mentioned"`
+	StateChanged bool   `json:"state_changed"`
+	Commented    bool   `json:"commented"`
+	DueSoon      bool   `json:"due_soon"`
+	Digest       string `json:"digest"` // off, hourly or daily
+}
+
+// defaultPrefs applies to users who never saved any: everything on, sent
+// straight away, to the username if it is an email address.
+func defaultPrefs(user string) NotificationPrefs {
+	p := NotificationPrefs{User: user, Assigned: true, Mentioned: true, StateChanged: true,
+		Commented: true, DueSoon: true, Digest: "off"}
+	if strings.Contains(user, "@") {
+		p.Email = user
+	}
+	return p
+}
+
+func loadPrefs(user string) (NotificationPrefs, error) {
+	p := NotificationPrefs{User: user}
+	err := db.QueryRow(`SELECT email, assigned, mentioned, state_changed, commented, due_soon, digest
+		FROM notification_prefs WHERE account_id=$1 AND username=$2`, cfg.AccountID, user).
+		Scan(&p.Email, &p.Assigned, &p.Mentioned, &p.StateChanged, &p.Commented, &p.DueSoon, &p.Digest)
+	if err == sql.ErrNoRows {
+		return defaultPrefs(user), nil
+	}
+	return p, err
+}
+
+func (p NotificationPrefs) wants(kind string) bool {
+	switch kind {
+	case "assigned":
+		return p.Assigned
+	case "mentioned":
+		return p.Mentioned
+	case "state_changed", "blocker_resolved":
+		return p.StateChanged
+	case "commented":
+		return p.Commented
+	case "due_soon", "sla_breached":
+		return p.DueSoon
+	}
+	return false
+}
+
+// mentionRe finds @username mentions; the @ must not follow a word
+// character, so email addresses don't count.
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9_][A-Za-z0-9_.-]*[A-Za-z0-9_]|[A-Za-z0-9_])`)
+
+func parseMentions(text string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
+
+// notifyTicket is what notifications show of a ticket.
+type notifyTicket struct {
+	ID    int
+	Ref   string // CART-42
+	Title string
+	URL   string
+}
+
+func loadNotifyTicket(ticketID int) (notifyTicket, error) {
+	t := notifyTicket{ID: ticketID}
+	var key string
+	err := db.QueryRow(`SELECT p.key, t.title FROM tickets t JOIN projects p ON p.id = t.project_id
+		WHERE t.id=$1 AND t.account_id=$2`, ticketID, cfg.AccountID).Scan(&key, &t.Title)
+	t.Ref = fmt.Sprintf("%s-%d", key, ticketID)
+	t.URL = fmt.Sprintf("%s/board#T-%d", cfg.BaseURL, ticketID)
+	return t, err
+}
+
+// notifyLine describes a notification in a sentence, and the subject of
+// its email.
+func notifyLine(kind string, t notifyTicket, actor, detail string) (subject, line string) {
+	if actor == "" {
+		actor = "Pippin"
+	}
+	switch kind {
+	case "assigned":
+		return fmt.Sprintf("%s assigned to you: %s", t.Ref, t.Title), fmt.Sprintf("%s assigned %s to you.", actor, t.Ref)
+	case "mentioned":
+		return fmt.Sprintf("%s mentioned you on %s: %s", actor, t.Ref, t.Title), fmt.Sprintf("%s mentioned you on %s.", actor, t.Ref)
+	case "state_changed":
+		state := stateTitles[detail]
+		if state == "" {
+			state = detail
+		}
+		return fmt.Sprintf("%s moved to %s: %s", t.Ref, state, t.Title), fmt.Sprintf("%s moved %s to %s.", actor, t.Ref, state)
+	case "commented":
+		return fmt.Sprintf("%s commented on %s: %s", actor, t.Ref, t.Title), fmt.Sprintf("%s commented on %s.", actor, t.Ref)
+	case "due_soon":
+		return fmt.Sprintf("%s is due %s: %s", t.Ref, detail, t.Title), fmt.Sprintf("%s is due %s.", t.Ref, detail)
+	case "sla_breached":
+		return fmt.Sprintf("%s broke its SLA: %s", t.Ref, t.Title), fmt.Sprintf("%s has been %s.", t.Ref, detail)
+	case "blocker_resolved":
+		return fmt.Sprintf("%s is no longer blocked by T-%s: %s", t.Ref, detail, t.Title),
+			fmt.Sprintf("%s finished T-%s, which was blocking %s.", actor, detail, t.Ref)
+	}
+	return t.Ref + ": " + t.Title, t.Ref + " changed."
+}
+
+// notifyItem is one notification as rendered into an email.
+type notifyItem struct {
+	Line   string
+	Ticket notifyTicket
+	Quote  string // comment text, for comments and mentions
+	At     time.Time
+}
+
+type mailData struct {
+	Items   []notifyItem
+	BaseURL string
+}
+
+var (
+	mailText = texttemplate.Must(texttemplate.New("mail").Parse(`{{range .Items}}{{.Line}}
+
+{{.Ticket.Ref}}: {{.Ticket.Title}}
+{{.Ticket.URL}}
+{{with .Quote}}
+> {{.}}
+{{end}}
+{{end}}--
+You can change which emails you get in Pippin under Settings: {{.BaseURL}}/board
+`))
+	mailHTML = htmltemplate.Must(htmltemplate.New("mail").Parse(`<!DOCTYPE html>
+<html><body style="font-family:-apple-system,Segoe UI,Roboto,sans-serif;font-size:14px;color:#3a2e2a">
+{{range .Items}}
+<div style="margin-bottom:16px">
+  <p style="margin:0 0 4px 0">{{.Line}}</p>
+  <p style="margin:0"><a href="{{.Ticket.URL}}" style="color:#a0522d;font-weight:600">{{.Ticket.Ref}}</a> {{.Ticket.Title}}</p>
+  {{with .Quote}}<blockquote style="margin:6px 0;padding-left:8px;border-left:3px solid #e8d5c4;color:#6b5b53">{{.}}</blockquote>{{end}}
+</div>
+{{end}}
+<p style="font-size:12px;color:#8a7a72">You can change which emails you get in <a href="{{.BaseURL}}/board">Pippin</a> under Settings.</p>
+</body></html>
+`))
+)
+
+func renderMail(to, subject string, items []notifyItem) (mailMessage, error) {
+	data := mailData{Items: items, BaseURL: cfg.BaseURL}
+	var text, html bytes.Buffer
+	if err := mailText.Execute(&text, data); err != nil {
+		return mailMessage{}, err
+	}
+	if err := mailHTML.Execute(&html, data); err != nil {
+		return mailMessage{}, err
+	}
+	return mailMessage{To: to, Subject: "[Pippin] " + subject, Text: text.String(), HTML: html.String()}, nil
+}
+
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func queueMail(q dbExecer, m mailMessage) error {
+	_, err := q.Exec(`INSERT INTO email_outbox (account_id, to_addr, subject, text_body, html_body)
+		VALUES ($1,$2,$3,$4,$5)`, cfg.AccountID, m.To, m.Subject, m.Text, m.HTML)
+	return err
+}
+
+// notify records a notification for each recipient except the actor, and
+// queues or holds back its email. detail is the comment for comments and
+// mentions, the new state for state changes and the date for reminders.
+// Errors are only logged: the change itself has already happened.
+func notify(kind string, ticketID int, actor, detail string, recipients ...string) {
+	var t notifyTicket
+	loaded := false
+	seen := map[string]bool{}
+	for _, user := range recipients {
+		if user == "" || user == actor || seen[user] {
+			continue
+		}
+		seen[user] = true
+		if !loaded {
+			var err error
+			if t, err = loadNotifyTicket(ticketID); err != nil {
+				log.Printf("notify: T-%d: %v", ticketID, err)
+				return
+			}
+			loaded = true
+		}
+
+		// Reminders are unique per ticket, user and date; a second
+		// instance queuing the same one gets nothing back.
+		var id int
+		err := db.QueryRow(`INSERT INTO notifications (account_id, username, kind, ticket_id, actor, detail)
+			VALUES ($1,$2,$3,$4,$5,$6) ON CONFLICT DO NOTHING RETURNING id`,
+			cfg.AccountID, user, kind, ticketID, actor, detail).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("notify %s %s: %v", kind, user, err)
+			continue
+		}
+
+		if cfg.SMTPHost == "" {
+			continue
+		}
+		prefs, err := loadPrefs(user)
+		if err != nil {
+			log.Printf("notify %s %s: %v", kind, user, err)
+			continue
+		}
+		if prefs.Email == "" || !prefs.wants(kind) {
+			continue
+		}
+		if prefs.Digest != "off" {
+			db.Exec("UPDATE notifications SET digest_pending=true WHERE id=$1", id)
+			continue
+		}
+		subject, line := notifyLine(kind, t, actor, detail)
+		item := notifyItem{Line: line, Ticket: t, At: time.Now()}
+		if kind == "commented" || kind == "mentioned" {
+			item.Quote = detail
+		}
+		m, err := renderMail(prefs.Email, subject, []notifyItem{item})
+		if err == nil {
+			err = queueMail(db, m)
+		}
+		if err != nil {
+			log.Printf("notify %s %s: %v", kind, user, err)
+		}
+	}
+}
+
+// ticketAudience is who hears about changes to a ticket: its watchers
+// (see watchers.go).
+func ticketAudience(ticketID int) []string {
+	users, err := ticketWatchers(ticketID)
+	if err != nil {
+		log.Printf("notify: audience of T-%d: %v", ticketID, err)
+	}
+	return users
+}
+
+// notifyComment tells the people @mentioned in a comment (see
+// mentions.go), and the rest of the ticket's audience that it was made.
+func notifyComment(ticketID int, comment, actor string) {
+	told := map[string]bool{}
+	for _, u := range recordMentions(ticketID, "comment", comment, actor) {
+		told[u] = true
+	}
+	var rest []string
+	for _, u := range ticketAudience(ticketID) {
+		if !told[u] {
+			rest = append(rest, u)
+		}
+	}
+	notify("commented", ticketID, actor, comment, rest...)
+}
+
+// notifyStateChange tells a ticket's audience it moved. A ticket that is
+// done no longer blocks anything, so the audiences of the tickets it
+// blocked hear about that too.
+func notifyStateChange(ticketID int, actor, state string) {
+	notify("state_changed", ticketID, actor, state, ticketAudience(ticketID)...)
+	if state != "done" {
+		return
+	}
+	rows, err := db.Query("SELECT blocked_ticket_id FROM blocks WHERE blocker_ticket_id=$1 AND account_id=$2", ticketID, cfg.AccountID)
+	if err != nil {
+		log.Printf("notify: tickets blocked by T-%d: %v", ticketID, err)
+		return
+	}
+	var blocked []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			blocked = append(blocked, id)
+		}
+	}
+	rows.Close()
+	for _, id := range blocked {
+		notify("blocker_resolved", id, actor, strconv.Itoa(ticketID), ticketAudience(id)...)
+	}
+}
+
+func runNotifier(interval time.Duration) {
+	for {
+		queueDueReminders()
+		for {
+			sent, err := runNextDigest()
+			if err != nil {
+				log.Printf("digest: %v", err)
+			}
+			if !sent || err != nil {
+				break
+			}
+		}
+		if cfg.SMTPHost != "" {
+			for {
+				n, err := runMailBatch()
+				if err != nil {
+					log.Printf("mail: %v", err)
+				}
+				if n < mailBatch || err != nil {
+					break
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// queueDueReminders notifies the watchers of open tickets due today or
+// tomorrow, once per ticket, watcher and due date.
+func queueDueReminders() {
+	rows, err := db.Query(`SELECT t.id, w.username, to_char(t.due_date, 'YYYY-MM-DD')
+		FROM tickets t JOIN ticket_watchers w ON w.ticket_id = t.id AND w.watching
+		WHERE t.account_id=$1 AND t.state <> 'done'
+			AND t.due_date BETWEEN CURRENT_DATE AND CURRENT_DATE + 1
+			AND NOT EXISTS (SELECT 1 FROM notifications n WHERE n.ticket_id = t.id AND n.kind = 'due_soon'
+				AND n.username = w.username AND n.detail = to_char(t.due_date, 'YYYY-MM-DD'))`, cfg.AccountID)
+	if err != nil {
+		log.Printf("due reminders: %v", err)
+		return
+	}
+	type due struct {
+		id         int
+		user, date string
+	}
+	var list []due
+	for rows.Next() {
+		var d due
+		if rows.Scan(&d.id, &d.user, &d.date) == nil {
+			list = append(list, d)
+		}
+	}
+	rows.Close()
+	for _, d := range list {
+		notify("due_soon", d.id, "", d.date, d.user)
+	}
+}
+
+// runNextDigest sends one user's digest once their oldest held
+// notification is a period old. The prefs row lock keeps two instances
+// from sending the same digest.
+func runNextDigest() (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var user, email string
+	err = tx.QueryRow(`SELECT p.username, p.email FROM notification_prefs p
+		WHERE p.account_id=$1 AND p.digest <> 'off' AND p.email <> ''
+			AND EXISTS (SELECT 1 FROM notifications n WHERE n.account_id = p.account_id AND n.username = p.username
+				AND n.digest_pending AND n.created_at <= now() - CASE p.digest WHEN 'hourly' THEN interval '1 hour' ELSE interval '1 day' END)
+		LIMIT 1 FOR UPDATE OF p SKIP LOCKED`, cfg.AccountID).Scan(&user, &email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(`SELECT n.id, n.kind, n.ticket_id, n.actor, n.detail, n.created_at FROM notifications n
+		WHERE n.account_id=$1 AND n.username=$2 AND n.digest_pending ORDER BY n.id`, cfg.AccountID, user)
+	if err != nil {
+		return false, err
+	}
+	type held struct {
+		id, ticketID        int
+		kind, actor, detail string
+		at                  time.Time
+	}
+	var list []held
+	for rows.Next() {
+		var h held
+		if err := rows.Scan(&h.id, &h.kind, &h.ticketID, &h.actor, &h.detail, &h.at); err != nil {
+			rows.Close()
+			return false, err
+		}
+		list = append(list, h)
+	}
+	rows.Close()
+
+	var ids []int64
+	var items []notifyItem
+	for _, h := range list {
+		ids = append(ids, int64(h.id))
+		t, err := loadNotifyTicket(h.ticketID)
+		if err != nil {
+			continue // deleted since
+		}
+		_, line := notifyLine(h.kind, t, h.actor, h.detail)
+		item := notifyItem{Line: line, Ticket: t, At: h.at}
+		if h.kind == "commented" || h.kind == "mentioned" {
+			item.Quote = h.detail
+		}
+		items = append(items, item)
+	}
+	if len(items) > 0 {
+		subject := fmt.Sprintf("%d updates on your tickets", len(items))
+		if len(items) == 1 {
+			subject = "1 update on your tickets"
+		}
+		m, err := renderMail(email, subject, items)
+		if err != nil {
+			return false, err
+		}
+		if err := queueMail(tx, m); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE notifications SET digest_pending=false WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// runMailBatch sends up to mailBatch due emails from the outbox.
+func runMailBatch() (int, error) {
+	rows, err := db.Query(`UPDATE email_outbox SET next_attempt_at = now() + interval '5 minutes'
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status='pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, to_addr, subject, text_body, html_body, attempts`, mailBatch)
+	if err != nil {
+		return 0, err
+	}
+	type queued struct {
+		id       int
+		msg      mailMessage
+		attempts int
+	}
+	var batch []queued
+	for rows.Next() {
+		var q queued
+		if err := rows.Scan(&q.id, &q.msg.To, &q.msg.Subject, &q.msg.Text, &q.msg.HTML, &q.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, q := range batch {
+		q.attempts++
+		err := sendMail(q.msg)
+		status, errText := "sent", ""
+		var next, sentAt interface{}
+		if err != nil {
+			errText = err.Error()
+			if q.attempts >= mailMaxAttempts {
+				status = "failed"
+			} else {
+				status = "pending"
+				next = time.Now().UTC().Add(retryBackoff(q.attempts, mailBaseDelay, mailMaxDelay))
+			}
+			log.Printf("mail %d to %s attempt %d: %v", q.id, q.msg.To, q.attempts, err)
+		} else {
+			sentAt = time.Now().UTC()
+		}
+		if _, err := db.Exec(`UPDATE email_outbox SET status=$1, attempts=$2, next_attempt_at=$3, last_error=$4, sent_at=$5
+			WHERE id=$6`, status, q.attempts, next, errText, sentAt, q.id); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// handleGetNotificationPrefs returns the current user's preferences
+// (see currentUser); defaults if they never saved any.
+func handleGetNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == "" {
+		writeJSON(w, 400, map[string]string{"error": "set your username first (X-Pippin-User header or Settings)"})
+		return
+	}
+	p, err := loadPrefs(user)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, p)
+}
+
+func handleUpdateNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == "" {
+		writeJSON(w, 400, map[string]string{"error": "set your username first (X-Pippin-User header or Settings)"})
+		return
+	}
+	req := defaultPrefs(user)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && (!strings.Contains(req.Email, "@") || strings.ContainsAny(req.Email, " <>,\r\n")) {
+		writeJSON(w, 400, map[string]string{"error": "invalid email address"})
+		return
+	}
+	if req.Digest == "" {
+		req.Digest = "off"
+	}
+	if !digestModes[req.Digest] {
+		writeJSON(w, 400, map[string]string{"error": "digest must be off, hourly or daily"})
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO notification_prefs (account_id, username, email, assigned, mentioned, state_changed, commented, due_soon, digest)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+		ON CONFLICT (account_id, username) DO UPDATE SET email=EXCLUDED.email, assigned=EXCLUDED.assigned,
+			mentioned=EXCLUDED.mentioned, state_changed=EXCLUDED.state_changed, commented=EXCLUDED.commented,
+			due_soon=EXCLUDED.due_soon, digest=EXCLUDED.digest`,
+		cfg.AccountID, user, req.Email, req.Assigned, req.Mentioned, req.StateChanged, req.Commented, req.DueSoon, req.Digest)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Digest == "off" {
+		// Nothing is held for a digest any more; what was is dropped.
+		db.Exec("UPDATE notifications SET digest_pending=false WHERE account_id=$1 AND username=$2 AND digest_pending", cfg.AccountID, user)
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+// Notification is an entry in a user's in-app notification center.
+type Notification struct {
+	ID          int        `json:"id"`
+	Kind        string     `json:"kind"`
+	TicketID    int        `json:"ticket_id"`
+	TicketRef   string     `json:"ticket_ref"`
+	TicketTitle string     `json:"ticket_title"`
+	Actor       string     `json:"actor"`
+	Detail      string     `json:"detail"`
+	Text        string     `json:"text"` // one line, as in emails
+	CreatedAt   time.Time  `json:"created_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+var notificationSortColumns = map[string]sortColumn[Notification]{
+	"id":      {"n.id", func(n *Notification) string { return strconv.Itoa(n.ID) }},
+	"created": {"n.created_at", func(n *Notification) string { return cursorTime(n.CreatedAt) }},
+}
+
+// handleGetNotifications lists the current user's notifications, newest
+// first, paged like the other lists but 50 at a time when no limit is
+// given. ?unread=true leaves out read ones.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	opts, err := parseListOptions(r, notificationSortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if opts.Limit == 0 {
+		opts.Limit = 50
+	}
+	query := `SELECT n.id, n.kind, n.ticket_id, p.key, t.title, n.actor, n.detail, n.created_at, n.read_at
+		FROM notifications n JOIN tickets t ON t.id = n.ticket_id JOIN projects p ON p.id = t.project_id
+		WHERE n.account_id=$1 AND n.username=$2`
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID, user}}
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND n.read_at IS NULL"
+	}
+	where, tail := pageSQL(opts, b, notificationSortColumns, "-id", "n.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		var key string
+		if err := rows.Scan(&n.ID, &n.Kind, &n.TicketID, &key, &n.TicketTitle, &n.Actor, &n.Detail, &n.CreatedAt, &n.ReadAt); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		n.TicketRef = key + "-" + strconv.Itoa(n.TicketID)
+		_, n.Text = notifyLine(n.Kind, notifyTicket{ID: n.TicketID, Ref: n.TicketRef, Title: n.TicketTitle}, n.Actor, n.Detail)
+		list = append(list, n)
+	}
+	writeList(w, r, list, opts, notificationSortColumns, "-id", func(n *Notification) int { return n.ID })
+}
+
+func handleNotificationCount(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM notifications WHERE account_id=$1 AND username=$2 AND read_at IS NULL",
+		cfg.AccountID, user).Scan(&n); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]int{"unread": n})
+}
+
+func handleReadNotification(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	result, err := db.Exec("UPDATE notifications SET read_at=COALESCE(read_at, now()) WHERE id=$1 AND account_id=$2 AND username=$3",
+		r.PathValue("id"), cfg.AccountID, user)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "notification not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "read"})
+}
+
+func handleReadAllNotifications(w http.ResponseWriter, r *http.Request) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	if _, err := db.Exec("UPDATE notifications SET read_at=now() WHERE account_id=$1 AND username=$2 AND read_at IS NULL",
+		cfg.AccountID, user); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "read"})
+}
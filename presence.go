@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Presence: the board keeps a WebSocket open on /api/ws and reports the
+// ticket it has open in the ticket view and whether the user has started
+// editing it. Rows in ticket_presence are shared by all instances and
+// changes fan out as presence.changed events (events.go), so everyone
+// sees who is viewing or editing what, on cards and in the modal.
+//
+// Editing is a soft lock: others get a warning, not a refusal. Lost
+// updates are prevented separately, by expected_updated_at on PATCH.
+
+// presenceTTL is how long a row lives without a heartbeat, e.g. after an
+// instance died without cleaning up.
+const presenceTTL = 90 * time.Second
+
+// presenceBuffer is how many messages a socket may fall behind before it
+// is dropped.
+const presenceBuffer = 32
+
+type Viewer struct {
+	User    string `json:"user"`
+	Editing bool   `json:"editing"`
+}
+
+type presenceSession struct {
+	id   string
+	user string
+	ws   *wsConn
+	out  chan []byte // written by writer
+
+	mu      sync.Mutex
+	ticket  int // 0 = no ticket open
+	editing bool
+}
+
+var sessions = struct {
+	sync.Mutex
+	m map[*presenceSession]bool
+}{m: map[*presenceSession]bool{}}
+
+func newSessionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// queryPresence returns the live viewers by ticket, for one ticket if
+// ticketID is non-zero. A user with several tabs open is listed once.
+func queryPresence(ticketID int) (map[int][]Viewer, error) {
+	query := `SELECT ticket_id, username, bool_or(editing) FROM ticket_presence
+		WHERE account_id=$1 AND seen_at > now() - $2::float8 * interval '1 second'`
+	args := []interface{}{cfg.AccountID, int(presenceTTL.Seconds())}
+	if ticketID != 0 {
+		query += " AND ticket_id=$3"
+		args = append(args, ticketID)
+	}
+	rows, err := db.Query(query+" GROUP BY ticket_id, username ORDER BY username", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int][]Viewer{}
+	for rows.Next() {
+		var id int
+		var v Viewer
+		if err := rows.Scan(&id, &v.User, &v.Editing); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], v)
+	}
+	return out, rows.Err()
+}
+
+// set records what the session has open and announces the change for
+// the ticket it left and the one it opened.
+func (s *presenceSession) set(ticketID int, editing bool) {
+	s.mu.Lock()
+	old, wasEditing := s.ticket, s.editing
+	s.ticket, s.editing = ticketID, editing
+	s.mu.Unlock()
+	if old == ticketID && wasEditing == editing {
+		return
+	}
+
+	if ticketID == 0 {
+		if _, err := db.Exec("DELETE FROM ticket_presence WHERE session_id=$1", s.id); err != nil {
+			log.Printf("presence: %v", err)
+		}
+	} else {
+		// The SELECT keeps sessions from claiming another account's tickets.
+		if _, err := db.Exec(`INSERT INTO ticket_presence (session_id, account_id, username, ticket_id, editing, seen_at)
+			SELECT $1, $2, $3, id, $5, now() FROM tickets WHERE id=$4 AND account_id=$2
+			ON CONFLICT (session_id) DO UPDATE SET ticket_id=EXCLUDED.ticket_id, editing=EXCLUDED.editing, seen_at=now()`,
+			s.id, cfg.AccountID, s.user, ticketID, editing); err != nil {
+			log.Printf("presence: %v", err)
+		}
+	}
+	if old != 0 && old != ticketID {
+		publish(Event{Type: "presence.changed", TicketID: old})
+	}
+	if ticketID != 0 {
+		publish(Event{Type: "presence.changed", TicketID: ticketID})
+	}
+}
+
+// heartbeat keeps the session's row fresh and pings the browser, so dead
+// connections are noticed.
+func (s *presenceSession) heartbeat(done <-chan struct{}) {
+	tick := time.NewTicker(presenceTTL / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			if err := s.ws.writeFrame(wsPing, nil); err != nil {
+				s.ws.Close()
+				return
+			}
+			db.Exec("UPDATE ticket_presence SET seen_at=now() WHERE session_id=$1", s.id)
+			db.Exec("DELETE FROM ticket_presence WHERE seen_at < now() - $1::float8 * interval '1 second'", int(presenceTTL.Seconds()))
+		}
+	}
+}
+
+// send queues v for the session's writer, so a slow browser never holds
+// up event delivery. One that has fallen presenceBuffer messages behind
+// is dropped, as SSE subscribers are; the board reconnects and gets a
+// fresh "hello".
+func (s *presenceSession) send(v interface{}) {
+	data, _ := json.Marshal(v)
+	select {
+	case s.out <- data:
+	default:
+		s.ws.Close() // the read loop then ends the session
+	}
+}
+
+// writer writes queued messages to the socket until the session ends.
+func (s *presenceSession) writer(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-s.out:
+			if err := s.ws.writeText(data); err != nil {
+				s.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// handleWebSocket serves the collaboration channel. The browser sends
+// {"type": "view"|"edit"|"leave", "ticket_id": 5}; the server sends
+// "hello" (with every ticket's viewers), "presence" (one ticket's
+// viewers) and "changed" (someone saved the ticket you have open).
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	s := &presenceSession{id: newSessionID(), user: currentUser(r), ws: ws, out: make(chan []byte, presenceBuffer)}
+	if s.user == "" {
+		s.user = "guest-" + s.id[:4]
+	}
+
+	sessions.Lock()
+	sessions.m[s] = true
+	sessions.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		sessions.Lock()
+		delete(sessions.m, s)
+		sessions.Unlock()
+		s.set(0, false)
+		ws.Close()
+	}()
+	go s.heartbeat(done)
+	go s.writer(done)
+
+	all, err := queryPresence(0)
+	if err != nil {
+		log.Printf("presence: %v", err)
+	}
+	s.send(map[string]interface{}{"type": "hello", "session": s.id, "user": s.user, "presence": all})
+
+	for {
+		data, err := ws.readMessage()
+		if err != nil {
+			return
+		}
+		var msg struct {
+			Type     string `json:"type"`
+			TicketID int    `json:"ticket_id"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "view":
+			s.set(msg.TicketID, false)
+		case "edit":
+			s.set(msg.TicketID, true)
+		case "leave":
+			s.set(0, false)
+		}
+	}
+}
+
+// deliverPresence runs on every instance for every event: it pushes
+// presence changes to this instance's sockets and tells anyone with a
+// ticket open when someone else changes it.
+func deliverPresence(ev Event) {
+	sessions.Lock()
+	local := make([]*presenceSession, 0, len(sessions.m))
+	for s := range sessions.m {
+		local = append(local, s)
+	}
+	sessions.Unlock()
+	if len(local) == 0 || ev.TicketID == 0 {
+		return
+	}
+
+	switch ev.Type {
+	case "presence.changed":
+		viewers, err := queryPresence(ev.TicketID)
+		if err != nil {
+			log.Printf("presence: %v", err)
+			return
+		}
+		msg := map[string]interface{}{"type": "presence", "ticket_id": ev.TicketID, "viewers": viewers[ev.TicketID]}
+		for _, s := range local {
+			s.send(msg)
+		}
+	case "ticket.updated", "ticket.moved", "comment.added":
+		msg := map[string]interface{}{"type": "changed", "ticket_id": ev.TicketID, "actor": ev.Actor, "event": ev.Type}
+		for _, s := range local {
+			s.mu.Lock()
+			open := s.ticket == ev.TicketID
+			s.mu.Unlock()
+			if open {
+				s.send(msg)
+			}
+		}
+	}
+}
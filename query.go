@@ -0,0 +1,605 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Ticket query language (a tiny JQL).
+//
+//	project = CART AND state IN (todo, in_progress) AND assignee = jane
+//	updated > -7d AND blocked = true
+//	title ~ "wheel" OR NOT (assignee IS EMPTY)
+//	epic = "Checkout v2" AND points >= 3
+//	label IN (bug, ux) AND label != wontfix
+//	cf.customer = Acme AND cf.env IN (prod, staging)
+//
+// Queries are parsed into a tree and compiled to a parameterized SQL
+// predicate over the `tickets t JOIN projects p` used by queryTickets.
+// User input never reaches the SQL text; every value becomes a $N arg.
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindState
+	kindInt
+	kindTime
+	kindBool
+	// kindSet fields are multi-valued: column is a subquery yielding one
+	// lower-cased value per row, and = / IN / ~ match if any row does.
+	kindSet
+)
+
+type queryField struct {
+	column string
+	kind   fieldKind
+}
+
+var queryFields = map[string]queryField{
+	"project":  {"p.key", kindString},
+	"state":    {"t.state", kindState},
+	"assignee": {"t.assignee", kindString},
+	"title":    {"t.title", kindString},
+	"body":     {"t.body", kindString},
+	"text":     {"t.title || ' ' || t.body", kindString},
+	"id":       {"t.id", kindInt},
+	"created":  {"t.created_at", kindTime},
+	"updated":  {"t.updated_at", kindTime},
+	"blocked": {`EXISTS (SELECT 1 FROM blocks qb JOIN tickets qbt ON qbt.id=qb.blocker_ticket_id
+		WHERE qb.blocked_ticket_id=t.id AND qbt.state <> 'done')`, kindBool},
+	"epic":    {"(SELECT qe.name FROM epics qe WHERE qe.id=t.epic_id)", kindString},
+	"epic_id": {"t.epic_id", kindInt},
+	"points":  {"t.points", kindInt},
+	"parent": {`(SELECT ql.source_ticket_id FROM ticket_links ql
+		WHERE ql.link_type='parent' AND ql.target_ticket_id=t.id)`, kindInt},
+	"priority": {"t.priority", kindString},
+	"due":      {"t.due_date", kindTime},
+	"overdue":  {"COALESCE(t.due_date < CURRENT_DATE AND t.state <> 'done', false)", kindBool},
+	"label": {`SELECT lower(qlb.name) FROM ticket_labels qtl JOIN labels qlb ON qlb.id=qtl.label_id
+		WHERE qtl.ticket_id=t.id`, kindSet},
+}
+
+// lookupQueryField resolves a field name, including custom fields
+// written cf.<key> (see customfields.go). Custom values compare as text.
+func lookupQueryField(name string) (queryField, bool) {
+	if key, ok := strings.CutPrefix(name, "cf."); ok {
+		return queryField{kind: kindString}, customKeyRe.MatchString(key)
+	}
+	f, ok := queryFields[name]
+	return f, ok
+}
+
+var ticketStates = []string{"backlog", "todo", "in_progress", "done"}
+
+// QueryError is a parse or validation error with a 1-based column.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query error at position %d: %s", e.Pos, e.Msg)
+}
+
+// ---- lexer ----
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func lexQuery(src string) ([]token, error) {
+	var toks []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, token{tokLParen, "(", pos})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")", pos})
+			i++
+		case r == ',':
+			toks = append(toks, token{tokComma, ",", pos})
+			i++
+		case r == '"' || r == '\'':
+			quote := r
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != quote; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, &QueryError{pos, "unterminated string"}
+			}
+			toks = append(toks, token{tokString, sb.String(), pos})
+			i = j + 1
+		case r == '=' || r == '~':
+			toks = append(toks, token{tokOp, string(r), pos})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(rs) && (rs[i+1] == '=' || (r == '!' && rs[i+1] == '~')) {
+				toks = append(toks, token{tokOp, string(rs[i : i+2]), pos})
+				i += 2
+			} else if r == '!' {
+				return nil, &QueryError{pos, "unexpected '!'"}
+			} else {
+				toks = append(toks, token{tokOp, string(r), pos})
+				i++
+			}
+		case isWordRune(r):
+			j := i
+			for j < len(rs) && isWordRune(rs[j]) {
+				j++
+			}
+			toks = append(toks, token{tokWord, string(rs[i:j]), pos})
+			i = j
+		default:
+			return nil, &QueryError{pos, fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	toks = append(toks, token{tokEOF, "", len(rs) + 1})
+	return toks, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == '@' || r == ':'
+}
+
+// ---- parser ----
+
+type queryNode interface {
+	sql(b *sqlBuilder) string
+}
+
+type boolNode struct {
+	op          string // AND / OR
+	left, right queryNode
+}
+
+type notNode struct{ inner queryNode }
+
+type clauseNode struct {
+	field  string
+	op     string // = != < <= > >= ~ !~ IN NOT_IN EMPTY NOT_EMPTY
+	values []interface{}
+}
+
+type queryParser struct {
+	toks []token
+	i    int
+}
+
+// parseTicketQuery parses src. An empty query yields a nil node.
+func parseTicketQuery(src string) (queryNode, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+	toks, err := lexQuery(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &QueryError{t.pos, fmt.Sprintf("unexpected %q, expected AND, OR or end of query", t.text)}
+	}
+	return n, nil
+}
+
+func (p *queryParser) peek() token { return p.toks[p.i] }
+func (p *queryParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *queryParser) keyword(kw string) bool {
+	t := p.peek()
+	if t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &boolNode{"OR", left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &boolNode{"AND", left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{inner}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, &QueryError{t.pos, "expected ')'"}
+		}
+		return n, nil
+	}
+	return p.parseClause()
+}
+
+func (p *queryParser) parseClause() (queryNode, error) {
+	ft := p.next()
+	if ft.kind != tokWord {
+		return nil, &QueryError{ft.pos, "expected a field name"}
+	}
+	name := strings.ToLower(ft.text)
+	field, ok := lookupQueryField(name)
+	if !ok {
+		return nil, &QueryError{ft.pos, fmt.Sprintf("unknown field %q", ft.text)}
+	}
+
+	c := &clauseNode{field: name}
+	opTok := p.peek()
+	switch {
+	case opTok.kind == tokOp:
+		p.next()
+		c.op = opTok.text
+	case p.keyword("IN"):
+		c.op = "IN"
+	case p.keyword("NOT"):
+		if !p.keyword("IN") {
+			return nil, &QueryError{p.peek().pos, "expected IN after NOT"}
+		}
+		c.op = "NOT_IN"
+	case p.keyword("IS"):
+		c.op = "EMPTY"
+		if p.keyword("NOT") {
+			c.op = "NOT_EMPTY"
+		}
+		if !p.keyword("EMPTY") {
+			return nil, &QueryError{p.peek().pos, "expected EMPTY after IS"}
+		}
+	default:
+		return nil, &QueryError{opTok.pos, fmt.Sprintf("expected an operator after %q", ft.text)}
+	}
+	if !opAllowed(field.kind, c.op) {
+		return nil, &QueryError{opTok.pos, fmt.Sprintf("operator %s not supported for field %q", strings.ReplaceAll(c.op, "_", " "), name)}
+	}
+
+	switch c.op {
+	case "EMPTY", "NOT_EMPTY":
+		return c, nil
+	case "IN", "NOT_IN":
+		if t := p.next(); t.kind != tokLParen {
+			return nil, &QueryError{t.pos, "expected '(' after IN"}
+		}
+		for {
+			v, err := p.parseValue(name, field.kind)
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, v)
+			t := p.next()
+			if t.kind == tokRParen {
+				break
+			}
+			if t.kind != tokComma {
+				return nil, &QueryError{t.pos, "expected ',' or ')' in value list"}
+			}
+		}
+	default:
+		v, err := p.parseValue(name, field.kind)
+		if err != nil {
+			return nil, err
+		}
+		c.values = []interface{}{v}
+	}
+	return c, nil
+}
+
+func opAllowed(kind fieldKind, op string) bool {
+	switch kind {
+	case kindString, kindSet:
+		switch op {
+		case "=", "!=", "~", "!~", "IN", "NOT_IN", "EMPTY", "NOT_EMPTY":
+			return true
+		}
+		return false
+	case kindState:
+		return op == "=" || op == "!=" || op == "IN" || op == "NOT_IN"
+	case kindInt:
+		return op != "~" && op != "!~" && op != "EMPTY" && op != "NOT_EMPTY"
+	case kindTime:
+		return op == "<" || op == "<=" || op == ">" || op == ">="
+	case kindBool:
+		return op == "=" || op == "!="
+	}
+	return false
+}
+
+func (p *queryParser) parseValue(field string, kind fieldKind) (interface{}, error) {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return nil, &QueryError{t.pos, fmt.Sprintf("expected a value for %q", field)}
+	}
+	switch kind {
+	case kindState:
+		v := strings.ToLower(t.text)
+		for _, s := range ticketStates {
+			if s == v {
+				return v, nil
+			}
+		}
+		return nil, &QueryError{t.pos, fmt.Sprintf("invalid state %q (want one of %s)", t.text, strings.Join(ticketStates, ", "))}
+	case kindInt:
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(t.text), "T-"))
+		if err != nil {
+			return nil, &QueryError{t.pos, fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return n, nil
+	case kindTime:
+		ts, err := parseQueryTime(t.text, time.Now())
+		if err != nil {
+			return nil, &QueryError{t.pos, err.Error()}
+		}
+		return ts, nil
+	case kindBool:
+		switch strings.ToLower(t.text) {
+		case "true", "yes":
+			return true, nil
+		case "false", "no":
+			return false, nil
+		}
+		return nil, &QueryError{t.pos, fmt.Sprintf("invalid boolean %q (want true or false)", t.text)}
+	}
+	return t.text, nil
+}
+
+// parseQueryTime accepts relative offsets (-7d, -2w, -12h, -30m),
+// ISO dates (2025-01-31), RFC 3339 timestamps, and the words now/today.
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	switch strings.ToLower(s) {
+	case "now":
+		return now, nil
+	case "today":
+		y, m, d := now.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location()), nil
+	}
+	if len(s) >= 3 && (s[0] == '-' || s[0] == '+') {
+		n, err := strconv.Atoi(s[1 : len(s)-1])
+		if err == nil {
+			if s[0] == '-' {
+				n = -n
+			}
+			switch s[len(s)-1] {
+			case 'm':
+				return now.Add(time.Duration(n) * time.Minute), nil
+			case 'h':
+				return now.Add(time.Duration(n) * time.Hour), nil
+			case 'd':
+				return now.AddDate(0, 0, n), nil
+			case 'w':
+				return now.AddDate(0, 0, 7*n), nil
+			}
+		}
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q (use -7d, -2w, 2025-01-31 or today)", s)
+}
+
+// andQuery joins two optional filters with AND.
+func andQuery(left, right queryNode) queryNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	return &boolNode{op: "AND", left: left, right: right}
+}
+
+// epicFilter turns the ?epic= param into a filter: an epic ID, or
+// "none" for tickets outside any epic.
+func epicFilter(s string) (queryNode, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "none":
+		return &clauseNode{field: "epic", op: "EMPTY"}, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid epic %q (want an epic id or none)", s)
+	}
+	return &clauseNode{field: "epic_id", op: "=", values: []interface{}{id}}, nil
+}
+
+// ---- SQL compilation ----
+
+// sqlBuilder hands out $N placeholders, continuing after any args the
+// caller has already bound.
+type sqlBuilder struct {
+	args []interface{}
+}
+
+func (b *sqlBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (n *boolNode) sql(b *sqlBuilder) string {
+	return "(" + n.left.sql(b) + " " + n.op + " " + n.right.sql(b) + ")"
+}
+
+func (n *notNode) sql(b *sqlBuilder) string {
+	return "NOT (" + n.inner.sql(b) + ")"
+}
+
+func (c *clauseNode) sql(b *sqlBuilder) string {
+	f, _ := lookupQueryField(c.field)
+	col := f.column
+	if key, ok := strings.CutPrefix(c.field, "cf."); ok {
+		// The key is bound like any value; only the shape is fixed here.
+		col = "(t.custom->>" + b.arg(key) + "::text)"
+	}
+
+	if f.kind == kindBool {
+		want := c.values[0].(bool)
+		if c.op == "!=" {
+			want = !want
+		}
+		if want {
+			return col
+		}
+		return "NOT " + col
+	}
+
+	if f.kind == kindSet {
+		return c.setSQL(b, col)
+	}
+
+	values := c.values
+	if f.kind == kindString {
+		col = "lower(COALESCE(" + col + ",''))"
+		switch c.op {
+		case "~":
+			return col + " LIKE " + b.arg("%"+likeEscape(strings.ToLower(c.values[0].(string)))+"%")
+		case "!~":
+			return col + " NOT LIKE " + b.arg("%"+likeEscape(strings.ToLower(c.values[0].(string)))+"%")
+		case "EMPTY":
+			return col + " = ''"
+		case "NOT_EMPTY":
+			return col + " <> ''"
+		}
+		values = make([]interface{}, len(c.values))
+		for i, v := range c.values {
+			values[i] = strings.ToLower(v.(string))
+		}
+	}
+
+	switch c.op {
+	case "IN", "NOT_IN":
+		ph := make([]string, len(values))
+		for i, v := range values {
+			ph[i] = b.arg(v)
+		}
+		op := " IN "
+		if c.op == "NOT_IN" {
+			op = " NOT IN "
+		}
+		return col + op + "(" + strings.Join(ph, ", ") + ")"
+	case "!=":
+		return col + " <> " + b.arg(values[0])
+	default:
+		return col + " " + c.op + " " + b.arg(values[0])
+	}
+}
+
+// setSQL compiles a clause on a multi-valued field into EXISTS over its
+// subquery. Negated operators are NOT EXISTS of the positive match, so
+// "label != bug" means "has no bug label", not "has some other label".
+func (c *clauseNode) setSQL(b *sqlBuilder, sub string) string {
+	switch c.op {
+	case "EMPTY":
+		return "NOT EXISTS (" + sub + ")"
+	case "NOT_EMPTY":
+		return "EXISTS (" + sub + ")"
+	}
+	var match string
+	switch c.op {
+	case "~", "!~":
+		match = "qs.v LIKE " + b.arg("%"+likeEscape(strings.ToLower(c.values[0].(string)))+"%")
+	default:
+		ph := make([]string, len(c.values))
+		for i, v := range c.values {
+			ph[i] = b.arg(strings.ToLower(v.(string)))
+		}
+		match = "qs.v IN (" + strings.Join(ph, ", ") + ")"
+	}
+	exists := "EXISTS (SELECT 1 FROM (" + sub + ") qs(v) WHERE " + match + ")"
+	if c.op == "!=" || c.op == "!~" || c.op == "NOT_IN" {
+		return "NOT " + exists
+	}
+	return exists
+}
+
+// labelFilter turns the ?label= param (comma-separated names) into a
+// filter matching tickets with any of the labels.
+func labelFilter(s string) queryNode {
+	var names []interface{}
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return &clauseNode{field: "label", op: "IN", values: names}
+}
+
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compileQuery(t *testing.T, src string) (string, []interface{}) {
+	t.Helper()
+	n, err := parseTicketQuery(src)
+	if err != nil {
+		t.Fatalf("parseTicketQuery(%q): %v", src, err)
+	}
+	b := &sqlBuilder{}
+	return n.sql(b), b.args
+}
+
+func TestCompileQuery(t *testing.T) {
+	blocked := queryFields["blocked"].column
+	labels := queryFields["label"].column
+
+	for _, tc := range []struct {
+		src  string
+		sql  string
+		args []interface{}
+	}{
+		{"project = CART AND state IN (todo, in_progress)",
+			"(lower(COALESCE(p.key,'')) = $1 AND t.state IN ($2, $3))", []interface{}{"cart", "todo", "in_progress"}},
+		// AND binds tighter than OR; parentheses override it.
+		{"assignee = jane OR assignee = lee AND state = done",
+			"(lower(COALESCE(t.assignee,'')) = $1 OR (lower(COALESCE(t.assignee,'')) = $2 AND t.state = $3))",
+			[]interface{}{"jane", "lee", "done"}},
+		{"(assignee = jane OR assignee = lee) AND state = done",
+			"((lower(COALESCE(t.assignee,'')) = $1 OR lower(COALESCE(t.assignee,'')) = $2) AND t.state = $3)",
+			[]interface{}{"jane", "lee", "done"}},
+		{"state = todo or state = done and id != 3",
+			"(t.state = $1 OR (t.state = $2 AND t.id <> $3))", []interface{}{"todo", "done", 3}},
+		// NOT applies to the next clause only.
+		{"NOT state = done AND id = 3", "(NOT (t.state = $1) AND t.id = $2)", []interface{}{"done", 3}},
+		{"NOT (assignee IS EMPTY)", "NOT (lower(COALESCE(t.assignee,'')) = '')", nil},
+		{"assignee IS NOT EMPTY", "lower(COALESCE(t.assignee,'')) <> ''", nil},
+		{"state NOT IN (done, backlog)", "t.state NOT IN ($1, $2)", []interface{}{"done", "backlog"}},
+		{"id IN (T-4, 5)", "t.id IN ($1, $2)", []interface{}{4, 5}},
+		{"points >= 3", "t.points >= $1", []interface{}{3}},
+
+		// Quoting: values are always bound, never spliced in.
+		{`epic = "Checkout v2"`, "lower(COALESCE((SELECT qe.name FROM epics qe WHERE qe.id=t.epic_id),'')) = $1",
+			[]interface{}{"checkout v2"}},
+		{`title = 'it\'s'`, "lower(COALESCE(t.title,'')) = $1", []interface{}{"it's"}},
+		{`assignee = "x' OR 1=1 --"`, "lower(COALESCE(t.assignee,'')) = $1", []interface{}{"x' or 1=1 --"}},
+		{`title ~ "50% off_now"`, "lower(COALESCE(t.title,'')) LIKE $1", []interface{}{`%50\% off\_now%`}},
+		{`text !~ Wheel`, "lower(COALESCE(t.title || ' ' || t.body,'')) NOT LIKE $1", []interface{}{"%wheel%"}},
+
+		// Custom fields bind their key too.
+		{"cf.customer = Acme", "lower(COALESCE((t.custom->>$1::text),'')) = $2", []interface{}{"customer", "acme"}},
+		{"cf.env IN (prod, staging) AND cf.env IS NOT EMPTY",
+			"(lower(COALESCE((t.custom->>$1::text),'')) IN ($2, $3) AND lower(COALESCE((t.custom->>$4::text),'')) <> '')",
+			[]interface{}{"env", "prod", "staging", "env"}},
+
+		{"blocked = true", blocked, nil},
+		{"blocked = no", "NOT " + blocked, nil},
+		{"blocked != true", "NOT " + blocked, nil},
+		{"overdue = yes", queryFields["overdue"].column, nil},
+
+		{"label = Bug", "EXISTS (SELECT 1 FROM (" + labels + ") qs(v) WHERE qs.v IN ($1))", []interface{}{"bug"}},
+		{"label != wontfix", "NOT EXISTS (SELECT 1 FROM (" + labels + ") qs(v) WHERE qs.v IN ($1))", []interface{}{"wontfix"}},
+		{"label ~ ux", "EXISTS (SELECT 1 FROM (" + labels + ") qs(v) WHERE qs.v LIKE $1)", []interface{}{"%ux%"}},
+		{"label IS EMPTY", "NOT EXISTS (" + labels + ")", nil},
+	} {
+		sql, args := compileQuery(t, tc.src)
+		if sql != tc.sql || len(args) != len(tc.args) || len(args) > 0 && !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%s:\n got %s %v\nwant %s %v", tc.src, sql, args, tc.sql, tc.args)
+		}
+	}
+}
+
+func TestCompileQueryArgs(t *testing.T) {
+	// Placeholders continue after the caller's own args.
+	n, _ := parseTicketQuery("state = done")
+	b := &sqlBuilder{args: []interface{}{"acct"}}
+	if sql := n.sql(b); sql != "t.state = $2" || len(b.args) != 2 {
+		t.Errorf("sql = %s, args %v", sql, b.args)
+	}
+
+	sql, args := compileQuery(t, "created > 2025-01-31")
+	if sql != "t.created_at > $1" || args[0] != time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("sql = %s, args %v", sql, args)
+	}
+	before := time.Now().AddDate(0, 0, -7)
+	_, args = compileQuery(t, "updated >= -7d")
+	if d := args[0].(time.Time).Sub(before); d < 0 || d > time.Minute {
+		t.Errorf("-7d = %v, want about %v", args[0], before)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		pos int
+		msg string
+	}{
+		{"foo = 1", 1, `unknown field "foo"`},
+		{"cf.Bad-Key = x", 1, "unknown field"},
+		{"state =", 8, `expected a value for "state"`},
+		{"state ~ done", 7, "operator ~ not supported"},
+		{"title > x", 7, "operator > not supported"},
+		{"created = today", 9, "operator = not supported"},
+		{"state = shipped", 9, `invalid state "shipped"`},
+		{"id = abc", 6, `invalid number "abc"`},
+		{"blocked = maybe", 11, `invalid boolean "maybe"`},
+		{"created > yesterday", 11, `invalid date "yesterday"`},
+		{`title = "abc`, 9, "unterminated string"},
+		{"(state = done", 14, "expected ')'"},
+		{"state = done assignee = x", 14, `unexpected "assignee"`},
+		{"state NOT done", 11, "expected IN after NOT"},
+		{"assignee IS jane", 13, "expected EMPTY after IS"},
+		{"state IN todo", 10, "expected '(' after IN"},
+		{"state IN (todo done)", 16, "expected ',' or ')'"},
+		{"AND state = done", 1, `unknown field "AND"`},
+		{"= done", 1, "expected a field name"},
+		{"state", 6, "expected an operator"},
+		{"title ! x", 7, "unexpected '!'"},
+		{"title = x; drop", 10, "unexpected character ';'"},
+	} {
+		_, err := parseTicketQuery(tc.src)
+		qe, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("%s: err = %v, want a QueryError", tc.src, err)
+			continue
+		}
+		if qe.Pos != tc.pos || !strings.Contains(qe.Msg, tc.msg) {
+			t.Errorf("%s: error at %d %q, want %d %q", tc.src, qe.Pos, qe.Msg, tc.pos, tc.msg)
+		}
+	}
+
+	if n, err := parseTicketQuery("   "); n != nil || err != nil {
+		t.Errorf("empty query = %v, %v", n, err)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Recurring tickets are definitions the scheduler turns into real tickets
+// on a schedule: a 5-field cron expression ("0 9 * * 1" = Mondays 09:00),
+// an alias (@hourly, @daily, @weekly, @monthly), or "sprint" / "sprint+N"
+// for the start of every sprint, or N days into it. Times are UTC.
+//
+// Each definition stores its next_run. A scheduler pass locks one due
+// definition (FOR UPDATE SKIP LOCKED), creates the ticket and advances
+// next_run in the same transaction, so any number of instances sharing
+// the database create each occurrence exactly once. Occurrences missed
+// while no instance was running collapse into one ticket.
+
+type RecurringTicket struct {
+	ID           int        `json:"id"`
+	ProjectKey   string     `json:"project_key"`
+	Title        string     `json:"title"` // "{date}" expands to the occurrence date
+	Body         string     `json:"body"`
+	Assignee     string     `json:"assignee"`
+	State        string     `json:"state"`
+	Priority     string     `json:"priority"`
+	Labels       []string   `json:"labels"`
+	Schedule     string     `json:"schedule"`
+	Enabled      bool       `json:"enabled"`
+	NextRun      time.Time  `json:"next_run"`
+	LastRun      *time.Time `json:"last_run"`
+	LastTicketID *int       `json:"last_ticket_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	projectID    int
+}
+
+// Occurrence is one upcoming instantiation of a recurring ticket.
+type Occurrence struct {
+	RecurringID int       `json:"recurring_id"`
+	ProjectKey  string    `json:"project_key"`
+	Title       string    `json:"title"`
+	At          time.Time `json:"at"`
+}
+
+const recurringSelect = `SELECT r.id, p.key, r.title, r.body, r.assignee, r.state, r.priority, r.labels, r.schedule,
+		r.enabled, r.next_run, r.last_run, r.last_ticket_id, r.created_at, r.project_id
+	FROM recurring_tickets r JOIN projects p ON p.id=r.project_id`
+
+func scanRecurring(row interface{ Scan(...interface{}) error }) (RecurringTicket, error) {
+	var rt RecurringTicket
+	err := row.Scan(&rt.ID, &rt.ProjectKey, &rt.Title, &rt.Body, &rt.Assignee, &rt.State, &rt.Priority, pq.Array(&rt.Labels),
+		&rt.Schedule, &rt.Enabled, &rt.NextRun, &rt.LastRun, &rt.LastTicketID, &rt.CreatedAt, &rt.projectID)
+	return rt, err
+}
+
+func queryRecurring(project string) ([]RecurringTicket, error) {
+	query := recurringSelect + " WHERE r.account_id=$1"
+	args := []interface{}{cfg.AccountID}
+	if project != "" && project != "ALL" {
+		query += " AND p.key=$2"
+		args = append(args, project)
+	}
+	rows, err := db.Query(query+" ORDER BY r.next_run, r.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []RecurringTicket
+	for rows.Next() {
+		rt, err := scanRecurring(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rt)
+	}
+	return list, rows.Err()
+}
+
+func (rt *RecurringTicket) titleFor(at time.Time) string {
+	return strings.ReplaceAll(rt.Title, "{date}", at.Format("2006-01-02"))
+}
+
+// ---- schedules ----
+
+type schedule interface {
+	// next returns the first occurrence strictly after t, or the zero
+	// time if there is none within five years.
+	next(t time.Time) time.Time
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseSchedule(s string) (schedule, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if alias, ok := cronAliases[s]; ok {
+		s = alias
+	}
+	if rest, ok := strings.CutPrefix(s, "sprint"); ok {
+		offset := 0
+		if rest != "" {
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rest, "+"), "d"))
+			if err != nil || !strings.HasPrefix(rest, "+") || n < 0 || n >= cfg.SprintLength {
+				return nil, fmt.Errorf("sprint schedules are sprint or sprint+N (N days into the sprint, 0-%d)", cfg.SprintLength-1)
+			}
+			offset = n
+		}
+		return sprintSchedule{offset}, nil
+	}
+	return parseCron(s)
+}
+
+// cronSchedule holds one bit per allowed value of each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func parseCron(s string) (*cronSchedule, error) {
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("schedule must be 5 cron fields (minute hour day month weekday), an @alias or sprint[+N]")
+	}
+	c := &cronSchedule{domAny: f[2] == "*", dowAny: f[4] == "*"}
+	var err error
+	fields := []struct {
+		dst      *uint64
+		src      string
+		min, max int
+		name     string
+	}{
+		{&c.minute, f[0], 0, 59, "minute"},
+		{&c.hour, f[1], 0, 23, "hour"},
+		{&c.dom, f[2], 1, 31, "day"},
+		{&c.month, f[3], 1, 12, "month"},
+		{&c.dow, f[4], 0, 7, "weekday"},
+	}
+	for _, fl := range fields {
+		if *fl.dst, err = parseCronField(fl.src, fl.min, fl.max); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", fl.name, fl.src, err)
+		}
+	}
+	// 7 is another spelling of Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField reads lists of values, ranges and steps: 1,15  9-17  */15  5/10.
+func parseCronField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			n, err := strconv.Atoi(a)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", a)
+			}
+			lo = n
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", b)
+				}
+			} else if !hasStep {
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches follows cron: when both day fields are restricted, either
+// may match.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// sprintSchedule fires offset days after each sprint start, at 00:00 UTC.
+type sprintSchedule struct{ offset int }
+
+func (s sprintSchedule) next(after time.Time) time.Time {
+	days := int(after.Sub(cfg.SprintEpoch).Hours() / 24)
+	k := days / cfg.SprintLength
+	if days < 0 {
+		k = days/cfg.SprintLength - 1
+	}
+	for {
+		t := cfg.SprintEpoch.AddDate(0, 0, k*cfg.SprintLength+s.offset).UTC()
+		if t.After(after) {
+			return t
+		}
+		k++
+	}
+}
+
+// ---- scheduler ----
+
+// runRecurringScheduler instantiates due recurring tickets every interval
+// until the process exits.
+func runRecurringScheduler(interval time.Duration) {
+	for {
+		for {
+			ran, err := runNextRecurring(time.Now().UTC())
+			if err != nil {
+				log.Printf("recurring: %v", err)
+			}
+			if !ran || err != nil {
+				break
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// runNextRecurring handles one due definition. It reports whether there
+// was one, so the caller can drain the queue.
+func runNextRecurring(now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Another instance working on a definition holds its row lock; SKIP
+	// LOCKED moves on instead of waiting and then duplicating the ticket.
+	rt, err := scanRecurring(tx.QueryRow(recurringSelect+`
+		WHERE r.enabled AND r.next_run <= $1
+		ORDER BY r.next_run LIMIT 1
+		FOR UPDATE OF r SKIP LOCKED`, now))
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	sched, err := parseSchedule(rt.Schedule)
+	next := time.Time{}
+	if err == nil {
+		next = sched.next(now)
+	}
+	if next.IsZero() {
+		// Nothing left to run (or the schedule no longer parses).
+		log.Printf("recurring %d: disabling, no next run for %q", rt.ID, rt.Schedule)
+		if _, err := tx.Exec("UPDATE recurring_tickets SET enabled=false WHERE id=$1", rt.ID); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	var ticketID int
+	err = tx.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state,assignee,priority)
+		VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id`,
+		cfg.AccountID, rt.projectID, rt.titleFor(rt.NextRun), rt.Body, rt.State, rt.Assignee, rt.Priority).Scan(&ticketID)
+	if err != nil {
+		return false, err
+	}
+	// Labels deleted since the definition was saved are skipped.
+	if _, err := tx.Exec(`INSERT INTO ticket_labels (ticket_id,label_id)
+		SELECT $1, l.id FROM labels l
+		WHERE l.account_id=$2 AND lower(l.name) = ANY($3) AND (l.project_id IS NULL OR l.project_id=$4)
+		ON CONFLICT DO NOTHING`, ticketID, cfg.AccountID, pq.Array(lowerAll(rt.Labels)), rt.projectID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE recurring_tickets SET next_run=$1, last_run=$2, last_ticket_id=$3 WHERE id=$4",
+		next, rt.NextRun, ticketID, rt.ID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Printf("recurring %d: created T-%d %q", rt.ID, ticketID, rt.titleFor(rt.NextRun))
+	publish(Event{Type: "ticket.created", TicketID: ticketID})
+	autoWatch(ticketID, "assigned", rt.Assignee)
+	notify("assigned", ticketID, "", "", rt.Assignee)
+	recordMentions(ticketID, "body", rt.Body, "")
+	return true, nil
+}
+
+func lowerAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
+
+// ---- handlers ----
+
+func handleGetRecurring(w http.ResponseWriter, r *http.Request) {
+	list, err := queryRecurring(r.URL.Query().Get("project"))
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if list == nil {
+		list = []RecurringTicket{}
+	}
+	writeJSON(w, 200, list)
+}
+
+// validate normalises a definition, resolves its project and returns
+// its first run after now.
+func (rt *RecurringTicket) validate(now time.Time) (int, time.Time, int, string) {
+	rt.Title = strings.TrimSpace(rt.Title)
+	if rt.Title == "" {
+		return 0, time.Time{}, 400, "title is required"
+	}
+	if rt.State == "" {
+		rt.State = "todo"
+	}
+	if !isTicketState(rt.State) {
+		return 0, time.Time{}, 400, "state must be one of " + strings.Join(ticketStates, ", ")
+	}
+	if rt.Priority == "" {
+		rt.Priority = "medium"
+	}
+	if !isPriority(rt.Priority) {
+		return 0, time.Time{}, 400, "priority must be one of " + strings.Join(priorities, ", ")
+	}
+	sched, err := parseSchedule(rt.Schedule)
+	if err != nil {
+		return 0, time.Time{}, 400, err.Error()
+	}
+	next := sched.next(now)
+	if next.IsZero() {
+		return 0, time.Time{}, 400, "schedule never runs"
+	}
+	rt.Labels = trimList(rt.Labels)
+	var projectID int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, rt.ProjectKey).Scan(&projectID); err != nil {
+		return 0, time.Time{}, 404, "project not found"
+	}
+	if _, err := labelIDsByName(projectID, rt.Labels); err != nil {
+		return 0, time.Time{}, 400, err.Error()
+	}
+	return projectID, next, 0, ""
+}
+
+func handleCreateRecurring(w http.ResponseWriter, r *http.Request) {
+	req := RecurringTicket{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, next, status, msg := req.validate(time.Now().UTC())
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO recurring_tickets (account_id,project_id,title,body,assignee,state,priority,labels,schedule,enabled,next_run)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id`,
+		cfg.AccountID, projectID, req.Title, req.Body, req.Assignee, req.State, req.Priority, pq.Array(req.Labels),
+		req.Schedule, req.Enabled, next).Scan(&id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]interface{}{"id": id, "next_run": next})
+}
+
+// handleUpdateRecurring replaces a definition. next_run is recomputed
+// from now, so editing never back-fills missed occurrences.
+func handleUpdateRecurring(w http.ResponseWriter, r *http.Request) {
+	req := RecurringTicket{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, next, status, msg := req.validate(time.Now().UTC())
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE recurring_tickets SET project_id=$1, title=$2, body=$3, assignee=$4, state=$5,
+			priority=$6, labels=$7, schedule=$8, enabled=$9, next_run=$10
+		WHERE id=$11 AND account_id=$12`,
+		projectID, req.Title, req.Body, req.Assignee, req.State, req.Priority, pq.Array(req.Labels),
+		req.Schedule, req.Enabled, next, r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "recurring ticket not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{"status": "updated", "next_run": next})
+}
+
+func handleDeleteRecurring(w http.ResponseWriter, r *http.Request) {
+	// Tickets already created stay.
+	result, err := db.Exec("DELETE FROM recurring_tickets WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "recurring ticket not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// handleUpcomingRecurring lists the occurrences of enabled definitions in
+// the next ?days= (default 14, max 366), soonest first. ?project= and
+// ?id= narrow it down.
+func handleUpcomingRecurring(w http.ResponseWriter, r *http.Request) {
+	days := 14
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 366 {
+			writeJSON(w, 400, map[string]string{"error": "days must be 1-366"})
+			return
+		}
+		days = n
+	}
+	list, err := queryRecurring(r.URL.Query().Get("project"))
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+	until := time.Now().UTC().AddDate(0, 0, days)
+	occurrences := []Occurrence{}
+	for _, rt := range list {
+		if !rt.Enabled || id != 0 && rt.ID != id {
+			continue
+		}
+		sched, err := parseSchedule(rt.Schedule)
+		if err != nil {
+			continue
+		}
+		// Cap each definition so "* * * * *" can't flood the response.
+		for at, n := rt.NextRun, 0; !at.IsZero() && at.Before(until) && n < 100; at, n = sched.next(at), n+1 {
+			occurrences = append(occurrences, Occurrence{rt.ID, rt.ProjectKey, rt.titleFor(at), at})
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool { return occurrences[i].At.Before(occurrences[j].At) })
+	writeJSON(w, 200, occurrences)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	defer func(n int) { cfg.SprintLength = n }(cfg.SprintLength)
+	cfg.SprintLength = 7
+
+	for _, s := range []string{
+		"", "* * * *", "* * * * * *", "@yearly",
+		"60 * * * *", "* 24 * * *", "0 0 0 * *", "0 0 32 * *", "0 0 * 13 *", "0 0 * * 8",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "1-x * * * *",
+		"sprint+7", "sprint+27", "sprint-1", "sprint+x", "sprint3", "sprints",
+	} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", s)
+		}
+	}
+	for _, s := range []string{"sprint", "sprint+0", "sprint+6", "sprint+6d", " @Weekly ", "0 9 * * 1-5", "*/15 0,12 1-7 */2 7"} {
+		if _, err := parseSchedule(s); err != nil {
+			t.Errorf("parseSchedule(%q): %v", s, err)
+		}
+	}
+
+	cfg.SprintLength = 28
+	if _, err := parseSchedule("sprint+27"); err != nil {
+		t.Errorf("sprint+27 with 28-day sprints: %v", err)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		ts, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	for _, tc := range []struct {
+		schedule, after, want string
+	}{
+		{"@hourly", "2025-01-01 10:00", "2025-01-01 11:00"}, // strictly after
+		{"@daily", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"@weekly", "2025-01-01 10:00", "2025-01-05 00:00"}, // a Wednesday; cron weeks start on Sunday
+		{"@weekly", "2025-12-28 00:00", "2026-01-04 00:00"},
+		{"@monthly", "2025-01-31 12:00", "2025-02-01 00:00"},
+		{"@monthly", "2025-12-15 00:00", "2026-01-01 00:00"},
+		{"*/15 * * * *", "2025-03-01 10:07", "2025-03-01 10:15"},
+		{"*/15 * * * *", "2025-12-31 23:50", "2026-01-01 00:00"},
+		{"0 9 * * 1", "2025-01-31 10:00", "2025-02-03 09:00"},
+		{"0 18 * * 1-5", "2025-12-26 19:00", "2025-12-29 18:00"},
+		{"0 0 * * 7", "2025-01-01 00:00", "2025-01-05 00:00"},
+		{"0 0 1 1 *", "2025-06-01 00:00", "2026-01-01 00:00"},
+		{"30 8 31 * *", "2025-01-31 09:00", "2025-03-31 08:30"}, // February has no 31st
+		{"0 0 29 2 *", "2025-01-01 00:00", "2028-02-29 00:00"},
+		// With both day fields set, either one matches.
+		{"0 12 1 * 5", "2025-01-01 12:00", "2025-01-03 12:00"},
+		{"0 12 1 * 5", "2025-01-31 12:00", "2025-02-01 12:00"},
+		{"0 0 30 2 *", "2025-01-01 00:00", ""},
+	} {
+		sched, err := parseSchedule(tc.schedule)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.schedule, err)
+		}
+		got := sched.next(at(tc.after))
+		if tc.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%s after %s = %v, want none", tc.schedule, tc.after, got)
+			}
+			continue
+		}
+		if want := at(tc.want); !got.Equal(want) {
+			t.Errorf("%s after %s = %v, want %v", tc.schedule, tc.after, got, want)
+		}
+	}
+
+	// Times in other zones are read as the instant they are.
+	sched, _ := parseSchedule("@daily")
+	if got, want := sched.next(time.Date(2025, 1, 1, 1, 0, 0, 0, time.FixedZone("CEST", 2*3600))), at("2025-01-01 00:00"); !got.Equal(want) {
+		t.Errorf("@daily after 01:00+02:00 = %v, want %v", got, want)
+	}
+}
+
+func TestSprintNext(t *testing.T) {
+	defer func(n int, e time.Time) { cfg.SprintLength, cfg.SprintEpoch = n, e }(cfg.SprintLength, cfg.SprintEpoch)
+	cfg.SprintLength = 14
+	cfg.SprintEpoch = time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)
+	day := func(m time.Month, d, y int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		schedule    string
+		after, want time.Time
+	}{
+		{"sprint", day(1, 6, 2025), day(1, 20, 2025)},
+		{"sprint", day(1, 1, 2025), day(1, 6, 2025)}, // before the epoch
+		{"sprint", day(12, 1, 2024), day(12, 9, 2024)},
+		{"sprint+3", day(1, 6, 2025), day(1, 9, 2025)},
+		{"sprint+3", day(1, 9, 2025), day(1, 23, 2025)},
+		{"sprint+13", day(12, 28, 2025), day(1, 4, 2026)},
+		{"sprint", day(12, 28, 2025), day(1, 5, 2026)},
+	} {
+		sched, err := parseSchedule(tc.schedule)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.schedule, err)
+		}
+		if got := sched.next(tc.after); !got.Equal(tc.want) {
+			t.Errorf("%s after %s = %s, want %s", tc.schedule, tc.after.Format("2006-01-02"),
+				got.Format("2006-01-02"), tc.want.Format("2006-01-02"))
+		}
+	}
+}
@@ -10,6 +10,16 @@ CREATE TABLE IF NOT EXISTS projects (
   UNIQUE (account_id, key)
 );
 
+-- Epics group tickets across sprints; project_id NULL means account-wide
+CREATE TABLE IF NOT EXISTS epics (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  project_id INTEGER REFERENCES projects(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT now()
+);
+
 CREATE TABLE IF NOT EXISTS tickets (
   id SERIAL PRIMARY KEY,
   account_id TEXT NOT NULL,
@@ -18,16 +28,134 @@ CREATE TABLE IF NOT EXISTS tickets (
   body TEXT DEFAULT '',
   state TEXT NOT NULL CHECK (state IN ('backlog','todo','in_progress','done')),
   assignee TEXT DEFAULT '',
+  epic_id INTEGER REFERENCES epics(id) ON DELETE SET NULL,
+  points INTEGER CHECK (points >= 0),
+  priority TEXT NOT NULL DEFAULT 'medium' CHECK (priority IN ('low','medium','high','urgent')),
+  due_date DATE,
+  state_changed_at TIMESTAMP DEFAULT now(),
+  custom JSONB NOT NULL DEFAULT '{}',
   created_at TIMESTAMP DEFAULT now(),
   updated_at TIMESTAMP DEFAULT now()
 );
 
-CREATE TABLE IF NOT EXISTS blocks (
-  blocker_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
-  blocked_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+-- Typed links between tickets: blocks, relates, duplicates, clones, parent
+CREATE TABLE IF NOT EXISTS ticket_links (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  link_type TEXT NOT NULL,
+  source_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  target_ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (link_type, source_ticket_id, target_ticket_id),
+  CHECK (source_ticket_id != target_ticket_id)
+);
+
+-- Compatibility view: "blocks" links in the original blocks shape
+CREATE OR REPLACE VIEW blocks AS
+  SELECT source_ticket_id AS blocker_ticket_id, target_ticket_id AS blocked_ticket_id, account_id
+  FROM ticket_links WHERE link_type='blocks';
+
+-- Coloured labels; project_id NULL means usable in every project
+CREATE TABLE IF NOT EXISTS labels (
+  id SERIAL PRIMARY KEY,
   account_id TEXT NOT NULL,
-  PRIMARY KEY (blocker_ticket_id, blocked_ticket_id),
-  CHECK (blocker_ticket_id != blocked_ticket_id)
+  project_id INTEGER REFERENCES projects(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  color TEXT NOT NULL DEFAULT '#8b6f64',
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS ticket_labels (
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  label_id INTEGER NOT NULL REFERENCES labels(id) ON DELETE CASCADE,
+  PRIMARY KEY (ticket_id, label_id)
+);
+
+-- Per-project custom field definitions; values live in tickets.custom
+CREATE TABLE IF NOT EXISTS custom_fields (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  key TEXT NOT NULL,
+  name TEXT NOT NULL,
+  type TEXT NOT NULL CHECK (type IN ('text','number','select','date','user')),
+  options TEXT[] NOT NULL DEFAULT '{}',
+  required BOOLEAN NOT NULL DEFAULT false,
+  position INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (project_id, key)
+);
+
+-- Per-project ticket templates (defaults applied on create)
+CREATE TABLE IF NOT EXISTS ticket_templates (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  title_prefix TEXT NOT NULL DEFAULT '',
+  body TEXT NOT NULL DEFAULT '',
+  assignee TEXT NOT NULL DEFAULT '',
+  state TEXT NOT NULL DEFAULT '',
+  labels TEXT[] NOT NULL DEFAULT '{}',
+  subtasks TEXT[] NOT NULL DEFAULT '{}',
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (project_id, name)
+);
+
+-- Recurring ticket definitions, instantiated by the scheduler at next_run
+CREATE TABLE IF NOT EXISTS recurring_tickets (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  title TEXT NOT NULL,
+  body TEXT NOT NULL DEFAULT '',
+  assignee TEXT NOT NULL DEFAULT '',
+  state TEXT NOT NULL DEFAULT 'todo',
+  priority TEXT NOT NULL DEFAULT 'medium',
+  labels TEXT[] NOT NULL DEFAULT '{}',
+  schedule TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT true,
+  next_run TIMESTAMP NOT NULL,
+  last_run TIMESTAMP,
+  last_ticket_id INTEGER REFERENCES tickets(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT now()
+);
+
+-- SLA: tickets of a priority must leave a state within max_hours
+CREATE TABLE IF NOT EXISTS sla_rules (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  priority TEXT NOT NULL,
+  state TEXT NOT NULL,
+  max_hours INTEGER NOT NULL CHECK (max_hours > 0),
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (project_id, priority, state)
+);
+
+-- One row per rule violation; resolved when the ticket moves on
+CREATE TABLE IF NOT EXISTS sla_breaches (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  rule_id INTEGER NOT NULL REFERENCES sla_rules(id) ON DELETE CASCADE,
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  entered_at TIMESTAMP NOT NULL,
+  breached_at TIMESTAMP NOT NULL DEFAULT now(),
+  resolved_at TIMESTAMP,
+  UNIQUE (rule_id, ticket_id, entered_at)
+);
+
+CREATE TABLE IF NOT EXISTS saved_filters (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  owner TEXT NOT NULL DEFAULT '',
+  name TEXT NOT NULL,
+  shared BOOLEAN NOT NULL DEFAULT false,
+  query TEXT NOT NULL DEFAULT '',
+  sort TEXT NOT NULL DEFAULT '',
+  columns TEXT NOT NULL DEFAULT 'backlog,todo,in_progress,done',
+  created_at TIMESTAMP DEFAULT now(),
+  updated_at TIMESTAMP DEFAULT now()
 );
 
 -- Indexes for performance
@@ -35,4 +163,174 @@ CREATE INDEX IF NOT EXISTS idx_projects_account ON projects(account_id);
 CREATE INDEX IF NOT EXISTS idx_tickets_account ON tickets(account_id);
 CREATE INDEX IF NOT EXISTS idx_tickets_project ON tickets(project_id);
 CREATE INDEX IF NOT EXISTS idx_tickets_state ON tickets(state);
-CREATE INDEX IF NOT EXISTS idx_blocks_account ON blocks(account_id);
+CREATE INDEX IF NOT EXISTS idx_tickets_epic ON tickets(epic_id);
+CREATE INDEX IF NOT EXISTS idx_epics_account ON epics(account_id);
+CREATE INDEX IF NOT EXISTS idx_ticket_links_account ON ticket_links(account_id, link_type);
+CREATE INDEX IF NOT EXISTS idx_ticket_links_target ON ticket_links(target_ticket_id);
+CREATE INDEX IF NOT EXISTS idx_saved_filters_account ON saved_filters(account_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_labels_name ON labels(account_id, COALESCE(project_id, 0), lower(name));
+CREATE INDEX IF NOT EXISTS idx_ticket_labels_label ON ticket_labels(label_id);
+CREATE INDEX IF NOT EXISTS idx_sla_breaches_open ON sla_breaches(ticket_id) WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_recurring_due ON recurring_tickets(next_run) WHERE enabled;
+
+-- Who has which ticket open (presence.go); one row per browser tab
+CREATE TABLE IF NOT EXISTS ticket_presence (
+  session_id TEXT PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  username TEXT NOT NULL,
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  editing BOOLEAN NOT NULL DEFAULT false,
+  seen_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_ticket_presence_account ON ticket_presence(account_id, ticket_id);
+
+-- Outgoing webhook subscriptions and their delivery queue/log (webhooks.go)
+CREATE TABLE IF NOT EXISTS webhooks (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL DEFAULT '{}', -- empty = every event
+  active BOOLEAN NOT NULL DEFAULT true,
+  created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id SERIAL PRIMARY KEY,
+  webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending', -- pending, delivered, failed
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP DEFAULT now(),
+  last_status_code INTEGER,
+  last_error TEXT NOT NULL DEFAULT '',
+  last_response TEXT NOT NULL DEFAULT '',
+  last_duration_ms INTEGER,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  delivered_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_account ON webhooks(account_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status='pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
+
+-- Notifications (notify.go): per-user preferences, what happened, and the
+-- email outbox the notifier sends from
+CREATE TABLE IF NOT EXISTS notification_prefs (
+  account_id TEXT NOT NULL,
+  username TEXT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  assigned BOOLEAN NOT NULL DEFAULT true,
+  mentioned BOOLEAN NOT NULL DEFAULT true,
+  state_changed BOOLEAN NOT NULL DEFAULT true,
+  commented BOOLEAN NOT NULL DEFAULT true,
+  due_soon BOOLEAN NOT NULL DEFAULT true,
+  digest TEXT NOT NULL DEFAULT 'off', -- off, hourly, daily
+  PRIMARY KEY (account_id, username)
+);
+CREATE TABLE IF NOT EXISTS notifications (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  username TEXT NOT NULL,
+  kind TEXT NOT NULL, -- assigned, mentioned, state_changed, commented, due_soon, blocker_resolved
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  actor TEXT NOT NULL DEFAULT '',
+  detail TEXT NOT NULL DEFAULT '',
+  digest_pending BOOLEAN NOT NULL DEFAULT false,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  read_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(account_id, username, id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_due ON notifications(ticket_id, username, detail) WHERE kind='due_soon';
+CREATE TABLE IF NOT EXISTS email_outbox (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  to_addr TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  text_body TEXT NOT NULL,
+  html_body TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending', -- pending, sent, failed
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP DEFAULT now(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  sent_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(next_attempt_at) WHERE status='pending';
+
+-- @mentions in comments and descriptions; the per-user mentions inbox (mentions.go)
+CREATE TABLE IF NOT EXISTS mentions (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  username TEXT NOT NULL,
+  source TEXT NOT NULL, -- comment or body
+  actor TEXT NOT NULL DEFAULT '',
+  excerpt TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  read_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(account_id, username, id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mentions_body ON mentions(ticket_id, username) WHERE source='body';
+
+-- Who hears about changes to a ticket (watchers.go); watching=false
+-- remembers an unwatch so auto-watching doesn't undo it
+CREATE TABLE IF NOT EXISTS ticket_watchers (
+  account_id TEXT NOT NULL,
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  username TEXT NOT NULL,
+  reason TEXT NOT NULL DEFAULT 'manual', -- created, assigned, commented, mentioned or manual
+  watching BOOLEAN NOT NULL DEFAULT true,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  PRIMARY KEY (ticket_id, username)
+);
+
+-- Emails filed as tickets or comments (inbound.go), so a redelivered
+-- message isn't filed twice
+CREATE TABLE IF NOT EXISTS inbound_messages (
+  account_id TEXT NOT NULL,
+  message_id TEXT NOT NULL,
+  ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE, -- NULL while being filed
+  sender TEXT NOT NULL,
+  received_at TIMESTAMP NOT NULL DEFAULT now(),
+  PRIMARY KEY (account_id, message_id)
+);
+
+-- Files attached to tickets (attachments.go); the files themselves are in
+-- the blob store under storage_key and thumb_key
+CREATE TABLE IF NOT EXISTS attachments (
+  id SERIAL PRIMARY KEY,
+  account_id TEXT NOT NULL,
+  ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+  filename TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size BIGINT NOT NULL,
+  storage_key TEXT NOT NULL,
+  thumb_key TEXT NOT NULL DEFAULT '', -- '' when there is no thumbnail
+  uploaded_by TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_ticket ON attachments(ticket_id);
+
+-- Stored files waiting to be deleted by the cleanup worker
+CREATE TABLE IF NOT EXISTS attachment_deletions (
+  id SERIAL PRIMARY KEY,
+  storage_key TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- However an attachment row goes (deleted itself, or with its ticket or
+-- project), its files are queued for deletion
+CREATE OR REPLACE FUNCTION queue_attachment_deletion() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO attachment_deletions (storage_key) VALUES (OLD.storage_key);
+  IF OLD.thumb_key <> '' THEN
+    INSERT INTO attachment_deletions (storage_key) VALUES (OLD.thumb_key);
+  END IF;
+  RETURN OLD;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS attachments_cleanup ON attachments;
+CREATE TRIGGER attachments_cleanup AFTER DELETE ON attachments
+  FOR EACH ROW EXECUTE FUNCTION queue_attachment_deletion();
@@ -34,8 +34,8 @@ FROM projects p WHERE p.key='STORE' AND p.account_id='demo'
 ON CONFLICT DO NOTHING;
 
 -- Example blocking relationship: Cart frame must be designed before POS setup
-INSERT INTO blocks (blocker_ticket_id, blocked_ticket_id, account_id)
-SELECT t1.id, t2.id, 'demo'
+INSERT INTO ticket_links (link_type, source_ticket_id, target_ticket_id, account_id)
+SELECT 'blocks', t1.id, t2.id, 'demo'
 FROM tickets t1
 JOIN projects p1 ON p1.id = t1.project_id
 CROSS JOIN tickets t2
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Priorities, due dates and SLA rules. An SLA rule says tickets of a given
+// priority in a project must leave a state within max_hours of entering
+// it (tickets.state_changed_at). A background checker records each
+// violation once in sla_breaches and resolves it when the ticket moves on.
+
+var priorities = []string{"low", "medium", "high", "urgent"}
+
+var priorityIcons = map[string]string{
+	"low":    "▽",
+	"medium": "◇",
+	"high":   "△",
+	"urgent": "🔥",
+}
+
+// PriorityIcon is the card glyph for the ticket's priority.
+func (t Ticket) PriorityIcon() string { return priorityIcons[t.Priority] }
+
+func isPriority(s string) bool { return priorityRank(s) > 0 }
+
+// priorityRank is the 1-based position in priorities, as used for sorting.
+func priorityRank(s string) int {
+	for i, p := range priorities {
+		if p == s {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// parseDueDate validates an optional YYYY-MM-DD due date; "" clears it.
+func parseDueDate(s string) (*string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if _, err := time.Parse("2006-01-02", s); err != nil {
+		return nil, fmt.Errorf("due_date must be YYYY-MM-DD")
+	}
+	return &s, nil
+}
+
+type SLARule struct {
+	ID         int       `json:"id"`
+	ProjectKey string    `json:"project_key"`
+	Priority   string    `json:"priority"`
+	State      string    `json:"state"`
+	MaxHours   int       `json:"max_hours"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type SLABreach struct {
+	ID         int        `json:"id"`
+	RuleID     int        `json:"rule_id"`
+	TicketID   int        `json:"ticket_id"`
+	ProjectKey string     `json:"project_key"`
+	Title      string     `json:"title"`
+	Priority   string     `json:"priority"`
+	State      string     `json:"state"`
+	MaxHours   int        `json:"max_hours"`
+	EnteredAt  time.Time  `json:"entered_at"`
+	BreachedAt time.Time  `json:"breached_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
+
+func handleGetSLARules(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT r.id, p.key, r.priority, r.state, r.max_hours, r.created_at
+		FROM sla_rules r JOIN projects p ON p.id=r.project_id
+		WHERE r.account_id=$1 ORDER BY p.key, r.id`, cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rules := []SLARule{}
+	for rows.Next() {
+		var rule SLARule
+		if err := rows.Scan(&rule.ID, &rule.ProjectKey, &rule.Priority, &rule.State, &rule.MaxHours, &rule.CreatedAt); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		rules = append(rules, rule)
+	}
+	writeJSON(w, 200, rules)
+}
+
+func handleCreateSLARule(w http.ResponseWriter, r *http.Request) {
+	var req SLARule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if !isPriority(req.Priority) {
+		writeJSON(w, 400, map[string]string{"error": "priority must be one of " + strings.Join(priorities, ", ")})
+		return
+	}
+	if !isTicketState(req.State) || req.State == "done" {
+		writeJSON(w, 400, map[string]string{"error": "state must be backlog, todo or in_progress"})
+		return
+	}
+	if req.MaxHours < 1 {
+		writeJSON(w, 400, map[string]string{"error": "max_hours must be at least 1"})
+		return
+	}
+
+	var projectID int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, req.ProjectKey).Scan(&projectID); err != nil {
+		writeJSON(w, 404, map[string]string{"error": "project not found"})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO sla_rules (account_id,project_id,priority,state,max_hours) VALUES ($1,$2,$3,$4,$5)
+		ON CONFLICT (project_id, priority, state) DO UPDATE SET max_hours=EXCLUDED.max_hours
+		RETURNING id`, cfg.AccountID, projectID, req.Priority, req.State, req.MaxHours).Scan(&id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+func handleDeleteSLARule(w http.ResponseWriter, r *http.Request) {
+	result, err := db.Exec("DELETE FROM sla_rules WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "rule not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+const breachSelect = `SELECT b.id, b.rule_id, b.ticket_id, p.key, t.title, r.priority, r.state, r.max_hours,
+		b.entered_at, b.breached_at, b.resolved_at
+	FROM sla_breaches b
+	JOIN sla_rules r ON r.id=b.rule_id
+	JOIN tickets t ON t.id=b.ticket_id JOIN projects p ON p.id=t.project_id`
+
+func scanBreach(row interface{ Scan(...interface{}) error }) (SLABreach, error) {
+	var b SLABreach
+	err := row.Scan(&b.ID, &b.RuleID, &b.TicketID, &b.ProjectKey, &b.Title, &b.Priority, &b.State, &b.MaxHours,
+		&b.EnteredAt, &b.BreachedAt, &b.ResolvedAt)
+	return b, err
+}
+
+// handleGetSLABreaches lists breaches, open ones only unless ?all=true.
+// ?project=KEY narrows to one project.
+func handleGetSLABreaches(w http.ResponseWriter, r *http.Request) {
+	query := breachSelect + " WHERE b.account_id=$1"
+	b := &sqlBuilder{args: []interface{}{cfg.AccountID}}
+	if r.URL.Query().Get("all") != "true" {
+		query += " AND b.resolved_at IS NULL"
+	}
+	if project := r.URL.Query().Get("project"); project != "" && project != "ALL" {
+		query += " AND p.key=" + b.arg(project)
+	}
+	rows, err := db.Query(query+" ORDER BY b.breached_at DESC, b.id DESC", b.args...)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	breaches := []SLABreach{}
+	for rows.Next() {
+		br, err := scanBreach(rows)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		breaches = append(breaches, br)
+	}
+	writeJSON(w, 200, breaches)
+}
+
+// runSLAChecker evaluates SLA rules every interval until the process
+// exits. Each pass is idempotent: breaches are keyed on (rule, ticket,
+// state entry time), so several instances checking the same database
+// record and notify a breach once.
+func runSLAChecker(interval time.Duration) {
+	for {
+		if err := checkSLAs(); err != nil {
+			log.Printf("sla check: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func checkSLAs() error {
+	// Close breaches whose ticket has left the state (or re-entered it,
+	// which starts a new clock).
+	if _, err := db.Exec(`UPDATE sla_breaches b SET resolved_at=now()
+		FROM sla_rules r, tickets t
+		WHERE b.rule_id=r.id AND t.id=b.ticket_id AND b.resolved_at IS NULL
+			AND (t.state <> r.state OR t.state_changed_at <> b.entered_at OR t.priority <> r.priority)`); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`INSERT INTO sla_breaches (account_id, rule_id, ticket_id, entered_at)
+		SELECT t.account_id, r.id, t.id, t.state_changed_at
+		FROM tickets t JOIN sla_rules r ON r.project_id=t.project_id AND r.priority=t.priority AND r.state=t.state
+		WHERE t.account_id=$1 AND t.state_changed_at + r.max_hours * interval '1 hour' < now()
+		ON CONFLICT (rule_id, ticket_id, entered_at) DO NOTHING
+		RETURNING id`, cfg.AccountID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		br, err := scanBreach(db.QueryRow(breachSelect+" WHERE b.id=$1", id))
+		if err != nil {
+			return err
+		}
+		notifySLABreach(br)
+	}
+	return nil
+}
+
+// notifySLABreach reports a new breach: to the log, as an sla.breached
+// event (and so to webhook subscribers), and to the ticket's watchers.
+func notifySLABreach(br SLABreach) {
+	log.Printf("SLA breach: %s-%d %q has been %s (%s) for over %dh",
+		br.ProjectKey, br.TicketID, br.Title, br.State, br.Priority, br.MaxHours)
+	publish(Event{Type: "sla.breached", TicketID: br.TicketID})
+	notify("sla_breached", br.TicketID, "", fmt.Sprintf("%s for over %dh", stateTitles[br.State], br.MaxHours),
+		ticketAudience(br.TicketID)...)
+}
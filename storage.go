@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where attachment files live. ATTACHMENT_STORE picks "disk" (files under
+// ATTACHMENT_DIR) or "s3": any S3-compatible service (AWS, MinIO, Garage,
+// R2, ...) at S3_ENDPOINT, spoken to with path-style URLs and SigV4
+// signed requests, so a local MinIO is enough to try it out. Keys are
+// made up by Pippin (see attachments.go) and never come from users.
+
+type blobStore interface {
+	// Put reads size bytes from body. S3 needs the content hash before
+	// sending, so body is read twice.
+	Put(key, contentType string, body io.ReadSeeker, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+var errBlobNotFound = errors.New("file not found in storage")
+
+// store is the configured attachment store, set up in main.
+var store blobStore
+
+func initStore() {
+	var err error
+	if store, err = newBlobStore(); err != nil {
+		log.Fatalf("attachments: %v", err)
+	}
+}
+
+func newBlobStore() (blobStore, error) {
+	switch cfg.AttachmentStore {
+	case "disk":
+		if err := os.MkdirAll(cfg.AttachmentDir, 0o755); err != nil {
+			return nil, err
+		}
+		return diskStore{dir: cfg.AttachmentDir}, nil
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required with ATTACHMENT_STORE=s3")
+		}
+		u, err := url.Parse(cfg.S3Endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT %q", cfg.S3Endpoint)
+		}
+		return &s3Store{
+			endpoint:  u,
+			bucket:    cfg.S3Bucket,
+			region:    cfg.S3Region,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+			client:    &http.Client{Timeout: 60 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid ATTACHMENT_STORE %q: expected disk or s3", cfg.AttachmentStore)
+}
+
+type diskStore struct{ dir string }
+
+func (d diskStore) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first, so a half-written upload is
+// never served.
+func (d diskStore) Put(key, contentType string, body io.ReadSeeker, size int64) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (d diskStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (d diskStore) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type s3Store struct {
+	endpoint             *url.URL
+	bucket, region       string
+	accessKey, secretKey string
+	client               *http.Client
+}
+
+func (s *s3Store) Put(key, contentType string, body io.ReadSeeker, size int64) error {
+	resp, err := s.do("PUT", key, body, size, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete succeeds for keys that are already gone; S3 answers 204 either
+// way.
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, 0, nil)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for one object, with an optional body of size
+// bytes, and turns error statuses into errors.
+func (s *s3Store) do(method, key string, body io.ReadSeeker, size int64, headers map[string]string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	payloadHash := sha256Hex(nil)
+	var reqBody io.Reader
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+		reqBody = io.LimitReader(body, size)
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signS3(req, payloadHash, s.accessKey, s.secretKey, s.region, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// signS3 adds AWS Signature Version 4 headers to req, whose body hashes
+// to payloadHash. Every header already set is signed, along with Host.
+func signS3(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+}
+
+// s3EscapePath percent-encodes everything but unreserved characters and
+// slashes, as SigV4 wants.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Ticket templates prefill new tickets of a common kind (bug report,
+// release checklist, ...) in one project. A template applies only to the
+// fields the request leaves empty, except labels, which are added, and
+// the title prefix and subtasks, which are always applied.
+
+type TicketTemplate struct {
+	ID          int       `json:"id"`
+	ProjectKey  string    `json:"project_key"`
+	Name        string    `json:"name"`
+	TitlePrefix string    `json:"title_prefix"`
+	Body        string    `json:"body"`
+	Assignee    string    `json:"assignee"`
+	State       string    `json:"state"`
+	Labels      []string  `json:"labels"`
+	Subtasks    []string  `json:"subtasks"` // titles, created as subtasks
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const templateSelect = `SELECT tt.id, p.key, tt.name, tt.title_prefix, tt.body, tt.assignee, tt.state, tt.labels, tt.subtasks, tt.created_at
+	FROM ticket_templates tt JOIN projects p ON p.id=tt.project_id`
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (TicketTemplate, error) {
+	var tt TicketTemplate
+	err := row.Scan(&tt.ID, &tt.ProjectKey, &tt.Name, &tt.TitlePrefix, &tt.Body, &tt.Assignee, &tt.State,
+		pq.Array(&tt.Labels), pq.Array(&tt.Subtasks), &tt.CreatedAt)
+	return tt, err
+}
+
+// queryTemplates lists the account's templates, for one project unless
+// project is "" or ALL.
+func queryTemplates(project string) ([]TicketTemplate, error) {
+	query := templateSelect + " WHERE tt.account_id=$1"
+	args := []interface{}{cfg.AccountID}
+	if project != "" && project != "ALL" {
+		query += " AND p.key=$2"
+		args = append(args, project)
+	}
+	rows, err := db.Query(query+" ORDER BY p.key, lower(tt.name)", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []TicketTemplate
+	for rows.Next() {
+		tt, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, tt)
+	}
+	return templates, rows.Err()
+}
+
+func handleGetTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := queryTemplates(r.URL.Query().Get("project"))
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if templates == nil {
+		templates = []TicketTemplate{}
+	}
+	writeJSON(w, 200, templates)
+}
+
+func handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	tt, err := scanTemplate(db.QueryRow(templateSelect+" WHERE tt.id=$1 AND tt.account_id=$2", r.PathValue("id"), cfg.AccountID))
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": "template not found"})
+		return
+	}
+	writeJSON(w, 200, tt)
+}
+
+// validate normalises a template and resolves its project.
+func (tt *TicketTemplate) validate() (int, int, string) {
+	tt.Name = strings.TrimSpace(tt.Name)
+	if tt.Name == "" {
+		return 0, 400, "name is required"
+	}
+	if tt.State != "" && !isTicketState(tt.State) {
+		return 0, 400, "state must be one of " + strings.Join(ticketStates, ", ")
+	}
+	tt.Labels = trimList(tt.Labels)
+	tt.Subtasks = trimList(tt.Subtasks)
+	var projectID int
+	if err := db.QueryRow("SELECT id FROM projects WHERE account_id=$1 AND key=$2", cfg.AccountID, tt.ProjectKey).Scan(&projectID); err != nil {
+		return 0, 404, "project not found"
+	}
+	// Resolve labels now so a typo fails here, not on every ticket.
+	if _, err := labelIDsByName(projectID, tt.Labels); err != nil {
+		return 0, 400, err.Error()
+	}
+	return projectID, 0, ""
+}
+
+// trimList drops blank entries; the result is never nil, since the
+// array columns are NOT NULL.
+func trimList(in []string) []string {
+	out := []string{}
+	for _, s := range in {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req TicketTemplate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.validate()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO ticket_templates (account_id,project_id,name,title_prefix,body,assignee,state,labels,subtasks)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING id`,
+		cfg.AccountID, projectID, req.Name, req.TitlePrefix, req.Body, req.Assignee, req.State,
+		pq.Array(req.Labels), pq.Array(req.Subtasks)).Scan(&id)
+	if isUniqueViolation(err) {
+		writeJSON(w, 409, map[string]string{"error": fmt.Sprintf("template %q already exists in %s", req.Name, req.ProjectKey)})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
+
+func handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req TicketTemplate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	projectID, status, msg := req.validate()
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE ticket_templates SET project_id=$1, name=$2, title_prefix=$3, body=$4, assignee=$5,
+			state=$6, labels=$7, subtasks=$8
+		WHERE id=$9 AND account_id=$10`,
+		projectID, req.Name, req.TitlePrefix, req.Body, req.Assignee, req.State,
+		pq.Array(req.Labels), pq.Array(req.Subtasks), r.PathValue("id"), cfg.AccountID)
+	if isUniqueViolation(err) {
+		writeJSON(w, 409, map[string]string{"error": fmt.Sprintf("template %q already exists in %s", req.Name, req.ProjectKey)})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "template not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	result, err := db.Exec("DELETE FROM ticket_templates WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "template not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+// findTemplate resolves the create payload's "template", either an ID or
+// a name (case-insensitive), within the ticket's project.
+func findTemplate(raw json.RawMessage, projectKey string) (*TicketTemplate, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	query := templateSelect + " WHERE tt.account_id=$1 AND p.key=$2"
+	var ref interface{}
+	var id int
+	var name string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		query += " AND tt.id=$3"
+		ref = id
+	} else if err := json.Unmarshal(raw, &name); err == nil {
+		query += " AND lower(tt.name)=lower($3)"
+		ref = name
+	} else {
+		return nil, fmt.Errorf("template must be an id or a name")
+	}
+	tt, err := scanTemplate(db.QueryRow(query, cfg.AccountID, projectKey, ref))
+	if err != nil {
+		return nil, fmt.Errorf("template %s not found in %s", string(raw), projectKey)
+	}
+	return &tt, nil
+}
+
+// apply fills a create request from the template.
+func (tt *TicketTemplate) apply(req *createTicketRequest) {
+	if tt.TitlePrefix != "" && !strings.HasPrefix(req.Title, tt.TitlePrefix) {
+		req.Title = tt.TitlePrefix + req.Title
+	}
+	if req.Body == "" {
+		req.Body = tt.Body
+	}
+	if req.Assignee == "" {
+		req.Assignee = tt.Assignee
+	}
+	if req.State == "" {
+		req.State = tt.State
+	}
+	for _, l := range tt.Labels {
+		if !slices.ContainsFunc(req.Labels, func(s string) bool { return strings.EqualFold(s, l) }) {
+			req.Labels = append(req.Labels, l)
+		}
+	}
+}
+
+// createSubtasks adds the template's subtasks under parent. They share the
+// parent's project, assignee, epic, priority and custom values.
+func (tt *TicketTemplate) createSubtasks(tx *sql.Tx, parent int) ([]int, error) {
+	var ids []int
+	for _, title := range tt.Subtasks {
+		var id int
+		err := tx.QueryRow(`INSERT INTO tickets (account_id,project_id,title,body,state,assignee,epic_id,priority,custom)
+			SELECT account_id, project_id, $1, '', 'backlog', assignee, epic_id, priority, custom
+			FROM tickets WHERE id=$2 RETURNING id`, title, parent).Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+		if status, msg := setParent(tx, id, &parent); status != 0 {
+			return ids, fmt.Errorf("%s", msg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Watchers: the people who hear about changes to a ticket (see
+// ticketAudience in notify.go). Creating, being assigned, commenting on
+// or being @mentioned in a ticket watches it; anyone can watch or unwatch
+// by hand. Unwatching is remembered as a row with watching=false, so a
+// later comment or assignment doesn't quietly subscribe the user again;
+// only watching by hand does.
+
+// watchTicket adds watchers unless they already have a row, watching or
+// not. reason is what subscribed them: created, assigned, commented,
+// mentioned or manual.
+func watchTicket(q dbExecer, ticketID int, reason string, users ...string) error {
+	for _, u := range users {
+		if u == "" {
+			continue
+		}
+		if _, err := q.Exec(`INSERT INTO ticket_watchers (account_id, ticket_id, username, reason)
+			VALUES ($1,$2,$3,$4) ON CONFLICT DO NOTHING`, cfg.AccountID, ticketID, u, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// autoWatch is watchTicket for handlers, where a failure to subscribe
+// someone shouldn't fail the change itself.
+func autoWatch(ticketID int, reason string, users ...string) {
+	if err := watchTicket(db, ticketID, reason, users...); err != nil {
+		log.Printf("watchers: T-%d: %v", ticketID, err)
+	}
+}
+
+// ticketWatchers lists who is watching a ticket, by name.
+func ticketWatchers(ticketID int) ([]string, error) {
+	rows, err := db.Query(`SELECT username FROM ticket_watchers
+		WHERE ticket_id=$1 AND account_id=$2 AND watching ORDER BY lower(username)`, ticketID, cfg.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []string{}
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func handleGetWatchers(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if !ticketExists(ticketID) {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	users, err := ticketWatchers(ticketID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, users)
+}
+
+func handleWatchTicket(w http.ResponseWriter, r *http.Request) {
+	setWatching(w, r, true)
+}
+
+func handleUnwatchTicket(w http.ResponseWriter, r *http.Request) {
+	setWatching(w, r, false)
+}
+
+// setWatching subscribes or unsubscribes the current user and answers
+// with the ticket's watchers.
+func setWatching(w http.ResponseWriter, r *http.Request, watching bool) {
+	user := mentionsUser(w, r)
+	if user == "" {
+		return
+	}
+	ticketID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid ticket id"})
+		return
+	}
+	if !ticketExists(ticketID) {
+		writeJSON(w, 404, map[string]string{"error": "ticket not found"})
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO ticket_watchers (account_id, ticket_id, username, reason, watching)
+		VALUES ($1,$2,$3,'manual',$4)
+		ON CONFLICT (ticket_id, username) DO UPDATE SET watching=EXCLUDED.watching`,
+		cfg.AccountID, ticketID, user, watching); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	users, err := ticketWatchers(ticketID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{"watching": watching, "watchers": users})
+}
+
+func ticketExists(ticketID int) bool {
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM tickets WHERE id=$1 AND account_id=$2)", ticketID, cfg.AccountID).Scan(&exists)
+	return exists
+}
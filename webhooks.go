@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Outgoing webhooks: every published Event (events.go) is queued in
+// webhook_deliveries for each subscription whose filter matches, by the
+// instance that published it. A worker on every instance claims due
+// deliveries (FOR UPDATE SKIP LOCKED), POSTs them and retries failures
+// with exponential backoff until webhookMaxAttempts.
+//
+// Bodies are signed with the subscription's secret: the
+// X-Pippin-Signature header is "sha256=" + hex(HMAC-SHA256(secret, body)).
+
+const (
+	webhookMaxAttempts = 8
+	webhookBaseDelay   = 30 * time.Second
+	webhookMaxDelay    = time.Hour
+	webhookBatch       = 20
+)
+
+// webhookEvents are the event types a subscription can filter on.
+var webhookEvents = []string{
+	"ticket.created", "ticket.updated", "ticket.moved", "comment.added",
+	"block.added", "block.removed", "link.added", "link.removed", "attachment.added", "attachment.removed",
+	"project.created", "project.deleted", "data.imported", "sla.breached",
+}
+
+// webhookWake nudges this instance's worker when it has queued something,
+// so deliveries don't wait for the next poll.
+var webhookWake = make(chan struct{}, 1)
+
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // only returned on create
+	Events    []string  `json:"events"`           // empty = every event
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID          int        `json:"id"`
+	WebhookID   int        `json:"webhook_id"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload"`
+	Status      string     `json:"status"` // pending, delivered, failed
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"next_attempt_at"`
+	StatusCode  *int       `json:"last_status_code"`
+	Error       string     `json:"last_error"`
+	Response    string     `json:"last_response"`
+	DurationMS  *int       `json:"last_duration_ms"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
+const webhookSelect = `SELECT id, url, events, active, created_at FROM webhooks`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var h Webhook
+	err := row.Scan(&h.ID, &h.URL, pq.Array(&h.Events), &h.Active, &h.CreatedAt)
+	if h.Events == nil {
+		h.Events = []string{}
+	}
+	return h, err
+}
+
+const deliverySelect = `SELECT d.id, d.webhook_id, d.event_type, d.payload, d.status, d.attempts,
+		d.next_attempt_at, d.last_status_code, d.last_error, d.last_response, d.last_duration_ms, d.created_at, d.delivered_at
+	FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttempt, &d.StatusCode, &d.Error, &d.Response, &d.DurationMS, &d.CreatedAt, &d.DeliveredAt)
+	return d, err
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// signWebhook returns the X-Pippin-Signature value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryBackoff is the wait before retrying after the given number of
+// failed attempts: base, then doubling up to max. Webhooks wait 30s, 1m,
+// 2m, ... capped at an hour.
+func retryBackoff(attempts int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// enqueueWebhooks queues ev for every matching subscription. Like
+// publish, failures are only logged.
+func enqueueWebhooks(ev Event) {
+	if strings.HasPrefix(ev.Type, "presence.") {
+		return
+	}
+	const match = `account_id=$1 AND active AND (cardinality(events) = 0 OR $2 = ANY(events))`
+	var subscribed bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks WHERE "+match+")", ev.AccountID, ev.Type).Scan(&subscribed); err != nil || !subscribed {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"event":   ev.Type,
+		"at":      ev.At,
+		"account": ev.AccountID,
+	}
+	if ev.Actor != "" {
+		payload["actor"] = ev.Actor
+	}
+	if ev.Project != "" {
+		payload["project"] = ev.Project
+	}
+	if len(ev.Related) > 0 {
+		payload["related"] = ev.Related
+	}
+	if ev.TicketID != 0 {
+		payload["ticket_id"] = ev.TicketID
+		// A snapshot of the ticket as it is now; gone if it was deleted.
+		if t, err := scanTicket(db.QueryRow(ticketSelect+" WHERE t.id=$1 AND t.account_id=$2", ev.TicketID, ev.AccountID)); err == nil {
+			tickets := []Ticket{t}
+			if loadLabels(tickets) == nil {
+				payload["ticket"] = tickets[0]
+			}
+		}
+	}
+	body, _ := json.Marshal(payload)
+
+	result, err := db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+		SELECT id, $2, $3 FROM webhooks WHERE `+match,
+		ev.AccountID, ev.Type, string(body))
+	if err != nil {
+		log.Printf("webhooks: queue %s: %v", ev.Type, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func runWebhookWorker(interval time.Duration) {
+	for {
+		for {
+			n, err := runWebhookBatch()
+			if err != nil {
+				log.Printf("webhooks: %v", err)
+			}
+			if n < webhookBatch || err != nil {
+				break
+			}
+		}
+		select {
+		case <-webhookWake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+type pendingDelivery struct {
+	id       int
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+// runWebhookBatch sends up to webhookBatch due deliveries. Claiming
+// pushes next_attempt_at out first, so a crashed instance's claims are
+// picked up again later instead of being lost.
+func runWebhookBatch() (int, error) {
+	rows, err := db.Query(`UPDATE webhook_deliveries d SET next_attempt_at = now() + interval '5 minutes'
+		FROM webhooks h
+		WHERE h.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status='pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, h.url, h.secret`, webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+	var batch []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		if err := rows.Scan(&p.id, &p.event, &p.payload, &p.attempts, &p.url, &p.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range batch {
+		p.attempts++
+		start := time.Now()
+		code, response, err := sendWebhook(p.url, p.secret, p.id, p.event, []byte(p.payload))
+		duration := int(time.Since(start).Milliseconds())
+
+		status, errText := "delivered", ""
+		var next interface{}
+		var deliveredAt interface{} = time.Now().UTC()
+		if err != nil {
+			errText = err.Error()
+			deliveredAt = nil
+			if p.attempts >= webhookMaxAttempts {
+				status = "failed"
+			} else {
+				status = "pending"
+				next = time.Now().UTC().Add(retryBackoff(p.attempts, webhookBaseDelay, webhookMaxDelay))
+			}
+			log.Printf("webhook delivery %d (%s) attempt %d: %v", p.id, p.event, p.attempts, err)
+		}
+		var statusCode interface{}
+		if code != 0 {
+			statusCode = code
+		}
+		if _, err := db.Exec(`UPDATE webhook_deliveries SET status=$1, attempts=$2, next_attempt_at=$3,
+				last_status_code=$4, last_error=$5, last_response=$6, last_duration_ms=$7, delivered_at=$8
+			WHERE id=$9`,
+			status, p.attempts, next, statusCode, errText, response, duration, deliveredAt, p.id); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// sendWebhook POSTs one delivery. Anything but a 2xx is an error; the
+// status code and the start of the response body are kept for the log.
+func sendWebhook(target, secret string, deliveryID int, event string, body []byte) (int, string, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Pippin-Webhook")
+	req.Header.Set("X-Pippin-Event", event)
+	req.Header.Set("X-Pippin-Delivery", fmt.Sprint(deliveryID))
+	req.Header.Set("X-Pippin-Signature", signWebhook(secret, body))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, string(snippet), fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return resp.StatusCode, string(snippet), nil
+}
+
+func (h *Webhook) validate() (int, string) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 400, "url must be an http or https URL"
+	}
+	h.Events = trimList(h.Events)
+	for _, ev := range h.Events {
+		known := false
+		for _, name := range webhookEvents {
+			known = known || ev == name
+		}
+		if !known {
+			return 400, "unknown event: " + ev + " (expected one of " + strings.Join(webhookEvents, ", ") + ")"
+		}
+	}
+	return 0, ""
+}
+
+func handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(webhookSelect+" WHERE account_id=$1 ORDER BY id", cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	list := []Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		list = append(list, h)
+	}
+	writeJSON(w, 200, list)
+}
+
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	req := Webhook{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if status, msg := req.validate(); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = newWebhookSecret()
+	}
+
+	var id int
+	err := db.QueryRow(`INSERT INTO webhooks (account_id, url, secret, events, active)
+		VALUES ($1,$2,$3,$4,$5) RETURNING id`,
+		cfg.AccountID, req.URL, req.Secret, pq.Array(req.Events), req.Active).Scan(&id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	// The secret is only shown now; receivers need it to check signatures.
+	writeJSON(w, 201, map[string]interface{}{"id": id, "secret": req.Secret})
+}
+
+// handleUpdateWebhook replaces the subscription; an empty secret keeps
+// the current one.
+func handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	req := Webhook{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+	if status, msg := req.validate(); status != 0 {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE webhooks SET url=$1, secret=COALESCE(NULLIF($2,''), secret), events=$3, active=$4
+		WHERE id=$5 AND account_id=$6`,
+		req.URL, req.Secret, pq.Array(req.Events), req.Active, r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "webhook not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "updated"})
+}
+
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	// Queued deliveries and their log go with it.
+	result, err := db.Exec("DELETE FROM webhooks WHERE id=$1 AND account_id=$2", r.PathValue("id"), cfg.AccountID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		writeJSON(w, 404, map[string]string{"error": "webhook not found"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "deleted"})
+}
+
+var deliverySortColumns = map[string]sortColumn[WebhookDelivery]{
+	"id":      {"d.id", func(d *WebhookDelivery) string { return strconv.Itoa(d.ID) }},
+	"created": {"d.created_at", func(d *WebhookDelivery) string { return cursorTime(d.CreatedAt) }},
+}
+
+// handleGetDeliveries is the delivery log, newest first, paged like the
+// other lists but 100 at a time when no limit is given. ?status= narrows
+// it to pending, delivered or failed deliveries.
+func handleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, deliverySortColumns)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if opts.Limit == 0 {
+		opts.Limit = 100
+	}
+	query := deliverySelect + " WHERE d.webhook_id=$1 AND h.account_id=$2"
+	b := &sqlBuilder{args: []interface{}{r.PathValue("id"), cfg.AccountID}}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND d.status=" + b.arg(status)
+	}
+	where, tail := pageSQL(opts, b, deliverySortColumns, "-id", "d.id")
+	if where != "" {
+		query += " AND " + where
+	}
+	rows, err := db.Query(query+tail, b.args...)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	var list []WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		list = append(list, d)
+	}
+	writeList(w, r, list, opts, deliverySortColumns, "-id", func(d *WebhookDelivery) int { return d.ID })
+}
+
+// handleRedeliver queues a delivery's payload again as a new delivery,
+// leaving the original in the log.
+func handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	var id int
+	err := db.QueryRow(`INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+		SELECT d.webhook_id, d.event_type, d.payload FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id
+		WHERE d.id=$1 AND d.webhook_id=$2 AND h.account_id=$3
+		RETURNING id`, r.PathValue("delivery_id"), r.PathValue("id"), cfg.AccountID).Scan(&id)
+	if err == sql.ErrNoRows {
+		writeJSON(w, 404, map[string]string{"error": "delivery not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+	writeJSON(w, 201, map[string]int{"id": id})
+}
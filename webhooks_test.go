@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// receiver is a webhook endpoint that answers with the queued status
+// codes in turn (200 once they run out) and keeps what it was sent.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	got      []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.got = append(rc.got, r)
+	rc.bodies = append(rc.bodies, body)
+	status := 200
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("ok"))
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.got)
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	body := []byte(`{"event":"ticket.created"}`)
+	code, response, err := sendWebhook(srv.URL, "s3cret", 7, "ticket.created", body)
+	if err != nil || code != 200 || response != "ok" {
+		t.Fatalf("sendWebhook = %d, %q, %v", code, response, err)
+	}
+	r := rc.got[0]
+	// Checked the way a receiver would.
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(rc.bodies[0])
+	if got, want := r.Header.Get("X-Pippin-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if r.Header.Get("X-Pippin-Event") != "ticket.created" || r.Header.Get("X-Pippin-Delivery") != "7" {
+		t.Errorf("headers = %v", r.Header)
+	}
+	if string(rc.bodies[0]) != string(body) {
+		t.Errorf("body = %s", rc.bodies[0])
+	}
+}
+
+func TestSendWebhookError(t *testing.T) {
+	rc := &receiver{statuses: []int{500}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	code, _, err := sendWebhook(srv.URL, "s", 1, "ticket.created", []byte("{}"))
+	if err == nil || code != 500 {
+		t.Fatalf("sendWebhook = %d, %v; want a 500 error", code, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	} {
+		if got := retryBackoff(tc.attempts, webhookBaseDelay, webhookMaxDelay); got != tc.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+// webhookTestAccount sets up the test account with one subscription per
+// events list, all pointing at url, and returns their IDs.
+func webhookTestAccount(t *testing.T, url string, events ...[]string) []int {
+	const account = "test-webhooks"
+	testDB(t, account)
+	if _, err := db.Exec("DELETE FROM webhooks WHERE account_id=$1", account); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, ev := range events {
+		var id int
+		if err := db.QueryRow(`INSERT INTO webhooks (account_id, url, secret, events) VALUES ($1,$2,'s3cret',$3) RETURNING id`,
+			account, url, pq.Array(ev)).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func deliveryCount(t *testing.T, webhookID int) int {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM webhook_deliveries WHERE webhook_id=$1", webhookID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestEnqueueWebhooksFilter(t *testing.T) {
+	ids := webhookTestAccount(t, "http://127.0.0.1:1/", nil, []string{"comment.added"}, []string{"ticket.moved", "link.added"})
+	for _, typ := range []string{"ticket.created", "comment.added", "presence.changed"} {
+		enqueueWebhooks(Event{Type: typ, AccountID: cfg.AccountID, At: time.Now().UTC()})
+	}
+	// Every event but presence; only comments; neither.
+	for i, want := range []int{2, 1, 0} {
+		if got := deliveryCount(t, ids[i]); got != want {
+			t.Errorf("webhook %d (%d): %d deliveries, want %d", i, ids[i], got, want)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	rc := &receiver{statuses: []int{500}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	ids := webhookTestAccount(t, srv.URL, nil)
+
+	enqueueWebhooks(Event{Type: "ticket.created", AccountID: cfg.AccountID, At: time.Now().UTC()})
+	if _, err := runWebhookBatch(); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	var attempts int
+	var code *int
+	var next time.Time
+	load := func() {
+		t.Helper()
+		if err := db.QueryRow(`SELECT status, attempts, last_status_code, COALESCE(next_attempt_at, 'epoch')
+			FROM webhook_deliveries WHERE webhook_id=$1`, ids[0]).Scan(&status, &attempts, &code, &next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load()
+	if status != "pending" || attempts != 1 || code == nil || *code != 500 {
+		t.Fatalf("after a 500: status %s, attempts %d, code %v", status, attempts, code)
+	}
+	backoff := retryBackoff(1, webhookBaseDelay, webhookMaxDelay)
+	if wait := next.Sub(time.Now().UTC()); wait <= 0 || wait > backoff {
+		t.Errorf("next attempt in %v, want about %v", wait, backoff)
+	}
+
+	// Not due yet, so nothing is sent; once due, the retry succeeds.
+	if _, err := runWebhookBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.count() != 1 {
+		t.Fatalf("retried before the backoff: %d requests", rc.count())
+	}
+	if _, err := db.Exec("UPDATE webhook_deliveries SET next_attempt_at='epoch' WHERE webhook_id=$1", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runWebhookBatch(); err != nil {
+		t.Fatal(err)
+	}
+	load()
+	if status != "delivered" || attempts != 2 || rc.count() != 2 {
+		t.Errorf("after the retry: status %s, attempts %d, %d requests", status, attempts, rc.count())
+	}
+	if string(rc.bodies[0]) != string(rc.bodies[1]) {
+		t.Errorf("retry sent a different body")
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	ids := webhookTestAccount(t, "http://127.0.0.1:1/", nil)
+	var first int
+	if err := db.QueryRow(`INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, attempts)
+		VALUES ($1, 'ticket.created', '{"event":"ticket.created"}', 'failed', 8) RETURNING id`, ids[0]).Scan(&first); err != nil {
+		t.Fatal(err)
+	}
+
+	redeliver := func(webhookID, deliveryID int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.SetPathValue("id", strconv.Itoa(webhookID))
+		r.SetPathValue("delivery_id", strconv.Itoa(deliveryID))
+		w := httptest.NewRecorder()
+		handleRedeliver(w, r)
+		return w
+	}
+
+	w := redeliver(ids[0], first)
+	if w.Code != 201 {
+		t.Fatalf("redeliver: %d %s", w.Code, w.Body)
+	}
+	var created struct{ ID int }
+	json.Unmarshal(w.Body.Bytes(), &created)
+	var event, payload, status string
+	var attempts int
+	if err := db.QueryRow("SELECT event_type, payload, status, attempts FROM webhook_deliveries WHERE id=$1 AND webhook_id=$2",
+		created.ID, ids[0]).Scan(&event, &payload, &status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == first || event != "ticket.created" || payload != `{"event":"ticket.created"}` || status != "pending" || attempts != 0 {
+		t.Errorf("redelivery %d: %s %s %s %d", created.ID, event, payload, status, attempts)
+	}
+	if got := deliveryCount(t, ids[0]); got != 2 {
+		t.Errorf("%d deliveries, want the original and the redelivery", got)
+	}
+
+	if w := redeliver(ids[0]+1000000, first); w.Code != 404 {
+		t.Errorf("redeliver under another webhook: %d", w.Code)
+	}
+}
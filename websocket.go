@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 WebSocket server: enough for the small JSON messages
+// of the collaboration channel (presence.go). It handles fragmentation,
+// ping/pong and close; extensions and compression are not negotiated.
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+
+	wsMaxMessage = 64 << 10
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex // serialises writes
+}
+
+// upgradeWebSocket completes the handshake. On failure it has already
+// written an HTTP error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		writeJSON(w, 400, map[string]string{"error": "websocket upgrade required"})
+		return nil, errors.New("not a websocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeJSON(w, 426, map[string]string{"error": "unsupported websocket version"})
+		return nil, errors.New("bad websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		writeJSON(w, 400, map[string]string{"error": "missing Sec-WebSocket-Key"})
+		return nil, errors.New("missing key")
+	}
+	// Browsers send cookies cross-site on WebSocket handshakes, so only
+	// accept pages served by this host.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeJSON(w, 403, map[string]string{"error": "cross-origin websocket rejected"})
+			return nil, errors.New("bad origin")
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeJSON(w, 500, map[string]string{"error": "websocket unsupported"})
+		return nil, errors.New("hijack unsupported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// readMessage returns the next text or binary message, answering pings on
+// the way. It returns io.EOF once the peer closes.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("websocket: unmasked client frame")
+		}
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > wsMaxMessage || uint64(len(msg))+n > wsMaxMessage {
+			c.writeFrame(wsClose, []byte{0x03, 0xf1}) // 1009: message too big
+			return nil, errors.New("websocket: message too big")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		}
+		// Text, binary or a continuation of either.
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.rw.Write(head)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeText(msg []byte) error {
+	return c.writeFrame(wsText, msg)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}